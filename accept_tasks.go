@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/datatogether/task_mgmt/taskdefs/gist"
@@ -21,26 +23,70 @@ func configureTasks() {
 	tasks.RegisterTaskdef("sb.addCatalogTree", sciencebase.NewAddCatalogTree)
 	tasks.RegisterTaskdef("gist.createCollection", gist.NewCollectionFromGist)
 
+	// only one active task per url / root url
+	dedupWindow := configDuration("TASK_DEDUP_WINDOW", cfg.TaskDedupWindow, 0)
+	tasks.RegisterDedupKey("ipfs.addurl", dedupWindow, ipfs.AddUrlDedupKey)
+	tasks.RegisterDedupKey("sb.addCatalogTree", dedupWindow, sciencebase.CatalogTreeDedupKey)
+
+	// expensive task params require the admin role
+	tasks.RegisterPrivileged("sb.addCatalogTree", sciencebase.CatalogTreePrivileged)
+
+	// count the urls tasks archive toward daily quotas
+	tasks.RegisterUrlCount("ipfs.addurl", ipfs.AddUrlUrlCount)
+	tasks.RegisterUrlCount("pod.addcatalog", pod.CatalogUrlCount)
+	tasks.RegisterUrlCount("sb.addCatalogTree", sciencebase.CatalogTreeUrlCount)
+
+	// route tasks to worker pools by the dependencies they need
+	tasks.TagTaskdef("ipfs.addurl", "ipfs")
+	tasks.TagTaskdef("ipfs.addcollection", "ipfs")
+	tasks.TagTaskdef("pod.addcatalog", "ipfs")
+	tasks.TagTaskdef("sb.addCatalogTree", "ipfs")
+	tasks.TagTaskdef("kiwix.updateSources", "disk")
+	tasks.TagTaskdef("gist.createCollection", "db")
+
 	// Must set api server url to make ipfs tasks work
 	ipfs.IpfsApiServerUrl = cfg.IpfsApiUrl
 	pod.IpfsApiServerUrl = cfg.IpfsApiUrl
 	sciencebase.IpfsApiServerUrl = cfg.IpfsApiUrl
+
+	// subtasks are distributed through the same queue as all other tasks
+	tasks.SubtaskAmqpUrl = cfg.AmqpUrl
 }
 
-// start accepting tasks from the queue, if setup doesn't error,
-// it returns a stop channel writing to stop will teardown the
-// func and stop accepting tasks
-func acceptTasks() (stop chan bool, err error) {
-	stop = make(chan bool)
+// workerCapabilities lists the task types & tags this process accepts,
+// an empty list accepts all tasks
+func workerCapabilities() []string {
+	accepts := []string{}
+	for _, c := range cfg.WorkerAccepts {
+		if c = strings.TrimSpace(c); c != "" {
+			accepts = append(accepts, c)
+		}
+	}
+	return accepts
+}
+
+// start accepting tasks from the queue. if setup doesn't error it returns
+// a drain func that stops accepting new tasks, waits for the task in
+// progress to finish, then closes the connection. readiness checks fail
+// once draining starts
+func acceptTasks() (drain func(), err error) {
 	if cfg.AmqpUrl == "" {
 		log.Infoln("no amqp url specified, queue listening disabled")
-		return stop, nil
+		return readiness.Drain, nil
+	}
+
+	accepts := workerCapabilities()
+	if err := tasks.ValidCapabilities(accepts); err != nil {
+		return nil, fmt.Errorf("invalid accepted task types: %s", err.Error())
 	}
 
-	log.Printf("connecting to: %s", cfg.AmqpUrl)
+	log.Infof("connecting to: %s", cfg.AmqpUrl)
 
 	var conn *amqp.Connection
 	for i := 0; i <= 1000; i++ {
+		if i > 0 {
+			amqpReconnects.Inc()
+		}
 		conn, err = amqp.Dial(cfg.AmqpUrl)
 		if err != nil {
 			log.Infof("Failed to connect to amqp server: %s", err.Error())
@@ -59,34 +105,75 @@ func acceptTasks() (stop chan bool, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open a channel: %s", err.Error())
 	}
+	watchAcceptChannel(ch)
 
-	q, err := ch.QueueDeclare(
-		"tasks", // name
-		false,   // durable
-		false,   // delete when unused
-		false,   // exclusive
-		false,   // no-wait
-		nil,     // arguments
-	)
-	if err != nil {
-		return nil, fmt.Errorf("Error declaring que: %s", err.Error())
+	// only hold one unacknowledged task at a time per queue, leaving
+	// the rest for other workers in the pool
+	if err := ch.Qos(1, 0, false); err != nil {
+		return nil, fmt.Errorf("Error setting channel qos: %s", err.Error())
 	}
 
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	if err != nil {
-		return nil, fmt.Errorf("", err)
+	worker = registerWorker(accepts)
+	lease := workerLease()
+
+	msgs := make(chan amqp.Delivery)
+	consumers := []string{}
+	forwarding := &sync.WaitGroup{}
+	for _, name := range tasks.WorkerQueues(accepts) {
+		q, err := ch.QueueDeclare(
+			name,  // name
+			false, // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			nil,   // arguments
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Error declaring que: %s", err.Error())
+		}
+
+		// named so consuming can be cancelled when draining
+		consumer := fmt.Sprintf("%s.%s", worker.Id, q.Name)
+		qmsgs, err := ch.Consume(
+			q.Name,   // queue
+			consumer, // consumer
+			false,    // auto-ack
+			false,    // exclusive
+			false,    // no-local
+			false,    // no-wait
+			nil,      // args
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Error consuming queue %s: %s", q.Name, err.Error())
+		}
+		consumers = append(consumers, consumer)
+
+		log.Infof("accepting tasks from queue: %s", q.Name)
+		forwarding.Add(1)
+		go func() {
+			for msg := range qmsgs {
+				msgs <- msg
+			}
+			forwarding.Done()
+		}()
 	}
 
+	// msgs closes once every consumer is cancelled, or the channel closes
+	go func() {
+		forwarding.Wait()
+		close(msgs)
+	}()
+
+	done := make(chan bool)
 	go func() {
 		for msg := range msgs {
+			// deliveries already sent to this worker go back to the queue
+			// once draining starts
+			if readiness.Draining() {
+				msg.Nack(false, true)
+				continue
+			}
+
 			// tasks.Tas
 			task, err := tasks.TaskFromDelivery(store, msg)
 			if err != nil {
@@ -95,32 +182,68 @@ func acceptTasks() (stop chan bool, err error) {
 				continue
 			}
 
+			// tagged queues can carry task types this worker doesn't accept,
+			// hand them back for another worker
+			if !tasks.Accepts(accepts, task.Type) {
+				msg.Nack(false, true)
+				continue
+			}
+
+			// a task can be delivered more than once if it was requeued
+			// by the reaper, there's no need to repeat finished work
+			if task.Succeeded != nil || task.Failed != nil {
+				log.WithFields(task.LogFields()).Info("skipping finished task")
+				msg.Ack(false)
+				continue
+			}
+
+			// the reaper requeues tasks the queue may also redeliver, only
+			// one delivery of a task can claim it
+			if err := task.Claim(store, worker.Id, lease); err == tasks.ErrTaskClaimed {
+				log.WithFields(task.LogFields()).Info("skipping task claimed by another worker")
+				msg.Ack(false)
+				continue
+			} else if err != nil {
+				log.WithFields(task.LogFields()).Errorf("error claiming task: %s", err.Error())
+				msg.Nack(false, true)
+				continue
+			}
+
 			tc := make(chan *tasks.Task, 10)
 			// accept tasks
 			go func() {
 				for t := range tc {
-					if err := PublishTaskProgress(rpool, t); err != nil && err != ErrNoRedisConn {
-						log.Infoln(err.Error())
-					}
+					publishTaskProgress(t)
 				}
 			}()
 
-			log.Infof("starting task %s,%s", task.Id, task.Type)
-			if err := task.Do(store, tc); err != nil {
-				log.Errorf("task error: %s", err.Error())
+			tlog := log.WithFields(task.LogFields())
+			tlog.Info("starting task")
+			tasksInFlight.Inc(worker.Id)
+			err = task.Do(store, tc)
+			tasksInFlight.Dec(worker.Id)
+			if err != nil {
+				tlog.Errorf("task error: %s", err.Error())
 				msg.Nack(false, false)
 			} else {
-				log.Infof("completed task: %s, %s", task.Id, msg.Type)
+				tlog.Info("completed task")
 				msg.Ack(false)
 			}
 
 		}
-		// TODO - figure out a way to bail out of the above loop
-		// if stop is ever published to
-		<-stop
 		ch.Close()
 		conn.Close()
+		close(done)
 	}()
 
-	return stop, nil
+	drain = func() {
+		readiness.Drain()
+		for _, consumer := range consumers {
+			if err := ch.Cancel(consumer, false); err != nil {
+				log.Infof("error cancelling consumer %s: %s", consumer, err.Error())
+			}
+		}
+		<-done
+	}
+	return drain, nil
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/datatogether/task_mgmt/auth"
+	"strings"
+	"time"
+)
+
+// runAPIKey is the apikey command for managing api keys, eg:
+// "task_mgmt apikey create -user alice -name laptop"
+func runAPIKey(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: task_mgmt apikey create|list|revoke")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("apikey", flag.ExitOnError)
+	userId := fs.String("user", "", "id of the user the key belongs to")
+	name := fs.String("name", "", "name to help identify the key")
+	fs.Parse(args[1:])
+
+	loadConfig()
+	if err := connectStore(&auth.APIKey{}); err != nil {
+		return err
+	}
+
+	switch action {
+	case "create":
+		if *userId == "" {
+			return fmt.Errorf("-user is required")
+		}
+		key, k, err := auth.NewAPIKey(*userId, *name)
+		if err != nil {
+			return err
+		}
+		if err := k.Save(store); err != nil {
+			return err
+		}
+		fmt.Printf("created api key %s for %s. it won't be shown again:\n%s\n", k.Id[:12], k.UserId, key)
+	case "list":
+		keys, err := auth.ReadAPIKeys(store, *userId)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			fmt.Printf("%s\t%-20s\t%-20s\t%s\n", k.Id[:12], k.UserId, k.Name, k.Created.Format(time.RFC3339))
+		}
+	case "revoke":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: task_mgmt apikey revoke <id>")
+		}
+		keys, err := auth.ReadAPIKeys(store, *userId)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if len(fs.Arg(0)) >= 8 && strings.HasPrefix(k.Id, fs.Arg(0)) {
+				if err := k.Delete(store); err != nil {
+					return err
+				}
+				fmt.Printf("revoked api key %s for %s\n", k.Id[:12], k.UserId)
+				return nil
+			}
+		}
+		return fmt.Errorf("no api key with id: %s", fs.Arg(0))
+	default:
+		return fmt.Errorf("unknown apikey command: %s", action)
+	}
+	return nil
+}
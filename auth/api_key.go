@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// prefix for generated api keys, makes keys easy to spot & distinguishes
+// them from other bearer tokens
+const apiKeyPrefix = "tm_"
+
+// APIKey is a stored api key. Only a hash of the key is stored,
+// the key itself is shown once when the key is created
+type APIKey struct {
+	// sha256 hash of the key, hex-encoded
+	Id string `json:"id"`
+	// id of the user this key authenticates as
+	UserId string `json:"userId"`
+	// human-readable description of the key
+	Name string `json:"name"`
+	// when the key was created
+	Created time.Time `json:"created"`
+}
+
+// NewAPIKey generates a key for userId, returning the key & it's
+// storable record
+func NewAPIKey(userId, name string) (key string, k *APIKey, err error) {
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+
+	key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	k = &APIKey{
+		Id:      HashAPIKey(key),
+		UserId:  userId,
+		Name:    name,
+		Created: time.Now().Round(time.Second).In(time.UTC),
+	}
+	return
+}
+
+// HashAPIKey gives the stored identifier for key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// DatastoreType is to fulfill the sql_datastore.Model interface
+func (k APIKey) DatastoreType() string {
+	return "APIKey"
+}
+
+// GetId returns the key's hash
+func (k APIKey) GetId() string {
+	return k.Id
+}
+
+// Key is to fulfill the sql_datastore.Model interface
+func (k APIKey) Key() datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%s:%s", k.DatastoreType(), k.GetId()))
+}
+
+func (k *APIKey) Read(store datastore.Datastore) error {
+	ki, err := store.Get(k.Key())
+	if err != nil {
+		return err
+	}
+
+	got, ok := ki.(*APIKey)
+	if !ok {
+		return fmt.Errorf("Invalid Response")
+	}
+	*k = *got
+	return nil
+}
+
+func (k *APIKey) Save(store datastore.Datastore) error {
+	if k.Id == "" || k.UserId == "" {
+		return fmt.Errorf("api keys require an id & user id")
+	}
+	return store.Put(k.Key(), k)
+}
+
+func (k *APIKey) Delete(store datastore.Datastore) error {
+	return store.Delete(k.Key())
+}
+
+// ReadAPIKeys lists stored api keys, optionally limited to a single user
+func ReadAPIKeys(store datastore.Datastore, userId string) ([]*APIKey, error) {
+	res, err := store.Query(query.Query{
+		Prefix: fmt.Sprintf("/%s", APIKey{}.DatastoreType()),
+		Limit:  1000,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*APIKey{}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		k, ok := r.Value.(*APIKey)
+		if !ok {
+			return nil, fmt.Errorf("Invalid Response")
+		}
+		if userId == "" || k.UserId == userId {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// APIKeyAuthenticator authenticates requests with api keys, sent either as
+// an "X-Api-Key" header, or an "Authorization: Bearer" header
+type APIKeyAuthenticator struct {
+	Store datastore.Datastore
+}
+
+// Authenticate fulfills the Authenticator interface
+func (a APIKeyAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get("X-Api-Key")
+	if key == "" {
+		if token := bearerToken(r); token != "" && !isJWT(token) {
+			key = token
+		}
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, ErrInvalidCredentials
+	}
+
+	k := &APIKey{Id: HashAPIKey(key)}
+	if err := k.Read(a.Store); err == datastore.ErrNotFound {
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &Identity{UserId: k.UserId, Method: "apikey"}, nil
+}
+
+func (k *APIKey) NewSQLModel(key datastore.Key) sql_datastore.Model {
+	return &APIKey{Id: key.Name()}
+}
+
+func (k *APIKey) SQLQuery(cmd sql_datastore.Cmd) string {
+	switch cmd {
+	case sql_datastore.CmdCreateTable:
+		return qAPIKeyCreateTable
+	case sql_datastore.CmdExistsOne:
+		return qAPIKeyExists
+	case sql_datastore.CmdSelectOne:
+		return qAPIKeyRead
+	case sql_datastore.CmdInsertOne:
+		return qAPIKeyInsert
+	case sql_datastore.CmdUpdateOne:
+		return qAPIKeyUpdate
+	case sql_datastore.CmdDeleteOne:
+		return qAPIKeyDelete
+	case sql_datastore.CmdList:
+		return qAPIKeys
+	default:
+		return ""
+	}
+}
+
+func (k *APIKey) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		id, userId, name string
+		created          time.Time
+	)
+	if err := row.Scan(&id, &userId, &name, &created); err != nil {
+		if err == sql.ErrNoRows {
+			return datastore.ErrNotFound
+		}
+		return err
+	}
+
+	*k = APIKey{
+		Id:      id,
+		UserId:  userId,
+		Name:    name,
+		Created: created,
+	}
+	return nil
+}
+
+func (k *APIKey) SQLParams(cmd sql_datastore.Cmd) []interface{} {
+	switch cmd {
+	case sql_datastore.CmdSelectOne, sql_datastore.CmdExistsOne, sql_datastore.CmdDeleteOne:
+		return []interface{}{k.Id}
+	case sql_datastore.CmdList:
+		return []interface{}{}
+	default:
+		return []interface{}{
+			k.Id,
+			k.UserId,
+			k.Name,
+			k.Created,
+		}
+	}
+}
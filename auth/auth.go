@@ -0,0 +1,77 @@
+// Package auth identifies the users making requests to task_mgmt,
+// with hashed api keys or bearer JWTs
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrNoCredentials is returned when a request carries no credentials
+	ErrNoCredentials = errors.New("no credentials provided")
+	// ErrInvalidCredentials is returned when a request's credentials
+	// can't be verified
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is an authenticated user
+type Identity struct {
+	// id of the authenticated user
+	UserId string `json:"userId"`
+	// how the user authenticated, either "apikey" or "jwt"
+	Method string `json:"method"`
+}
+
+// Authenticator identifies the user making a request. Authenticators return
+// ErrNoCredentials if the request doesn't carry the kind of credentials
+// they handle, leaving the request for other authenticators
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Chain tries each authenticator in order, returning the first identity
+// found. It returns ErrNoCredentials if no authenticator found credentials
+type Chain []Authenticator
+
+// Authenticate fulfills the Authenticator interface
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// bearerToken reads the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// isJWT reports weather token is shaped like a JWT
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// identityKey is the context key for identities
+type identityKey struct{}
+
+// NewContext returns a copy of ctx carrying id
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity carried by ctx, nil if ctx has none
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
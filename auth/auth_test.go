@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+)
+
+// signJWT creates a token for claims, signed with key
+func signJWT(t *testing.T, alg string, key crypto.Signer, claims *Claims) string {
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Typ: "JWT"})
+	body, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	hash := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestParseJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	valid := &Claims{Subject: "user", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	expired := &Claims{Subject: "user", ExpiresAt: time.Now().Add(-time.Hour).Unix()}
+
+	cases := []struct {
+		token string
+		key   crypto.PublicKey
+		err   bool
+	}{
+		{signJWT(t, "RS256", rsaKey, valid), &rsaKey.PublicKey, false},
+		{signJWT(t, "ES256", ecKey, valid), &ecKey.PublicKey, false},
+		{signJWT(t, "RS256", rsaKey, expired), &rsaKey.PublicKey, true},
+		{signJWT(t, "RS256", otherKey, valid), &rsaKey.PublicKey, true},
+		{signJWT(t, "ES256", ecKey, valid), &rsaKey.PublicKey, true},
+		{"eyJhbGciOiJub25lIn0.eyJzdWIiOiJ1c2VyIn0.", &rsaKey.PublicKey, true},
+	}
+
+	for i, c := range cases {
+		claims, err := ParseJWT(c.token, c.key)
+		if c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if !c.err && claims.Subject != "user" {
+			t.Errorf("case %d subject mismatch: %s", i, claims.Subject)
+		}
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	for i, s := range []string{
+		string(pemBytes),
+		base64.StdEncoding.EncodeToString(pemBytes),
+		base64.StdEncoding.EncodeToString(der),
+	} {
+		if _, err := ParsePublicKey(s); err != nil {
+			t.Errorf("case %d: %s", i, err.Error())
+		}
+	}
+
+	if _, err := ParsePublicKey("nothing_yet"); err == nil {
+		t.Errorf("expected invalid key to error")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := datastore.NewMapDatastore()
+	key, k, err := NewAPIKey("apiuser", "test key")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := k.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	token := signJWT(t, "RS256", rsaKey, &Claims{Subject: "jwtuser"})
+
+	a := Chain{APIKeyAuthenticator{Store: store}, JWTAuthenticator{Key: &rsaKey.PublicKey}}
+
+	cases := []struct {
+		header, value string
+		userId        string
+		err           error
+	}{
+		{"", "", "", ErrNoCredentials},
+		{"X-Api-Key", key, "apiuser", nil},
+		{"Authorization", "Bearer " + key, "apiuser", nil},
+		{"Authorization", "Bearer " + token, "jwtuser", nil},
+		{"X-Api-Key", "tm_notakey", "", ErrInvalidCredentials},
+		{"Authorization", "Bearer " + token + "x", "", ErrInvalidCredentials},
+	}
+
+	for i, c := range cases {
+		r, _ := http.NewRequest("GET", "/tasks", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+
+		id, err := a.Authenticate(r)
+		if err != c.err {
+			t.Errorf("case %d error mismatch. expected: %v, got: %v", i, c.err, err)
+			continue
+		}
+		if err == nil && id.UserId != c.userId {
+			t.Errorf("case %d user mismatch. expected: %s, got: %s", i, c.userId, id.UserId)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Claims are the JWT claims task_mgmt reads from bearer tokens
+type Claims struct {
+	// Subject is the id of the user the token was issued to
+	Subject string `json:"sub"`
+	// ExpiresAt is a unix timestamp after which the token is invalid
+	ExpiresAt int64 `json:"exp,omitempty"`
+	// NotBefore is a unix timestamp before which the token is invalid
+	NotBefore int64 `json:"nbf,omitempty"`
+	// IssuedAt is a unix timestamp of when the token was issued
+	IssuedAt int64 `json:"iat,omitempty"`
+}
+
+// Valid checks the time-based claims against now
+func (c *Claims) Valid(now time.Time) error {
+	if c.Subject == "" {
+		return fmt.Errorf("token has no subject")
+	}
+	if c.ExpiresAt != 0 && now.Unix() >= c.ExpiresAt {
+		return fmt.Errorf("token is expired")
+	}
+	if c.NotBefore != 0 && now.Unix() < c.NotBefore {
+		return fmt.Errorf("token is not valid yet")
+	}
+	return nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// ParseJWT verifies a compact-serialized JWT signed by the private half of
+// key, returning it's claims. RS256 & ES256 signatures are supported
+func ParseJWT(token string, key crypto.PublicKey) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	header := &jwtHeader{}
+	if err := decodeSegment(parts[0], header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %s", err.Error())
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %s", err.Error())
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("RS256 tokens require an RSA public key")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig); err != nil {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("ES256 tokens require an ECDSA public key")
+		}
+		if len(sig) != 64 {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported token algorithm: '%s'", header.Alg)
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %s", err.Error())
+	}
+	if err := claims.Valid(time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ParsePublicKey reads a PKIX public key, either PEM-encoded, or as
+// base64-encoded PEM or DER, for keys set through the environment
+func ParsePublicKey(s string) (crypto.PublicKey, error) {
+	data := []byte(strings.TrimSpace(s))
+	if !strings.HasPrefix(string(data), "-----BEGIN") {
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("public key must be PEM, or base64-encoded PEM or DER")
+		}
+		data = decoded
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	key, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// JWTAuthenticator authenticates requests carrying an
+// "Authorization: Bearer" JWT signed by the private half of Key
+type JWTAuthenticator struct {
+	Key crypto.PublicKey
+}
+
+// Authenticate fulfills the Authenticator interface
+func (a JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" || !isJWT(token) {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := ParseJWT(token, a.Key)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{UserId: claims.Subject, Method: "jwt"}, nil
+}
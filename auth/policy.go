@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"time"
+)
+
+// ErrForbidden is returned when a user's role doesn't permit an operation
+var ErrForbidden = errors.New("permission denied")
+
+// Role is a level of access to a task type. Each role includes
+// the permissions of the roles below it
+type Role int
+
+const (
+	// RoleNone grants no access
+	RoleNone Role = iota
+	// RoleViewer can list & read tasks
+	RoleViewer
+	// RoleSubmitter can enqueue tasks, and cancel & retry their own tasks
+	RoleSubmitter
+	// RoleAdmin can perform privileged tasks, and cancel other users' tasks
+	RoleAdmin
+)
+
+// Wildcard matches any user or task type in a policy
+const Wildcard = "*"
+
+var roleNames = map[Role]string{
+	RoleNone:      "none",
+	RoleViewer:    "viewer",
+	RoleSubmitter: "submitter",
+	RoleAdmin:     "admin",
+}
+
+// String gives the name of the role
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// MarshalJSON encodes the role as it's name
+func (r Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON decodes a role from it's name
+func (r *Role) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	role, err := ParseRole(s)
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// ParseRole reads a role from it's name
+func ParseRole(s string) (Role, error) {
+	for r, name := range roleNames {
+		if s == name {
+			return r, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role: '%s', must be one of viewer, submitter, admin", s)
+}
+
+// Policy grants a user a role for a task type. The Wildcard user applies to
+// everyone, including unauthenticated requests, and the Wildcard task type
+// applies to all task types
+type Policy struct {
+	// hash of user & task type, so there's only ever one policy per pair
+	Id string `json:"id"`
+	// user this policy applies to
+	UserId string `json:"userId"`
+	// task type this policy applies to
+	TaskType string `json:"taskType"`
+	// role granted
+	Role Role `json:"role"`
+	// when the policy was created
+	Created time.Time `json:"created"`
+}
+
+// NewPolicy creates a policy granting userId role for taskType
+func NewPolicy(userId, taskType string, role Role) *Policy {
+	return &Policy{
+		Id:       policyId(userId, taskType),
+		UserId:   userId,
+		TaskType: taskType,
+		Role:     role,
+		Created:  time.Now().Round(time.Second).In(time.UTC),
+	}
+}
+
+func policyId(userId, taskType string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s", userId, taskType)))
+	return hex.EncodeToString(sum[:])
+}
+
+// DatastoreType is to fulfill the sql_datastore.Model interface
+func (p Policy) DatastoreType() string {
+	return "Policy"
+}
+
+// GetId returns the policy's id
+func (p Policy) GetId() string {
+	return p.Id
+}
+
+// Key is to fulfill the sql_datastore.Model interface
+func (p Policy) Key() datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%s:%s", p.DatastoreType(), p.GetId()))
+}
+
+func (p *Policy) Read(store datastore.Datastore) error {
+	pi, err := store.Get(p.Key())
+	if err != nil {
+		return err
+	}
+
+	got, ok := pi.(*Policy)
+	if !ok {
+		return fmt.Errorf("Invalid Response")
+	}
+	*p = *got
+	return nil
+}
+
+// Save writes the policy, replacing any existing policy for the
+// same user & task type
+func (p *Policy) Save(store datastore.Datastore) error {
+	if p.UserId == "" || p.TaskType == "" {
+		return fmt.Errorf("policies require a user id & task type")
+	}
+	p.Id = policyId(p.UserId, p.TaskType)
+	return store.Put(p.Key(), p)
+}
+
+func (p *Policy) Delete(store datastore.Datastore) error {
+	return store.Delete(p.Key())
+}
+
+// ReadPolicies lists stored policies, optionally limited to those that
+// apply to userId, including Wildcard user policies
+func ReadPolicies(store datastore.Datastore, userId string) (Policies, error) {
+	res, err := store.Query(query.Query{
+		Prefix: fmt.Sprintf("/%s", Policy{}.DatastoreType()),
+		Limit:  1000,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ps := Policies{}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		p, ok := r.Value.(*Policy)
+		if !ok {
+			return nil, fmt.Errorf("Invalid Response")
+		}
+		if userId == "" || p.UserId == userId || p.UserId == Wildcard {
+			ps = append(ps, p)
+		}
+	}
+	return ps, nil
+}
+
+// Policies is a set of policies, usually those that apply to a single user
+type Policies []*Policy
+
+// Role gives the role policies grant userId for taskType. The most specific
+// policy wins: user policies over Wildcard user policies, then task type
+// policies over Wildcard task type policies
+func (ps Policies) Role(userId, taskType string) Role {
+	var (
+		role Role
+		best = -1
+	)
+	for _, p := range ps {
+		if (p.UserId != userId && p.UserId != Wildcard) || (p.TaskType != taskType && p.TaskType != Wildcard) {
+			continue
+		}
+		rank := 0
+		if p.UserId != Wildcard {
+			rank += 2
+		}
+		if p.TaskType != Wildcard {
+			rank++
+		}
+		if rank > best {
+			role, best = p.Role, rank
+		}
+	}
+	return role
+}
+
+func (p *Policy) NewSQLModel(key datastore.Key) sql_datastore.Model {
+	return &Policy{Id: key.Name()}
+}
+
+func (p *Policy) SQLQuery(cmd sql_datastore.Cmd) string {
+	switch cmd {
+	case sql_datastore.CmdCreateTable:
+		return qPolicyCreateTable
+	case sql_datastore.CmdExistsOne:
+		return qPolicyExists
+	case sql_datastore.CmdSelectOne:
+		return qPolicyRead
+	case sql_datastore.CmdInsertOne:
+		return qPolicyInsert
+	case sql_datastore.CmdUpdateOne:
+		return qPolicyUpdate
+	case sql_datastore.CmdDeleteOne:
+		return qPolicyDelete
+	case sql_datastore.CmdList:
+		return qPolicies
+	default:
+		return ""
+	}
+}
+
+func (p *Policy) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		id, userId, taskType, role string
+		created                    time.Time
+	)
+	if err := row.Scan(&id, &userId, &taskType, &role, &created); err != nil {
+		if err == sql.ErrNoRows {
+			return datastore.ErrNotFound
+		}
+		return err
+	}
+
+	r, err := ParseRole(role)
+	if err != nil {
+		return err
+	}
+
+	*p = Policy{
+		Id:       id,
+		UserId:   userId,
+		TaskType: taskType,
+		Role:     r,
+		Created:  created,
+	}
+	return nil
+}
+
+func (p *Policy) SQLParams(cmd sql_datastore.Cmd) []interface{} {
+	switch cmd {
+	case sql_datastore.CmdSelectOne, sql_datastore.CmdExistsOne, sql_datastore.CmdDeleteOne:
+		return []interface{}{p.Id}
+	case sql_datastore.CmdList:
+		return []interface{}{}
+	default:
+		return []interface{}{
+			p.Id,
+			p.UserId,
+			p.TaskType,
+			p.Role.String(),
+			p.Created,
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPoliciesRole(t *testing.T) {
+	ps := Policies{
+		NewPolicy(Wildcard, Wildcard, RoleViewer),
+		NewPolicy(Wildcard, "ipfs.addurl", RoleSubmitter),
+		NewPolicy("alice", Wildcard, RoleAdmin),
+		NewPolicy("alice", "kiwix.updateSources", RoleViewer),
+		NewPolicy("bob", "ipfs.addurl", RoleNone),
+	}
+
+	cases := []struct {
+		userId, taskType string
+		expect           Role
+	}{
+		{"", "pod.addcatalog", RoleViewer},
+		{"", "ipfs.addurl", RoleSubmitter},
+		{"alice", "pod.addcatalog", RoleAdmin},
+		{"alice", "ipfs.addurl", RoleAdmin},
+		{"alice", "kiwix.updateSources", RoleViewer},
+		{"bob", "ipfs.addurl", RoleNone},
+		{"bob", "pod.addcatalog", RoleViewer},
+	}
+
+	for i, c := range cases {
+		if got := ps.Role(c.userId, c.taskType); got != c.expect {
+			t.Errorf("case %d: %s on %s expected: %s, got: %s", i, c.userId, c.taskType, c.expect, got)
+		}
+	}
+
+	if (Policies{}).Role("alice", "ipfs.addurl") != RoleNone {
+		t.Errorf("expected no policies to grant no role")
+	}
+}
+
+func TestRoleJSON(t *testing.T) {
+	data, err := json.Marshal(RoleSubmitter)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(data) != `"submitter"` {
+		t.Errorf("expected role to marshal to it's name, got: %s", data)
+	}
+
+	var r Role
+	if err := json.Unmarshal([]byte(`"admin"`), &r); err != nil {
+		t.Fatal(err.Error())
+	}
+	if r != RoleAdmin {
+		t.Errorf("expected admin role, got: %s", r)
+	}
+	if err := json.Unmarshal([]byte(`"superuser"`), &r); err == nil {
+		t.Errorf("expected unknown role to error")
+	}
+}
@@ -0,0 +1,74 @@
+package auth
+
+const qAPIKeyCreateTable = `
+CREATE TABLE api_keys (
+  id               text NOT NULL PRIMARY KEY,
+  user_id          text NOT NULL,
+  name             text NOT NULL DEFAULT '',
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);`
+
+const qAPIKeys = `
+SELECT
+  id, user_id, name, created
+FROM api_keys
+ORDER BY created DESC
+LIMIT $1 OFFSET $2;`
+
+const qAPIKeyExists = `SELECT exists(SELECT 1 FROM api_keys WHERE id = $1);`
+
+const qAPIKeyRead = `
+SELECT
+  id, user_id, name, created
+FROM api_keys
+WHERE id = $1;`
+
+const qAPIKeyInsert = `
+INSERT INTO api_keys
+  (id, user_id, name, created)
+VALUES
+  ($1, $2, $3, $4);`
+
+const qAPIKeyUpdate = `
+UPDATE api_keys SET
+  user_id = $2, name = $3, created = $4
+WHERE id = $1;`
+
+const qAPIKeyDelete = `DELETE FROM api_keys WHERE id = $1;`
+
+const qPolicyCreateTable = `
+CREATE TABLE policies (
+  id               text NOT NULL PRIMARY KEY,
+  user_id          text NOT NULL,
+  task_type        text NOT NULL,
+  role             text NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);`
+
+const qPolicies = `
+SELECT
+  id, user_id, task_type, role, created
+FROM policies
+ORDER BY user_id, task_type
+LIMIT $1 OFFSET $2;`
+
+const qPolicyExists = `SELECT exists(SELECT 1 FROM policies WHERE id = $1);`
+
+const qPolicyRead = `
+SELECT
+  id, user_id, task_type, role, created
+FROM policies
+WHERE id = $1;`
+
+const qPolicyInsert = `
+INSERT INTO policies
+  (id, user_id, task_type, role, created)
+VALUES
+  ($1, $2, $3, $4, $5);`
+
+const qPolicyUpdate = `
+UPDATE policies SET
+  user_id = $2, task_type = $3, role = $4, created = $5
+WHERE id = $1;`
+
+const qPolicyDelete = `DELETE FROM policies WHERE id = $1;`
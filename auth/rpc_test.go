@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type Echo struct{}
+
+func (Echo) Say(args *string, res *string) error {
+	*res = *args
+	return nil
+}
+
+// serveRPC serves the Echo service on a local listener, performing
+// the handshake with secret if it's set
+func serveRPC(t *testing.T, tlsConfig *tls.Config, secret string) net.Listener {
+	s := rpc.NewServer()
+	if err := s.Register(Echo{}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if secret != "" {
+					if err := ServerHandshake(conn, secret); err != nil {
+						conn.Close()
+						return
+					}
+				}
+				s.ServeConn(conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func callEcho(cli *rpc.Client) error {
+	in, out := "hello", ""
+	if err := cli.Call("Echo.Say", &in, &out); err != nil {
+		return err
+	}
+	if out != in {
+		return rpc.ServerError("echo mismatch")
+	}
+	return nil
+}
+
+func TestRPCHandshake(t *testing.T) {
+	ln := serveRPC(t, nil, "secret")
+	defer ln.Close()
+
+	cli, err := DialRPC(ln.Addr().String(), nil, "secret")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer cli.Close()
+	if err := callEcho(cli); err != nil {
+		t.Error(err.Error())
+	}
+
+	if _, err := DialRPC(ln.Addr().String(), nil, "wrong"); err != ErrHandshakeFailed {
+		t.Errorf("expected wrong secret to fail the handshake, got: %v", err)
+	}
+}
+
+// writeCert creates a certificate signed by parent (self-signed if nil),
+// writing PEM cert & key files to dir
+func writeCert(t *testing.T, dir, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return cert, key
+}
+
+func TestRPCMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpc_tls")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCert(t, dir, "ca", true, nil, nil)
+	writeCert(t, dir, "server", false, ca, caKey)
+	writeCert(t, dir, "client", false, ca, caKey)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	serverConfig, err := ServerTLSConfig(path("server.crt"), path("server.key"), path("ca.crt"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ln := serveRPC(t, serverConfig, "secret")
+	defer ln.Close()
+
+	clientConfig, err := ClientTLSConfig(path("ca.crt"), path("client.crt"), path("client.key"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cli, err := DialRPC(ln.Addr().String(), clientConfig, "secret")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer cli.Close()
+	if err := callEcho(cli); err != nil {
+		t.Error(err.Error())
+	}
+
+	// without a client certificate the server rejects the connection
+	noCert, err := ClientTLSConfig(path("ca.crt"), "", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if cli, err := DialRPC(ln.Addr().String(), noCert, "secret"); err == nil {
+		if err := callEcho(cli); err == nil {
+			t.Errorf("expected connection without a client certificate to fail")
+		}
+		cli.Close()
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/datatogether/task_mgmt/auth"
+	"github.com/datatogether/task_mgmt/client"
+	"github.com/datatogether/task_mgmt/tasks"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// taskSubcommands are the operations of the task command
+var taskSubcommands = map[string]func(c client.Client, args []string) error{
+	"enqueue": taskEnqueue,
+	"get":     taskGet,
+	"list":    taskList,
+	"cancel":  taskCancel,
+	"retry":   taskRetry,
+	"watch":   taskWatch,
+	"logs":    taskLogs,
+}
+
+// runTask performs task subcommands against a running server, eg:
+// "task_mgmt task -server http://localhost:8080 get [id]"
+func runTask(args []string) error {
+	fs := flag.NewFlagSet("task", flag.ExitOnError)
+	server := fs.String("server", envOr("TASK_MGMT_URL", "http://localhost:8080"), "url of the task_mgmt HTTP api")
+	rpcAddr := fs.String("rpc", os.Getenv("TASK_MGMT_RPC"), "address of the task_mgmt RPC api, used in place of HTTP if set")
+	apiKey := fs.String("key", os.Getenv("TASK_MGMT_API_KEY"), "api key or JWT to authenticate HTTP requests with")
+	rpcSecret := fs.String("rpc-secret", os.Getenv("TASK_MGMT_RPC_SECRET"), "shared secret for the RPC handshake")
+	rpcTls := fs.Bool("rpc-tls", false, "connect to the RPC api over TLS")
+	rpcCa := fs.String("rpc-ca", os.Getenv("TASK_MGMT_RPC_CA"), "PEM CA certificates to verify the RPC server with, implies -rpc-tls")
+	rpcCert := fs.String("rpc-cert", os.Getenv("TASK_MGMT_RPC_CERT"), "PEM client certificate for mutual TLS, implies -rpc-tls")
+	rpcKey := fs.String("rpc-key", os.Getenv("TASK_MGMT_RPC_KEY"), "PEM client key for mutual TLS")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: task_mgmt task [flags] enqueue|get|list|cancel|retry|watch|logs [args]\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	sub, ok := taskSubcommands[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown task command: %s", fs.Arg(0))
+	}
+
+	var c client.Client
+	if *rpcAddr != "" {
+		var tlsConfig *tls.Config
+		if *rpcTls || *rpcCa != "" || *rpcCert != "" {
+			var err error
+			if tlsConfig, err = auth.ClientTLSConfig(*rpcCa, *rpcCert, *rpcKey); err != nil {
+				return err
+			}
+		}
+
+		rc, err := client.DialRPC(*rpcAddr, tlsConfig, *rpcSecret)
+		if err != nil {
+			return fmt.Errorf("error connecting to rpc server: %s", err.Error())
+		}
+		c = rc
+	} else {
+		c = client.NewHTTPClient(*server, *apiKey)
+	}
+	defer c.Close()
+
+	return sub(c, fs.Args()[1:])
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// paramFlags collects repeated -param key=value flags
+type paramFlags map[string]interface{}
+
+func (p paramFlags) String() string {
+	return fmt.Sprintf("%v", map[string]interface{}(p))
+}
+
+// Set parses key=value, values that are valid json are decoded, so
+// -param parallelism=4 sets a number, anything else is a string
+func (p paramFlags) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("params must be of the form key=value")
+	}
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(kv[1]), &v); err != nil {
+		v = kv[1]
+	}
+	p[kv[0]] = v
+	return nil
+}
+
+func taskEnqueue(c client.Client, args []string) error {
+	fs := flag.NewFlagSet("enqueue", flag.ExitOnError)
+	typ := fs.String("type", "", "type of task to enqueue. required")
+	title := fs.String("title", "", "human-readable title for the task")
+	userId := fs.String("user", "", "id of the user submitting the task")
+	file := fs.String("params", "", "path to a json file of task params")
+	watch := fs.Bool("watch", false, "watch the task's progress once enqueued")
+	callback := fs.String("callback", "", "url to notify when the task finishes")
+	params := paramFlags{}
+	fs.Var(params, "param", "task param as key=value, can be repeated. overrides values from -params")
+	fs.Parse(args)
+
+	if *typ == "" {
+		return fmt.Errorf("-type is required")
+	}
+
+	p := map[string]interface{}{}
+	if *file != "" {
+		data, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &p); err != nil {
+			return fmt.Errorf("error decoding params file: %s", err.Error())
+		}
+	}
+	for k, v := range params {
+		p[k] = v
+	}
+
+	t, err := c.Enqueue(context.Background(), &tasks.TasksEnqueueParams{
+		Title:       *title,
+		Type:        *typ,
+		UserId:      *userId,
+		Params:      p,
+		CallbackUrl: *callback,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *watch {
+		return watchTask(c, t.Id)
+	}
+	return printJSON(t)
+}
+
+func taskGet(c client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: task_mgmt task get [id]")
+	}
+	t, err := c.Get(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(t)
+}
+
+func taskList(c client.Client, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	page := fs.Int("page", 1, "page of results")
+	pageSize := fs.Int("pageSize", 25, "number of tasks per page")
+	fs.Parse(args)
+
+	if *page < 1 {
+		*page = 1
+	}
+	ts, err := c.List(context.Background(), *pageSize, (*page-1)**pageSize)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range ts {
+		fmt.Printf("%s\t%-10s\t%s\t%s\n", t.Id, taskState(t), t.Type, t.Title)
+	}
+	return nil
+}
+
+func taskCancel(c client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: task_mgmt task cancel [id]")
+	}
+	t, err := c.Cancel(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("cancelled task %s\n", t.Id)
+	return nil
+}
+
+func taskRetry(c client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: task_mgmt task retry [id]")
+	}
+	t, err := c.Retry(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("re-enqueued task %s\n", t.Id)
+	return nil
+}
+
+func taskWatch(c client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: task_mgmt task watch [id]")
+	}
+	return watchTask(c, args[0])
+}
+
+func taskLogs(c client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: task_mgmt task logs [id]")
+	}
+	events, err := c.Events(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		fmt.Printf("%s\t%-10s\t%s\n", e.Created.Local().Format(time.RFC3339), e.Type, e.Message)
+	}
+	return nil
+}
+
+// watchTask renders progress updates for a task until it finishes,
+// returning an error if the task failed
+func watchTask(c client.Client, id string) error {
+	updates := make(chan *tasks.Task)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Stream(context.Background(), id, updates)
+		close(updates)
+	}()
+
+	var last *tasks.Task
+	for t := range updates {
+		last = t
+		printProgress(t)
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	if last != nil && last.Failed != nil {
+		return fmt.Errorf("task failed: %s", last.Error)
+	}
+	if last != nil && last.Succeeded != nil {
+		fmt.Printf("task %s succeeded\n", last.Id)
+	}
+	return nil
+}
+
+// printProgress writes a single line describing a task update
+func printProgress(t *tasks.Task) {
+	if t.Progress != nil {
+		p := t.Progress
+		fmt.Printf("[%3.0f%%] %d/%d %s\n", p.Percent*100, p.Step, p.Steps, p.Status)
+	} else {
+		fmt.Printf("%s %s\n", taskState(t), t.Status)
+	}
+}
+
+// taskState is a short description of where a task is in it's lifecycle
+func taskState(t *tasks.Task) string {
+	switch {
+	case t.Succeeded != nil:
+		return "succeeded"
+	case t.Failed != nil:
+		return "failed"
+	case t.Started != nil:
+		return "running"
+	case t.Enqueued != nil:
+		return "queued"
+	default:
+		return "created"
+	}
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
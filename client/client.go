@@ -0,0 +1,111 @@
+// Package client performs task requests against a running task_mgmt server,
+// over it's HTTP api or the TaskRequests RPC service. Requests that fail for
+// reasons that may pass, like dropped connections & busy servers, are retried
+// with backoff. Retries that could run a request twice are only made for
+// requests that are safe to repeat
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/datatogether/task_mgmt/tasks"
+	"time"
+)
+
+// DefaultBackoff is how long clients wait between attempts at a request,
+// three retries are made over about five seconds
+var DefaultBackoff = []time.Duration{
+	250 * time.Millisecond,
+	time.Second,
+	4 * time.Second,
+}
+
+// ErrTimeout is returned by Wait if the task doesn't finish in time
+var ErrTimeout = fmt.Errorf("timed out waiting for task to finish")
+
+// Client is the set of requests a task_mgmt server answers
+type Client interface {
+	Enqueue(ctx context.Context, params *tasks.TasksEnqueueParams) (*tasks.Task, error)
+	Get(ctx context.Context, id string) (*tasks.Task, error)
+	List(ctx context.Context, limit, offset int) ([]*tasks.Task, error)
+	Cancel(ctx context.Context, id string) (*tasks.Task, error)
+	Retry(ctx context.Context, id string) (*tasks.Task, error)
+	Events(ctx context.Context, id string) ([]*tasks.TaskEvent, error)
+	// Stream sends updates to a task until it finishes, starting with the
+	// task as it is now. Stream returns nil once the finished task is sent
+	Stream(ctx context.Context, id string, updates chan<- *tasks.Task) error
+	// Wait blocks until a task finishes, returning the finished task. if
+	// timeout passes first Wait returns the latest version of the task and
+	// ErrTimeout. zero waits until ctx is done
+	Wait(ctx context.Context, id string, timeout time.Duration) (*tasks.Task, error)
+	// Close releases the client's connections
+	Close() error
+}
+
+// Finished reports weather t has succeeded or failed
+func Finished(t *tasks.Task) bool {
+	return t.Succeeded != nil || t.Failed != nil
+}
+
+// wait implements Wait on top of a client's Stream
+func wait(ctx context.Context, c Client, id string, timeout time.Duration) (*tasks.Task, error) {
+	parent := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	updates := make(chan *tasks.Task)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Stream(ctx, id, updates)
+		close(updates)
+	}()
+
+	var last *tasks.Task
+	for t := range updates {
+		last = t
+	}
+	err := <-errs
+
+	switch {
+	case last != nil && Finished(last):
+		return last, nil
+	case err == nil:
+		return last, fmt.Errorf("stream of task %s ended before it finished", id)
+	case ctx.Err() == context.DeadlineExceeded && parent.Err() == nil:
+		return last, ErrTimeout
+	}
+	return last, err
+}
+
+// send delivers t to updates unless ctx is done first
+func send(ctx context.Context, updates chan<- *tasks.Task, t *tasks.Task) error {
+	select {
+	case updates <- t:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sleep pauses for d, returning early with an error if ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backoffOr returns backoff, or DefaultBackoff if it's nil
+func backoffOr(backoff []time.Duration) []time.Duration {
+	if backoff != nil {
+		return backoff
+	}
+	return DefaultBackoff
+}
@@ -0,0 +1,364 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/datatogether/task_mgmt/tasks"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testBackoff = []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}
+
+// respond writes an apiutil-style response
+func respond(w http.ResponseWriter, status int, data string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if status == http.StatusOK {
+		fmt.Fprintf(w, `{"meta":{"code":200},"data":%s}`, data)
+	} else {
+		fmt.Fprintf(w, `{"meta":{"code":%d,"error":%q}}`, status, data)
+	}
+}
+
+// counter counts requests made to a test server
+type counter struct {
+	sync.Mutex
+	n int
+}
+
+func (c *counter) inc() int {
+	c.Lock()
+	defer c.Unlock()
+	c.n++
+	return c.n
+}
+
+func TestHTTPClientRetries(t *testing.T) {
+	reqs := &counter{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer key" {
+			respond(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if reqs.inc() < 3 {
+			respond(w, http.StatusServiceUnavailable, "busy")
+			return
+		}
+		respond(w, http.StatusOK, `{"id":"abc"}`)
+	}))
+	defer s.Close()
+
+	c := NewHTTPClient(s.URL+"/", "key")
+	c.Backoff = testBackoff
+	got, err := c.Get(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Id != "abc" || reqs.n != 3 {
+		t.Errorf("expected task abc after 3 requests, got: '%s' after %d", got.Id, reqs.n)
+	}
+
+	c.Key = ""
+	_, err = c.Get(context.Background(), "abc")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusUnauthorized || e.Message != "unauthorized" {
+		t.Errorf("expected an unauthorized error, got: %#v", err)
+	}
+}
+
+func TestHTTPClientErrors(t *testing.T) {
+	cases := []struct {
+		method     string
+		status     int
+		retryAfter string
+		requests   int
+	}{
+		{"GET", http.StatusBadGateway, "", 4},
+		{"POST", http.StatusBadGateway, "", 1},
+		{"POST", http.StatusTooManyRequests, "", 4},
+		{"POST", http.StatusTooManyRequests, "3600", 1},
+		{"GET", http.StatusNotFound, "", 1},
+		{"POST", http.StatusBadRequest, "", 1},
+	}
+
+	for i, c := range cases {
+		reqs := &counter{}
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqs.inc()
+			if c.retryAfter != "" {
+				w.Header().Set("Retry-After", c.retryAfter)
+			}
+			respond(w, c.status, "oh no")
+		}))
+
+		cli := &HTTPClient{Url: s.URL, Backoff: testBackoff}
+		var err error
+		if c.method == "GET" {
+			_, err = cli.Get(context.Background(), "abc")
+		} else {
+			_, err = cli.Enqueue(context.Background(), &tasks.TasksEnqueueParams{Type: "test"})
+		}
+		s.Close()
+
+		if e, ok := err.(*Error); !ok || e.StatusCode != c.status || e.Message != "oh no" {
+			t.Errorf("case %d: expected a %d error, got: %#v", i, c.status, err)
+		}
+		if reqs.n != c.requests {
+			t.Errorf("case %d: expected %d requests, got: %d", i, c.requests, reqs.n)
+		}
+	}
+}
+
+func TestHTTPClientDialRetries(t *testing.T) {
+	// grab a free port, then stop listening on it
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := &HTTPClient{Url: "http://" + addr, Backoff: []time.Duration{50 * time.Millisecond}}
+	listening := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			close(listening)
+			return
+		}
+		listening <- ln
+		http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			respond(w, http.StatusOK, `{"id":"abc"}`)
+		}))
+	}()
+
+	// refused connections never reached the server, so POSTs are retried
+	got, err := c.Enqueue(context.Background(), &tasks.TasksEnqueueParams{Type: "test"})
+	if ln, ok := <-listening; ok {
+		defer ln.Close()
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Id != "abc" {
+		t.Errorf("expected task abc, got: %s", got.Id)
+	}
+}
+
+// streamServer serves task streams, each connection writes the next set of
+// events & closes, except the last which stays open until the client leaves
+func streamServer(streams ...[]string) (*httptest.Server, *counter) {
+	conns := &counter{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tasks/abc/stream" {
+			respond(w, http.StatusNotFound, "not found")
+			return
+		}
+		n := conns.inc()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		if n > len(streams) {
+			<-r.Context().Done()
+			return
+		}
+		for _, data := range streams[n-1] {
+			fmt.Fprintf(w, "event: task\ndata: %s\n\n", data)
+			w.(http.Flusher).Flush()
+		}
+		if n == len(streams) {
+			<-r.Context().Done()
+		}
+	})), conns
+}
+
+func TestHTTPClientStream(t *testing.T) {
+	s, conns := streamServer(
+		[]string{`{"id":"abc","version":1}`, `{"id":"abc","version":2}`},
+		[]string{`{"id":"abc","version":2}`, `{"id":"abc","version":3,"succeeded":"2017-01-01T00:00:00Z"}`},
+	)
+	defer s.Close()
+
+	c := &HTTPClient{Url: s.URL, Backoff: testBackoff}
+	updates := make(chan *tasks.Task)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Stream(context.Background(), "abc", updates)
+		close(updates)
+	}()
+
+	versions := []int64{}
+	for u := range updates {
+		versions = append(versions, u.Version)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err.Error())
+	}
+	if fmt.Sprint(versions) != "[1 2 2 3]" {
+		t.Errorf("expected versions [1 2 2 3], got: %v", versions)
+	}
+	if conns.n != 2 {
+		t.Errorf("expected the dropped stream to reconnect once, got %d connections", conns.n)
+	}
+}
+
+func TestHTTPClientWait(t *testing.T) {
+	s, _ := streamServer([]string{`{"id":"abc","version":1}`})
+	defer s.Close()
+
+	c := &HTTPClient{Url: s.URL, Backoff: testBackoff}
+	got, err := c.Wait(context.Background(), "abc", 50*time.Millisecond)
+	if err != ErrTimeout {
+		t.Errorf("expected ErrTimeout, got: %v", err)
+	}
+	if got == nil || got.Version != 1 {
+		t.Errorf("expected the latest task on timeout, got: %v", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Wait(ctx, "abc", time.Minute); err != context.DeadlineExceeded {
+		t.Errorf("expected context errors to pass through, got: %v", err)
+	}
+
+	s, _ = streamServer([]string{`{"id":"abc","version":1}`, `{"id":"abc","version":2,"failed":"2017-01-01T00:00:00Z","error":"oops"}`})
+	defer s.Close()
+	c.Url = s.URL
+	got, err = c.Wait(context.Background(), "abc", time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Failed == nil || got.Error != "oops" {
+		t.Errorf("expected the failed task, got: %v", got)
+	}
+}
+
+// testRequests stands in for tasks.TaskRequests
+type testRequests struct {
+	sync.Mutex
+	userIds []string
+	calls   int
+}
+
+func (r *testRequests) Get(args *tasks.TasksGetParams, res *tasks.Task) error {
+	r.Lock()
+	defer r.Unlock()
+	r.userIds = append(r.userIds, args.UserId)
+	if args.Id != "abc" {
+		return fmt.Errorf("not found")
+	}
+	*res = tasks.Task{Id: args.Id}
+	return nil
+}
+
+func (r *testRequests) Enqueue(args *tasks.TasksEnqueueParams, res *tasks.Task) error {
+	r.Lock()
+	defer r.Unlock()
+	r.userIds = append(r.userIds, args.UserId)
+	*res = tasks.Task{Id: "abc", Type: args.Type, UserId: args.UserId}
+	return nil
+}
+
+// WaitForUpdate moves the task forward a version per call, until it succeeds
+func (r *testRequests) WaitForUpdate(args *tasks.TasksWaitParams, res *tasks.Task) error {
+	r.Lock()
+	defer r.Unlock()
+	r.calls++
+	*res = tasks.Task{Id: args.Id, Version: args.SinceVersion + 1}
+	if res.Version == 3 {
+		now := time.Now()
+		res.Succeeded = &now
+	}
+	return nil
+}
+
+// rpcServer serves testRequests, returning it's address & a func that
+// drops all open connections
+func rpcServer(t *testing.T, r *testRequests) (addr string, drop func(), stop func()) {
+	s := rpc.NewServer()
+	if err := s.RegisterName("TaskRequests", r); err != nil {
+		t.Fatal(err.Error())
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var lock sync.Mutex
+	conns := []net.Conn{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+			go s.ServeConn(conn)
+		}
+	}()
+
+	drop = func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+		conns = nil
+	}
+	return ln.Addr().String(), drop, func() { ln.Close(); drop() }
+}
+
+func TestRPCClient(t *testing.T) {
+	r := &testRequests{}
+	addr, drop, stop := rpcServer(t, r)
+	defer stop()
+
+	c, err := DialRPC(addr, nil, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	c.UserId = "user"
+	c.Backoff = testBackoff
+
+	ctx := context.Background()
+	if got, err := c.Get(ctx, "abc"); err != nil || got.Id != "abc" {
+		t.Fatalf("expected task abc, got: %v, %v", got, err)
+	}
+	if _, err := c.Get(ctx, "def"); err == nil || err.Error() != "not found" {
+		t.Errorf("expected server errors to pass through, got: %v", err)
+	}
+
+	// broken connections are redialed
+	drop()
+	if got, err := c.Get(ctx, "abc"); err != nil || got.Id != "abc" {
+		t.Fatalf("expected task abc after reconnecting, got: %v, %v", got, err)
+	}
+
+	if got, err := c.Enqueue(ctx, &tasks.TasksEnqueueParams{Type: "test", UserId: "other"}); err != nil || got.UserId != "other" {
+		t.Errorf("expected enqueues to keep their own user, got: %v, %v", got, err)
+	}
+	if r.userIds[0] != "user" {
+		t.Errorf("expected requests to be made as the client's user, got: %s", r.userIds[0])
+	}
+
+	got, err := c.Wait(ctx, "abc", time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Succeeded == nil || got.Version != 3 || r.calls != 3 {
+		t.Errorf("expected to wait for version 3 over 3 calls, got version %d over %d", got.Version, r.calls)
+	}
+
+	c.Close()
+	if _, err := c.Get(ctx, "abc"); err != rpc.ErrShutdown {
+		t.Errorf("expected closed clients to error, got: %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/datatogether/task_mgmt/tracing"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPClient performs requests against the HTTP api
+type HTTPClient struct {
+	// Url of the server, eg: http://localhost:8080
+	Url string
+	// Key is an api key or JWT, sent as a bearer token if set
+	Key string
+	// Client makes requests, http.DefaultClient if nil. streams are long
+	// lived, so Client shouldn't set a Timeout
+	Client *http.Client
+	// Backoff is how long to wait between attempts, DefaultBackoff if nil
+	Backoff []time.Duration
+}
+
+// NewHTTPClient creates a client for the api at url, authenticating with
+// key if it isn't empty
+func NewHTTPClient(url, key string) *HTTPClient {
+	return &HTTPClient{Url: strings.TrimSuffix(url, "/"), Key: key}
+}
+
+// Error is an error response from the api
+type Error struct {
+	// StatusCode of the response
+	StatusCode int
+	// Message the server gave
+	Message string
+	// RetryAfter is how long the server asked clients to wait before
+	// trying again, if it did
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return fmt.Sprintf("request failed with status %d", e.StatusCode)
+}
+
+// envelope is the wrapper apiutil writes responses in
+type envelope struct {
+	Meta struct {
+		Code    int    `json:"code"`
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	} `json:"meta"`
+	Data json.RawMessage `json:"data"`
+}
+
+// errDropped is returned when a stream closes before it's task finishes
+var errDropped = fmt.Errorf("stream ended before task finished")
+
+func (c *HTTPClient) httpClient() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
+
+// newRequest creates an api request, adding credentials if the client has them
+func (c *HTTPClient) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.Url, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Key)
+	}
+	return req, nil
+}
+
+// send performs a request, retrying it with backoff while it fails in a
+// way that's worth retrying. responses with error statuses are returned as
+// *Error, otherwise the caller must close the response body
+func (c *HTTPClient) send(ctx context.Context, method, path string, body []byte, header http.Header) (*http.Response, error) {
+	backoff := backoffOr(c.Backoff)
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest(ctx, method, path, body)
+		if err != nil {
+			return nil, err
+		}
+		for key, vals := range header {
+			req.Header[key] = vals
+		}
+
+		res, err := c.httpClient().Do(req)
+		if err == nil && res.StatusCode < http.StatusBadRequest {
+			return res, nil
+		}
+
+		var wait time.Duration
+		if err == nil {
+			e := readError(res)
+			wait, err = e.RetryAfter, e
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// servers that ask for a longer wait than we'd ever make get their error
+		if attempt >= len(backoff) || !retryable(method, err) || wait > backoff[len(backoff)-1] {
+			return nil, err
+		}
+		if wait < backoff[attempt] {
+			wait = backoff[attempt]
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readError reads an error response, closing it's body
+func readError(res *http.Response) *Error {
+	defer res.Body.Close()
+	e := &Error{StatusCode: res.StatusCode}
+	if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && secs > 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+
+	env := &envelope{}
+	if err := json.NewDecoder(res.Body).Decode(env); err == nil {
+		e.Message = env.Meta.Error
+		if e.Message == "" {
+			e.Message = env.Meta.Message
+		}
+	}
+	return e
+}
+
+// retryable reports weather a failed request can be sent again. GETs are
+// retried after any network error, other requests only if the connection
+// was never made, or the server turned them away without acting on them
+func retryable(method string, err error) bool {
+	if e, ok := err.(*Error); ok {
+		switch e.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return true
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			return method == "GET"
+		}
+		return false
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return method == "GET"
+}
+
+// do performs a request against the api, decoding response data into res
+func (c *HTTPClient) do(ctx context.Context, method, path string, body, res interface{}, header http.Header) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	resp, err := c.send(ctx, method, path, data, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	env := &envelope{}
+	if err := json.NewDecoder(resp.Body).Decode(env); err != nil {
+		return fmt.Errorf("error decoding response (status %d): %s", resp.StatusCode, err.Error())
+	}
+	if res != nil && len(env.Data) > 0 {
+		return json.Unmarshal(env.Data, res)
+	}
+	return nil
+}
+
+func (c *HTTPClient) Enqueue(ctx context.Context, params *tasks.TasksEnqueueParams) (*tasks.Task, error) {
+	var header http.Header
+	if params.TraceParent != "" {
+		header = http.Header{}
+		header.Set(tracing.Header, params.TraceParent)
+	}
+
+	t := &tasks.Task{}
+	err := c.do(ctx, "POST", "/tasks", &tasks.Task{
+		Title:       params.Title,
+		Type:        params.Type,
+		UserId:      params.UserId,
+		Params:      params.Params,
+		CallbackUrl: params.CallbackUrl,
+	}, t, header)
+	return t, err
+}
+
+func (c *HTTPClient) Get(ctx context.Context, id string) (*tasks.Task, error) {
+	t := &tasks.Task{}
+	err := c.do(ctx, "GET", "/tasks/"+id, nil, t, nil)
+	return t, err
+}
+
+// List pages through tasks, newest first. the api pages by page number,
+// so offset is rounded down to a multiple of limit
+func (c *HTTPClient) List(ctx context.Context, limit, offset int) ([]*tasks.Task, error) {
+	ts := []*tasks.Task{}
+	page := 1
+	if limit > 0 {
+		page = offset/limit + 1
+	}
+	err := c.do(ctx, "GET", fmt.Sprintf("/tasks?page=%d&pageSize=%d", page, limit), nil, &ts, nil)
+	return ts, err
+}
+
+func (c *HTTPClient) Cancel(ctx context.Context, id string) (*tasks.Task, error) {
+	t := &tasks.Task{}
+	err := c.do(ctx, "POST", "/tasks/"+id+"/cancel", nil, t, nil)
+	return t, err
+}
+
+func (c *HTTPClient) Retry(ctx context.Context, id string) (*tasks.Task, error) {
+	t := &tasks.Task{}
+	err := c.do(ctx, "POST", "/tasks/"+id+"/retry", nil, t, nil)
+	return t, err
+}
+
+func (c *HTTPClient) Events(ctx context.Context, id string) ([]*tasks.TaskEvent, error) {
+	events := []*tasks.TaskEvent{}
+	err := c.do(ctx, "GET", "/tasks/"+id+"/events", nil, &events, nil)
+	return events, err
+}
+
+// Stream reads the server-sent event stream for a task. dropped streams
+// are reconnected, the server starts each stream with the current task
+// so no state is missed
+func (c *HTTPClient) Stream(ctx context.Context, id string, updates chan<- *tasks.Task) error {
+	backoff := backoffOr(c.Backoff)
+	failures := 0
+	for {
+		res, err := c.send(ctx, "GET", "/tasks/"+id+"/stream", nil, nil)
+		if err != nil {
+			return err
+		}
+		received, err := readStream(ctx, res.Body, updates)
+		res.Body.Close()
+		if err != errDropped {
+			return err
+		}
+
+		if received {
+			failures = 0
+		}
+		if failures >= len(backoff) {
+			return err
+		}
+		if err := sleep(ctx, backoff[failures]); err != nil {
+			return err
+		}
+		failures++
+	}
+}
+
+// readStream sends tasks from a server-sent event stream to updates,
+// returning nil once the task finishes, or errDropped if the stream ends
+// first. received reports weather any updates were read
+func readStream(ctx context.Context, r io.Reader, updates chan<- *tasks.Task) (received bool, err error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		t := &tasks.Task{}
+		if err := json.Unmarshal([]byte(line[len("data: "):]), t); err != nil {
+			return received, err
+		}
+		if err := send(ctx, updates, t); err != nil {
+			return received, err
+		}
+		received = true
+		if Finished(t) {
+			return received, nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return received, ctx.Err()
+	}
+	return received, errDropped
+}
+
+// Wait follows the task's stream until it finishes
+func (c *HTTPClient) Wait(ctx context.Context, id string, timeout time.Duration) (*tasks.Task, error) {
+	return wait(ctx, c, id, timeout)
+}
+
+// Close releases idle connections of the client's http.Client, if it
+// has it's own
+func (c *HTTPClient) Close() error {
+	if c.Client != nil {
+		c.Client.CloseIdleConnections()
+	}
+	return nil
+}
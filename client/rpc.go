@@ -0,0 +1,203 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/datatogether/task_mgmt/auth"
+	"github.com/datatogether/task_mgmt/tasks"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// RPCClient performs requests against the TaskRequests rpc service
+type RPCClient struct {
+	// UserId is sent with requests that don't name a user. rpc callers
+	// are trusted to act on behalf of any user, empty acts as no one
+	UserId string
+	// Backoff is how long to wait between attempts, DefaultBackoff if nil
+	Backoff []time.Duration
+
+	// dial reconnects broken connections, nil if the client can't redial
+	dial   func() (*rpc.Client, error)
+	lock   sync.Mutex
+	cli    *rpc.Client
+	closed bool
+}
+
+// DialRPC connects to the rpc service at addr, see auth.DialRPC for the
+// meaning of tlsConfig & secret. broken connections are redialed
+func DialRPC(addr string, tlsConfig *tls.Config, secret string) (*RPCClient, error) {
+	dial := func() (*rpc.Client, error) {
+		return auth.DialRPC(addr, tlsConfig, secret)
+	}
+	cli, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return &RPCClient{dial: dial, cli: cli}, nil
+}
+
+// NewRPCClient creates a client from an existing connection, which isn't
+// redialed if it breaks
+func NewRPCClient(cli *rpc.Client) *RPCClient {
+	return &RPCClient{cli: cli}
+}
+
+// conn returns the current connection, dialing a new one if needed
+func (c *RPCClient) conn() (*rpc.Client, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed || (c.cli == nil && c.dial == nil) {
+		return nil, rpc.ErrShutdown
+	}
+	if c.cli == nil {
+		cli, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		c.cli = cli
+	}
+	return c.cli, nil
+}
+
+// broken drops a connection that's stopped working so the next call dials
+// a new one, reporting weather it will
+func (c *RPCClient) broken(cli *rpc.Client) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.dial == nil || c.closed {
+		return false
+	}
+	if c.cli == cli {
+		cli.Close()
+		c.cli = nil
+	}
+	return true
+}
+
+// call performs an rpc call, retrying with backoff if the connection can't
+// be made or has broken. calls that may have reached the server are only
+// retried if they're idempotent
+func (c *RPCClient) call(ctx context.Context, method string, args, reply interface{}, idempotent bool) error {
+	backoff := backoffOr(c.Backoff)
+	for attempt := 0; ; attempt++ {
+		cli, err := c.conn()
+		if err == rpc.ErrShutdown {
+			return err
+		} else if err == nil {
+			call := cli.Go(method, args, reply, make(chan *rpc.Call, 1))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-call.Done:
+				err = call.Error
+			}
+			if err == nil {
+				return nil
+			}
+			if _, ok := err.(rpc.ServerError); ok {
+				// the server answered, with an error
+				return err
+			}
+			// calls on a shut down connection are never sent
+			sent := err != rpc.ErrShutdown
+			if !c.broken(cli) || (sent && !idempotent) {
+				return err
+			}
+		}
+
+		if attempt >= len(backoff) {
+			return err
+		}
+		if err := sleep(ctx, backoff[attempt]); err != nil {
+			return err
+		}
+	}
+}
+
+// userId is the user a request acts as, the request's own if it names one
+func (c *RPCClient) userId(id string) string {
+	if id != "" {
+		return id
+	}
+	return c.UserId
+}
+
+func (c *RPCClient) Enqueue(ctx context.Context, params *tasks.TasksEnqueueParams) (*tasks.Task, error) {
+	p := *params
+	p.UserId = c.userId(p.UserId)
+	t := &tasks.Task{}
+	err := c.call(ctx, "TaskRequests.Enqueue", &p, t, false)
+	return t, err
+}
+
+func (c *RPCClient) Get(ctx context.Context, id string) (*tasks.Task, error) {
+	t := &tasks.Task{}
+	err := c.call(ctx, "TaskRequests.Get", &tasks.TasksGetParams{Id: id, UserId: c.UserId}, t, true)
+	return t, err
+}
+
+// List pages through tasks, newest first
+func (c *RPCClient) List(ctx context.Context, limit, offset int) ([]*tasks.Task, error) {
+	ts := []*tasks.Task{}
+	err := c.call(ctx, "TaskRequests.List", &tasks.TasksListParams{OrderBy: "created DESC", Limit: limit, Offset: offset, UserId: c.UserId}, &ts, true)
+	return ts, err
+}
+
+func (c *RPCClient) Cancel(ctx context.Context, id string) (*tasks.Task, error) {
+	t := &tasks.Task{}
+	err := c.call(ctx, "TaskRequests.Cancel", &tasks.TasksCancelParams{Id: id, UserId: c.UserId}, t, false)
+	return t, err
+}
+
+func (c *RPCClient) Retry(ctx context.Context, id string) (*tasks.Task, error) {
+	t := &tasks.Task{}
+	err := c.call(ctx, "TaskRequests.Retry", &tasks.TasksRetryParams{Id: id, UserId: c.UserId}, t, false)
+	return t, err
+}
+
+func (c *RPCClient) Events(ctx context.Context, id string) ([]*tasks.TaskEvent, error) {
+	events := []*tasks.TaskEvent{}
+	err := c.call(ctx, "TaskRequests.Events", &tasks.TasksEventsParams{Id: id, UserId: c.UserId}, &events, true)
+	return events, err
+}
+
+// Stream long-polls for changes to the task until it finishes
+func (c *RPCClient) Stream(ctx context.Context, id string, updates chan<- *tasks.Task) error {
+	var version int64
+	for first := true; ; first = false {
+		t := &tasks.Task{}
+		if err := c.call(ctx, "TaskRequests.WaitForUpdate", &tasks.TasksWaitParams{Id: id, SinceVersion: version, UserId: c.UserId}, t, true); err != nil {
+			return err
+		}
+		finished := Finished(t)
+		if first || finished || t.Version > version {
+			version = t.Version
+			if err := send(ctx, updates, t); err != nil {
+				return err
+			}
+		}
+		if finished {
+			return nil
+		}
+	}
+}
+
+// Wait long-polls the task until it finishes
+func (c *RPCClient) Wait(ctx context.Context, id string, timeout time.Duration) (*tasks.Task, error) {
+	return wait(ctx, c, id, timeout)
+}
+
+// Close shuts down the client's connection
+func (c *RPCClient) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	if c.cli == nil {
+		return nil
+	}
+	err := c.cli.Close()
+	c.cli = nil
+	return err
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/task_mgmt/auth"
+	"github.com/datatogether/task_mgmt/client"
+	"github.com/datatogether/task_mgmt/tasks"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clientTestTask reports halfway progress, then finishes after Delay
+// milliseconds. Name keeps otherwise equal tasks from being coalesced
+type clientTestTask struct {
+	Name  string `json:"name"`
+	Delay int    `json:"delay"`
+	Fail  bool   `json:"fail"`
+}
+
+func (t *clientTestTask) Valid() error {
+	return nil
+}
+
+func (t *clientTestTask) Do(updates chan tasks.Progress) {
+	updates <- tasks.Progress{Step: 1, Steps: 2, Percent: 0.5, Status: "halfway"}
+	time.Sleep(time.Duration(t.Delay) * time.Millisecond)
+	if t.Fail {
+		updates <- tasks.Progress{Error: fmt.Errorf("failed on purpose")}
+		return
+	}
+	updates <- tasks.Progress{Done: true}
+}
+
+// newClientTestServer serves NewServerRoutes from the test database,
+// running tasks in-process
+func newClientTestServer(t *testing.T, wrap func(http.Handler) http.Handler) *httptest.Server {
+	sql_datastore.SetDB(appDB)
+	if err := registerModels(); err != nil {
+		t.Fatal(err.Error())
+	}
+	tasks.RegisterTaskdef("test.client", func() tasks.Taskable { return &clientTestTask{} })
+
+	amqpUrl := cfg.AmqpUrl
+	cfg.AmqpUrl = ""
+	t.Cleanup(func() { cfg.AmqpUrl = amqpUrl })
+
+	var h http.Handler = NewServerRoutes()
+	if wrap != nil {
+		h = wrap(h)
+	}
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func enqueueClientTestTask(t *testing.T, c client.Client, params map[string]interface{}) *tasks.Task {
+	task, err := c.Enqueue(context.Background(), &tasks.TasksEnqueueParams{
+		Title:  t.Name(),
+		Type:   "test.client",
+		Params: params,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Id == "" {
+		t.Fatal("expected enqueued task to have an id")
+	}
+	return task
+}
+
+func TestClient(t *testing.T) {
+	s := newClientTestServer(t, nil)
+	c := client.NewHTTPClient(s.URL, "")
+	ctx := context.Background()
+
+	task := enqueueClientTestTask(t, c, map[string]interface{}{"name": "succeeds", "delay": 100})
+	got, err := c.Get(ctx, task.Id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Id != task.Id || got.Type != "test.client" {
+		t.Errorf("task mismatch, expected %s, got: %s %s", task.Id, got.Id, got.Type)
+	}
+	if _, err := c.Get(ctx, "not-a-task"); err == nil {
+		t.Errorf("expected getting a missing task to error")
+	}
+
+	updates := make(chan *tasks.Task)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Stream(ctx, task.Id, updates)
+		close(updates)
+	}()
+	var last *tasks.Task
+	for u := range updates {
+		if u.Id != task.Id {
+			t.Errorf("expected updates to task %s, got: %s", task.Id, u.Id)
+		}
+		last = u
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err.Error())
+	}
+	if last == nil || last.Succeeded == nil {
+		t.Errorf("expected the stream to end with the task succeeding, got: %v", last)
+	}
+
+	failing := enqueueClientTestTask(t, c, map[string]interface{}{"name": "fails", "fail": true})
+	got, err = c.Wait(ctx, failing.Id, 10*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Failed == nil || got.Error != "failed on purpose" {
+		t.Errorf("expected wait to return the failed task, got: %v", got)
+	}
+
+	ts, err := c.List(ctx, 25, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	listed := map[string]bool{}
+	for _, lt := range ts {
+		listed[lt.Id] = true
+	}
+	if !listed[task.Id] || !listed[failing.Id] {
+		t.Errorf("expected tasks %s & %s to be listed", task.Id, failing.Id)
+	}
+}
+
+func TestClientWaitCancel(t *testing.T) {
+	s := newClientTestServer(t, nil)
+	c := client.NewHTTPClient(s.URL, "")
+	ctx := context.Background()
+
+	task := enqueueClientTestTask(t, c, map[string]interface{}{"name": "slow", "delay": 2000})
+	got, err := c.Wait(ctx, task.Id, 100*time.Millisecond)
+	if err != client.ErrTimeout {
+		t.Errorf("expected wait to time out, got: %v", err)
+	}
+	if got == nil || got.Id != task.Id || client.Finished(got) {
+		t.Errorf("expected the unfinished task when waiting times out, got: %v", got)
+	}
+
+	if _, err := c.Cancel(ctx, task.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err = c.Wait(ctx, task.Id, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Failed == nil || got.Error != tasks.ErrTaskCancelled.Error() {
+		t.Errorf("expected a cancelled task, got: %v", got)
+	}
+	if _, err := c.Cancel(ctx, task.Id); err == nil {
+		t.Errorf("expected cancelling a finished task to error")
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	requireAuth := cfg.RequireAuth
+	cfg.RequireAuth = true
+	defer func() { cfg.RequireAuth = requireAuth }()
+
+	s := newClientTestServer(t, nil)
+	key, k, err := auth.NewAPIKey("client_test_user", "client test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := k.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer k.Delete(store)
+
+	_, err = client.NewHTTPClient(s.URL, "").List(context.Background(), 10, 0)
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected requests without a key to be unauthorized, got: %v", err)
+	}
+	_, err = client.NewHTTPClient(s.URL, "not-a-key").List(context.Background(), 10, 0)
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected requests with a bad key to be unauthorized, got: %v", err)
+	}
+
+	task := enqueueClientTestTask(t, client.NewHTTPClient(s.URL, key), map[string]interface{}{"name": "authed"})
+	if task.UserId != "client_test_user" {
+		t.Errorf("expected task to belong to the key's user, got: '%s'", task.UserId)
+	}
+}
+
+// flakyRoutes answers the first failures requests to each path with
+// 503s before handing them to h
+type flakyRoutes struct {
+	sync.Mutex
+	h        http.Handler
+	failures int
+	requests map[string]int
+}
+
+func (f *flakyRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	f.requests[r.URL.Path]++
+	n := f.requests[r.URL.Path]
+	f.Unlock()
+
+	if n <= f.failures {
+		apiutil.WriteErrResponse(w, http.StatusServiceUnavailable, fmt.Errorf("try again"))
+		return
+	}
+	f.h.ServeHTTP(w, r)
+}
+
+func TestClientRetries(t *testing.T) {
+	flaky := &flakyRoutes{failures: 2, requests: map[string]int{}}
+	s := newClientTestServer(t, func(h http.Handler) http.Handler {
+		flaky.h = h
+		return flaky
+	})
+	c := client.NewHTTPClient(s.URL, "")
+	c.Backoff = []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}
+
+	task := enqueueClientTestTask(t, c, map[string]interface{}{"name": "retried"})
+	got, err := c.Wait(context.Background(), task.Id, 10*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Succeeded == nil {
+		t.Errorf("expected task to succeed, got: %v", got)
+	}
+	if n := flaky.requests["/tasks"]; n != 3 {
+		t.Errorf("expected enqueue to be made in 3 attempts, got: %d", n)
+	}
+
+	c.Backoff = []time.Duration{time.Millisecond}
+	if _, err := c.Get(context.Background(), task.Id); err == nil {
+		t.Errorf("expected requests to give up once out of retries")
+	}
+}
+
+func TestClientRPC(t *testing.T) {
+	s := newClientTestServer(t, nil)
+	task := enqueueClientTestTask(t, client.NewHTTPClient(s.URL, ""), map[string]interface{}{"name": "rpc"})
+
+	server, err := newRpcServer()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveRpcConn(server, conn)
+		}
+	}()
+
+	c, err := client.DialRPC(ln.Addr().String(), nil, cfg.RpcSecret)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	got, err := c.Get(ctx, task.Id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Id != task.Id {
+		t.Errorf("expected task %s, got: %s", task.Id, got.Id)
+	}
+
+	got, err = c.Wait(ctx, task.Id, 10*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Succeeded == nil {
+		t.Errorf("expected task to succeed, got: %v", got)
+	}
+
+	events, err := c.Events(ctx, task.Id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(events) == 0 || events[len(events)-1].Type != tasks.EventSucceeded {
+		t.Errorf("expected the event log to end with the task succeeding, got: %v", events)
+	}
+}
+
+func TestCheckRpcConfig(t *testing.T) {
+	prev := *cfg
+	defer func() { *cfg = prev }()
+
+	cases := []struct {
+		port, cert, ca, secret string
+		enforce                bool
+		err                    bool
+	}{
+		{"", "", "", "", true, false},
+		{"4400", "", "", "", false, false},
+		{"4400", "", "", "", true, true},
+		{"4400", "", "", "secret", false, true},
+		{"4400", "cert.pem", "", "secret", true, false},
+		{"4400", "cert.pem", "ca.pem", "", true, false},
+	}
+
+	for i, c := range cases {
+		cfg.RpcPort, cfg.RpcTlsCert, cfg.RpcClientCa, cfg.RpcSecret, cfg.EnforcePolicies = c.port, c.cert, c.ca, c.secret, c.enforce
+		if err := checkRpcConfig(); c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// command is a task_mgmt subcommand, selected by the first argument
+// to the binary
+type command struct {
+	// one-line description for usage output
+	Usage string
+	// Run performs the command with any remaining arguments
+	Run func(args []string) error
+}
+
+// command run when the binary is called without one
+const defaultCommand = "all"
+
+// commands maps subcommand names to commands
+var commands = map[string]*command{
+	"serve": {
+		Usage: "run the HTTP & RPC apis, without accepting tasks from the queue",
+		Run:   runServe,
+	},
+	"worker": {
+		Usage: "accept & perform tasks from the queue, without serving the apis",
+		Run:   runWorker,
+	},
+	"task": {
+		Usage: "enqueue & inspect tasks on a running server",
+		Run:   runTask,
+	},
+	"run": {
+		Usage: "perform a single task in-process, without any infrastructure",
+		Run:   runLocal,
+	},
+	"migrate": {
+		Usage: "apply or revert database schema migrations",
+		Run:   runMigrate,
+	},
+	"apikey": {
+		Usage: "create, list & revoke api keys",
+		Run:   runAPIKey,
+	},
+	"policy": {
+		Usage: "grant, revoke & list role policies",
+		Run:   runPolicy,
+	},
+	"all": {
+		Usage: "serve the apis & accept tasks in a single process (default)",
+		Run:   runAll,
+	},
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "usage: task_mgmt <command> [flags]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].Usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun 'task_mgmt <command> -h' for command flags\n")
+}
+
+// serveFlags adds flags shared by commands that run the apis
+func serveFlags(fs *flag.FlagSet) (port *string) {
+	return fs.String("port", "", "port to serve the HTTP api on, overrides PORT")
+}
+
+// workerFlags adds flags shared by commands that accept tasks
+func workerFlags(fs *flag.FlagSet) (accept *string) {
+	return fs.String("accept", "", "comma-separated task types or tags to accept, overrides WORKER_ACCEPTS")
+}
+
+// applyFlags overrides configuration with any flags that were set
+func applyFlags(port, accept *string) {
+	if port != nil && *port != "" {
+		cfg.Port = *port
+	}
+	if accept != nil && *accept != "" {
+		cfg.WorkerAccepts = strings.Split(*accept, ",")
+	}
+}
+
+// runServe starts the HTTP & RPC apis. API nodes also run the reaper & retention jobs,
+// as they only need the database & queue
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := serveFlags(fs)
+	fs.Parse(args)
+
+	loadConfig()
+	applyFlags(port, nil)
+	if err := checkRpcConfig(); err != nil {
+		return err
+	}
+	// without a queue tasks are performed by the api
+	initBroker(cfg.AmqpUrl == "")
+
+	go initPostgres()
+	go listenRpc()
+	go connectRedis()
+	startReaper()
+	startRetention()
+	startWebhooks()
+	startNotifications()
+	startMetrics()
+	startDigest()
+
+	return serve()
+}
+
+// runWorker accepts tasks from the queue until the process is signalled to stop
+func runWorker(args []string) error {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	accept := workerFlags(fs)
+	fs.Parse(args)
+
+	loadConfig()
+	applyFlags(nil, accept)
+
+	if cfg.AmqpUrl == "" {
+		return fmt.Errorf("worker mode requires AMQP_URL to be set")
+	}
+
+	// workers need the database before the first task arrives
+	initPostgres()
+	connectRedis()
+	initBroker(false)
+	startWebhooks()
+	startNotifications()
+	startMetrics()
+
+	drain, err := acceptTasks()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("worker draining: %s", <-stopSignal())
+	drain()
+	log.Infoln("worker stopped")
+	return nil
+}
+
+// stopSignal is sent a signal when the process is asked to stop
+func stopSignal() <-chan os.Signal {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	return sig
+}
+
+// runAll runs the apis & accepts tasks in the same process
+func runAll(args []string) error {
+	fs := flag.NewFlagSet("all", flag.ExitOnError)
+	port := serveFlags(fs)
+	accept := workerFlags(fs)
+	fs.Parse(args)
+
+	loadConfig()
+	applyFlags(port, accept)
+	if err := checkRpcConfig(); err != nil {
+		return err
+	}
+	initBroker(true)
+
+	go initPostgres()
+	go listenRpc()
+	go connectRedis()
+
+	drain, err := acceptTasks()
+	if err != nil {
+		return err
+	}
+	// finish the task in progress before exiting, /readyz reports the
+	// process unavailable in the meantime
+	go func() {
+		log.Infof("draining: %s", <-stopSignal())
+		drain()
+		log.Infoln("stopped")
+		os.Exit(0)
+	}()
+	startReaper()
+	startRetention()
+	startWebhooks()
+	startNotifications()
+	startMetrics()
+	startDigest()
+
+	return serve()
+}
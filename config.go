@@ -5,6 +5,7 @@ import (
 	conf "github.com/datatogether/config"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // server modes
@@ -29,8 +30,31 @@ type config struct {
 	Port string
 	// root url
 	UrlRoot string
+	// port to serve prometheus metrics on, for worker processes that don't
+	// serve the api. metrics are also served by the api at /metrics
+	MetricsPort string
+	// how long each dependency check made by /readyz may take, default 5s
+	ReadyTimeout string
+	// minimum level of log entries to write: debug, info, warn or error.
+	// default info
+	LogLevel string
+	// format log entries are written in, text or json. default text
+	LogFormat string
+	// where to export trace spans as OTLP/JSON lines: "stdout", or a path
+	// to a file to append to. empty disables exporting
+	TraceExport string
 	// port to listen on for RPC calls
 	RpcPort string
+	// paths to a PEM certificate & key, if set the RPC listener requires TLS
+	RpcTlsCert string
+	RpcTlsKey  string
+	// path to PEM CA certificates, if set RPC clients must present a
+	// certificate signed by one of them. requires RpcTlsCert
+	RpcClientCa string
+	// shared secret RPC clients must prove they know before making calls,
+	// also accepted by the JSON-RPC endpoint as an X-Rpc-Secret header.
+	// requires RpcTlsCert
+	RpcSecret string
 	// url of postgres app db
 	PostgresDbUrl string
 	// url of message que server
@@ -39,20 +63,80 @@ type config struct {
 	IpfsApiUrl string
 	// redis connection URL
 	RedisUrl string
-	// Public Key to use for signing. required.
+	// Public Key to verify bearer JWTs with, as PEM or base64-encoded PEM or DER.
+	// JWTs aren't accepted if empty
 	PublicKey string
+	// reject api requests that don't carry an api key or JWT, default false
+	RequireAuth bool
+	// check requests against the role policies stored in the database,
+	// default false. manage policies with "task_mgmt policy"
+	EnforcePolicies bool
+	// limits on task submission per user, as rules of the form [user/][type]:[limit]=[max]
+	// where limit is one of active, hour or urls, eg: "*:active=10,ipfs.addurl:hour=100".
+	// empty sets no limits
+	QuotaRules []string
+	// key task callback requests are signed with, callbacks are unsigned if
+	// empty. webhook subscriptions are signed with their own secret
+	WebhookSecret string
+	// let webhooks & task callbacks be sent to loopback & private network
+	// addresses, default false
+	WebhookAllowPrivate bool
 	// TLS (HTTPS) enable support via LetsEncrypt, default false
 	// not needed if operating behind a TLS proxy
 	TLS bool
 	// if true, requests that have X-Forwarded-Proto: http will be redirected
 	// to their https variant, useful if operating behind a TLS proxy
 	ProxyForceHttps bool
-	// key for sending emails
+	// key for sending emails through postmark
 	PostmarkKey string
+	// SMTP server to send emails through as host:port, used instead of
+	// postmark if set
+	SmtpAddr string
+	// credentials for the SMTP server, if it requires them
+	SmtpUsername string
+	SmtpPassword string
+	// address emails are sent from
+	EmailFrom string
 	// list of email addresses that should get notifications
 	EmailNotificationRecipients []string
+	// tasks that run at least this long send a notification when they succeed,
+	// as a duration string. default "1h", "0s" disables
+	NotifySucceededAfter string
+	// time of day to send a digest of finished tasks, as "HH:MM" UTC.
+	// empty sends no digest
+	NotifyDigestTime string
+	// directory of custom notification templates, named for their event eg:
+	// "failed.tmpl". events without a template use the defaults
+	NotifyTemplateDir string
 	// CertbotResponse is only for doing manual SSL certificate generation via LetsEncrypt.
 	CertbotResponse string
+	// how long a succeeded task continues to absorb duplicate submissions,
+	// as a duration string eg: "1h". active tasks are always deduplicated
+	TaskDedupWindow string
+	// how often workers check in with the registry, as a duration string. default "10s"
+	WorkerHeartbeatInterval string
+	// how long a worker can go without checking in before it's considered dead,
+	// as a duration string. default "1m"
+	WorkerLeaseTimeout string
+	// what to do with tasks left behind by dead workers, either "requeue" or "fail".
+	// default "requeue"
+	ReaperAction string
+	// task types or tags this process will accept from the queue, eg:
+	// "ipfs,kiwix.updateSources". empty accepts all task types. tagged task
+	// types share a queue, so must be accepted by their tag
+	WorkerAccepts []string
+	// apply pending schema migrations on startup, default false
+	AutoMigrate bool
+	// how long to keep finished tasks, as rules of the form [type]:[state]=[age],
+	// eg: "ipfs.addurl:succeeded=30d,*:failed=90d". empty keeps tasks forever
+	RetentionRules []string
+	// how often to remove expired tasks, as a duration string. default "1h"
+	RetentionInterval string
+	// directory to export expired tasks to as compressed ndjson before removal
+	RetentionExportDir string
+	// export expired tasks to ipfs before removal, takes precedence
+	// over RetentionExportDir. default false
+	RetentionExportIpfs bool
 }
 
 // initConfig pulls configuration from config.json
@@ -122,6 +206,20 @@ func fileExists(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+// configDuration parses a duration string config value, falling back to def
+// if the value is empty or invalid
+func configDuration(key, value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Infof("invalid %s duration '%s', using default: %s", key, value, def)
+		return def
+	}
+	return d
+}
+
 // outputs any notable settings to stdout
 func printConfigInfo() {
 	// TODO
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/task_mgmt/auth"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/datatogether/task_mgmt/tracing"
+	"github.com/ipfs/go-datastore"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dashboardFiles holds the dashboard's templates & static assets, so the
+// dashboard works without a public dir next to the binary
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+const (
+	// dashboardPrefix is the path the dashboard is served under
+	dashboardPrefix = "/dashboard"
+	// dashboardCookie holds the credentials of a logged in browser
+	dashboardCookie = "task_mgmt_auth"
+	// dashboardPageSize is the number of tasks listed per page
+	dashboardPageSize = 50
+)
+
+var dashboardFuncs = template.FuncMap{
+	"time":    dashboardTime,
+	"percent": dashboardPercent,
+	"json":    dashboardJSON,
+}
+
+// dashboardPages are parsed once, each page is rendered inside layout.html
+var dashboardPages = parseDashboardPages("tasks", "task", "queues", "enqueue", "login", "error")
+
+func parseDashboardPages(names ...string) map[string]*template.Template {
+	pages := map[string]*template.Template{}
+	for _, name := range names {
+		pages[name] = template.Must(template.New("layout.html").Funcs(dashboardFuncs).ParseFS(dashboardFiles, "dashboard/layout.html", "dashboard/"+name+".html"))
+	}
+	return pages
+}
+
+// dashboardPage is the data every dashboard template is rendered with
+type dashboardPage struct {
+	Title string
+	// section of the nav to highlight
+	Nav string
+	// authenticated user viewing the page, if any
+	UserId string
+	// weather the browser is logged in with a cookie, & can log out
+	LoggedIn bool
+	// page-specific data
+	Data interface{}
+}
+
+// renderDashboard writes a dashboard page
+func renderDashboard(w http.ResponseWriter, r *http.Request, status int, name, title string, data interface{}) {
+	_, err := r.Cookie(dashboardCookie)
+	page := &dashboardPage{
+		Title:    title,
+		Nav:      name,
+		UserId:   requestUserId(r),
+		LoggedIn: err == nil,
+		Data:     data,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := dashboardPages[name].Execute(w, page); err != nil {
+		log.Errorf("error rendering dashboard %s page: %s", name, err.Error())
+	}
+}
+
+// dashboardError renders err as a page, with a status that suits it
+func dashboardError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	switch err {
+	case datastore.ErrNotFound:
+		status = http.StatusNotFound
+	case auth.ErrForbidden:
+		status = http.StatusForbidden
+	}
+	if _, ok := err.(*tasks.QuotaError); ok {
+		status = http.StatusTooManyRequests
+	}
+	renderDashboard(w, r, status, "error", http.StatusText(status), err.Error())
+}
+
+// dashboardAuth authenticates dashboard requests like authMiddleware,
+// additionally accepting credentials from the login cookie, as browsers
+// can't add headers to page loads. requests that aren't authenticated when
+// they need to be are sent to log in
+func dashboardAuth(handler http.HandlerFunc) http.HandlerFunc {
+	a := newAuthenticator()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(dashboardCookie); err == nil && r.Header.Get("X-Api-Key") == "" && r.Header.Get("Authorization") == "" {
+			r = r.Clone(r.Context())
+			r.Header.Set("Authorization", "Bearer "+c.Value)
+		}
+
+		id, err := a.Authenticate(r)
+		if err == auth.ErrNoCredentials && !cfg.RequireAuth {
+			handler(w, r)
+			return
+		} else if err != nil {
+			http.Redirect(w, r, dashboardPrefix+"/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+
+		if sw, ok := w.(*statusWriter); ok {
+			sw.userId = id.UserId
+		}
+		handler(w, r.WithContext(auth.NewContext(r.Context(), id)))
+	}
+}
+
+// DashboardLoginHandler checks credentials entered in a browser, storing
+// them in a cookie. the cookie is same-site only, so cross-site forms
+// can't act on the user's behalf
+func DashboardLoginHandler(w http.ResponseWriter, r *http.Request) {
+	next := dashboardNext(r.FormValue("next"))
+	if r.Method != "POST" {
+		renderDashboard(w, r, http.StatusOK, "login", "Log In", map[string]string{"Next": next})
+		return
+	}
+
+	token := strings.TrimSpace(r.FormValue("token"))
+	check := &http.Request{Header: http.Header{"Authorization": {"Bearer " + token}}}
+	if _, err := newAuthenticator().Authenticate(check.WithContext(r.Context())); err != nil {
+		renderDashboard(w, r, http.StatusUnauthorized, "login", "Log In", map[string]string{"Next": next, "Error": err.Error()})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardCookie,
+		Value:    token,
+		Path:     dashboardPrefix,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || cfg.TLS || cfg.ProxyForceHttps,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// DashboardLogoutHandler forgets the credentials stored by logging in
+func DashboardLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: dashboardCookie, Path: dashboardPrefix, MaxAge: -1})
+	http.Redirect(w, r, dashboardPrefix+"/login", http.StatusSeeOther)
+}
+
+// dashboardNext only allows redirects within the dashboard
+func dashboardNext(next string) string {
+	if strings.HasPrefix(next, dashboardPrefix+"/") && !strings.Contains(next, "\\") {
+		return next
+	}
+	return dashboardPrefix + "/tasks"
+}
+
+// DashboardStaticHandler serves the dashboard's css & js
+var DashboardStaticHandler = func() http.Handler {
+	static, err := fs.Sub(dashboardFiles, "dashboard/static")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix(dashboardPrefix+"/static/", http.FileServer(http.FS(static)))
+}()
+
+// DashboardHandler routes dashboard pages:
+//
+//	GET  /dashboard/tasks                lists tasks, with filters
+//	GET  /dashboard/tasks/{id}           shows a task
+//	GET  /dashboard/tasks/{id}/stream    streams task updates to the task page
+//	POST /dashboard/tasks/{id}/cancel    cancels a task
+//	POST /dashboard/tasks/{id}/retry     retries a task
+//	GET  /dashboard/queues               shows queue depths & workers
+//	GET  /dashboard/enqueue?type={type}  shows a form for enqueuing a task
+//	POST /dashboard/enqueue?type={type}  enqueues a task
+func DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, dashboardPrefix), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "":
+		http.Redirect(w, r, dashboardPrefix+"/tasks", http.StatusFound)
+	case path == "tasks" && r.Method == "GET":
+		dashboardTasks(w, r)
+	case len(parts) == 2 && parts[0] == "tasks" && r.Method == "GET":
+		dashboardTask(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "tasks" && parts[2] == "stream" && r.Method == "GET":
+		// streams are served by the api, the request is only rewritten so
+		// the browser can send it's cookie along
+		stream := r.Clone(r.Context())
+		stream.URL.Path = "/tasks/" + parts[1] + "/stream"
+		StreamTaskHandler(w, stream)
+	case len(parts) == 3 && parts[0] == "tasks" && (parts[2] == "cancel" || parts[2] == "retry") && r.Method == "POST":
+		dashboardTaskAction(w, r, parts[1], parts[2])
+	case path == "queues" && r.Method == "GET":
+		dashboardQueues(w, r)
+	case path == "enqueue" && (r.Method == "GET" || r.Method == "POST"):
+		dashboardEnqueue(w, r)
+	default:
+		dashboardError(w, r, http.StatusNotFound, fmt.Errorf("page not found"))
+	}
+}
+
+// dashboardTaskFilter is the set of filters the task list accepts
+type dashboardTaskFilter struct {
+	Status string
+	Type   string
+	UserId string
+	Title  string
+}
+
+// filter gives a TaskFilter that matches all set filters, nil if none are
+func (f dashboardTaskFilter) filter() tasks.TaskFilter {
+	if f == (dashboardTaskFilter{}) {
+		return nil
+	}
+	title := strings.ToLower(f.Title)
+	return func(t *tasks.Task) bool {
+		return (f.Status == "" || t.StatusString() == f.Status) &&
+			(f.Type == "" || t.Type == f.Type) &&
+			(f.UserId == "" || t.UserId == f.UserId) &&
+			(title == "" || strings.Contains(strings.ToLower(t.Title), title))
+	}
+}
+
+// query encodes the filters, for linking to other pages of results
+func (f dashboardTaskFilter) query(page int) string {
+	q := url.Values{}
+	for k, v := range map[string]string{"status": f.Status, "type": f.Type, "userId": f.UserId, "title": f.Title} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	q.Set("page", strconv.Itoa(page))
+	return q.Encode()
+}
+
+func dashboardTasks(w http.ResponseWriter, r *http.Request) {
+	f := dashboardTaskFilter{
+		Status: r.FormValue("status"),
+		Type:   r.FormValue("type"),
+		UserId: r.FormValue("userId"),
+		Title:  r.FormValue("title"),
+	}
+	page := 1
+	if n, err := reqParamInt("page", r); err == nil && n > 1 {
+		page = n
+	}
+	p := apiutil.NewPage(page, dashboardPageSize)
+
+	filter, err := authorizedFilter(r, tasks.ActionRead, f.filter())
+	if err != nil {
+		dashboardError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// read one extra task to tell if there's a next page
+	var ts []*tasks.Task
+	if filter != nil {
+		ts, err = tasks.ReadTasksFilter(store, filter, p.Limit()+1, p.Offset())
+	} else {
+		ts, err = tasks.ReadTasks(store, "created DESC", p.Limit()+1, p.Offset())
+	}
+	if err != nil {
+		dashboardError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Filter":   f,
+		"Statuses": []string{"enquing", "queued", "running", "finished", "failed", "cancelled"},
+		"Types":    tasks.RegisteredTaskdefs(),
+	}
+	if len(ts) > p.Limit() {
+		ts = ts[:p.Limit()]
+		data["Next"] = f.query(page + 1)
+	}
+	if page > 1 {
+		data["Prev"] = f.query(page - 1)
+	}
+	data["Tasks"] = ts
+	renderDashboard(w, r, http.StatusOK, "tasks", "Tasks", data)
+}
+
+func dashboardTask(w http.ResponseWriter, r *http.Request, id string) {
+	tr := newTaskRequests()
+	uid := requestUserId(r)
+
+	t := &tasks.Task{}
+	if err := tr.Get(&tasks.TasksGetParams{Id: id, UserId: uid}, t); err != nil {
+		dashboardError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	events := []*tasks.TaskEvent{}
+	if err := tr.Events(&tasks.TasksEventsParams{Id: id, UserId: uid}, &events); err != nil {
+		dashboardError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	subtasks, err := tasks.ReadChildTasks(store, id)
+	if err != nil {
+		dashboardError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderDashboard(w, r, http.StatusOK, "task", t.Title, map[string]interface{}{
+		"Task":     t,
+		"Events":   events,
+		"Subtasks": subtasks,
+		"Finished": t.Succeeded != nil || t.Failed != nil,
+	})
+}
+
+func dashboardTaskAction(w http.ResponseWriter, r *http.Request, id, action string) {
+	tr := newTaskRequests()
+	uid := requestUserId(r)
+
+	t := &tasks.Task{}
+	var err error
+	if action == "cancel" {
+		err = tr.Cancel(&tasks.TasksCancelParams{Id: id, UserId: uid}, t)
+	} else if cfg.AmqpUrl == "" {
+		err = fmt.Errorf("tasks can't be retried without a queue")
+	} else {
+		err = tr.Retry(&tasks.TasksRetryParams{Id: id, UserId: uid}, t)
+	}
+	if err != nil {
+		dashboardError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	http.Redirect(w, r, dashboardPrefix+"/tasks/"+url.PathEscape(id), http.StatusSeeOther)
+}
+
+// dashboardWorker is a registered worker & weather it's stopped heartbeating
+type dashboardWorker struct {
+	*tasks.Worker
+	Expired bool
+}
+
+func dashboardQueues(w http.ResponseWriter, r *http.Request) {
+	depths := map[string]float64{}
+	for _, s := range queueDepths() {
+		depths[s.LabelValues[0]] = s.Value
+	}
+
+	type queue struct {
+		Name     string
+		Types    []string
+		Messages float64
+		Known    bool
+	}
+	queues := []*queue{}
+	byName := map[string]*queue{}
+	for _, name := range tasks.WorkerQueues(nil) {
+		messages, known := depths[name]
+		q := &queue{Name: name, Messages: messages, Known: known}
+		queues = append(queues, q)
+		byName[name] = q
+	}
+	for _, typ := range tasks.RegisteredTaskdefs() {
+		if q := byName[tasks.QueueName(typ)]; q != nil {
+			q.Types = append(q.Types, typ)
+		}
+	}
+
+	ws, err := tasks.ReadWorkers(store, 100, 0)
+	if err != nil {
+		dashboardError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	lease := workerLease()
+	workers := make([]dashboardWorker, len(ws))
+	for i, wk := range ws {
+		workers[i] = dashboardWorker{Worker: wk, Expired: wk.Expired(lease)}
+	}
+
+	renderDashboard(w, r, http.StatusOK, "queues", "Queues & Workers", map[string]interface{}{
+		"Queues":  queues,
+		"Workers": workers,
+		"Broker":  cfg.AmqpUrl != "",
+	})
+}
+
+// dashboardField is a form input for a param, generated from it's schema
+type dashboardField struct {
+	Name        string
+	Input       string
+	Description string
+	Placeholder string
+	Required    bool
+	Value       string
+	Checked     bool
+}
+
+// dashboardFields generates form inputs for each property of s, filled in
+// with previously submitted values
+func dashboardFields(s *tasks.Schema, form url.Values) []dashboardField {
+	fields := make([]dashboardField, 0, len(s.Order))
+	required := map[string]bool{}
+	for _, name := range s.Required {
+		required[name] = true
+	}
+
+	for _, name := range s.Order {
+		prop := s.Properties[name]
+		f := dashboardField{
+			Name:        name,
+			Description: prop.Description,
+			Required:    required[name],
+			Value:       form.Get("param." + name),
+		}
+		if prop.Default != nil {
+			f.Placeholder = fmt.Sprintf("%v", prop.Default)
+		}
+
+		switch prop.Type {
+		case "boolean":
+			f.Input = "checkbox"
+			f.Checked = prop.Default == true
+			if form != nil {
+				f.Checked = f.Value == "true"
+			}
+		case "integer", "number":
+			f.Input = "number"
+		case "string":
+			f.Input = "text"
+			if prop.Format == "date-time" {
+				f.Placeholder = time.Now().Format(time.RFC3339)
+			}
+		case "array":
+			f.Input = "textarea"
+			if prop.Items != nil && prop.Items.Type == "string" {
+				f.Placeholder = "one per line"
+			} else {
+				f.Placeholder = "json array"
+			}
+		default:
+			f.Input = "textarea"
+			f.Placeholder = "json"
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// dashboardParams decodes params from a form generated by dashboardFields.
+// empty inputs are left out, so the taskdef's defaults apply
+func dashboardParams(s *tasks.Schema, form url.Values) (map[string]interface{}, error) {
+	params := map[string]interface{}{}
+	for _, name := range s.Order {
+		prop := s.Properties[name]
+		raw := strings.TrimSpace(form.Get("param." + name))
+
+		if prop.Type == "boolean" {
+			// unchecked boxes aren't submitted
+			if checked := raw == "true"; checked || prop.Default == true {
+				params[name] = checked
+			}
+			continue
+		}
+		if raw == "" {
+			continue
+		}
+
+		switch prop.Type {
+		case "integer":
+			i, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a whole number", name)
+			}
+			params[name] = i
+		case "number":
+			n, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number", name)
+			}
+			params[name] = n
+		case "string":
+			params[name] = raw
+		case "array":
+			if prop.Items != nil && prop.Items.Type == "string" {
+				items := []string{}
+				for _, line := range strings.Split(raw, "\n") {
+					if line = strings.TrimSpace(line); line != "" {
+						items = append(items, line)
+					}
+				}
+				params[name] = items
+				continue
+			}
+			fallthrough
+		default:
+			var v interface{}
+			if err := json.Unmarshal([]byte(raw), &v); err != nil {
+				return nil, fmt.Errorf("%s must be valid json: %s", name, err.Error())
+			}
+			params[name] = v
+		}
+	}
+
+	for _, name := range s.Required {
+		if _, ok := params[name]; !ok {
+			return nil, fmt.Errorf("%s is required", name)
+		}
+	}
+	return params, nil
+}
+
+func dashboardEnqueue(w http.ResponseWriter, r *http.Request) {
+	typ := r.FormValue("type")
+	if typ == "" {
+		renderDashboard(w, r, http.StatusOK, "enqueue", "Enqueue a Task", map[string]interface{}{
+			"Types": tasks.RegisteredTaskdefs(),
+		})
+		return
+	}
+
+	schema, err := tasks.TaskdefSchema(typ)
+	if err != nil {
+		dashboardError(w, r, http.StatusNotFound, err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Type":   typ,
+		"Schema": schema,
+	}
+	if r.Method == "GET" {
+		data["Fields"] = dashboardFields(schema, nil)
+		renderDashboard(w, r, http.StatusOK, "enqueue", "Enqueue "+typ, data)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		dashboardError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	data["Fields"] = dashboardFields(schema, r.PostForm)
+	data["Title"] = r.PostForm.Get("title")
+	data["CallbackUrl"] = r.PostForm.Get("callbackUrl")
+
+	t, err := dashboardSubmit(r, schema)
+	if err != nil {
+		data["Error"] = err.Error()
+		renderDashboard(w, r, http.StatusBadRequest, "enqueue", "Enqueue "+typ, data)
+		return
+	}
+
+	http.Redirect(w, r, dashboardPrefix+"/tasks/"+url.PathEscape(t.Id), http.StatusSeeOther)
+}
+
+// dashboardSubmit enqueues a task from a submitted enqueue form, or
+// performs it in this process if there's no queue, like the api does
+func dashboardSubmit(r *http.Request, schema *tasks.Schema) (*tasks.Task, error) {
+	params, err := dashboardParams(schema, r.PostForm)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &tasks.TasksEnqueueParams{
+		Title:       strings.TrimSpace(r.PostForm.Get("title")),
+		Type:        schema.Title,
+		UserId:      requestUserId(r),
+		Params:      params,
+		CallbackUrl: strings.TrimSpace(r.PostForm.Get("callbackUrl")),
+		TraceParent: r.Header.Get(tracing.Header),
+	}
+	if p.Title == "" {
+		p.Title = p.Type
+	}
+
+	tr := newTaskRequests()
+	if cfg.AmqpUrl != "" {
+		t := &tasks.Task{}
+		return t, tr.Enqueue(p, t)
+	}
+
+	t := &tasks.Task{Title: p.Title, Type: p.Type, UserId: p.UserId, Params: p.Params, CallbackUrl: p.CallbackUrl, TraceParent: p.TraceParent}
+	if tr.Authorizer != nil {
+		if err := tr.Authorizer.Authorize(p.UserId, tasks.ActionSubmit, t); err != nil {
+			return nil, err
+		}
+	}
+	err = tasks.SubmitWithinQuota(store, quotas, t, func() (err error) {
+		t, _, err = runTaskRaw(t)
+		return err
+	})
+	return t, err
+}
+
+// dashboardTime formats a time.Time or *time.Time, empty for nil & zero times
+func dashboardTime(v interface{}) string {
+	var t time.Time
+	switch tv := v.(type) {
+	case time.Time:
+		t = tv
+	case *time.Time:
+		if tv != nil {
+			t = *tv
+		}
+	}
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05 MST")
+}
+
+// dashboardPercent gives progress as a whole percentage
+func dashboardPercent(p *tasks.Progress) int {
+	if p == nil {
+		return 0
+	}
+	if p.Done {
+		return 100
+	}
+	return int(p.Percent * 100)
+}
+
+// dashboardJSON indents v as json, for showing params
+func dashboardJSON(v interface{}) string {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
@@ -0,0 +1,45 @@
+// live progress for the task page, updates arrive as server-sent events
+// from the task's stream. the page reloads once the task finishes to show
+// it's results & events
+(function () {
+  var el = document.querySelector("[data-stream]");
+  if (!el || !window.EventSource) {
+    return;
+  }
+
+  function field(name) {
+    return el.querySelector("[data-field=" + name + "]");
+  }
+
+  function state(t) {
+    if (t.failed) {
+      return t.error === "task cancelled" ? "cancelled" : "failed";
+    }
+    if (t.succeeded) {
+      return "finished";
+    }
+    if (t.started) {
+      return "running";
+    }
+    return t.enqueued ? "queued" : "enquing";
+  }
+
+  var stream = new EventSource(el.getAttribute("data-stream"));
+  stream.addEventListener("task", function (e) {
+    var t = JSON.parse(e.data);
+    var s = state(t);
+    field("status").textContent = s;
+    field("status").className = "status " + s;
+
+    var p = t.progress;
+    if (p) {
+      field("percent").style.width = (p.done ? 100 : Math.round(p.percent * 100)) + "%";
+      field("step").textContent = (p.steps ? "step " + p.step + " of " + p.steps + ": " : "") + (p.status || "");
+    }
+
+    if (t.succeeded || t.failed) {
+      stream.close();
+      window.location.reload();
+    }
+  });
+})();
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/datatogether/task_mgmt/tasks"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestDashboardParams(t *testing.T) {
+	s := &tasks.Schema{
+		Properties: map[string]*tasks.Schema{
+			"url":      {Type: "string"},
+			"depth":    {Type: "integer"},
+			"ratio":    {Type: "number"},
+			"force":    {Type: "boolean"},
+			"follow":   {Type: "boolean", Default: true},
+			"urls":     {Type: "array", Items: &tasks.Schema{Type: "string"}},
+			"metadata": {Type: "object"},
+		},
+		Order:    []string{"url", "depth", "ratio", "force", "follow", "urls", "metadata"},
+		Required: []string{"url"},
+	}
+
+	cases := []struct {
+		form   url.Values
+		expect map[string]interface{}
+		err    bool
+	}{
+		{url.Values{"param.url": {" http://a.com "}}, map[string]interface{}{"url": "http://a.com", "follow": false}, false},
+		{url.Values{
+			"param.url":      {"http://a.com"},
+			"param.depth":    {"3"},
+			"param.ratio":    {"0.5"},
+			"param.force":    {"true"},
+			"param.follow":   {"true"},
+			"param.urls":     {"http://b.com\n\n  http://c.com  \n"},
+			"param.metadata": {`{"title":"a"}`},
+		}, map[string]interface{}{
+			"url":      "http://a.com",
+			"depth":    int64(3),
+			"ratio":    0.5,
+			"force":    true,
+			"follow":   true,
+			"urls":     []string{"http://b.com", "http://c.com"},
+			"metadata": map[string]interface{}{"title": "a"},
+		}, false},
+		{url.Values{}, nil, true},
+		{url.Values{"param.url": {"  "}}, nil, true},
+		{url.Values{"param.url": {"http://a.com"}, "param.depth": {"deep"}}, nil, true},
+		{url.Values{"param.url": {"http://a.com"}, "param.ratio": {"half"}}, nil, true},
+		{url.Values{"param.url": {"http://a.com"}, "param.metadata": {"{"}}, nil, true},
+	}
+
+	for i, c := range cases {
+		got, err := dashboardParams(s, c.form)
+		if c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if !c.err && !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("case %d mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestDashboardNext(t *testing.T) {
+	cases := []struct {
+		next, expect string
+	}{
+		{"/dashboard/tasks/abc", "/dashboard/tasks/abc"},
+		{"/dashboard/queues", "/dashboard/queues"},
+		{"", "/dashboard/tasks"},
+		{"/dashboard", "/dashboard/tasks"},
+		{"/tasks", "/dashboard/tasks"},
+		{"https://evil.com/dashboard/tasks", "/dashboard/tasks"},
+		{"//evil.com/dashboard/tasks", "/dashboard/tasks"},
+		{"/dashboard/\\evil.com", "/dashboard/tasks"},
+	}
+
+	for i, c := range cases {
+		if got := dashboardNext(c.next); got != c.expect {
+			t.Errorf("case %d: expected %s, got: %s", i, c.expect, got)
+		}
+	}
+}
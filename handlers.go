@@ -4,10 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/task_mgmt/auth"
 	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/datatogether/task_mgmt/tracing"
+	"github.com/ipfs/go-datastore"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -31,40 +35,48 @@ func EnqueueTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	enqueueTask(w, r, t)
+}
+
+// enqueueTask submits t on behalf of the user making r, writing the result
+// as a response. client-supplied user ids are never trusted
+func enqueueTask(w http.ResponseWriter, r *http.Request, t *tasks.Task) {
+	t.UserId = requestUserId(r)
+	t.TraceParent = r.Header.Get(tracing.Header)
+	if !authorize(w, r, tasks.ActionSubmit, t) {
+		return
+	}
+
 	// perform the task raw if no amqp url is specified
 	if cfg.AmqpUrl == "" {
-		now := time.Now()
-		t.Enqueued = &now
-		if err := t.Save(store); err != nil {
-			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		task := tasks.Task{Id: t.Id}
-		if err := task.Read(store); err != nil {
-			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		var (
+			task      *tasks.Task
+			coalesced bool
+		)
+		err := tasks.SubmitWithinQuota(store, quotas, t, func() (err error) {
+			task, coalesced, err = runTaskRaw(t)
+			return err
+		})
+		if !writeQuotaError(w, err) {
 			return
+		} else if coalesced {
+			apiutil.WriteMessageResponse(w, "task is already running", task)
+		} else {
+			apiutil.WriteMessageResponse(w, "task is running", task)
 		}
-
-		go func() {
-			tc := make(chan *tasks.Task, 10)
-			go func() {
-				if err := task.Do(store, tc); err != nil {
-					log.Println(err.Error())
-				}
-			}()
-			for t := range tc {
-				fmt.Println(t.Progress.String())
-			}
-		}()
-
-		apiutil.WriteMessageResponse(w, "task is running", nil)
 		return
 	}
 
-	if err := t.Enqueue(store, cfg.AmqpUrl); err != nil {
-		log.Infoln(err)
-		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+	var enqueueErr error
+	err := tasks.SubmitWithinQuota(store, quotas, t, func() error {
+		enqueueErr = t.Enqueue(store, cfg.AmqpUrl)
+		return enqueueErr
+	})
+	if enqueueErr != nil {
+		log.Infoln(enqueueErr)
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, enqueueErr)
+		return
+	} else if !writeQuotaError(w, err) {
 		return
 	}
 
@@ -72,44 +84,151 @@ func EnqueueTaskHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func TaskHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
+	_, action := taskPath(r)
+	switch {
+	case r.Method == "GET" && action == "":
 		ReadTaskHandler(w, r)
-	case "POST":
+	case r.Method == "POST" && action == "":
 		EnqueueTaskHandler(w, r)
+	case r.Method == "POST" && action == "cancel":
+		CancelTaskHandler(w, r)
+	case r.Method == "POST" && action == "retry":
+		RetryTaskHandler(w, r)
+	case r.Method == "POST" && action == "clone":
+		CloneTaskHandler(w, r)
+	case r.Method == "GET" && action == "events":
+		TaskEventsHandler(w, r)
+	case r.Method == "GET" && action == "stream":
+		StreamTaskHandler(w, r)
 	default:
 		NotFoundHandler(w, r)
 	}
 }
 
-func ReadTaskHandler(w http.ResponseWriter, r *http.Request) {
-	t := &tasks.Task{
-		Id: r.URL.Path[len("/tasks/"):],
+// requestUserId gives the id of the authenticated user making r,
+// empty for unauthenticated requests
+func requestUserId(r *http.Request) string {
+	if id := auth.FromContext(r.Context()); id != nil {
+		return id.UserId
 	}
-	if err := t.Read(store); err != nil {
+	return ""
+}
+
+// authorize checks the user making r may perform action on t if policies
+// are enforced, writing an error response & returning false if not
+func authorize(w http.ResponseWriter, r *http.Request, action tasks.Action, t *tasks.Task) bool {
+	if !cfg.EnforcePolicies {
+		return true
+	}
+
+	err := tasks.Authorizer{Store: store}.Authorize(requestUserId(r), action, t)
+	if err == auth.ErrForbidden {
+		apiutil.WriteErrResponse(w, http.StatusForbidden, fmt.Errorf("%s: %s requires a higher role for %s tasks", err.Error(), action, t.Type))
+		return false
+	} else if err != nil {
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
-		return
+		return false
 	}
+	return true
+}
 
-	apiutil.WriteResponse(w, t)
+// authorizedFilter narrows f to tasks the user making r may perform
+// action on if policies are enforced. f may be nil, in which case the
+// returned filter is nil if policies aren't enforced
+func authorizedFilter(r *http.Request, action tasks.Action, f tasks.TaskFilter) (tasks.TaskFilter, error) {
+	if !cfg.EnforcePolicies {
+		return f, nil
+	}
+
+	allowed, err := tasks.Authorizer{Store: store}.Filter(requestUserId(r), action)
+	if err != nil || f == nil {
+		return allowed, err
+	}
+	return func(t *tasks.Task) bool {
+		return f(t) && allowed(t)
+	}, nil
 }
 
-func EnqueueIpfsAddHandler(w http.ResponseWriter, r *http.Request) {
-	t := &tasks.Task{
-		Type: "ipfs.add",
-		Params: map[string]interface{}{
-			"url":              r.FormValue("url"),
-			"ipfsApiServerUrl": cfg.IpfsApiUrl,
-		},
+// taskPath splits a /tasks/{id}/{action} request path
+func taskPath(r *http.Request) (id, action string) {
+	parts := strings.SplitN(strings.Trim(r.URL.Path[len("/tasks/"):], "/"), "/", 2)
+	id = parts[0]
+	if len(parts) > 1 {
+		action = parts[1]
 	}
+	return
+}
 
-	if err := t.Enqueue(store, cfg.AmqpUrl); err != nil {
-		log.Infoln(err)
-		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+// readTask reads the task identified by the request path, writing an
+// error response & returning nil if the task can't be read, or the
+// user making the request isn't permitted to read it
+func readTask(w http.ResponseWriter, r *http.Request) *tasks.Task {
+	id, _ := taskPath(r)
+	t := &tasks.Task{Id: id}
+	if err := t.Read(store); err == datastore.ErrNotFound {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+		return nil
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	if !authorize(w, r, tasks.ActionRead, t) {
+		return nil
+	}
+	return t
+}
+
+// runTaskRaw performs t in this process, for servers without a queue. if t
+// coalesces into an active task that task is returned & coalesced is true
+func runTaskRaw(t *tasks.Task) (task *tasks.Task, coalesced bool, err error) {
+	now := time.Now()
+	t.Enqueued = &now
+	if coalesced, err := t.Coalesce(store); err != nil {
+		return nil, false, err
+	} else if coalesced {
+		return t, true, nil
+	}
+
+	task = &tasks.Task{Id: t.Id}
+	if err := task.Read(store); err != nil {
+		return nil, false, err
+	}
+	task.TraceParent = t.TraceParent
+
+	run := *task
+	go func() {
+		tc := make(chan *tasks.Task, 10)
+		go func() {
+			if err := run.Do(store, tc); err != nil {
+				log.WithFields(run.LogFields()).Errorf("task error: %s", err.Error())
+			}
+		}()
+		for t := range tc {
+			log.WithFields(t.LogFields()).Info(t.Progress.String())
+			publishTaskProgress(t)
+		}
+	}()
+
+	return task, false, nil
+}
+
+func ReadTaskHandler(w http.ResponseWriter, r *http.Request) {
+	t := readTask(w, r)
+	if t == nil {
 		return
 	}
 
-	apiutil.WriteMessageResponse(w, "task successfully enqueued", t)
+	apiutil.WriteResponse(w, t)
+}
+
+// EnqueueIpfsAddHandler submits an ipfs.addurl task for the url param
+func EnqueueIpfsAddHandler(w http.ResponseWriter, r *http.Request) {
+	url := r.FormValue("url")
+	enqueueTask(w, r, &tasks.Task{
+		Title:  fmt.Sprintf("add %s to ipfs", url),
+		Type:   "ipfs.addurl",
+		Params: map[string]interface{}{"url": url},
+	})
 }
 
 func reqParamInt(key string, r *http.Request) (int, error) {
@@ -123,7 +242,21 @@ func reqParamBool(key string, r *http.Request) (bool, error) {
 
 func ListTasksHandler(w http.ResponseWriter, r *http.Request) {
 	p := apiutil.PageFromRequest(r)
-	ts, err := tasks.ReadTasks(store, "created DESC", p.Limit(), p.Offset())
+
+	var (
+		ts  []*tasks.Task
+		err error
+	)
+	if cfg.EnforcePolicies {
+		q, qerr := tasks.Authorizer{Store: store}.Readable(requestUserId(r), tasks.TaskQuery{Limit: p.Limit(), Offset: p.Offset()})
+		if qerr != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, qerr)
+			return
+		}
+		ts, err = tasks.ReadTaskQuery(store, q)
+	} else {
+		ts, err = tasks.ReadTasks(store, "created DESC", p.Limit(), p.Offset())
+	}
 	if err != nil {
 		log.Infoln(err.Error())
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
@@ -133,30 +266,119 @@ func ListTasksHandler(w http.ResponseWriter, r *http.Request) {
 	apiutil.WritePageResponse(w, ts, r, p)
 }
 
-// TODO - restore
 func CancelTaskHandler(w http.ResponseWriter, r *http.Request) {
-	// t := &tasks.Task{
-	// 	Id: r.URL.Path[len("/tasks/cancel/"):],
-	// }
-	// if err := t.Read(store); err != nil {
-	// 	renderError(w, err)
-	// 	return
-	// }
-
-	// if err := t.Cancel(store); err != nil {
-	// 	renderError(w, err)
-	// 	return
-	// }
-
-	// renderMessage(w, "Task Cancelled", "You've cancelled this task")
-}
-
-// HealthCheckHandler is a basic "hey I'm fine" for load balancers & co
-// TODO - add Database connection & proper configuration checks here for more accurate
-// health reporting
-func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{ "status" : 200 }`))
+	t := readTask(w, r)
+	if t == nil {
+		return
+	}
+
+	if !authorize(w, r, tasks.ActionCancel, t) {
+		return
+	}
+
+	if err := t.Cancel(store); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	apiutil.WriteMessageResponse(w, "task cancelled", t)
+}
+
+func RetryTaskHandler(w http.ResponseWriter, r *http.Request) {
+	t := readTask(w, r)
+	if t == nil {
+		return
+	}
+
+	if !authorize(w, r, tasks.ActionRetry, t) {
+		return
+	}
+
+	var retryErr error
+	err := tasks.SubmitWithinQuota(store, quotas, t, func() error {
+		retryErr = t.Retry(store, cfg.AmqpUrl)
+		return retryErr
+	})
+	if retryErr != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, retryErr)
+		return
+	} else if !writeQuotaError(w, err) {
+		return
+	}
+
+	apiutil.WriteMessageResponse(w, "task re-enqueued", t)
+}
+
+// cloneTaskRequest is the optional body of a clone request
+type cloneTaskRequest struct {
+	Title  string                 `json:"title"`
+	Params map[string]interface{} `json:"params"`
+}
+
+func CloneTaskHandler(w http.ResponseWriter, r *http.Request) {
+	t := readTask(w, r)
+	if t == nil {
+		return
+	}
+
+	req := &cloneTaskRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil && err != io.EOF {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	enqueueTask(w, r, t.Clone(req.Title, req.Params))
+}
+
+// RetryTasksHandler retries failed tasks in bulk. tasks can be filtered
+// by type, and by time of failure with since, which is either a duration
+// ("24h") or a timestamp in RFC3339 format, eg:
+// POST /tasks/retry?type=pod.addcatalog&since=24h
+func RetryTasksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	var since time.Time
+	if s := r.FormValue("since"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			since = time.Now().Add(-d)
+		} else if since, err = time.Parse(time.RFC3339, s); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("since must be a duration or RFC3339 timestamp"))
+			return
+		}
+	}
+
+	filter, err := authorizedFilter(r, tasks.ActionRetry, tasks.FailedSince(r.FormValue("type"), since))
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	retried, err := tasks.RetryTasks(store, cfg.AmqpUrl, quotas, filter)
+	if !writeQuotaError(w, err) {
+		return
+	}
+
+	apiutil.WriteMessageResponse(w, fmt.Sprintf("re-enqueued %d tasks", len(retried)), retried)
+}
+
+func TaskEventsHandler(w http.ResponseWriter, r *http.Request) {
+	t := readTask(w, r)
+	if t == nil {
+		return
+	}
+
+	events, err := tasks.ReadTaskEvents(store, t.Id)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	apiutil.WriteResponse(w, events)
 }
 
 // EmptyOkHandler is an empty 200 response, often used
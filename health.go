@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/datatogether/task_mgmt/health"
+	"github.com/streadway/amqp"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// readiness checks the services this process depends on, serving /readyz
+var readiness = &health.Checker{}
+
+// state of the amqp channel this process accepts tasks on
+const (
+	channelNone int32 = iota
+	channelOpen
+	channelClosed
+)
+
+var (
+	// postgresConnected is set once initPostgres has connected, appDB can't
+	// be pinged before then
+	postgresConnected int32
+	// acceptChannel is channelNone unless this process accepts tasks
+	acceptChannel = channelNone
+)
+
+// configureReadiness adds checks for each configured dependency
+func configureReadiness() {
+	readiness.Timeout = configDuration("READY_TIMEOUT", cfg.ReadyTimeout, 5*time.Second)
+
+	readiness.Add("postgres", checkPostgres)
+	if cfg.AmqpUrl != "" {
+		readiness.Add("amqp", checkAmqp)
+	}
+	if cfg.RedisUrl != "" {
+		readiness.Add("redis", checkRedis)
+	}
+	if cfg.IpfsApiUrl != "" {
+		readiness.Add("ipfs", health.HTTP(&http.Client{}, "POST", strings.TrimSuffix(cfg.IpfsApiUrl, "/")+"/version"))
+	}
+}
+
+func checkPostgres(ctx context.Context) error {
+	if atomic.LoadInt32(&postgresConnected) == 0 {
+		return fmt.Errorf("not connected")
+	}
+	return appDB.PingContext(ctx)
+}
+
+// checkAmqp checks the channel tasks are accepted on is open. processes
+// that don't accept tasks connect to check the server is reachable
+func checkAmqp(ctx context.Context) error {
+	switch atomic.LoadInt32(&acceptChannel) {
+	case channelOpen:
+		return nil
+	case channelClosed:
+		return fmt.Errorf("channel closed")
+	}
+
+	conn, err := amqp.Dial(cfg.AmqpUrl)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	return ch.Close()
+}
+
+func checkRedis(ctx context.Context) error {
+	if rpool == nil {
+		return ErrNoRedisConn
+	}
+	conn := rpool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+// watchAcceptChannel tracks whether ch is open for readiness checks
+func watchAcceptChannel(ch *amqp.Channel) {
+	atomic.StoreInt32(&acceptChannel, channelOpen)
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if err := <-closed; err != nil {
+			log.Infof("amqp channel closed: %s", err.Error())
+		}
+		atomic.StoreInt32(&acceptChannel, channelClosed)
+	}()
+}
@@ -0,0 +1,195 @@
+// Package health reports whether a process is alive, and whether the
+// services it depends on are reachable enough for it to do useful work
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTimeout is how long each check gets if a Checker has no Timeout
+var DefaultTimeout = 5 * time.Second
+
+// Statuses reported for a process & each dependency
+const (
+	StatusOk          = "ok"
+	StatusUnavailable = "unavailable"
+	StatusDraining    = "draining"
+)
+
+// Check tests a dependency, returning an error if it isn't usable. checks
+// should give up when ctx is done
+type Check func(ctx context.Context) error
+
+// Dependency is the result of checking a single dependency
+type Dependency struct {
+	Status string `json:"status"`
+	// how long the check took in milliseconds
+	Latency float64 `json:"latencyMs"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Report is the result of checking every dependency
+type Report struct {
+	Status       string                 `json:"status"`
+	Dependencies map[string]*Dependency `json:"dependencies"`
+}
+
+// Ok is true if the process is ready to accept work
+func (r *Report) Ok() bool {
+	return r.Status == StatusOk
+}
+
+// Checker runs readiness checks for a set of named dependencies
+type Checker struct {
+	// how long each check may take before it's reported unavailable,
+	// DefaultTimeout if zero
+	Timeout time.Duration
+
+	lock     sync.Mutex
+	checks   map[string]Check
+	draining int32
+}
+
+// Add registers a check for the named dependency, replacing any existing
+// check with the same name
+func (c *Checker) Add(name string, check Check) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.checks == nil {
+		c.checks = map[string]Check{}
+	}
+	c.checks[name] = check
+}
+
+// Drain marks the process as shutting down, it won't be reported ready again
+func (c *Checker) Drain() {
+	atomic.StoreInt32(&c.draining, 1)
+}
+
+// Draining is true once Drain has been called
+func (c *Checker) Draining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// Check runs all checks concurrently, reporting the process ready if none
+// of them fail & it isn't draining
+func (c *Checker) Check(ctx context.Context) *Report {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	c.lock.Lock()
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.lock.Unlock()
+
+	report := &Report{Status: StatusOk, Dependencies: map[string]*Dependency{}}
+	type result struct {
+		name string
+		dep  *Dependency
+	}
+	results := make(chan result, len(checks))
+	for name, check := range checks {
+		go func(name string, check Check) {
+			results <- result{name, run(ctx, check, timeout)}
+		}(name, check)
+	}
+	for range checks {
+		res := <-results
+		report.Dependencies[res.name] = res.dep
+		if res.dep.Status != StatusOk {
+			report.Status = StatusUnavailable
+		}
+	}
+
+	if c.Draining() {
+		report.Status = StatusDraining
+	}
+	return report
+}
+
+// run performs a single check, giving up after timeout even if the check
+// ignores it's context
+func run(ctx context.Context, check Check, timeout time.Duration) *Dependency {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errs <- fmt.Errorf("check panicked: %v", r)
+			}
+		}()
+		errs <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	dep := &Dependency{Status: StatusOk, Latency: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		dep.Status = StatusUnavailable
+		dep.Error = err.Error()
+	}
+	return dep
+}
+
+// ReadyHandler serves a Report, responding 503 if the process isn't ready
+func (c *Checker) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	report := c.Check(r.Context())
+	status := http.StatusOK
+	if !report.Ok() {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// LiveHandler reports the process is alive, it doesn't check dependencies
+// so a process waiting on one isn't restarted
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": StatusOk})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// HTTP checks that a request to url succeeds with a 2xx status
+func HTTP(client *http.Client, method, url string) Check {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("%s %s responded %s", method, url, res.Status)
+		}
+		return nil
+	}
+}
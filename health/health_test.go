@@ -0,0 +1,117 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func ok(ctx context.Context) error { return nil }
+
+func TestCheck(t *testing.T) {
+	c := &Checker{Timeout: 50 * time.Millisecond}
+	c.Add("postgres", ok)
+	c.Add("redis", ok)
+
+	report := c.Check(context.Background())
+	if !report.Ok() || len(report.Dependencies) != 2 {
+		t.Fatalf("expected 2 ok dependencies, got: %s %v", report.Status, report.Dependencies)
+	}
+
+	c.Add("redis", func(ctx context.Context) error { return fmt.Errorf("connection refused") })
+	c.Add("ipfs", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	c.Add("amqp", func(ctx context.Context) error { panic("oh no") })
+
+	start := time.Now()
+	report = c.Check(context.Background())
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected slow checks to time out")
+	}
+	if report.Status != StatusUnavailable {
+		t.Errorf("expected status %s, got: %s", StatusUnavailable, report.Status)
+	}
+
+	cases := []struct {
+		name, status, err string
+	}{
+		{"postgres", StatusOk, ""},
+		{"redis", StatusUnavailable, "connection refused"},
+		{"ipfs", StatusUnavailable, "timed out after 50ms"},
+		{"amqp", StatusUnavailable, "check panicked: oh no"},
+	}
+	for _, c := range cases {
+		dep := report.Dependencies[c.name]
+		if dep == nil {
+			t.Errorf("%s: missing from report", c.name)
+			continue
+		}
+		if dep.Status != c.status || dep.Error != c.err {
+			t.Errorf("%s: expected %s '%s', got: %s '%s'", c.name, c.status, c.err, dep.Status, dep.Error)
+		}
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	c := &Checker{}
+	c.Add("postgres", ok)
+
+	w := httptest.NewRecorder()
+	c.ReadyHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got: %d", w.Code)
+	}
+
+	report := &Report{}
+	if err := json.NewDecoder(w.Body).Decode(report); err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.Dependencies["postgres"] == nil || report.Dependencies["postgres"].Status != StatusOk {
+		t.Errorf("expected postgres to be reported ok, got: %v", report.Dependencies)
+	}
+
+	c.Drain()
+	w = httptest.NewRecorder()
+	c.ReadyHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected draining to respond 503, got: %d", w.Code)
+	}
+	if err := json.NewDecoder(w.Body).Decode(report); err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.Status != StatusDraining {
+		t.Errorf("expected status %s, got: %s", StatusDraining, report.Status)
+	}
+}
+
+func TestLiveHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	LiveHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v0/version" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"Version":"0.4.10"}`))
+	}))
+	defer srv.Close()
+
+	if err := HTTP(nil, "POST", srv.URL+"/api/v0/version")(context.Background()); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if err := HTTP(nil, "GET", srv.URL+"/api/v0/version")(context.Background()); err == nil {
+		t.Errorf("expected a 404 to error")
+	}
+}
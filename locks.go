@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// postgres advisory lock ids, one per job that only one node may run
+// at a time
+const (
+	lockMigrate int64 = iota + 4200
+	lockRetention
+	lockReaper
+)
+
+// advisory locks belong to the session that takes them, so they're held
+// on a dedicated connection instead of one from the pool
+
+// withAdvisoryLock waits for the advisory lock id, calling f with the
+// connection that holds it
+func withAdvisoryLock(ctx context.Context, db *sql.DB, id int64, f func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1);`, id); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1);`, id)
+	return f(conn)
+}
+
+// tryAdvisoryLock calls f if the advisory lock id is free, reporting
+// weather it was
+func tryAdvisoryLock(ctx context.Context, db *sql.DB, id int64, f func() error) (bool, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	locked := false
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1);`, id).Scan(&locked); err != nil || !locked {
+		return false, err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1);`, id)
+	return true, f()
+}
@@ -0,0 +1,80 @@
+// Package logging configures the single logger task_mgmt & it's taskdefs
+// write to. Taskables log with the entry carried by the context they're
+// given, which has the running task's fields, see FromContext
+package logging
+
+import (
+	"context"
+	"fmt"
+	stdlog "log"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log is the logger everything should write to
+var Log = logrus.New()
+
+// Fields is an alias for logrus.Fields, so callers needn't import logrus
+type Fields = logrus.Fields
+
+// Entry is an alias for logrus.Entry
+type Entry = logrus.Entry
+
+func init() {
+	Log.Out = os.Stderr
+	Log.Level = logrus.InfoLevel
+	Log.Formatter = &logrus.TextFormatter{}
+
+	// route packages that use the standard library logger through Log
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(Log.WriterLevel(logrus.InfoLevel))
+}
+
+// Formats Configure accepts
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Configure sets the minimum level of entries that are written, one of
+// "debug", "info", "warn" or "error", and the format they're written in.
+// empty values leave the current setting
+func Configure(level, format string) error {
+	if level != "" {
+		lvl, err := logrus.ParseLevel(level)
+		if err != nil {
+			return fmt.Errorf("invalid log level: '%s'", level)
+		}
+		Log.SetLevel(lvl)
+	}
+
+	switch strings.ToLower(format) {
+	case "":
+	case FormatText:
+		Log.Formatter = &logrus.TextFormatter{}
+	case FormatJSON:
+		Log.Formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("invalid log format: '%s', expected '%s' or '%s'", format, FormatText, FormatJSON)
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// ContextWithEntry returns a copy of ctx carrying entry, so work done on
+// behalf of a task can log with the task's fields
+func ContextWithEntry(ctx context.Context, entry *Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, entry)
+}
+
+// FromContext gives the entry carried by ctx, or an entry without fields
+// if it doesn't carry one
+func FromContext(ctx context.Context) *Entry {
+	if e, ok := ctx.Value(contextKey{}).(*Entry); ok {
+		return e
+	}
+	return logrus.NewEntry(Log)
+}
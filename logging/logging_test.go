@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	stdlog "log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lockedBuffer is safe to read while the standard logger's pipe writes
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// capture writes Log to a buffer as json for the duration of a test
+func capture(t *testing.T) (*lockedBuffer, func()) {
+	buf := &lockedBuffer{}
+	out, formatter, level := Log.Out, Log.Formatter, Log.Level
+	Log.Out = buf
+	if err := Configure("debug", FormatJSON); err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf, func() {
+		Log.Out, Log.Formatter = out, formatter
+		Log.SetLevel(level)
+	}
+}
+
+func entries(t *testing.T, buf *lockedBuffer) []map[string]interface{} {
+	es := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		e := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("expected json entries, got: %s", line)
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+func TestConfigure(t *testing.T) {
+	buf, restore := capture(t)
+	defer restore()
+
+	if err := Configure("warn", ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	Log.Info("hidden")
+	Log.Warn("shown")
+	if es := entries(t, buf); len(es) != 1 || es[0]["msg"] != "shown" || es[0]["level"] != "warning" {
+		t.Errorf("expected a single warning, got: %v", es)
+	}
+
+	if err := Configure("loud", ""); err == nil {
+		t.Errorf("expected an invalid level to error")
+	}
+	if err := Configure("", "xml"); err == nil {
+		t.Errorf("expected an invalid format to error")
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	buf, restore := capture(t)
+	defer restore()
+
+	task := Log.WithFields(Fields{"task_id": "a", "worker_id": "w1"})
+	ctx := ContextWithEntry(context.Background(), task)
+	FromContext(ctx).Info("task")
+	FromContext(ctx).WithField("task_id", "explicit").Info("explicit")
+	FromContext(context.Background()).Info("idle")
+
+	es := entries(t, buf)
+	if len(es) != 3 {
+		t.Fatalf("expected 3 entries, got: %d", len(es))
+	}
+	cases := []struct {
+		msg, taskId, worker string
+	}{
+		{"task", "a", "w1"},
+		{"explicit", "explicit", "w1"},
+		{"idle", "", ""},
+	}
+	for i, c := range cases {
+		e := es[i]
+		if e["msg"] != c.msg {
+			t.Errorf("case %d: expected message %s, got: %v", i, c.msg, e["msg"])
+		}
+		if id, _ := e["task_id"].(string); id != c.taskId {
+			t.Errorf("case %d: expected task_id '%s', got: '%s'", i, c.taskId, id)
+		}
+		if w, _ := e["worker_id"].(string); w != c.worker {
+			t.Errorf("case %d: expected worker_id '%s', got: '%s'", i, c.worker, w)
+		}
+	}
+}
+
+func TestStandardLogger(t *testing.T) {
+	buf, restore := capture(t)
+	defer restore()
+
+	stdlog.Println("from a vendored package")
+
+	// the standard logger writes through a pipe, read by another goroutine
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && buf.String() == "" {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if es := entries(t, buf); len(es) != 1 || es[0]["msg"] != "from a vendored package" || es[0]["level"] != logrus.InfoLevel.String() {
+		t.Errorf("expected standard logger output as an entry, got: %s", buf.String())
+	}
+}
@@ -60,9 +60,19 @@ func initializeAppSchema(db *sql.DB) (func(), error) {
 	for _, cmd := range []string{
 		"drop-all",
 		"create-tasks",
+		"create-task_dedups",
+		"create-task_checkpoints",
+		"create-task_checkpoint_entries",
+		"create-workers",
+		"create-task_events",
 		"create-sources",
 		"create-repos",
 		"create-repo_sources",
+		"create-api_keys",
+		"create-policies",
+		"create-webhook_subscriptions",
+		"create-webhook_deliveries",
+		"create-notify_digests",
 	} {
 		if _, err := schema.Exec(db, cmd); err != nil {
 			log.Info(cmd, "error:", err)
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"github.com/datatogether/task_mgmt/health"
+	"github.com/datatogether/task_mgmt/metrics"
+	"github.com/datatogether/task_mgmt/notify"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/streadway/amqp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// taskDurationBuckets are upper bounds for task durations in seconds,
+// from a second to a day
+var taskDurationBuckets = []float64{1, 5, 15, 60, 300, 900, 1800, 3600, 3 * 3600, 6 * 3600, 24 * 3600}
+
+var (
+	tasksEnqueued  = metrics.NewCounter("task_mgmt_tasks_enqueued_total", "Tasks sent to the queue.", "type")
+	tasksStarted   = metrics.NewCounter("task_mgmt_tasks_started_total", "Tasks started by workers.", "type")
+	tasksSucceeded = metrics.NewCounter("task_mgmt_tasks_succeeded_total", "Tasks that completed.", "type")
+	tasksFailed    = metrics.NewCounter("task_mgmt_tasks_failed_total", "Tasks that errored.", "type")
+	taskDuration   = metrics.NewHistogram("task_mgmt_task_duration_seconds", "How long finished tasks ran.", taskDurationBuckets, "type", "state")
+
+	tasksInFlight = metrics.NewGauge("task_mgmt_worker_tasks_in_flight", "Tasks a worker is currently running.", "worker")
+
+	httpRequestDuration = metrics.NewHistogram("task_mgmt_http_request_duration_seconds", "HTTP api request latencies.", nil, "method", "path", "code")
+
+	amqpReconnects = metrics.NewCounter("task_mgmt_amqp_reconnects_total", "Attempts to reconnect to the amqp server after a failed connection.")
+
+	_ = metrics.NewGaugeFunc("task_mgmt_queue_depth", "Messages waiting in each task queue.", queueDepths, "queue")
+)
+
+// startMetrics counts task events this process logs, & serves metrics &
+// health checks on cfg.MetricsPort if it's set, for processes that don't
+// serve the api
+func startMetrics() {
+	tasks.HandleEvents(recordTaskEvent)
+
+	if cfg.MetricsPort == "" || cfg.MetricsPort == cfg.Port {
+		return
+	}
+	go func() {
+		m := http.NewServeMux()
+		m.HandleFunc("/metrics", metrics.Handler)
+		m.HandleFunc("/healthz", health.LiveHandler)
+		m.HandleFunc("/readyz", readiness.ReadyHandler)
+		log.Infof("serving metrics on port %s", cfg.MetricsPort)
+		if err := http.ListenAndServe(fmt.Sprintf(":%s", cfg.MetricsPort), m); err != nil {
+			log.Infof("metrics server error: %s", err.Error())
+		}
+	}()
+}
+
+// recordTaskEvent updates task metrics for an event
+func recordTaskEvent(t *tasks.Task, e *tasks.TaskEvent) {
+	switch e.Type {
+	case tasks.EventEnqueued:
+		tasksEnqueued.Inc(t.Type)
+	case tasks.EventStarted:
+		tasksStarted.Inc(t.Type)
+	case tasks.EventSucceeded:
+		tasksSucceeded.Inc(t.Type)
+		taskDuration.Observe(notify.Duration(t).Seconds(), t.Type, "succeeded")
+	case tasks.EventFailed:
+		tasksFailed.Inc(t.Type)
+		taskDuration.Observe(notify.Duration(t).Seconds(), t.Type, "failed")
+	}
+}
+
+// queueDepths reads the number of messages waiting in each task queue,
+// connecting to the amqp server each time metrics are read
+func queueDepths() []metrics.Sample {
+	samples := []metrics.Sample{}
+	if cfg == nil || cfg.AmqpUrl == "" {
+		return samples
+	}
+
+	conn, err := amqp.Dial(cfg.AmqpUrl)
+	if err != nil {
+		log.Infof("queue depth error: %s", err.Error())
+		return samples
+	}
+	defer conn.Close()
+
+	for _, name := range tasks.WorkerQueues(nil) {
+		// inspecting a queue that doesn't exist closes the channel, so
+		// each queue gets it's own
+		ch, err := conn.Channel()
+		if err != nil {
+			log.Infof("queue depth error: %s", err.Error())
+			return samples
+		}
+		if q, err := ch.QueueInspect(name); err == nil {
+			samples = append(samples, metrics.Sample{LabelValues: []string{name}, Value: float64(q.Messages)})
+		}
+		ch.Close()
+	}
+	return samples
+}
+
+// statusWriter records the status code & size of a response, and the
+// user that made the request once they're authenticated
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	userId string
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += n
+	return n, err
+}
+
+// Flush passes through to the underlying writer, for streaming responses
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// observeRequest records how long the request r took. requests are grouped
+// by the first segment of their path to keep the number of series down,
+// requests for paths that weren't found are grouped together
+func observeRequest(r *http.Request, status int, d time.Duration) {
+	path := "/" + strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	if status == http.StatusNotFound {
+		path = "other"
+	}
+	httpRequestDuration.Observe(d.Seconds(), r.Method, path, strconv.Itoa(status))
+}
@@ -0,0 +1,356 @@
+// Package metrics collects counters, gauges & histograms, and serves them
+// in the prometheus text exposition format. Metrics are registered with
+// the Default registry when they're created
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the registry metrics are added to when they're created
+var Default = &Registry{}
+
+// DefaultBuckets are histogram bucket upper bounds in seconds, for latencies
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Sample is a single value of a metric, for a set of label values
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// collector is a metric that can be written out
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry is a set of metrics
+type Registry struct {
+	lock       sync.Mutex
+	collectors []collector
+}
+
+func (r *Registry) register(c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, existing := range r.collectors {
+		if existing.name() == c.name() {
+			panic(fmt.Sprintf("metric %s is already registered", c.name()))
+		}
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes all metrics in text exposition format, sorted by name
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	cs := append([]collector{}, r.collectors...)
+	r.lock.Unlock()
+
+	sort.Slice(cs, func(i, j int) bool { return cs[i].name() < cs[j].name() })
+	buf := bufio.NewWriter(w)
+	for _, c := range cs {
+		c.write(buf)
+	}
+	return buf.Flush()
+}
+
+// Handler serves the Default registry's metrics
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	Default.Write(w)
+}
+
+// desc is the name, help text & label names common to all metrics
+type desc struct {
+	metric string
+	help   string
+	labels []string
+	typ    string
+}
+
+func (d *desc) name() string { return d.metric }
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.metric, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.metric, d.typ)
+}
+
+// writeSample writes a line for a value. extra is an additional label
+// name & value pair, eg for histogram buckets
+func (d *desc) writeSample(w *bufio.Writer, suffix string, values []string, extra []string, v float64) {
+	w.WriteString(d.metric + suffix)
+	names, vals := d.labels, values
+	if len(extra) == 2 {
+		names = append(append([]string{}, names...), extra[0])
+		vals = append(append([]string{}, vals...), extra[1])
+	}
+	if len(names) > 0 {
+		w.WriteString("{")
+		for i, n := range names {
+			if i > 0 {
+				w.WriteString(",")
+			}
+			fmt.Fprintf(w, `%s="%s"`, n, escapeLabel(vals[i]))
+		}
+		w.WriteString("}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", d.metric, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer("\\", `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// series holds values for each set of label values, in the order they were
+// first seen
+type series struct {
+	lock   sync.Mutex
+	keys   []string
+	values map[string][]string
+}
+
+func (s *series) add(key string, values []string) bool {
+	if s.values == nil {
+		s.values = map[string][]string{}
+	}
+	if _, ok := s.values[key]; ok {
+		return false
+	}
+	s.keys = append(s.keys, key)
+	s.values[key] = append([]string{}, values...)
+	return true
+}
+
+// sortedKeys gives keys ordered by label values
+func (s *series) sortedKeys() []string {
+	keys := append([]string{}, s.keys...)
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value that only increases, partitioned by label values
+type Counter struct {
+	desc
+	series
+	counts map[string]float64
+}
+
+// NewCounter creates & registers a counter
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, labels, "counter"}, counts: map[string]float64{}}
+	Default.register(c)
+	return c
+}
+
+// Inc adds one to the counter for labelValues
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for labelValues, v must not be negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", c.metric))
+	}
+	key := c.key(labelValues)
+	c.lock.Lock()
+	c.add(key, labelValues)
+	c.counts[key] += v
+	c.lock.Unlock()
+}
+
+// Value gives the count for labelValues
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.counts[c.key(labelValues)]
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, k := range c.sortedKeys() {
+		c.writeSample(w, "", c.values[k], nil, c.counts[k])
+	}
+}
+
+// Gauge is a value that can go up & down, partitioned by label values
+type Gauge struct {
+	desc
+	series
+	gauges map[string]float64
+}
+
+// NewGauge creates & registers a gauge
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{name, help, labels, "gauge"}, gauges: map[string]float64{}}
+	Default.register(g)
+	return g
+}
+
+// Set sets the gauge for labelValues to v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.lock.Lock()
+	g.add(key, labelValues)
+	g.gauges[key] = v
+	g.lock.Unlock()
+}
+
+// Add adds v to the gauge for labelValues, v can be negative
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.lock.Lock()
+	g.add(key, labelValues)
+	g.gauges[key] += v
+	g.lock.Unlock()
+}
+
+// Inc adds one to the gauge for labelValues
+func (g *Gauge) Inc(labelValues ...string) { g.Add(1, labelValues...) }
+
+// Dec subtracts one from the gauge for labelValues
+func (g *Gauge) Dec(labelValues ...string) { g.Add(-1, labelValues...) }
+
+// Value gives the gauge for labelValues
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.gauges[g.key(labelValues)]
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, k := range g.sortedKeys() {
+		g.writeSample(w, "", g.values[k], nil, g.gauges[k])
+	}
+}
+
+// GaugeFunc is a gauge whose values are read when metrics are written
+type GaugeFunc struct {
+	desc
+	fn func() []Sample
+}
+
+// NewGaugeFunc creates & registers a gauge that calls fn for it's values
+// each time metrics are written. fn must be safe for concurrent use
+func NewGaugeFunc(name, help string, fn func() []Sample, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name, help, labels, "gauge"}, fn: fn}
+	Default.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	samples := g.fn()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].LabelValues, "\xff") < strings.Join(samples[j].LabelValues, "\xff")
+	})
+	for _, s := range samples {
+		if len(s.LabelValues) == len(g.labels) {
+			g.writeSample(w, "", s.LabelValues, nil, s.Value)
+		}
+	}
+}
+
+// Histogram counts observations in buckets, partitioned by label values
+type Histogram struct {
+	desc
+	series
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+// NewHistogram creates & registers a histogram with buckets as upper bounds,
+// DefaultBuckets if nil
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+
+	h := &Histogram{
+		desc:    desc{name, help, labels, "histogram"},
+		buckets: buckets,
+		counts:  map[string][]uint64{},
+		sums:    map[string]float64{},
+		totals:  map[string]uint64{},
+	}
+	Default.register(h)
+	return h
+}
+
+// Observe adds an observation for labelValues
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.add(key, labelValues) {
+		h.counts[key] = make([]uint64, len(h.buckets))
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[key][i]++
+		}
+	}
+	h.sums[key] += v
+	h.totals[key]++
+}
+
+// Count gives the number of observations for labelValues
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.totals[h.key(labelValues)]
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, k := range h.sortedKeys() {
+		values := h.values[k]
+		for i, b := range h.buckets {
+			h.writeSample(w, "_bucket", values, []string{"le", formatFloat(b)}, float64(h.counts[k][i]))
+		}
+		h.writeSample(w, "_bucket", values, []string{"le", "+Inf"}, float64(h.totals[k]))
+		h.writeSample(w, "_sum", values, nil, h.sums[k])
+		h.writeSample(w, "_count", values, nil, float64(h.totals[k]))
+	}
+}
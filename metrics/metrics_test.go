@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func written(t *testing.T) string {
+	buf := &bytes.Buffer{}
+	if err := Default.Write(buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.String()
+}
+
+func expectLines(t *testing.T, out string, lines ...string) {
+	for _, l := range lines {
+		if !strings.Contains(out, l+"\n") {
+			t.Errorf("expected output to contain line: %s\n%s", l, out)
+		}
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A test counter.", "type")
+	c.Inc("a")
+	c.Add(2.5, "a")
+	c.Inc(`b"\`)
+
+	if c.Value("a") != 3.5 {
+		t.Errorf("expected 3.5, got: %f", c.Value("a"))
+	}
+	expectLines(t, written(t),
+		"# HELP test_counter_total A test counter.",
+		"# TYPE test_counter_total counter",
+		`test_counter_total{type="a"} 3.5`,
+		`test_counter_total{type="b\"\\"} 1`,
+	)
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected decreasing a counter to panic")
+		}
+	}()
+	c.Add(-1, "a")
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_gauge", "A test gauge.", "worker")
+	g.Inc("w1")
+	g.Inc("w1")
+	g.Dec("w1")
+	g.Set(7, "w2")
+
+	NewGaugeFunc("test_gauge_func", "A test gauge func.", func() []Sample {
+		return []Sample{{LabelValues: []string{"b"}, Value: 2}, {LabelValues: []string{"a"}, Value: 1}}
+	}, "queue")
+
+	out := written(t)
+	expectLines(t, out,
+		"# TYPE test_gauge gauge",
+		`test_gauge{worker="w1"} 1`,
+		`test_gauge{worker="w2"} 7`,
+		`test_gauge_func{queue="a"} 1`,
+		`test_gauge_func{queue="b"} 2`,
+	)
+	if strings.Index(out, `test_gauge_func{queue="a"}`) > strings.Index(out, `test_gauge_func{queue="b"}`) {
+		t.Errorf("expected samples to be sorted by label values")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_latency_seconds", "A test histogram.", []float64{1, 0.1}, "path")
+	h.Observe(0.05, "/tasks")
+	h.Observe(0.5, "/tasks")
+	h.Observe(5, "/tasks")
+
+	if h.Count("/tasks") != 3 {
+		t.Errorf("expected 3 observations, got: %d", h.Count("/tasks"))
+	}
+	expectLines(t, written(t),
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{path="/tasks",le="0.1"} 1`,
+		`test_latency_seconds_bucket{path="/tasks",le="1"} 2`,
+		`test_latency_seconds_bucket{path="/tasks",le="+Inf"} 3`,
+		`test_latency_seconds_sum{path="/tasks"} 5.55`,
+		`test_latency_seconds_count{path="/tasks"} 3`,
+	)
+}
+
+func TestUnlabeled(t *testing.T) {
+	c := NewCounter("test_unlabeled_total", "A counter without labels.")
+	c.Inc()
+	expectLines(t, written(t), "test_unlabeled_total 1")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected registering a duplicate name to panic")
+		}
+	}()
+	NewCounter("test_unlabeled_total", "A duplicate.")
+}
+
+func TestHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type mismatch, got: %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), "# TYPE") {
+		t.Errorf("expected metrics in response body")
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"crypto/tls"
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/task_mgmt/auth"
+	"github.com/datatogether/task_mgmt/logging"
 	"net/http"
 	"time"
 )
@@ -15,12 +18,16 @@ func init() {
 	}
 }
 
-// middleware handles request logging
+// middleware handles request logging & metrics
 func middleware(handler http.HandlerFunc) http.HandlerFunc {
 	// no-auth middware func
-	return func(w http.ResponseWriter, r *http.Request) {
-		// poor man's logging:
-		log.Infoln(r.Method, r.URL.Path, time.Now())
+	return func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		w := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+		defer func() {
+			observeRequest(r, w.status, time.Since(start))
+			logRequest(r, w, time.Since(start))
+		}()
 
 		// If this server is operating behind a proxy, but we still want to force
 		// users to use https, cfg.ProxyForceHttps == true will listen for the common
@@ -45,72 +52,69 @@ func middleware(handler http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// authMiddleware checks for github auth
-// TODO - this is a carry-over from a former implementation of task_mgmt
-// that was specific to executing the kiwix zim task it should be shifted
-// over to some sort of permissions service
-
-// func authMiddleware(handler http.HandlerFunc) http.HandlerFunc {
-// 	return func(w http.ResponseWriter, r *http.Request) {
-// 		token := r.FormValue("access_token")
-// 		c, err := r.Cookie(cfg.UserCookieKey)
-// 		if err != nil {
-// 			log.Info(err.Error())
-// 		}
-
-// 		// we gots no login info, so login required
-// 		if c == nil && token == "" {
-// 			msg := fmt.Sprintf("github login required: %s/oauth/github?redirect=%s", cfg.IdentityServerUrl, cfg.UrlRoot)
-// 			apiutil.WriteMessageResponse(w, msg, nil)
-// 			return
-// 		}
-
-// 		req, err := http.NewRequest("GET", fmt.Sprintf("%s/session/oauth/github/repoaccess?access_token=%s&owner=%s&repo=%s", cfg.IdentityServerUrl, token, cfg.GithubRepoOwner, cfg.GithubRepoName), nil)
-// 		if err != nil {
-// 			log.Info(err.Error())
-// 			apiutil.WriteErrResponse(w, http.StatusInternalServerError, fmt.Errorf("error contacting identity server: %s", err.Error()))
-// 			return
-// 		}
-
-// 		req.AddCookie(c)
-// 		res, err := http.DefaultClient.Do(req)
-// 		if err != nil {
-// 			log.Info(err.Error())
-// 			apiutil.WriteErrResponse(w, http.StatusInternalServerError, fmt.Errorf("error contacting identity server: %s", err.Error()))
-// 			return
-// 		}
-// 		defer res.Body.Close()
-
-// 		data := map[string]interface{}{}
-// 		if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
-// 			log.Info(err.Error())
-// 			apiutil.WriteErrResponse(w, http.StatusInternalServerError, fmt.Errorf("error contacting identity server: %s", err.Error()))
-// 			return
-// 		}
+// authMiddleware identifies the user making a request with an api key or a
+// bearer JWT signed by cfg.PublicKey, adding their identity to the request
+// context. invalid credentials are always rejected, missing credentials are
+// only rejected if cfg.RequireAuth is set
+func authMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	a := newAuthenticator()
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := a.Authenticate(r)
+		if err == auth.ErrNoCredentials && !cfg.RequireAuth {
+			handler(w, r)
+			return
+		} else if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="task_mgmt"`)
+			apiutil.WriteErrResponse(w, http.StatusUnauthorized, err)
+			return
+		}
 
-// 		// User Needs github added to their account
-// 		if res.StatusCode == http.StatusUnauthorized {
-// 			msg := fmt.Sprintf("github login required: %s/oauth/github?redirect=%s", cfg.IdentityServerUrl, cfg.UrlRoot)
-// 			apiutil.WriteMessageResponse(w, msg, nil)
-// 			return
-// 		} else if res.StatusCode != http.StatusOK {
-// 			log.Info(data["meta"].(map[string]interface{})["message"])
-// 			apiutil.WriteErrResponse(w, http.StatusInternalServerError, fmt.Errorf("%s", data["meta"].(map[string]interface{})["message"]))
-// 			return
-// 		}
+		if sw, ok := w.(*statusWriter); ok {
+			sw.userId = id.UserId
+		}
+		handler(w, r.WithContext(auth.NewContext(r.Context(), id)))
+	}
+}
 
-// 		perm := data["data"].(map[string]interface{})["permission"]
-// 		if perm != "admin" && perm != "write" {
-// 			apiutil.WriteErrResponse(w, http.StatusUnauthorized, fmt.Errorf("access denied"))
-// 			return
-// 		}
+// logRequest writes an entry for a finished request. probes from load
+// balancers & metrics scrapers are only logged at debug level
+func logRequest(r *http.Request, w *statusWriter, d time.Duration) {
+	entry := log.WithFields(logging.Fields{
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"status":      w.status,
+		"bytes":       w.bytes,
+		"duration_ms": float64(d) / float64(time.Millisecond),
+		"remote_addr": r.RemoteAddr,
+	})
+	if w.userId != "" {
+		entry = entry.WithField("user_id", w.userId)
+	}
 
-// 		ctx := context.WithValue(r.Context(), "permission", perm)
+	switch {
+	case w.status >= 500:
+		entry.Error("request")
+	case r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/healthcheck" || r.URL.Path == "/metrics":
+		entry.Debug("request")
+	default:
+		entry.Info("request")
+	}
+}
 
-// 		// no-auth middware func
-// 		middleware(handler)(w, r.WithContext(ctx))
-// 	}
-// }
+// newAuthenticator builds the authenticator for api requests. JWTs are only
+// accepted if a valid PublicKey is configured
+func newAuthenticator() auth.Authenticator {
+	a := auth.Chain{auth.APIKeyAuthenticator{Store: store}}
+	if cfg.PublicKey != "" {
+		key, err := auth.ParsePublicKey(cfg.PublicKey)
+		if err != nil {
+			log.Infof("JWT authentication disabled: %s", err.Error())
+			return a
+		}
+		a = append(a, auth.JWTAuthenticator{Key: key})
+	}
+	return a
+}
 
 // addCORSHeaders adds CORS header info for whitelisted servers
 func addCORSHeaders(w http.ResponseWriter, r *http.Request) {
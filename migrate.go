@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/datatogether/sqlutil"
+	"github.com/gchaincl/dotsql"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const qSchemaMigrationsCreateTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version          integer NOT NULL PRIMARY KEY,
+  name             text NOT NULL DEFAULT '',
+  applied          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);`
+
+// migration is a versioned change to the database schema
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// when the migration was applied, nil if it hasn't been
+	Applied *time.Time
+}
+
+// migration commands are named [version]-[name]-[up|down]
+var migrationName = regexp.MustCompile(`^(\d+)-(.+)-(up|down)$`)
+
+// loadMigrations reads migrations from a dotsql file, ordered by version
+func loadMigrations(path string) ([]*migration, error) {
+	ds, err := dotsql.LoadFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for name, query := range ds.QueryMap() {
+		match := migrationName.FindStringSubmatch(name)
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration name: %s", name)
+		}
+		version, _ := strconv.Atoi(match[1])
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names: %s, %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = query
+		} else {
+			m.Down = query
+		}
+	}
+
+	migrations := make([]*migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d-%s must have both up & down commands", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// migrationStatus loads migrations, marking the ones that have been applied to db
+func migrationStatus(db *sql.DB) ([]*migration, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return readMigrationStatus(conn)
+}
+
+// readMigrationStatus is migrationStatus on a single connection
+func readMigrationStatus(conn *sql.Conn) ([]*migration, error) {
+	ctx := context.Background()
+	migrations, err := loadMigrations(packagePath("sql/migrations.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.ExecContext(ctx, qSchemaMigrationsCreateTable); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied FROM schema_migrations;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var (
+			version int
+			t       time.Time
+		)
+		if err := rows.Scan(&version, &t); err != nil {
+			return nil, err
+		}
+		applied[version] = t
+	}
+
+	for _, m := range migrations {
+		if t, ok := applied[m.Version]; ok {
+			m.Applied = &t
+		}
+	}
+	return migrations, rows.Err()
+}
+
+// migrateUp applies all pending migrations to db, returning the
+// migrations that were applied. nodes starting together take turns, so
+// each migration is only applied once
+func migrateUp(db *sql.DB) (ran []*migration, err error) {
+	ran = []*migration{}
+	err = withAdvisoryLock(context.Background(), db, lockMigrate, func(conn *sql.Conn) error {
+		migrations, err := readMigrationStatus(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if m.Applied != nil {
+				continue
+			}
+			if err := runMigration(conn, m.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2);`, m.Version, m.Name); err != nil {
+				return fmt.Errorf("error applying migration %d-%s: %s", m.Version, m.Name, err.Error())
+			}
+			ran = append(ran, m)
+		}
+		return nil
+	})
+	return ran, err
+}
+
+// migrateDown reverts the most recent steps applied migrations,
+// returning the migrations that were reverted
+func migrateDown(db *sql.DB, steps int) (ran []*migration, err error) {
+	ran = []*migration{}
+	err = withAdvisoryLock(context.Background(), db, lockMigrate, func(conn *sql.Conn) error {
+		migrations, err := readMigrationStatus(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(ran) < steps; i-- {
+			m := migrations[i]
+			if m.Applied == nil {
+				continue
+			}
+			if err := runMigration(conn, m.Down, `DELETE FROM schema_migrations WHERE version = $1;`, m.Version); err != nil {
+				return fmt.Errorf("error reverting migration %d-%s: %s", m.Version, m.Name, err.Error())
+			}
+			ran = append(ran, m)
+		}
+		return nil
+	})
+	return ran, err
+}
+
+// runMigration executes a migration command & records it in a single transaction
+func runMigration(conn *sql.Conn, query, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(query); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// runMigrate is the migrate command, eg: "task_mgmt migrate down -steps 2"
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: task_mgmt migrate up|down|status")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	steps := fs.Int("steps", 1, "number of migrations to revert when migrating down")
+	fs.Parse(args[1:])
+
+	loadConfig()
+	if err := sqlutil.ConnectToDb("postgres", cfg.PostgresDbUrl, appDB); err != nil {
+		return err
+	}
+
+	var (
+		ran []*migration
+		err error
+	)
+	switch action {
+	case "up":
+		ran, err = migrateUp(appDB)
+	case "down":
+		ran, err = migrateDown(appDB, *steps)
+	case "status":
+		migrations, err := migrationStatus(appDB)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			applied := "pending"
+			if m.Applied != nil {
+				applied = m.Applied.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d\t%-30s\t%s\n", m.Version, m.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command: %s", action)
+	}
+
+	for _, m := range ran {
+		fmt.Printf("%s %04d-%s\n", action, m.Version, m.Name)
+	}
+	if err == nil && len(ran) == 0 {
+		fmt.Println("no migrations to run")
+	}
+	return err
+}
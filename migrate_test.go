@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	defer func() {
+		if err := resetTestData(appDB, "repos", "sources", "repo_sources", "tasks"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}()
+
+	all, err := loadMigrations("sql/migrations.sql")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i, m := range all {
+		if i > 0 && m.Version <= all[i-1].Version {
+			t.Errorf("migrations out of order: %d after %d", m.Version, all[i-1].Version)
+		}
+	}
+
+	// the test schema already exists, so applying migrations on top of
+	// it should be a no-op that brings the schema under version control
+	if _, err := migrateUp(appDB); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	reverted, err := migrateDown(appDB, len(all))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reverted) != len(all) {
+		t.Errorf("expected %d migrations to be reverted, got: %d", len(all), len(reverted))
+	}
+
+	applied, err := migrateUp(appDB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(applied) != len(all) {
+		t.Errorf("expected %d migrations to be applied, got: %d", len(all), len(applied))
+	}
+
+	status, err := migrationStatus(appDB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, m := range status {
+		if m.Applied == nil {
+			t.Errorf("expected migration %d-%s to be applied", m.Version, m.Name)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"github.com/datatogether/task_mgmt/notify"
+	"github.com/datatogether/task_mgmt/tasks"
+	"os"
+	"time"
+)
+
+// sender sends notifications, nil if notifications aren't configured.
+// set by startNotifications
+var sender *notify.Sender
+
+// newNotifier picks a notifier from configuration: SMTP if an SMTP server
+// is set, otherwise postmark if a key is set. In develop mode notifications
+// are logged if neither is set
+func newNotifier() (notify.Notifier, error) {
+	switch {
+	case cfg.SmtpAddr != "" || cfg.PostmarkKey != "":
+		if cfg.EmailFrom == "" {
+			return nil, fmt.Errorf("EMAIL_FROM is required to send email")
+		}
+		if cfg.SmtpAddr != "" {
+			return notify.SMTPNotifier{
+				Addr:     cfg.SmtpAddr,
+				Username: cfg.SmtpUsername,
+				Password: cfg.SmtpPassword,
+				From:     cfg.EmailFrom,
+			}, nil
+		}
+		return notify.PostmarkNotifier{Key: cfg.PostmarkKey, From: cfg.EmailFrom}, nil
+	case os.Getenv("GOLANG_ENV") == DEVELOP_MODE:
+		return &notify.LogNotifier{Logf: log.Infof}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// startNotifications sends notifications for task events this process
+// logs to cfg.EmailNotificationRecipients
+func startNotifications() {
+	if len(cfg.EmailNotificationRecipients) == 0 {
+		return
+	}
+
+	n, err := newNotifier()
+	if err != nil {
+		log.Infof("notifications disabled: %s", err.Error())
+		return
+	} else if n == nil {
+		return
+	}
+
+	templates, err := notify.LoadTemplates(cfg.NotifyTemplateDir)
+	if err != nil {
+		log.Infof("notifications disabled: %s", err.Error())
+		return
+	}
+
+	sender = &notify.Sender{
+		Notifier:       n,
+		Templates:      templates,
+		To:             cfg.EmailNotificationRecipients,
+		UrlRoot:        cfg.UrlRoot,
+		SucceededAfter: configDuration("NOTIFY_SUCCEEDED_AFTER", cfg.NotifySucceededAfter, time.Hour),
+		OnError: func(err error) {
+			log.Infof("notification error: %s", err.Error())
+		},
+	}
+	tasks.HandleEvents(sender.HandleEvent)
+}
+
+// startDigest sends a daily digest of finished tasks at cfg.NotifyDigestTime,
+// if notifications are configured. call after startNotifications
+func startDigest() {
+	if sender == nil || cfg.NotifyDigestTime == "" {
+		return
+	}
+
+	at, err := time.Parse("15:04", cfg.NotifyDigestTime)
+	if err != nil {
+		log.Infof("invalid NOTIFY_DIGEST_TIME '%s', digests disabled. use HH:MM", cfg.NotifyDigestTime)
+		return
+	}
+
+	go func() {
+		for {
+			next := nextDigest(time.Now().UTC(), at)
+			time.Sleep(time.Until(next))
+			// every node runs the schedule, but only the first to claim a
+			// digest sends it
+			if claimed, err := claimDigest(next); err != nil {
+				log.Infof("digest error: %s", err.Error())
+				continue
+			} else if !claimed {
+				continue
+			}
+			if err := sender.SendDigest(store, next.Add(-24*time.Hour), next); err != nil {
+				log.Infof("digest error: %s", err.Error())
+			}
+		}
+	}()
+}
+
+// claimDigest records the digest of tasks up to until as sent, reporting
+// weather it hadn't been already. without postgres there's only this
+// process to send it
+func claimDigest(until time.Time) (bool, error) {
+	if appDB == nil {
+		return true, nil
+	}
+	res, err := appDB.Exec(qNotifyDigestClaim, until)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// nextDigest gives the next time after now at the time of day in at, UTC
+func nextDigest(now, at time.Time) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.Add(24 * time.Hour)
+	}
+	return next
+}
@@ -0,0 +1,34 @@
+package notify
+
+import (
+	"sync"
+)
+
+// LogNotifier records messages instead of sending them, for development
+// & tests
+type LogNotifier struct {
+	// Logf is called with each message, optional
+	Logf func(format string, args ...interface{})
+
+	lock     sync.Mutex
+	messages []*Message
+}
+
+// Notify fulfills the Notifier interface
+func (n *LogNotifier) Notify(m *Message) error {
+	n.lock.Lock()
+	n.messages = append(n.messages, m)
+	n.lock.Unlock()
+
+	if n.Logf != nil {
+		n.Logf("notification to %v: %s\n%s", m.To, m.Subject, m.Body)
+	}
+	return nil
+}
+
+// Messages gives the messages sent so far, oldest first
+func (n *LogNotifier) Messages() []*Message {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]*Message{}, n.messages...)
+}
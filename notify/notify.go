@@ -0,0 +1,217 @@
+// Package notify sends people notifications about tasks, like emails when
+// tasks fail. Notifiers deliver messages, rendered from per-event templates
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Event names a kind of notification
+type Event string
+
+const (
+	// EventFailed is sent when a task fails
+	EventFailed Event = "failed"
+	// EventSucceeded is sent when a long-running task succeeds
+	EventSucceeded Event = "succeeded"
+	// EventDigest is a daily summary of finished tasks
+	EventDigest Event = "digest"
+)
+
+// Message is a rendered notification
+type Message struct {
+	// kind of notification
+	Event Event
+	// addresses to send to
+	To []string
+	// subject line
+	Subject string
+	// plain text body
+	Body string
+}
+
+// Notifier delivers messages
+type Notifier interface {
+	Notify(m *Message) error
+}
+
+// Data is passed to templates when rendering a message
+type Data struct {
+	Event Event
+	// task the notification is about, nil for digests
+	Task *tasks.Task
+	// how long the task ran
+	Duration time.Duration
+	// summary of finished tasks, for digests
+	Digest *Digest
+	// root url of the api, for linking to tasks
+	UrlRoot string
+}
+
+// Templates render messages for each event. each template defines a
+// "subject" & a "body" template
+type Templates map[Event]*template.Template
+
+// DefaultTemplates are used for events without a custom template
+var DefaultTemplates = Templates{
+	EventFailed: template.Must(template.New("failed").Parse(`
+{{define "subject"}}Task failed: {{.Task.Title}}{{end}}
+{{define "body"}}{{.Task.Type}} task "{{.Task.Title}}" failed after {{.Duration}}.
+
+error: {{.Task.Error}}
+{{if .UrlRoot}}
+{{.UrlRoot}}/tasks/{{.Task.Id}}
+{{end}}{{end}}`)),
+
+	EventSucceeded: template.Must(template.New("succeeded").Parse(`
+{{define "subject"}}Task succeeded: {{.Task.Title}}{{end}}
+{{define "body"}}{{.Task.Type}} task "{{.Task.Title}}" succeeded after {{.Duration}}.
+{{if .UrlRoot}}
+{{.UrlRoot}}/tasks/{{.Task.Id}}
+{{end}}{{end}}`)),
+
+	EventDigest: template.Must(template.New("digest").Parse(`
+{{define "subject"}}Task digest: {{.Digest.Succeeded}} succeeded, {{len .Digest.Failed}} failed{{end}}
+{{define "body"}}Tasks finished between {{.Digest.Since.Format "2006-01-02 15:04 MST"}} and {{.Digest.Until.Format "2006-01-02 15:04 MST"}}:
+
+succeeded: {{.Digest.Succeeded}}
+failed:    {{len .Digest.Failed}}
+cancelled: {{.Digest.Cancelled}}
+active:    {{.Digest.Active}}
+{{if .Digest.Failed}}
+failures:
+{{range .Digest.Failed}}
+* {{.Type}} "{{.Title}}" ({{.Id}}): {{.Error}}{{end}}
+{{end}}{{end}}`)),
+}
+
+// LoadTemplates reads custom templates from dir, named for their event, eg:
+// "failed.tmpl". events without a file use DefaultTemplates
+func LoadTemplates(dir string) (Templates, error) {
+	ts := Templates{}
+	for e, t := range DefaultTemplates {
+		ts[e] = t
+	}
+	if dir == "" {
+		return ts, nil
+	}
+
+	for e := range DefaultTemplates {
+		path := filepath.Join(dir, string(e)+".tmpl")
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		t, err := template.New(string(e)).Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", path, err.Error())
+		}
+		if t.Lookup("subject") == nil || t.Lookup("body") == nil {
+			return nil, fmt.Errorf("%s must define subject & body templates", path)
+		}
+		ts[e] = t
+	}
+	return ts, nil
+}
+
+// Render creates a message for data.Event from it's template
+func (ts Templates) Render(data *Data, to []string) (*Message, error) {
+	t := ts[data.Event]
+	if t == nil {
+		t = DefaultTemplates[data.Event]
+	}
+	if t == nil {
+		return nil, fmt.Errorf("no template for '%s' notifications", data.Event)
+	}
+
+	subject, body := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := t.ExecuteTemplate(subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := t.ExecuteTemplate(body, "body", data); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Event: data.Event,
+		To:    to,
+		// subjects are a single line
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Body:    strings.TrimSpace(body.String()) + "\n",
+	}, nil
+}
+
+// Digest summarizes top-level tasks that finished in a window of time
+type Digest struct {
+	Since time.Time
+	Until time.Time
+	// number of tasks that succeeded
+	Succeeded int
+	// tasks that failed, excluding cancelled tasks
+	Failed []*tasks.Task
+	// number of tasks that were cancelled
+	Cancelled int
+	// number of unfinished tasks as of Until
+	Active int
+}
+
+// ReadDigest summarizes tasks that finished between since & until
+func ReadDigest(store datastore.Datastore, since, until time.Time) (*Digest, error) {
+	d := &Digest{Since: since, Until: until, Failed: []*tasks.Task{}}
+
+	finished, err := tasks.ReadTaskQuery(store, tasks.TaskQuery{TopLevel: true, FinishedSince: since, FinishedBefore: until})
+	if err != nil {
+		return d, err
+	}
+	for _, t := range finished {
+		switch {
+		case t.Succeeded != nil:
+			d.Succeeded++
+		case t.Cancelled():
+			d.Cancelled++
+		default:
+			d.Failed = append(d.Failed, t)
+		}
+	}
+
+	active, err := tasks.ReadTaskQuery(store, tasks.TaskQuery{TopLevel: true, Unfinished: true})
+	if err != nil {
+		return d, err
+	}
+	for _, t := range active {
+		if t.Created.Before(until) {
+			d.Active++
+		}
+	}
+	return d, nil
+}
+
+// Duration gives how long a finished task ran, from when it started, or was
+// created if it never started
+func Duration(t *tasks.Task) time.Duration {
+	start := t.Created
+	if t.Started != nil {
+		start = *t.Started
+	}
+
+	switch {
+	case t.Succeeded != nil:
+		return t.Succeeded.Sub(start).Round(time.Second)
+	case t.Failed != nil:
+		return t.Failed.Sub(start).Round(time.Second)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,229 @@
+package notify
+
+import (
+	"encoding/json"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func finishedTask(title string, ran time.Duration, err string) *tasks.Task {
+	started := time.Now().Add(-ran)
+	finished := time.Now()
+	t := &tasks.Task{Id: title, Title: title, Type: "test", Created: started, Started: &started, Error: err}
+	if err == "" {
+		t.Succeeded = &finished
+	} else {
+		t.Failed = &finished
+	}
+	return t
+}
+
+// waitForMessages waits for n messages to be sent to n
+func waitForMessages(t *testing.T, n *LogNotifier, count int) []*Message {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if ms := n.Messages(); len(ms) >= count {
+			return ms
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d messages, got: %d", count, len(n.Messages()))
+	return nil
+}
+
+func TestRenderDefaults(t *testing.T) {
+	failed := finishedTask("broken", time.Minute, "oh no")
+	digest := &Digest{
+		Since:     time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:     time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC),
+		Succeeded: 3,
+		Failed:    []*tasks.Task{failed},
+	}
+
+	cases := []struct {
+		data    *Data
+		subject string
+		body    []string
+	}{
+		{&Data{Event: EventFailed, Task: failed, Duration: time.Minute, UrlRoot: "https://tasks.example.com"},
+			"Task failed: broken", []string{"failed after 1m0s", "error: oh no", "https://tasks.example.com/tasks/broken"}},
+		{&Data{Event: EventSucceeded, Task: finishedTask("slow", 2*time.Hour, ""), Duration: 2 * time.Hour},
+			"Task succeeded: slow", []string{"succeeded after 2h0m0s"}},
+		{&Data{Event: EventDigest, Digest: digest},
+			"Task digest: 3 succeeded, 1 failed", []string{"2017-01-01 00:00 UTC", "succeeded: 3", `test "broken" (broken): oh no`}},
+	}
+
+	for _, c := range cases {
+		m, err := DefaultTemplates.Render(c.data, []string{"ops@example.com"})
+		if err != nil {
+			t.Fatalf("%s: %s", c.data.Event, err.Error())
+		}
+		if m.Subject != c.subject {
+			t.Errorf("%s subject mismatch. expected: %s, got: %s", c.data.Event, c.subject, m.Subject)
+		}
+		for _, s := range c.body {
+			if !strings.Contains(m.Body, s) {
+				t.Errorf("%s body missing '%s':\n%s", c.data.Event, s, m.Body)
+			}
+		}
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify_templates")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	custom := `{{define "subject"}}[tasks] {{.Task.Title}} broke{{end}}{{define "body"}}{{.Task.Error}}{{end}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "failed.tmpl"), []byte(custom), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ts, err := LoadTemplates(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	m, err := ts.Render(&Data{Event: EventFailed, Task: finishedTask("broken", time.Minute, "oh no")}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if m.Subject != "[tasks] broken broke" || m.Body != "oh no\n" {
+		t.Errorf("custom template not used, got: %s\n%s", m.Subject, m.Body)
+	}
+	if ts[EventDigest] != DefaultTemplates[EventDigest] {
+		t.Errorf("expected events without a file to use the default template")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "digest.tmpl"), []byte(`{{define "subject"}}digest{{end}}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := LoadTemplates(dir); err == nil {
+		t.Errorf("expected a template without a body to error")
+	}
+}
+
+func TestSenderHandleEvent(t *testing.T) {
+	n := &LogNotifier{}
+	s := &Sender{Notifier: n, To: []string{"ops@example.com"}, SucceededAfter: time.Hour}
+
+	subtask := finishedTask("subtask", time.Minute, "oh no")
+	subtask.ParentId = "parent"
+
+	s.HandleEvent(finishedTask("quick", time.Minute, ""), &tasks.TaskEvent{Type: tasks.EventSucceeded})
+	s.HandleEvent(subtask, &tasks.TaskEvent{Type: tasks.EventFailed})
+	s.HandleEvent(finishedTask("running", time.Minute, ""), &tasks.TaskEvent{Type: tasks.EventStarted})
+	s.HandleEvent(finishedTask("broken", time.Minute, "oh no"), &tasks.TaskEvent{Type: tasks.EventFailed})
+	s.HandleEvent(finishedTask("slow", 2*time.Hour, ""), &tasks.TaskEvent{Type: tasks.EventSucceeded})
+
+	ms := waitForMessages(t, n, 2)
+	time.Sleep(20 * time.Millisecond)
+	if ms = n.Messages(); len(ms) != 2 {
+		t.Fatalf("expected 2 messages, got: %d", len(ms))
+	}
+
+	subjects := map[string]bool{}
+	for _, m := range ms {
+		subjects[m.Subject] = true
+		if len(m.To) != 1 || m.To[0] != "ops@example.com" {
+			t.Errorf("recipient mismatch: %v", m.To)
+		}
+	}
+	for _, expect := range []string{"Task failed: broken", "Task succeeded: slow"} {
+		if !subjects[expect] {
+			t.Errorf("expected a '%s' message", expect)
+		}
+	}
+}
+
+func TestReadDigest(t *testing.T) {
+	store := datastore.NewMapDatastore()
+	tasks.RegisterTaskdef("notify-test", func() tasks.Taskable { return &nopTask{} })
+
+	until := time.Now()
+	since := until.Add(-24 * time.Hour)
+	old := until.Add(-48 * time.Hour)
+
+	cancelled := finishedTask("cancelled", time.Minute, tasks.ErrTaskCancelled.Error())
+	ancient := finishedTask("ancient", time.Minute, "")
+	ancient.Succeeded = &old
+	active := &tasks.Task{Title: "active"}
+	subtask := finishedTask("subtask", time.Minute, "")
+	subtask.ParentId = "parent"
+
+	for _, task := range []*tasks.Task{
+		finishedTask("ok", time.Minute, ""),
+		finishedTask("also ok", time.Minute, ""),
+		finishedTask("broken", time.Minute, "oh no"),
+		cancelled, ancient, active, subtask,
+	} {
+		task.Id, task.Type = "", "notify-test"
+		if err := task.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	d, err := ReadDigest(store, since, until.Add(time.Second))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if d.Succeeded != 2 || len(d.Failed) != 1 || d.Cancelled != 1 || d.Active != 1 {
+		t.Errorf("digest mismatch. expected 2 succeeded, 1 failed, 1 cancelled, 1 active. got: %d, %d, %d, %d", d.Succeeded, len(d.Failed), d.Cancelled, d.Active)
+	}
+}
+
+type nopTask struct{}
+
+func (nopTask) Valid() error               { return nil }
+func (nopTask) Do(pch chan tasks.Progress) { pch <- tasks.Progress{Done: true} }
+
+func TestPostmarkNotifier(t *testing.T) {
+	var got map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Postmark-Server-Token") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"ErrorCode":10,"Message":"bad token"}`))
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"ErrorCode":0,"Message":"OK"}`))
+	}))
+	defer srv.Close()
+
+	prev := PostmarkEndpoint
+	PostmarkEndpoint = srv.URL
+	defer func() { PostmarkEndpoint = prev }()
+
+	m := &Message{Event: EventFailed, To: []string{"a@example.com", "b@example.com"}, Subject: "subject", Body: "body"}
+	if err := (PostmarkNotifier{Key: "key", From: "tasks@example.com"}).Notify(m); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got["To"] != "a@example.com,b@example.com" || got["Subject"] != "subject" || got["TextBody"] != "body" || got["Tag"] != "failed" {
+		t.Errorf("unexpected email: %v", got)
+	}
+
+	if err := (PostmarkNotifier{Key: "wrong", From: "tasks@example.com"}).Notify(m); err == nil || !strings.Contains(err.Error(), "bad token") {
+		t.Errorf("expected postmark error, got: %v", err)
+	}
+}
+
+func TestSMTPEmail(t *testing.T) {
+	n := SMTPNotifier{From: "tasks@example.com"}
+	m := &Message{To: []string{"a@example.com", "b@example.com"}, Subject: "subject", Body: "line one\nline two\n"}
+	email := string(n.email(m, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	expect := "From: tasks@example.com\r\nTo: a@example.com, b@example.com\r\nSubject: subject\r\nDate: Sun, 01 Jan 2017 00:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nline one\r\nline two\r\n"
+	if email != expect {
+		t.Errorf("email mismatch. expected:\n%q\ngot:\n%q", expect, email)
+	}
+}
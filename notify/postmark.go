@@ -0,0 +1,83 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// PostmarkEndpoint is the postmark api for sending a single email
+var PostmarkEndpoint = "https://api.postmarkapp.com/email"
+
+// PostmarkNotifier sends messages as email through the postmark
+// transactional email service, postmarkapp.com
+type PostmarkNotifier struct {
+	// postmark server token
+	Key string
+	// sender address, must be a verified postmark sender
+	From string
+	// Client sends requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+type postmarkEmail struct {
+	From     string
+	To       string
+	Subject  string
+	Tag      string
+	TextBody string
+}
+
+// postmarkResponse is the body postmark responds with
+type postmarkResponse struct {
+	ErrorCode int
+	Message   string
+}
+
+// Notify fulfills the Notifier interface
+func (n PostmarkNotifier) Notify(m *Message) error {
+	if n.Key == "" {
+		return fmt.Errorf("missing postmark key for sending email")
+	}
+	if len(m.To) == 0 {
+		return fmt.Errorf("message has no recipients")
+	}
+
+	body, err := json.Marshal(&postmarkEmail{
+		From:     n.From,
+		To:       strings.Join(m.To, ","),
+		Subject:  m.Subject,
+		Tag:      string(m.Event),
+		TextBody: m.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", PostmarkEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Postmark-Server-Token", n.Key)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	cli := n.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	res, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	pr := &postmarkResponse{}
+	json.NewDecoder(res.Body).Decode(pr)
+	if res.StatusCode != http.StatusOK || pr.ErrorCode != 0 {
+		return fmt.Errorf("postmark error %d (%s): %s", pr.ErrorCode, res.Status, pr.Message)
+	}
+	return nil
+}
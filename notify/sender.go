@@ -0,0 +1,78 @@
+package notify
+
+import (
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"time"
+)
+
+// Sender renders & sends notifications for task events
+type Sender struct {
+	Notifier Notifier
+	// templates to render messages with, DefaultTemplates if nil
+	Templates Templates
+	// addresses notifications are sent to
+	To []string
+	// root url of the api, for linking to tasks
+	UrlRoot string
+	// tasks that run at least this long notify when they succeed, zero
+	// disables success notifications
+	SucceededAfter time.Duration
+	// OnError is called with errors sending notifications from
+	// HandleEvent, optional
+	OnError func(err error)
+}
+
+// HandleEvent sends notifications for top-level tasks that fail, or succeed
+// after running for at least SucceededAfter. it's meant to be registered
+// with tasks.HandleEvents
+func (s *Sender) HandleEvent(t *tasks.Task, e *tasks.TaskEvent) {
+	// subtasks are reported by the task that spawned them
+	if t.ParentId != "" {
+		return
+	}
+
+	data := &Data{Duration: Duration(t), UrlRoot: s.UrlRoot}
+	switch e.Type {
+	case tasks.EventFailed:
+		data.Event = EventFailed
+	case tasks.EventSucceeded:
+		if s.SucceededAfter <= 0 || data.Duration < s.SucceededAfter {
+			return
+		}
+		data.Event = EventSucceeded
+	default:
+		return
+	}
+
+	// copy the task, t may change once HandleEvent returns
+	task := *t
+	data.Task = &task
+	go func() {
+		if err := s.Send(data); err != nil && s.OnError != nil {
+			s.OnError(err)
+		}
+	}()
+}
+
+// SendDigest sends a summary of tasks that finished between since & until
+func (s *Sender) SendDigest(store datastore.Datastore, since, until time.Time) error {
+	d, err := ReadDigest(store, since, until)
+	if err != nil {
+		return err
+	}
+	return s.Send(&Data{Event: EventDigest, Digest: d, UrlRoot: s.UrlRoot})
+}
+
+// Send renders & sends a notification
+func (s *Sender) Send(data *Data) error {
+	ts := s.Templates
+	if ts == nil {
+		ts = DefaultTemplates
+	}
+	m, err := ts.Render(data, s.To)
+	if err != nil {
+		return err
+	}
+	return s.Notifier.Notify(m)
+}
@@ -0,0 +1,52 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPNotifier sends messages as plain text email through an SMTP server
+type SMTPNotifier struct {
+	// server address as host:port
+	Addr string
+	// credentials for PLAIN auth, no auth is attempted if Username is empty
+	Username string
+	Password string
+	// sender address
+	From string
+}
+
+// Notify fulfills the Notifier interface
+func (n SMTPNotifier) Notify(m *Message) error {
+	if len(m.To) == 0 {
+		return fmt.Errorf("message has no recipients")
+	}
+
+	var a smtp.Auth
+	if n.Username != "" {
+		host, _, err := net.SplitHostPort(n.Addr)
+		if err != nil {
+			return err
+		}
+		a = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+	return smtp.SendMail(n.Addr, a, n.From, m.To, n.email(m, time.Now()))
+}
+
+// email formats m as an RFC 5322 message
+func (n SMTPNotifier) email(m *Message, date time.Time) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", n.From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
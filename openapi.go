@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/datatogether/task_mgmt/health"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/datatogether/task_mgmt/webhooks"
+	"net/http"
+)
+
+// OpenAPIHandler serves an OpenAPI 3 description of the api. it's
+// generated on each request, so taskdefs registered at startup are
+// included
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	data, err := json.MarshalIndent(newOpenAPIDoc(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// openAPIDoc is the root of an OpenAPI document
+type openAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       map[string]string                       `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+	Security   []map[string][]string                   `json:"security"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*tasks.Schema     `json:"schemas"`
+	SecuritySchemes map[string]map[string]string `json:"securitySchemes"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	// Security overrides the document's security, an empty list for
+	// routes that don't authenticate
+	Security *[]map[string][]string `json:"security,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string        `json:"name"`
+	In          string        `json:"in"`
+	Description string        `json:"description,omitempty"`
+	Required    bool          `json:"required,omitempty"`
+	Schema      *tasks.Schema `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                              `json:"required,omitempty"`
+	Content  map[string]map[string]interface{} `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                            `json:"description"`
+	Content     map[string]map[string]interface{} `json:"content,omitempty"`
+}
+
+// openAPIRef refers to a schema in the document's components
+func openAPIRef(name string) *tasks.Schema {
+	return &tasks.Schema{Ref: "#/components/schemas/" + name}
+}
+
+// openAPIArray is an array of a component schema
+func openAPIArray(name string) *tasks.Schema {
+	return &tasks.Schema{Type: "array", Items: openAPIRef(name)}
+}
+
+// openAPIEnvelope describes a response written with apiutil.WriteResponse,
+// WriteMessageResponse or WritePageResponse, with data in the "data" field
+func openAPIEnvelope(description string, data *tasks.Schema, page bool) *openAPIResponse {
+	env := &tasks.Schema{
+		Type:       "object",
+		Properties: map[string]*tasks.Schema{"meta": openAPIRef("Meta"), "data": data},
+	}
+	if page {
+		env.Properties["pagination"] = openAPIRef("Pagination")
+	}
+	return &openAPIResponse{
+		Description: description,
+		Content:     map[string]map[string]interface{}{"application/json": {"schema": env}},
+	}
+}
+
+// openAPIError describes a response written with apiutil.WriteErrResponse
+func openAPIError(description string) *openAPIResponse {
+	return &openAPIResponse{
+		Description: description,
+		Content:     map[string]map[string]interface{}{"application/json": {"schema": openAPIRef("Error")}},
+	}
+}
+
+// openAPIContent describes a response that isn't json
+func openAPIContent(description, contentType string) *openAPIResponse {
+	return &openAPIResponse{
+		Description: description,
+		Content:     map[string]map[string]interface{}{contentType: {"schema": &tasks.Schema{Type: "string"}}},
+	}
+}
+
+// openAPIJSONBody describes a json request body
+func openAPIJSONBody(s *tasks.Schema, required bool) *openAPIBody {
+	return &openAPIBody{Required: required, Content: map[string]map[string]interface{}{"application/json": {"schema": s}}}
+}
+
+// openAPIResponses adds the errors every authenticated api route can respond with
+func openAPIResponses(ok *openAPIResponse, errs map[string]string) map[string]*openAPIResponse {
+	rs := map[string]*openAPIResponse{
+		"200": ok,
+		"401": openAPIError("credentials are invalid, or missing when REQUIRE_AUTH is set"),
+		"500": openAPIError("internal error"),
+	}
+	for code, description := range errs {
+		rs[code] = openAPIError(description)
+	}
+	return rs
+}
+
+func openAPIPathParam(name, description string) *openAPIParameter {
+	return &openAPIParameter{Name: name, In: "path", Description: description, Required: true, Schema: &tasks.Schema{Type: "string"}}
+}
+
+func openAPIQueryParam(name, typ, description string) *openAPIParameter {
+	return &openAPIParameter{Name: name, In: "query", Description: description, Schema: &tasks.Schema{Type: typ}}
+}
+
+var openAPIPageParams = []*openAPIParameter{
+	openAPIQueryParam("page", "integer", "page number, starting at 1"),
+	openAPIQueryParam("pageSize", "integer", "number of results per page, defaults to 100"),
+}
+
+// openAPINoAuth is the security of routes that don't authenticate
+var openAPINoAuth = &[]map[string][]string{}
+
+// taskdefSchemaName is the component name of a taskdef's params schema
+func taskdefSchemaName(name string) string {
+	return "TaskParams." + name
+}
+
+// openAPIComponentSchemas derives schemas for the types the api reads &
+// writes, and the params of each registered taskdef
+func openAPIComponentSchemas() map[string]*tasks.Schema {
+	task := tasks.SchemaOf(&tasks.Task{})
+	task.Properties["progress"] = openAPIRef("Progress")
+
+	schemas := map[string]*tasks.Schema{
+		"Task":         task,
+		"Progress":     tasks.SchemaOf(&tasks.Progress{}),
+		"TaskEvent":    tasks.SchemaOf(&tasks.TaskEvent{}),
+		"Worker":       tasks.SchemaOf(&tasks.Worker{}),
+		"UsageReport":  tasks.SchemaOf(&tasks.UsageReport{}),
+		"Subscription": tasks.SchemaOf(&webhooks.Subscription{}),
+		"Delivery":     tasks.SchemaOf(&webhooks.Delivery{}),
+		"HealthReport": tasks.SchemaOf(&health.Report{}),
+		"CloneRequest": tasks.SchemaOf(&cloneTaskRequest{}),
+		"Meta": {
+			Type: "object",
+			Properties: map[string]*tasks.Schema{
+				"code":    {Type: "integer"},
+				"message": {Type: "string"},
+			},
+		},
+		"Error": {
+			Type: "object",
+			Properties: map[string]*tasks.Schema{
+				"meta": {
+					Type: "object",
+					Properties: map[string]*tasks.Schema{
+						"code":  {Type: "integer"},
+						"error": {Type: "string"},
+					},
+				},
+			},
+		},
+		"Pagination": {
+			Type:       "object",
+			Properties: map[string]*tasks.Schema{"nextUrl": {Type: "string"}},
+		},
+	}
+
+	// submissions are a task's title, type, params & callback url. params
+	// depend on the type
+	enqueue := &tasks.Schema{
+		Type: "object",
+		Properties: map[string]*tasks.Schema{
+			"title":       {Type: "string"},
+			"type":        {Type: "string", Enum: tasks.RegisteredTaskdefs()},
+			"params":      {Type: "object"},
+			"callbackUrl": {Type: "string", Format: "uri"},
+		},
+		Required: []string{"type"},
+	}
+	for _, name := range tasks.RegisteredTaskdefs() {
+		s, err := tasks.TaskdefSchema(name)
+		if err != nil {
+			continue
+		}
+		s.Schema = ""
+		schemas[taskdefSchemaName(name)] = s
+		enqueue.OneOf = append(enqueue.OneOf, &tasks.Schema{
+			Properties: map[string]*tasks.Schema{
+				"type":   {Const: name},
+				"params": openAPIRef(taskdefSchemaName(name)),
+			},
+		})
+	}
+	schemas["EnqueueRequest"] = enqueue
+
+	return schemas
+}
+
+// newOpenAPIDoc describes the routes served by NewServerRoutes, other than
+// the dashboard & static files
+func newOpenAPIDoc() *openAPIDoc {
+	taskId := openAPIPathParam("id", "task id")
+	webhookId := openAPIPathParam("id", "webhook subscription id")
+	taskErrs := map[string]string{"403": "policies don't permit the action", "404": "task not found"}
+
+	paths := map[string]map[string]*openAPIOperation{
+		"/healthz": {
+			"get": {
+				Summary:   "liveness check, ok while the process is running",
+				Responses: map[string]*openAPIResponse{"200": openAPIContent("the process is running", "text/plain")},
+				Security:  openAPINoAuth,
+			},
+		},
+		"/healthcheck": {
+			"get": {
+				Summary:   "alias of /healthz",
+				Responses: map[string]*openAPIResponse{"200": openAPIContent("the process is running", "text/plain")},
+				Security:  openAPINoAuth,
+			},
+		},
+		"/readyz": {
+			"get": {
+				Summary: "readiness check, reports each dependency",
+				Responses: map[string]*openAPIResponse{
+					"200": {Description: "ready to accept work", Content: map[string]map[string]interface{}{"application/json": {"schema": openAPIRef("HealthReport")}}},
+					"503": {Description: "a dependency is unavailable, or the process is draining", Content: map[string]map[string]interface{}{"application/json": {"schema": openAPIRef("HealthReport")}}},
+				},
+				Security: openAPINoAuth,
+			},
+		},
+		"/metrics": {
+			"get": {
+				Summary:   "prometheus metrics",
+				Responses: map[string]*openAPIResponse{"200": openAPIContent("metrics in the prometheus text format", "text/plain")},
+				Security:  openAPINoAuth,
+			},
+		},
+		"/openapi.json": {
+			"get": {
+				Summary:   "this document",
+				Responses: map[string]*openAPIResponse{"200": {Description: "an OpenAPI 3 document", Content: map[string]map[string]interface{}{"application/json": {"schema": &tasks.Schema{Type: "object"}}}}},
+				Security:  openAPINoAuth,
+			},
+		},
+		"/tasks": {
+			"get": {
+				Summary:    "list tasks, newest first",
+				Parameters: openAPIPageParams,
+				Responses:  openAPIResponses(openAPIEnvelope("tasks the user can read", openAPIArray("Task"), true), nil),
+			},
+			"post": {
+				Summary:     "submit a task",
+				RequestBody: openAPIJSONBody(openAPIRef("EnqueueRequest"), true),
+				Responses: openAPIResponses(openAPIEnvelope("the enqueued task, or the task it coalesced into", openAPIRef("Task"), false), map[string]string{
+					"400": "invalid task",
+					"403": "policies don't permit submitting the task type",
+					"429": "submitting the task would exceed a quota",
+				}),
+			},
+		},
+		"/tasks/{id}": {
+			"get": {
+				Summary:    "read a task",
+				Parameters: []*openAPIParameter{taskId},
+				Responses:  openAPIResponses(openAPIEnvelope("the task", openAPIRef("Task"), false), taskErrs),
+			},
+		},
+		"/tasks/{id}/cancel": {
+			"post": {
+				Summary:    "cancel an unfinished task & it's unfinished subtasks",
+				Parameters: []*openAPIParameter{taskId},
+				Responses:  openAPIResponses(openAPIEnvelope("the cancelled task", openAPIRef("Task"), false), map[string]string{"400": "the task has finished", "403": taskErrs["403"], "404": taskErrs["404"]}),
+			},
+		},
+		"/tasks/{id}/retry": {
+			"post": {
+				Summary:    "send a failed task back to the queue",
+				Parameters: []*openAPIParameter{taskId},
+				Responses:  openAPIResponses(openAPIEnvelope("the re-enqueued task", openAPIRef("Task"), false), map[string]string{"400": "the task hasn't failed", "403": taskErrs["403"], "404": taskErrs["404"]}),
+			},
+		},
+		"/tasks/{id}/clone": {
+			"post": {
+				Summary:     "submit a new task with a task's type & params",
+				Parameters:  []*openAPIParameter{taskId},
+				RequestBody: openAPIJSONBody(openAPIRef("CloneRequest"), false),
+				Responses:   openAPIResponses(openAPIEnvelope("the new task", openAPIRef("Task"), false), map[string]string{"400": "invalid task", "403": taskErrs["403"], "404": taskErrs["404"], "429": "submitting the task would exceed a quota"}),
+			},
+		},
+		"/tasks/{id}/events": {
+			"get": {
+				Summary:    "a task's event log, oldest first",
+				Parameters: []*openAPIParameter{taskId},
+				Responses:  openAPIResponses(openAPIEnvelope("the task's events", openAPIArray("TaskEvent"), false), taskErrs),
+			},
+		},
+		"/tasks/{id}/stream": {
+			"get": {
+				Summary:    "stream updates to a task as server-sent events",
+				Parameters: []*openAPIParameter{taskId},
+				Responses:  openAPIResponses(openAPIContent("\"task\" events with the task encoded as json in their data, until the task finishes", "text/event-stream"), taskErrs),
+			},
+		},
+		"/tasks/retry": {
+			"post": {
+				Summary: "re-enqueue failed tasks",
+				Parameters: []*openAPIParameter{
+					openAPIQueryParam("type", "string", "only retry tasks of this type"),
+					openAPIQueryParam("since", "string", "only retry tasks that failed since a duration ago (eg: 2h), or an RFC3339 timestamp"),
+				},
+				Responses: openAPIResponses(openAPIEnvelope("the re-enqueued tasks", openAPIArray("Task"), false), map[string]string{"400": "invalid since"}),
+			},
+		},
+		"/workers": {
+			"get": {
+				Summary:    "list registered workers",
+				Parameters: openAPIPageParams,
+				Responses:  openAPIResponses(openAPIEnvelope("registered workers", openAPIArray("Worker"), true), nil),
+			},
+		},
+		"/users/{id}/usage": {
+			"get": {
+				Summary:    "a user's usage toward their quotas",
+				Parameters: []*openAPIParameter{openAPIPathParam("id", "user id")},
+				Responses:  openAPIResponses(openAPIEnvelope("the user's usage", openAPIRef("UsageReport"), false), map[string]string{"403": "only admins can view other users' usage"}),
+			},
+		},
+		"/webhooks": {
+			"get": {
+				Summary:   "list webhook subscriptions",
+				Responses: openAPIResponses(openAPIEnvelope("subscriptions", openAPIArray("Subscription"), false), map[string]string{"403": "only admins can manage webhooks"}),
+			},
+			"post": {
+				Summary:     "subscribe a url to task events",
+				RequestBody: openAPIJSONBody(openAPIRef("Subscription"), true),
+				Responses:   openAPIResponses(openAPIEnvelope("the subscription, including it's secret", openAPIRef("Subscription"), false), map[string]string{"400": "invalid subscription", "403": "only admins can manage webhooks"}),
+			},
+		},
+		"/webhooks/{id}": {
+			"get": {
+				Summary:    "read a webhook subscription",
+				Parameters: []*openAPIParameter{webhookId},
+				Responses:  openAPIResponses(openAPIEnvelope("the subscription", openAPIRef("Subscription"), false), map[string]string{"403": "only admins can manage webhooks", "404": "subscription not found"}),
+			},
+			"delete": {
+				Summary:    "delete a webhook subscription",
+				Parameters: []*openAPIParameter{webhookId},
+				Responses:  openAPIResponses(openAPIEnvelope("the deleted subscription", openAPIRef("Subscription"), false), map[string]string{"403": "only admins can manage webhooks", "404": "subscription not found"}),
+			},
+		},
+		"/webhooks/{id}/deliveries": {
+			"get": {
+				Summary:    "recent deliveries to a subscription, newest first",
+				Parameters: append([]*openAPIParameter{webhookId}, openAPIPageParams...),
+				Responses:  openAPIResponses(openAPIEnvelope("deliveries", openAPIArray("Delivery"), true), map[string]string{"403": "only admins can manage webhooks", "404": "subscription not found"}),
+			},
+		},
+		"/webhooks/{id}/test": {
+			"post": {
+				Summary:    "send a test event to a subscription",
+				Parameters: []*openAPIParameter{webhookId},
+				Responses:  openAPIResponses(openAPIEnvelope("the test delivery", openAPIRef("Delivery"), false), map[string]string{"403": "only admins can manage webhooks", "404": "subscription not found"}),
+			},
+		},
+		"/rpc": {
+			"post": {
+				Summary: "call TaskRequests methods with JSON-RPC 1.0, eg: TaskRequests.Get",
+				RequestBody: openAPIJSONBody(&tasks.Schema{
+					Type: "object",
+					Properties: map[string]*tasks.Schema{
+						"method": {Type: "string"},
+						"params": {Type: "array"},
+						"id":     {},
+					},
+					Required: []string{"method", "params", "id"},
+				}, true),
+				Responses: map[string]*openAPIResponse{
+					"200": {Description: "the call's result or error", Content: map[string]map[string]interface{}{"application/json": {"schema": &tasks.Schema{
+						Type: "object",
+						Properties: map[string]*tasks.Schema{
+							"result": {},
+							"error":  {},
+							"id":     {},
+						},
+					}}}},
+					"401": openAPIError("credentials are invalid, or missing when REQUIRE_AUTH is set"),
+				},
+			},
+		},
+		"/ipfs/add": {
+			"post": {
+				Summary:    "submit an ipfs.addurl task for a url",
+				Parameters: []*openAPIParameter{{Name: "url", In: "query", Required: true, Schema: &tasks.Schema{Type: "string", Format: "uri"}}},
+				Responses: openAPIResponses(openAPIEnvelope("the enqueued task, or the task it coalesced into", openAPIRef("Task"), false), map[string]string{
+					"400": "invalid task",
+					"403": "policies don't permit submitting ipfs.addurl tasks",
+					"429": "submitting the task would exceed a quota",
+				}),
+			},
+		},
+	}
+
+	return &openAPIDoc{
+		OpenAPI: "3.1.0",
+		Info: map[string]string{
+			"title":       "task_mgmt",
+			"description": "manage tasks, their queues & workers. responses are wrapped in an envelope with a \"meta\" object, & \"data\"",
+			"version":     "0.1.0",
+		},
+		Paths: paths,
+		Components: openAPIComponents{
+			Schemas: openAPIComponentSchemas(),
+			SecuritySchemes: map[string]map[string]string{
+				"apiKey": {"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+				"bearer": {"type": "http", "scheme": "bearer", "description": "an api key, or a JWT signed by PUBLIC_KEY"},
+			},
+		},
+		// credentials are optional unless REQUIRE_AUTH is set
+		Security: []map[string][]string{{}, {"apiKey": {}}, {"bearer": {}}},
+	}
+}
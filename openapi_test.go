@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/datatogether/task_mgmt/tasks"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// undocumentedRoutes aren't part of the api, so they're left out of the
+// openapi document
+var undocumentedRoutes = map[string]bool{
+	"/":                            true,
+	"/.well-known/acme-challenge/": true,
+	"/dashboard":                   true,
+	"/dashboard/":                  true,
+	"/dashboard/login":             true,
+	"/dashboard/logout":            true,
+	"/dashboard/static/":           true,
+	"/js/":                         true,
+	"/css/":                        true,
+}
+
+// routePatterns reads the patterns NewServerRoutes registers from it's
+// source, as a ServeMux can't list them
+func routePatterns(t *testing.T) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), "server.go", nil, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	patterns := []string{}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Name.Name != "NewServerRoutes" {
+			continue
+		}
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || (sel.Sel.Name != "Handle" && sel.Sel.Name != "HandleFunc") {
+				return true
+			}
+			if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if p, err := strconv.Unquote(lit.Value); err == nil {
+					patterns = append(patterns, p)
+				}
+			}
+			return true
+		})
+	}
+	if len(patterns) == 0 {
+		t.Fatal("no routes found in NewServerRoutes")
+	}
+	return patterns
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := newOpenAPIDoc()
+	patterns := routePatterns(t)
+
+	// every api route is described
+	for _, p := range patterns {
+		if undocumentedRoutes[p] {
+			continue
+		}
+		described := false
+		for path := range doc.Paths {
+			if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+				described = true
+				break
+			}
+		}
+		if !described {
+			t.Errorf("route %s isn't described by the openapi document, describe it in newOpenAPIDoc or add it to undocumentedRoutes", p)
+		}
+	}
+
+	// every described path is routed
+	registered := map[string]bool{}
+	for _, p := range patterns {
+		registered[p] = true
+	}
+	m := NewServerRoutes()
+	params := regexp.MustCompile(`\{[^}]+\}`)
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			req := httptest.NewRequest(strings.ToUpper(method), params.ReplaceAllString(path, "abc"), nil)
+			if _, pattern := m.Handler(req); pattern == "/" || !registered[pattern] || undocumentedRoutes[pattern] {
+				t.Errorf("%s %s is described, but routed by '%s'", strings.ToUpper(method), path, pattern)
+			}
+		}
+	}
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	configureTasks()
+	doc := newOpenAPIDoc()
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	refs := regexp.MustCompile(`"\$ref":"#/components/schemas/([^"]+)"`).FindAllSubmatch(data, -1)
+	if len(refs) == 0 {
+		t.Fatal("expected schemas to be referenced")
+	}
+	for _, ref := range refs {
+		if doc.Components.Schemas[string(ref[1])] == nil {
+			t.Errorf("reference to undefined schema: %s", ref[1])
+		}
+	}
+
+	names := tasks.RegisteredTaskdefs()
+	if len(names) == 0 {
+		t.Fatal("expected registered taskdefs")
+	}
+	for _, name := range names {
+		if doc.Components.Schemas[taskdefSchemaName(name)] == nil {
+			t.Errorf("expected a params schema for %s", name)
+		}
+	}
+	if n := len(doc.Components.Schemas["EnqueueRequest"].OneOf); n != len(names) {
+		t.Errorf("expected enqueue requests to have params for %d task types, got: %d", len(names), n)
+	}
+	if doc.Components.Schemas["Task"].Properties["progress"].Ref != "#/components/schemas/Progress" {
+		t.Errorf("expected tasks to refer to the progress schema")
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewServerRoutes().ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got: %d", w.Code)
+	}
+
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err.Error())
+	}
+	if doc["openapi"] != "3.1.0" {
+		t.Errorf("expected an openapi 3.1 document, got: %v", doc["openapi"])
+	}
+}
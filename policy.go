@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/datatogether/task_mgmt/auth"
+)
+
+// runPolicy is the policy command for managing role policies, eg:
+// "task_mgmt policy grant -user alice -type sb.addCatalogTree -role admin"
+func runPolicy(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: task_mgmt policy grant|revoke|list")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("policy", flag.ExitOnError)
+	userId := fs.String("user", "", "id of the user the policy applies to, \"*\" for everyone")
+	taskType := fs.String("type", auth.Wildcard, "task type the policy applies to, \"*\" for all types")
+	roleName := fs.String("role", "", "role to grant: viewer, submitter or admin")
+	fs.Parse(args[1:])
+
+	loadConfig()
+	if err := connectStore(&auth.Policy{}); err != nil {
+		return err
+	}
+
+	switch action {
+	case "grant":
+		if *userId == "" {
+			return fmt.Errorf("-user is required")
+		}
+		role, err := auth.ParseRole(*roleName)
+		if err != nil {
+			return err
+		}
+		p := auth.NewPolicy(*userId, *taskType, role)
+		if err := p.Save(store); err != nil {
+			return err
+		}
+		fmt.Printf("granted %s %s on %s tasks\n", p.UserId, p.Role, p.TaskType)
+	case "revoke":
+		if *userId == "" {
+			return fmt.Errorf("-user is required")
+		}
+		p := auth.NewPolicy(*userId, *taskType, auth.RoleNone)
+		if err := p.Delete(store); err != nil {
+			return fmt.Errorf("error revoking policy for %s on %s tasks: %s", *userId, *taskType, err.Error())
+		}
+		fmt.Printf("revoked policy for %s on %s tasks\n", *userId, *taskType)
+	case "list":
+		ps, err := auth.ReadPolicies(store, *userId)
+		if err != nil {
+			return err
+		}
+		for _, p := range ps {
+			fmt.Printf("%-20s\t%-25s\t%s\n", p.UserId, p.TaskType, p.Role)
+		}
+	default:
+		return fmt.Errorf("unknown policy command: %s", action)
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package main
 
 import (
 	"database/sql"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
 	_ "github.com/lib/pq"
 )
 
@@ -34,6 +36,16 @@ func connectToAppDb() {
 	}
 }
 
+// connectStore connects the datastore to the app db for one-off
+// commands, registering only the given models
+func connectStore(models ...sql_datastore.Model) error {
+	if err := sqlutil.ConnectToDb("postgres", cfg.PostgresDbUrl, appDB); err != nil {
+		return err
+	}
+	sql_datastore.SetDB(appDB)
+	return store.Register(models...)
+}
+
 // Sets up a connection with a given postgres db connection string
 func SetupConnection(connString string) (db *sql.DB, err error) {
 	db, err = sql.Open("postgres", connString)
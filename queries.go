@@ -25,3 +25,9 @@ UPDATE repos SET
 WHERE id = $1;`
 
 const qRepoDelete = `DELETE FROM repos WHERE id = $1;`
+
+// qNotifyDigestClaim records a digest as sent, inserting nothing if it
+// already was
+const qNotifyDigestClaim = `
+INSERT INTO notify_digests (period_end) VALUES ($1)
+ON CONFLICT DO NOTHING;`
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/task_mgmt/auth"
+	"github.com/datatogether/task_mgmt/tasks"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// quotas are the configured submission limits, set by loadConfig
+var quotas []tasks.QuotaRule
+
+// quotaRules parses configured quota rules, skipping invalid rules
+func quotaRules() []tasks.QuotaRule {
+	rules := []tasks.QuotaRule{}
+	for _, s := range cfg.QuotaRules {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		r, err := tasks.ParseQuotaRule(s)
+		if err != nil {
+			log.Infof("invalid quota rule: %s", err.Error())
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// writeQuotaError writes a 429 response for quota errors & a 500 for any
+// other error, returning false if err isn't nil
+func writeQuotaError(w http.ResponseWriter, err error) bool {
+	if qe, ok := err.(*tasks.QuotaError); ok {
+		if qe.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(qe.RetryAfter.Seconds()))))
+		}
+		apiutil.WriteErrResponse(w, http.StatusTooManyRequests, err)
+		return false
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return false
+	}
+	return true
+}
+
+// UserUsageHandler reports a user's usage toward their quotas, eg:
+// GET /users/alice/usage. When policies are enforced users can only see their
+// own usage, unless they're an admin for all task types
+func UserUsageHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path[len("/users/"):], "/"), "/")
+	if r.Method != "GET" || len(parts) != 2 || parts[1] != "usage" {
+		NotFoundHandler(w, r)
+		return
+	}
+	userId := parts[0]
+
+	if cfg.EnforcePolicies && userId != requestUserId(r) {
+		policies, err := auth.ReadPolicies(store, requestUserId(r))
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		if policies.Role(requestUserId(r), auth.Wildcard) < auth.RoleAdmin {
+			apiutil.WriteErrResponse(w, http.StatusForbidden, fmt.Errorf("%s: only admins can view other users' usage", auth.ErrForbidden.Error()))
+			return
+		}
+	}
+
+	report, err := tasks.ReadUsage(store, quotas, userId, time.Now())
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	apiutil.WriteResponse(w, report)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/datatogether/task_mgmt/tasks"
 	"github.com/garyburd/redigo/redis"
+	"strings"
 )
 
 // Main redis connection
@@ -18,8 +19,10 @@ func connectRedis() (err error) {
 	}
 
 	rpool = redis.NewPool(func() (redis.Conn, error) {
-		c, err := redis.Dial("tcp", cfg.RedisUrl)
-		return c, err
+		if strings.HasPrefix(cfg.RedisUrl, "redis://") {
+			return redis.DialURL(cfg.RedisUrl)
+		}
+		return redis.Dial("tcp", cfg.RedisUrl)
 	}, 3)
 
 	return nil
@@ -42,3 +45,108 @@ func PublishTaskProgress(pool *redis.Pool, t *tasks.Task) error {
 	_, err = c.Do("PUBLISH", t.PubSubChannelName(), data)
 	return err
 }
+
+// SubscribeTaskProgress sends progress published for t to updates until
+// the returned cancel func is called
+func SubscribeTaskProgress(pool *redis.Pool, t *tasks.Task, updates chan<- []byte) (cancel func(), err error) {
+	if pool == nil {
+		return nil, ErrNoRedisConn
+	}
+
+	psc := redis.PubSubConn{Conn: pool.Get()}
+	if err := psc.Subscribe(t.PubSubChannelName()); err != nil {
+		psc.Close()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				select {
+				case updates <- v.Data:
+				case <-done:
+					return
+				}
+			case error:
+				// closing the connection unblocks Receive with an error
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		psc.Unsubscribe()
+		psc.Close()
+	}, nil
+}
+
+// broker carries updates from the tasks this process performs to
+// subscribers, nil if there's no way for updates to reach them
+var broker tasks.Broker
+
+// initBroker publishes task updates through redis if it's configured.
+// without redis updates only reach subscribers in the same process, which
+// is only useful if this process performs tasks
+func initBroker(performsTasks bool) {
+	if cfg.RedisUrl != "" {
+		broker = redisBroker{}
+	} else if performsTasks {
+		broker = tasks.NewMemBroker()
+	}
+}
+
+// publishTaskProgress publishes an update to t through the broker, if any
+func publishTaskProgress(t *tasks.Task) {
+	if broker == nil {
+		return
+	}
+	if err := broker.Publish(t); err != nil && err != ErrNoRedisConn {
+		log.Infoln(err.Error())
+	}
+}
+
+// redisBroker is a tasks.Broker backed by the redis channels
+// PublishTaskProgress publishes to
+type redisBroker struct{}
+
+func (redisBroker) Publish(t *tasks.Task) error {
+	return PublishTaskProgress(rpool, t)
+}
+
+func (redisBroker) Subscribe(taskId string) (<-chan *tasks.Task, func(), error) {
+	data := make(chan []byte)
+	cancelSub, err := SubscribeTaskProgress(rpool, &tasks.Task{Id: taskId}, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	updates := make(chan *tasks.Task)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case d := <-data:
+				t := &tasks.Task{}
+				if err := json.Unmarshal(d, t); err != nil {
+					log.Infof("error decoding task update: %s", err.Error())
+					continue
+				}
+				select {
+				case updates <- t:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return updates, func() {
+		close(done)
+		cancelSub()
+	}, nil
+}
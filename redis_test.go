@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/datatogether/task_mgmt/tasks"
+	"testing"
+	"time"
+)
+
+func TestRedisBroker(t *testing.T) {
+	if cfg.RedisUrl == "" {
+		t.Skip("REDIS_URL isn't set")
+	}
+	if err := connectRedis(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b := redisBroker{}
+	updates, cancel, err := b.Subscribe("redis-broker-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer cancel()
+
+	// the subscription is made asynchronously by the redis server, publish
+	// until an update arrives
+	published := &tasks.Task{Id: "redis-broker-test", Title: "broker test", Version: 3}
+	timeout := time.After(5 * time.Second)
+	for {
+		if err := b.Publish(published); err != nil {
+			t.Fatal(err.Error())
+		}
+		select {
+		case got := <-updates:
+			if got.Id != published.Id || got.Title != published.Title || got.Version != published.Version {
+				t.Errorf("update mismatch. expected: %v, got: %v", published, got)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out waiting for an update")
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/datatogether/task_mgmt/taskdefs/ipfs"
+	"github.com/datatogether/task_mgmt/tasks"
+	"strings"
+	"time"
+)
+
+// ipfsArchiver archives tasks to ipfs as a compressed ndjson file
+type ipfsArchiver struct {
+	apiUrl string
+}
+
+func (a ipfsArchiver) Archive(ts []*tasks.Task) error {
+	buf := &bytes.Buffer{}
+	if err := tasks.WriteNDJSON(buf, ts); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("tasks-%s.ndjson.gz", time.Now().UTC().Format("20060102T150405"))
+	hash, err := ipfs.WriteToIpfs(context.Background(), a.apiUrl, name, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	log.Infof("archived %d tasks to ipfs: %s", len(ts), hash)
+	return nil
+}
+
+// retentionRules parses configured retention rules, skipping invalid rules
+func retentionRules() []tasks.RetentionRule {
+	rules := []tasks.RetentionRule{}
+	for _, s := range cfg.RetentionRules {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		r, err := tasks.ParseRetentionRule(s)
+		if err != nil {
+			log.Infof("invalid retention rule: %s", err.Error())
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// startRetention periodically removes finished tasks that have outlived
+// the configured retention rules, exporting them first if configured
+func startRetention() {
+	rules := retentionRules()
+	if len(rules) == 0 {
+		return
+	}
+
+	var archiver tasks.Archiver
+	if cfg.RetentionExportIpfs {
+		archiver = ipfsArchiver{apiUrl: cfg.IpfsApiUrl}
+	} else if cfg.RetentionExportDir != "" {
+		archiver = tasks.NDJSONArchiver{Dir: cfg.RetentionExportDir}
+	}
+
+	interval := configDuration("RETENTION_INTERVAL", cfg.RetentionInterval, time.Hour)
+	go func() {
+		for range time.Tick(interval) {
+			// every node runs the schedule, but only one enforces it at a time
+			_, err := tryAdvisoryLock(context.Background(), appDB, lockRetention, func() error {
+				removed, err := tasks.EnforceRetention(store, rules, archiver)
+				if len(removed) > 0 {
+					log.Infof("removed %d expired tasks", len(removed))
+				}
+				return err
+			})
+			if err != nil {
+				log.Infof("retention error: %s", err.Error())
+			}
+		}
+	}()
+}
@@ -1,16 +1,59 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/task_mgmt/auth"
 	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/datatogether/task_mgmt/tracing"
+	"io"
 	"net"
+	"net/http"
 	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
 	"time"
 )
 
+// newTaskRequests configures TaskRequests for this server, RPC calls &
+// the dashboard both go through it
+func newTaskRequests() *tasks.TaskRequests {
+	taskRequests := &tasks.TaskRequests{
+		AmqpUrl: cfg.AmqpUrl,
+		Store:   store,
+		Quotas:  quotas,
+		Broker:  broker,
+	}
+	if cfg.EnforcePolicies {
+		taskRequests.Authorizer = &tasks.Authorizer{Store: store}
+	}
+	return taskRequests
+}
+
+// newRpcServer creates an RPC server with all request types registered
+func newRpcServer() (*rpc.Server, error) {
+	s := rpc.NewServer()
+	if err := s.Register(newTaskRequests()); err != nil {
+		log.Infof("register RPC Users error: %s", err)
+		return nil, err
+	}
+	// if err := s.Register(GroupsRequests); err != nil {
+	// 	log.Infof("register RPC Groups error: %s", err)
+	// 	return nil, err
+	// }
+	return s, nil
+}
+
 // if cfg.RpcPort is specified listenRpc opens up a
 // Remote Procedure call listener to communicate with
-// other servers
+// other servers. Connections are optionally secured with TLS
+// (mutual if cfg.RpcClientCa is set), and a shared-secret
+// handshake if cfg.RpcSecret is set. callers should check the
+// configuration with checkRpcConfig first
 func listenRpc() (err error) {
 	var ln net.Listener
 
@@ -19,18 +62,20 @@ func listenRpc() (err error) {
 		return nil
 	}
 
-	taskRequests := &tasks.TaskRequests{
-		AmqpUrl: cfg.AmqpUrl,
-		Store:   store,
-	}
-	if err := rpc.Register(taskRequests); err != nil {
-		log.Infof("register RPC Users error: %s", err)
+	server, err := newRpcServer()
+	if err != nil {
 		return err
 	}
-	// if err := rpc.Register(GroupsRequests); err != nil {
-	// 	log.Infof("register RPC Groups error: %s", err)
-	// 	return err
-	// }
+
+	var tlsConfig *tls.Config
+	if cfg.RpcTlsCert != "" {
+		if tlsConfig, err = auth.ServerTLSConfig(cfg.RpcTlsCert, cfg.RpcTlsKey, cfg.RpcClientCa); err != nil {
+			log.Infof("rpc tls configuration error: %s", err)
+			return err
+		}
+	} else if cfg.RpcClientCa != "" {
+		return fmt.Errorf("rpc client certificates require RPC_TLS_CERT & RPC_TLS_KEY")
+	}
 
 	for i := 0; i < 1000; i++ {
 		ln, err = net.Listen("tcp", fmt.Sprintf(":%s", cfg.RpcPort))
@@ -43,7 +88,159 @@ func listenRpc() (err error) {
 		break
 	}
 
-	log.Infof("accepting RPC requests on port %s", cfg.RpcPort)
-	rpc.Accept(ln)
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	log.Infof("accepting RPC requests on port %s (tls: %t, mutual tls: %t, secret: %t)", cfg.RpcPort, tlsConfig != nil, cfg.RpcClientCa != "", cfg.RpcSecret != "")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Infof("rpc accept error: %s", err)
+			return err
+		}
+		go serveRpcConn(server, conn)
+	}
+}
+
+// checkRpcConfig refuses rpc configurations that leave policies open to
+// bypass. rpc callers are trusted to act as any user, so when policies
+// are enforced they must be authenticated by certificate or secret. the
+// secret handshake only authenticates the start of a connection, so it
+// requires tls to keep the rest of it from being read or hijacked
+func checkRpcConfig() error {
+	if cfg.RpcPort == "" {
+		return nil
+	}
+	if cfg.RpcSecret != "" && cfg.RpcTlsCert == "" {
+		return fmt.Errorf("RPC_SECRET requires RPC_TLS_CERT & RPC_TLS_KEY")
+	}
+	if cfg.EnforcePolicies && cfg.RpcClientCa == "" && cfg.RpcSecret == "" {
+		return fmt.Errorf("enforcing policies over rpc requires RPC_CLIENT_CA or RPC_SECRET, or no RPC_PORT to disable rpc")
+	}
 	return nil
 }
+
+// serveRpcConn performs the handshake on a new connection if
+// configured, then serves RPC requests until the connection closes
+func serveRpcConn(server *rpc.Server, conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(auth.HandshakeTimeout))
+		err := tc.Handshake()
+		tc.SetDeadline(time.Time{})
+		if err != nil {
+			log.Infof("rpc tls handshake error from %s: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	if cfg.RpcSecret != "" {
+		if err := auth.ServerHandshake(conn, cfg.RpcSecret); err != nil {
+			log.Infof("rpc handshake error from %s: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	server.ServeConn(conn)
+}
+
+// jsonRpcRequest is a JSON-RPC 1.0 request, net/rpc methods take a
+// single params argument
+type jsonRpcRequest struct {
+	Method string                   `json:"method"`
+	Params []map[string]interface{} `json:"params"`
+	Id     *json.RawMessage         `json:"id"`
+}
+
+// httpRpcConn adapts a single http request & response to the
+// io.ReadWriteCloser a jsonrpc codec expects
+type httpRpcConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (c httpRpcConn) Close() error { return nil }
+
+// JSONRPCHandler serves RPC methods as JSON-RPC 1.0 over HTTP, eg:
+// POST /rpc {"method":"TaskRequests.Get","params":[{"Id":"..."}],"id":1}
+//
+// Requests made by an authenticated user act as that user. Otherwise
+// callers that present cfg.RpcSecret in an X-Rpc-Secret header are
+// trusted to set UserId in params, like RPC connections are. If neither
+// is true requests are anonymous
+func JSONRPCHandler(server *rpc.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			NotFoundHandler(w, r)
+			return
+		}
+
+		req := &jsonRpcRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("invalid JSON-RPC request: %s", err.Error()))
+			return
+		}
+		if len(req.Params) != 1 || req.Params[0] == nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("JSON-RPC requests must have exactly one params object"))
+			return
+		}
+
+		if id := auth.FromContext(r.Context()); id != nil {
+			setRpcUserId(req.Params[0], id.UserId)
+		} else if !trustedRpcCaller(r) {
+			setRpcUserId(req.Params[0], "")
+		}
+		setRpcTraceParent(req.Params[0], r.Header.Get(tracing.Header))
+
+		body, err := json.Marshal(req)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// errors calling a method, including unknown methods, are written as
+		// JSON-RPC error responses. only unreadable requests leave buf empty
+		var buf bytes.Buffer
+		codec := jsonrpc.NewServerCodec(httpRpcConn{Reader: bytes.NewReader(body), Writer: &buf})
+		if err := server.ServeRequest(codec); err != nil && buf.Len() == 0 {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		io.Copy(w, &buf)
+	}
+}
+
+// trustedRpcCaller reports weather r presents the rpc shared secret
+func trustedRpcCaller(r *http.Request) bool {
+	secret := r.Header.Get("X-Rpc-Secret")
+	return cfg.RpcSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(cfg.RpcSecret)) == 1
+}
+
+// setRpcUserId replaces the UserId field of JSON-RPC params. JSON field names
+// match case-insensitively, so all case variants are removed
+func setRpcUserId(params map[string]interface{}, userId string) {
+	for key := range params {
+		if strings.EqualFold(key, "UserId") {
+			delete(params, key)
+		}
+	}
+	params["UserId"] = userId
+}
+
+// setRpcTraceParent continues the trace from a traceparent header, unless
+// the request params carry their own
+func setRpcTraceParent(params map[string]interface{}, traceParent string) {
+	if traceParent == "" {
+		return
+	}
+	for key := range params {
+		if strings.EqualFold(key, "TraceParent") {
+			return
+		}
+	}
+	params["TraceParent"] = traceParent
+}
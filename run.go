@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/datatogether/task_mgmt/logging"
+	"github.com/datatogether/task_mgmt/source"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runLocal performs a single task in-process, without a queue. Tasks are
+// stored in memory unless -db is given, eg:
+// "task_mgmt run sb.addCatalogTree --params fixtures/catalog.json"
+func runLocal(args []string) error {
+	if len(args) == 0 || args[0] == "" || args[0][0] == '-' {
+		return fmt.Errorf("usage: task_mgmt run <type> [flags]")
+	}
+	typ := args[0]
+
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	file := fs.String("params", "", "path to a json file of task params")
+	title := fs.String("title", "local run", "title for the task")
+	dbUrl := fs.String("db", "", "postgres url to store tasks in, defaults to an in-memory store")
+	ipfsUrl := fs.String("ipfs", "", "url of the ipfs api, overrides IPFS_API_URL")
+	fixtures := fs.String("fixtures", "", "directory of recorded http responses to replay in place of network requests")
+	record := fs.Bool("record", false, "record http responses to the -fixtures directory instead of replaying them")
+	params := paramFlags{}
+	fs.Var(params, "param", "task param as key=value, can be repeated. overrides values from -params")
+	fs.Parse(args[1:])
+
+	// local runs don't need a fully-configured server, so missing
+	// required settings aren't an error here
+	cfg, _ = initConfig(os.Getenv("GOLANG_ENV"))
+	if err := logging.Configure(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+	if *ipfsUrl != "" {
+		cfg.IpfsApiUrl = *ipfsUrl
+	}
+	// without a queue, subtasks are performed in-process as well
+	cfg.AmqpUrl = ""
+	configureTasks()
+
+	if *fixtures != "" {
+		http.DefaultClient.Transport = &fixtureTransport{
+			dir:    *fixtures,
+			record: *record,
+			next:   http.DefaultClient.Transport,
+		}
+	}
+	// replayed fixtures are traced as well
+	startTracing()
+
+	// tasks & their subtasks run concurrently, so the in-memory store
+	// needs locking
+	var ds datastore.Datastore = tasks.NewLockedStore(datastore.NewMapDatastore())
+	if *dbUrl != "" {
+		if err := sqlutil.ConnectToDb("postgres", *dbUrl, appDB); err != nil {
+			return err
+		}
+		sql_datastore.SetDB(appDB)
+		store.Register(
+			&tasks.Task{},
+			&tasks.TaskDedup{},
+			&tasks.Checkpoint{},
+			&tasks.CheckpointEntry{},
+			&tasks.TaskEvent{},
+			&source.Source{},
+		)
+		ds = store
+	}
+
+	p := map[string]interface{}{}
+	if *file != "" {
+		data, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &p); err != nil {
+			return fmt.Errorf("error decoding params file: %s", err.Error())
+		}
+	}
+	for k, v := range params {
+		p[k] = v
+	}
+
+	t := &tasks.Task{Title: *title, Type: typ, Params: p}
+	if err := t.Save(ds); err != nil {
+		return err
+	}
+
+	tc := make(chan *tasks.Task, 10)
+	done := make(chan bool)
+	go func() {
+		for t := range tc {
+			printProgress(t)
+		}
+		done <- true
+	}()
+
+	err := t.Do(ds, tc)
+	close(tc)
+	<-done
+
+	if perr := printJSON(t); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// fixtureTransport replays recorded http responses from a directory,
+// or records responses to the directory when record is true. Responses
+// are keyed by request method, url & body. multipart bodies, eg: ipfs
+// adds, are written with a random boundary, which is left out of the key
+type fixtureTransport struct {
+	dir    string
+	record bool
+	next   http.RoundTripper
+}
+
+// fixtureKey hashes the parts of a request that identify it's response
+func fixtureKey(req *http.Request, body []byte) string {
+	if mt, params, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err == nil && strings.HasPrefix(mt, "multipart/") && params["boundary"] != "" {
+		body = bytes.Replace(body, []byte(params["boundary"]), []byte("boundary"), -1)
+	}
+	sum := sha256.Sum256(append([]byte(req.Method+" "+req.URL.String()+"\n"), body...))
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	path := filepath.Join(f.dir, fixtureKey(req, body)+".http")
+
+	if !f.record {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("no fixture recorded for %s %s", req.Method, req.URL.String())
+		}
+		return http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	}
+
+	next := f.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	res, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := httputil.DumpResponse(res, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(f.dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/datatogether/task_mgmt/taskdefs/ipfs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestFixtureTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/add" {
+			fmt.Fprint(w, `{"Hash":"QmAdded"}`)
+			return
+		}
+		fmt.Fprint(w, "page")
+	}))
+
+	transport := http.DefaultClient.Transport
+	defer func() { http.DefaultClient.Transport = transport }()
+
+	fetch := func() (string, string, error) {
+		res, err := http.Get(s.URL + "/page")
+		if err != nil {
+			return "", "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return "", "", err
+		}
+		hash, err := ipfs.WriteToIpfs(context.Background(), s.URL, "page", body)
+		return string(body), hash, err
+	}
+
+	http.DefaultClient.Transport = &fixtureTransport{dir: dir, record: true}
+	if _, _, err := fetch(); err != nil {
+		t.Fatal(err.Error())
+	}
+	s.Close()
+
+	// replays can't reach the server, and write adds with a new boundary
+	http.DefaultClient.Transport = &fixtureTransport{dir: dir}
+	body, hash, err := fetch()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if body != "page" || hash != "QmAdded" {
+		t.Errorf("expected replayed page & hash, got: '%s', '%s'", body, hash)
+	}
+}
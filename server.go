@@ -7,51 +7,69 @@ import (
 	"fmt"
 	"github.com/datatogether/sql_datastore"
 	"github.com/datatogether/sqlutil"
+	"github.com/datatogether/task_mgmt/auth"
+	"github.com/datatogether/task_mgmt/health"
+	"github.com/datatogether/task_mgmt/logging"
+	"github.com/datatogether/task_mgmt/metrics"
 	"github.com/datatogether/task_mgmt/source"
 	"github.com/datatogether/task_mgmt/tasks"
-	"github.com/sirupsen/logrus"
+	"github.com/datatogether/task_mgmt/webhooks"
 	"net/http"
 	"os"
+	"strings"
+	"sync/atomic"
 )
 
 var (
 	// cfg is the global configuration for the server. It's read in at startup from
 	// the config.json file and enviornment variables, see config.go for more info.
 	cfg *config
-	// log output
-	log = logrus.New()
+	// log output, shared with taskdefs & the task runner
+	log = logging.Log
 	// application database connection
 	appDB = &sql.DB{}
 	// hoist default store
 	store = sql_datastore.DefaultStore
 )
 
-func init() {
-	log.Out = os.Stderr
-	log.Level = logrus.InfoLevel
-	log.Formatter = &logrus.TextFormatter{
-		ForceColors: true,
+func main() {
+	name, args := defaultCommand, os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+		printUsage()
+		os.Exit(2)
+	}
+
+	if err := cmd.Run(args); err != nil {
+		log.Fatal(err.Error())
 	}
 }
 
-func main() {
+// loadConfig reads configuration & registers taskdefs, it must be called
+// by commands before any other setup
+func loadConfig() {
 	var err error
 	cfg, err = initConfig(os.Getenv("GOLANG_ENV"))
 	if err != nil {
 		// panic if the server is missing a vital configuration detail
 		panic(fmt.Errorf("server configuration error: %s", err.Error()))
 	}
-	configureTasks()
-
-	go initPostgres()
-	go listenRpc()
-	go connectRedis()
-
-	stop, err := acceptTasks()
-	if err != nil {
-		panic(err.Error())
+	if err := logging.Configure(cfg.LogLevel, cfg.LogFormat); err != nil {
+		panic(fmt.Errorf("server configuration error: %s", err.Error()))
 	}
+	configureTasks()
+	configureReadiness()
+	startTracing()
+	quotas = quotaRules()
+}
 
+// serve starts the HTTP api, blocking until the server stops
+func serve() error {
 	s := &http.Server{}
 	// connect mux to server
 	s.Handler = NewServerRoutes()
@@ -62,14 +80,8 @@ func main() {
 	// fire it up!
 	log.Infoln("starting server on port", cfg.Port)
 
-	// start server wrapped in a log.Fatal b/c http.ListenAndServe will not
-	// return unless there's an error
-	log.Fatal(StartServer(cfg, s))
-
-	// lol will never happen, left here as a reminder
-	// that we should be able to stop accepting new tasks
-	// at any point without issue
-	stop <- true
+	// StartServer will not return unless there's an error
+	return StartServer(cfg, s)
 }
 
 // NewServerRoutes returns a Muxer that has all API routes.
@@ -78,15 +90,31 @@ func NewServerRoutes() *http.ServeMux {
 	m := http.NewServeMux()
 	m.HandleFunc("/.well-known/acme-challenge/", CertbotHandler)
 	m.Handle("/", middleware(NotFoundHandler))
-	m.Handle("/healthcheck", middleware(HealthCheckHandler))
+	m.Handle("/healthcheck", middleware(health.LiveHandler))
+	m.Handle("/healthz", middleware(health.LiveHandler))
+	m.Handle("/readyz", middleware(readiness.ReadyHandler))
+	m.HandleFunc("/metrics", metrics.Handler)
+	m.Handle("/openapi.json", middleware(OpenAPIHandler))
+
+	m.Handle("/tasks", middleware(authMiddleware(TasksHandler)))
+	m.Handle("/tasks/", middleware(authMiddleware(TaskHandler)))
+	m.Handle("/tasks/retry", middleware(authMiddleware(RetryTasksHandler)))
+	m.Handle("/workers", middleware(authMiddleware(WorkersHandler)))
+	m.Handle("/users/", middleware(authMiddleware(UserUsageHandler)))
+	m.Handle("/webhooks", middleware(authMiddleware(WebhooksHandler)))
+	m.Handle("/webhooks/", middleware(authMiddleware(WebhookHandler)))
+	if rpcServer, err := newRpcServer(); err == nil {
+		m.Handle("/rpc", middleware(authMiddleware(JSONRPCHandler(rpcServer))))
+	}
 
-	m.Handle("/tasks", middleware(TasksHandler))
-	m.Handle("/tasks/", middleware(TaskHandler))
-	// TODO - restore this:
-	// m.Handle("/tasks/cancel/", middleware(CancelTaskHandler))
+	m.Handle("/dashboard", middleware(dashboardAuth(DashboardHandler)))
+	m.Handle("/dashboard/", middleware(dashboardAuth(DashboardHandler)))
+	m.Handle("/dashboard/login", middleware(DashboardLoginHandler))
+	m.Handle("/dashboard/logout", middleware(DashboardLogoutHandler))
+	m.Handle("/dashboard/static/", DashboardStaticHandler)
 
 	// Example of individual task routing:
-	m.HandleFunc("/ipfs/add", middleware(EnqueueIpfsAddHandler))
+	m.Handle("/ipfs/add", middleware(authMiddleware(EnqueueIpfsAddHandler)))
 
 	m.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir("public/js"))))
 	m.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir("public/css"))))
@@ -99,19 +127,43 @@ func initPostgres() {
 	if err := sqlutil.ConnectToDb("postgres", cfg.PostgresDbUrl, appDB); err != nil {
 		panic(err)
 	}
+	atomic.StoreInt32(&postgresConnected, 1)
 	log.Infoln("connected to postgres db")
-	created, err := sqlutil.EnsureTables(appDB, packagePath("sql/schema.sql"),
-		"tasks")
-	if err != nil {
+	if cfg.AutoMigrate {
+		ran, err := migrateUp(appDB)
+		if err != nil {
+			log.Infoln(err)
+		}
+		for _, m := range ran {
+			log.Infof("applied migration %04d-%s", m.Version, m.Name)
+		}
+	} else if migrations, err := migrationStatus(appDB); err != nil {
 		log.Infoln(err)
-	}
-	if len(created) > 0 {
-		log.Infoln("created tables:", created)
+	} else {
+		for _, m := range migrations {
+			if m.Applied == nil {
+				log.Infof("pending migration %04d-%s, run 'task_mgmt migrate up' to apply", m.Version, m.Name)
+			}
+		}
 	}
 
 	sql_datastore.SetDB(appDB)
-	store.Register(
+	registerModels()
+}
+
+// registerModels tells the store about every model the server keeps
+func registerModels() error {
+	return store.Register(
 		&tasks.Task{},
+		&tasks.TaskDedup{},
+		&tasks.Checkpoint{},
+		&tasks.CheckpointEntry{},
+		&tasks.Worker{},
+		&tasks.TaskEvent{},
 		&source.Source{},
+		&auth.APIKey{},
+		&auth.Policy{},
+		&webhooks.Subscription{},
+		&webhooks.Delivery{},
 	)
 }
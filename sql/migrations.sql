@@ -0,0 +1,212 @@
+-- migrations are applied in order of their version number, each must have
+-- an "up" & a "down" command, named [version]-[name]-[up|down]
+
+-- name: 0001-baseline-up
+CREATE TABLE IF NOT EXISTS tasks (
+  id               UUID NOT NULL PRIMARY KEY,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  updated          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  title            text NOT NULL DEFAULT '',
+  user_id          text NOT NULL DEFAULT '',
+  type             text NOT NULL DEFAULT '',
+  params           json,
+  status           text NOT NULL DEFAULT '',
+  error            text NOT NULL DEFAULT '',
+  enqueued         timestamp,
+  started          timestamp,
+  succeeded        timestamp,
+  failed           timestamp
+);
+CREATE TABLE IF NOT EXISTS sources (
+  id               UUID NOT NULL PRIMARY KEY,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  updated          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  title            text NOT NULL DEFAULT '',
+  url              text NOT NULL,
+  checksum         text NOT NULL DEFAULT '',
+  meta             json
+);
+CREATE TABLE IF NOT EXISTS repos (
+  id               UUID NOT NULL PRIMARY KEY,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  updated          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  url              text NOT NULL,
+  branch           text NOT NULL default 'master',
+  latest_commit    text NOT NULL
+);
+CREATE TABLE IF NOT EXISTS repo_sources (
+  repo_id          UUID NOT NULL references repos(id) ON DELETE CASCADE,
+  source_id        UUID NOT NULL references sources(id) ON DELETE CASCADE
+);
+
+-- name: 0001-baseline-down
+DROP TABLE IF EXISTS tasks, sources, repos, repo_sources;
+
+-- name: 0002-task_orchestration-up
+ALTER TABLE tasks
+  ADD COLUMN IF NOT EXISTS parent_id text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS subtasks integer NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS worker_id text NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS task_dedups (
+  id               text NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+CREATE TABLE IF NOT EXISTS task_checkpoints (
+  id               UUID NOT NULL PRIMARY KEY,
+  updated          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  data             json
+);
+CREATE TABLE IF NOT EXISTS workers (
+  id               UUID NOT NULL PRIMARY KEY,
+  hostname         text NOT NULL DEFAULT '',
+  capabilities     json,
+  started          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  heartbeat        timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+-- name: 0002-task_orchestration-down
+DROP TABLE IF EXISTS task_dedups, task_checkpoints, workers;
+ALTER TABLE tasks
+  DROP COLUMN IF EXISTS parent_id,
+  DROP COLUMN IF EXISTS subtasks,
+  DROP COLUMN IF EXISTS worker_id;
+
+-- name: 0003-task_events-up
+CREATE TABLE IF NOT EXISTS task_events (
+  id               text NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  type             text NOT NULL DEFAULT '',
+  message          text NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS task_events_task_id ON task_events (task_id);
+
+-- name: 0003-task_events-down
+DROP TABLE IF EXISTS task_events;
+
+-- name: 0004-task_attempts-up
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 1;
+
+-- name: 0004-task_attempts-down
+ALTER TABLE tasks DROP COLUMN IF EXISTS attempts;
+
+-- name: 0005-api_keys-up
+CREATE TABLE IF NOT EXISTS api_keys (
+  id               text NOT NULL PRIMARY KEY,
+  user_id          text NOT NULL,
+  name             text NOT NULL DEFAULT '',
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+CREATE INDEX IF NOT EXISTS api_keys_user_id ON api_keys (user_id);
+
+-- name: 0005-api_keys-down
+DROP TABLE IF EXISTS api_keys;
+
+-- name: 0006-policies-up
+CREATE TABLE IF NOT EXISTS policies (
+  id               text NOT NULL PRIMARY KEY,
+  user_id          text NOT NULL,
+  task_type        text NOT NULL,
+  role             text NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+CREATE UNIQUE INDEX IF NOT EXISTS policies_user_task_type ON policies (user_id, task_type);
+
+-- name: 0006-policies-down
+DROP TABLE IF EXISTS policies;
+
+-- name: 0007-task_versions-up
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 0;
+
+-- name: 0007-task_versions-down
+ALTER TABLE tasks DROP COLUMN IF EXISTS version;
+
+-- name: 0008-webhooks-up
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS callback_url text NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+  id               UUID NOT NULL PRIMARY KEY,
+  user_id          text NOT NULL DEFAULT '',
+  url              text NOT NULL,
+  events           text NOT NULL DEFAULT '',
+  secret           text NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id               UUID NOT NULL PRIMARY KEY,
+  subscription_id  text NOT NULL DEFAULT '',
+  task_id          text NOT NULL DEFAULT '',
+  event            text NOT NULL,
+  url              text NOT NULL,
+  payload          json,
+  attempts         integer NOT NULL DEFAULT 0,
+  status_code      integer NOT NULL DEFAULT 0,
+  error            text NOT NULL DEFAULT '',
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  delivered        timestamp,
+  next_attempt     timestamp
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_id ON webhook_deliveries (subscription_id, created);
+
+-- name: 0008-webhooks-down
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_subscriptions;
+ALTER TABLE tasks DROP COLUMN IF EXISTS callback_url;
+
+-- name: 0009-checkpoint_entries-up
+CREATE TABLE IF NOT EXISTS task_checkpoint_entries (
+  id               text NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  data             json
+);
+CREATE INDEX IF NOT EXISTS task_checkpoint_entries_task_id ON task_checkpoint_entries (task_id, created);
+
+-- name: 0009-checkpoint_entries-down
+DROP TABLE IF EXISTS task_checkpoint_entries;
+
+-- name: 0010-task_parent_id_index-up
+CREATE INDEX IF NOT EXISTS tasks_parent_id ON tasks (parent_id);
+
+-- name: 0010-task_parent_id_index-down
+DROP INDEX IF EXISTS tasks_parent_id;
+
+-- name: 0011-task_worker_id_index-up
+CREATE INDEX IF NOT EXISTS tasks_unfinished_worker_id ON tasks (worker_id) WHERE succeeded IS NULL AND failed IS NULL;
+
+-- name: 0011-task_worker_id_index-down
+DROP INDEX IF EXISTS tasks_unfinished_worker_id;
+
+-- name: 0012-task_finished_index-up
+CREATE INDEX IF NOT EXISTS tasks_finished ON tasks ((COALESCE(succeeded, failed)));
+
+-- name: 0012-task_finished_index-down
+DROP INDEX IF EXISTS tasks_finished;
+
+-- name: 0013-task_user_id_created_index-up
+CREATE INDEX IF NOT EXISTS tasks_user_id_created ON tasks (user_id, created);
+
+-- name: 0013-task_user_id_created_index-down
+DROP INDEX IF EXISTS tasks_user_id_created;
+
+-- name: 0014-webhook_deliveries_next_attempt_index-up
+CREATE INDEX IF NOT EXISTS webhook_deliveries_next_attempt ON webhook_deliveries (next_attempt) WHERE next_attempt IS NOT NULL;
+
+-- name: 0014-webhook_deliveries_next_attempt_index-down
+DROP INDEX IF EXISTS webhook_deliveries_next_attempt;
+
+-- name: 0015-notify_digests-up
+CREATE TABLE IF NOT EXISTS notify_digests (
+  period_end       timestamp NOT NULL PRIMARY KEY,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+-- name: 0015-notify_digests-down
+DROP TABLE IF EXISTS notify_digests;
+
+-- name: 0016-task_parent_attempt-up
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS parent_attempt integer NOT NULL DEFAULT 0;
+UPDATE tasks SET parent_attempt = parents.attempts FROM tasks parents WHERE tasks.parent_id = parents.id::text;
+
+-- name: 0016-task_parent_attempt-down
+ALTER TABLE tasks DROP COLUMN IF EXISTS parent_attempt;
@@ -1,5 +1,5 @@
 -- name: drop-all
-DROP TABLE IF EXISTS tasks, sources, repos, repo_sources;
+DROP TABLE IF EXISTS schema_migrations, tasks, task_dedups, task_checkpoints, task_checkpoint_entries, workers, task_events, sources, repos, repo_sources, api_keys, policies, webhook_subscriptions, webhook_deliveries, notify_digests;
 
 -- name: create-tasks
 CREATE TABLE tasks (
@@ -15,7 +15,54 @@ CREATE TABLE tasks (
   enqueued         timestamp,
   started          timestamp,
   succeeded        timestamp,
-  failed           timestamp
+  failed           timestamp,
+  parent_id        text NOT NULL DEFAULT '',
+  subtasks         integer NOT NULL DEFAULT 0,
+  worker_id        text NOT NULL DEFAULT '',
+  attempts         integer NOT NULL DEFAULT 1,
+  version          bigint NOT NULL DEFAULT 0,
+  callback_url     text NOT NULL DEFAULT '',
+  parent_attempt   integer NOT NULL DEFAULT 0
+);
+
+-- name: create-task_dedups
+CREATE TABLE task_dedups (
+  id               text NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+-- name: create-task_checkpoints
+CREATE TABLE task_checkpoints (
+  id               UUID NOT NULL PRIMARY KEY,
+  updated          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  data             json
+);
+
+-- name: create-task_checkpoint_entries
+CREATE TABLE task_checkpoint_entries (
+  id               text NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  data             json
+);
+
+-- name: create-workers
+CREATE TABLE workers (
+  id               UUID NOT NULL PRIMARY KEY,
+  hostname         text NOT NULL DEFAULT '',
+  capabilities     json,
+  started          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  heartbeat        timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+-- name: create-task_events
+CREATE TABLE task_events (
+  id               text NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  type             text NOT NULL DEFAULT '',
+  message          text NOT NULL DEFAULT ''
 );
 
 -- name: create-sources
@@ -43,4 +90,53 @@ CREATE TABLE repos (
 CREATE TABLE repo_sources (
   repo_id          UUID NOT NULL references repos(id) ON DELETE CASCADE,
   source_id        UUID NOT NULL references sources(id) ON DELETE CASCADE
-);
\ No newline at end of file
+);
+
+-- name: create-api_keys
+CREATE TABLE api_keys (
+  id               text NOT NULL PRIMARY KEY,
+  user_id          text NOT NULL,
+  name             text NOT NULL DEFAULT '',
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+-- name: create-policies
+CREATE TABLE policies (
+  id               text NOT NULL PRIMARY KEY,
+  user_id          text NOT NULL,
+  task_type        text NOT NULL,
+  role             text NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+-- name: create-webhook_subscriptions
+CREATE TABLE webhook_subscriptions (
+  id               UUID NOT NULL PRIMARY KEY,
+  user_id          text NOT NULL DEFAULT '',
+  url              text NOT NULL,
+  events           text NOT NULL DEFAULT '',
+  secret           text NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+-- name: create-webhook_deliveries
+CREATE TABLE webhook_deliveries (
+  id               UUID NOT NULL PRIMARY KEY,
+  subscription_id  text NOT NULL DEFAULT '',
+  task_id          text NOT NULL DEFAULT '',
+  event            text NOT NULL,
+  url              text NOT NULL,
+  payload          json,
+  attempts         integer NOT NULL DEFAULT 0,
+  status_code      integer NOT NULL DEFAULT 0,
+  error            text NOT NULL DEFAULT '',
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  delivered        timestamp,
+  next_attempt     timestamp
+);
+
+-- name: create-notify_digests
+CREATE TABLE notify_digests (
+  period_end       timestamp NOT NULL PRIMARY KEY,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
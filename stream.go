@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/task_mgmt/tasks"
+	"net/http"
+	"time"
+)
+
+// how often task streams re-read the task from the store
+const streamPollInterval = 2 * time.Second
+
+// StreamTaskHandler streams updates to a task as server-sent events until
+// the task finishes or the client disconnects. Each event is the task
+// encoded as json. Live progress comes from the broker when there is one,
+// state changes are picked up by polling the store
+func StreamTaskHandler(w http.ResponseWriter, r *http.Request) {
+	t := readTask(w, r)
+	if t == nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, fmt.Errorf("streaming isn't supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(data []byte) {
+		fmt.Fprintf(w, "event: task\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return
+	}
+	send(data)
+	if t.Succeeded != nil || t.Failed != nil {
+		return
+	}
+
+	var updates <-chan *tasks.Task
+	if broker != nil {
+		ch, cancel, err := broker.Subscribe(t.Id)
+		if err == nil {
+			updates = ch
+			defer cancel()
+		} else if err != ErrNoRedisConn {
+			log.Infof("error subscribing to task progress: %s", err.Error())
+		}
+	}
+
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+	lastUpdate := t.Updated
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case update := <-updates:
+			if data, err := json.Marshal(update); err == nil {
+				send(data)
+			}
+		case <-ticker.C:
+			current := &tasks.Task{Id: t.Id}
+			if err := current.Read(store); err != nil {
+				log.Infof("error reading streamed task: %s", err.Error())
+				return
+			}
+			finished := current.Succeeded != nil || current.Failed != nil
+			if finished || !current.Updated.Equal(lastUpdate) {
+				lastUpdate = current.Updated
+				if data, err := json.Marshal(current); err == nil {
+					send(data)
+				}
+			}
+			if finished {
+				return
+			}
+		}
+	}
+}
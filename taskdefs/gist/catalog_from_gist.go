@@ -11,6 +11,7 @@ import (
 
 	"github.com/datatogether/core"
 	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/task_mgmt/logging"
 	"github.com/datatogether/task_mgmt/tasks"
 	"github.com/ipfs/go-datastore"
 )
@@ -24,7 +25,7 @@ const urlsFilename = "urls.txt"
 // the title, description, and url properties of the collection
 type CollectionFromGist struct {
 	// title for collection if no collection present
-	GistUrl string `json:"gistUrl"`
+	GistUrl string `json:"gistUrl" required:"true"`
 	// author of gist
 	CreatorId string `json:"creatorId"`
 	// internal datastore pointer
@@ -69,7 +70,7 @@ func (t *CollectionFromGist) Do(pch chan tasks.Progress) {
 		pch <- p
 		return
 	}
-	fmt.Println(id)
+	logging.Log.Debugf("gist id: %s", id)
 
 	col, err := CollectionFromGistId(t.store, id, t.CreatorId)
 	if err != nil {
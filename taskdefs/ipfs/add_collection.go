@@ -2,10 +2,12 @@ package ipfs
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/datatogether/cdxj"
 	"github.com/datatogether/core"
 	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/task_mgmt/logging"
 	"github.com/datatogether/task_mgmt/tasks"
 	"github.com/ipfs/go-datastore"
 	"path/filepath"
@@ -17,14 +19,17 @@ const pageSize = 100
 // it iterates through each setting hashes on collection urls
 // and, eventually, generates a cdxj index of the archive
 type AddCollection struct {
-	CollectionId     string              `json:"collectionId"`     // url to resource to be added
-	ipfsApiServerUrl string              `json:"ipfsApiServerUrl"` // url of IPFS api server
+	CollectionId     string              `json:"collectionId" required:"true"` // url to resource to be added
+	ipfsApiServerUrl string              `json:"ipfsApiServerUrl"`             // url of IPFS api server
 	store            datastore.Datastore // internal datastore pointer
+	checkpoint       tasks.Checkpointer  // internal checkpoint for resuming
+	ctx              context.Context     // cancelled if the task is
 }
 
 func NewAddCollection() tasks.Taskable {
 	return &AddCollection{
 		ipfsApiServerUrl: IpfsApiServerUrl,
+		ctx:              context.Background(),
 	}
 }
 
@@ -45,6 +50,17 @@ func (t *AddCollection) SetDatastore(store datastore.Datastore) {
 	t.store = store
 }
 
+// SetCheckpointer gives AddCollection a place to record archived urls,
+// so an interrupted task can pick up where it left off
+func (t *AddCollection) SetCheckpointer(cp tasks.Checkpointer) {
+	t.checkpoint = cp
+}
+
+// SetContext gives AddCollection a way to find out it's been cancelled
+func (t *AddCollection) SetContext(ctx context.Context) {
+	t.ctx = ctx
+}
+
 func (t *AddCollection) Valid() error {
 	if t.CollectionId == "" {
 		return fmt.Errorf("collectionId is required")
@@ -77,6 +93,13 @@ func (t *AddCollection) Do(pch chan tasks.Progress) {
 
 	pctAdd := 1.0 / float32(count)
 
+	cursor, err := NewArchiveCursor(t.checkpoint)
+	if err != nil {
+		p.Error = fmt.Errorf("Error loading checkpoint: %s", err.Error())
+		pch <- p
+		return
+	}
+
 	indexBuf := bytes.NewBuffer(nil)
 	index := cdxj.NewWriter(indexBuf)
 
@@ -91,6 +114,12 @@ func (t *AddCollection) Do(pch chan tasks.Progress) {
 
 		// TODO - parallelize a lil bit
 		for j, item := range items {
+			if err := t.ctx.Err(); err != nil {
+				p.Error = err
+				pch <- p
+				return
+			}
+
 			// TODO - parse this from schema
 			urlstr := item.Url.Url
 
@@ -100,7 +129,7 @@ func (t *AddCollection) Do(pch chan tasks.Progress) {
 
 			// TODO - get the actual start time from header WARC Record
 			// start := time.Now()
-			headerHash, bodyHash, err := ArchiveUrl(t.store, t.ipfsApiServerUrl, &item.Url)
+			headerHash, bodyHash, err := cursor.ArchiveUrl(t.ctx, t.store, t.ipfsApiServerUrl, &item.Url)
 			if err != nil {
 				p.Error = err
 				pch <- p
@@ -140,13 +169,13 @@ func (t *AddCollection) Do(pch chan tasks.Progress) {
 		pch <- p
 		return
 	}
-	indexhash, err := WriteToIpfs(t.ipfsApiServerUrl, fmt.Sprintf("%s.cdxj", collection.Id), indexBuf.Bytes())
+	indexhash, err := WriteToIpfs(t.ctx, t.ipfsApiServerUrl, fmt.Sprintf("%s.cdxj", collection.Id), indexBuf.Bytes())
 	if err != nil {
 		p.Error = fmt.Errorf("Error writing index to ipfs: %s", err.Error())
 		pch <- p
 		return
 	}
-	fmt.Printf("collection %s index hash: %s\n", collection.Id, indexhash)
+	logging.FromContext(t.ctx).Infof("collection %s index hash: %s", collection.Id, indexhash)
 
 	p.Step++
 	p.Status = "saving collection results"
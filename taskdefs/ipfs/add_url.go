@@ -1,23 +1,27 @@
 package ipfs
 
 import (
+	"context"
 	"fmt"
 	"github.com/datatogether/core"
 	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/task_mgmt/logging"
 	"github.com/datatogether/task_mgmt/tasks"
 	"github.com/ipfs/go-datastore"
 )
 
 type TaskAdd struct {
-	Url              string              `json:"url"`              // url to resource to be added
-	Checksum         string              `json:"checksum"`         // optional checksum to check resp against
-	ipfsApiServerUrl string              `json:"ipfsApiServerUrl"` // url of IPFS api server
+	Url              string              `json:"url" required:"true"` // url to resource to be added
+	Checksum         string              `json:"checksum"`            // optional checksum to check resp against
+	ipfsApiServerUrl string              `json:"ipfsApiServerUrl"`    // url of IPFS api server
 	store            datastore.Datastore // internal datastore pointer
+	ctx              context.Context     // cancelled if the task is
 }
 
 func NewTaskAdd() tasks.Taskable {
 	return &TaskAdd{
 		ipfsApiServerUrl: IpfsApiServerUrl,
+		ctx:              context.Background(),
 	}
 }
 
@@ -36,6 +40,27 @@ func (t *TaskAdd) SetDatastore(store datastore.Datastore) {
 	t.store = store
 }
 
+// SetContext gives TaskAdd a way to find out it's been cancelled
+func (t *TaskAdd) SetContext(ctx context.Context) {
+	t.ctx = ctx
+}
+
+// AddUrlDedupKey coalesces ipfs.addurl tasks that target the same url
+func AddUrlDedupKey(t tasks.Taskable) string {
+	if ta, ok := t.(*TaskAdd); ok {
+		return ta.Url
+	}
+	return ""
+}
+
+// AddUrlUrlCount counts the single url an ipfs.addurl task archives
+func AddUrlUrlCount(t tasks.Taskable) int {
+	if ta, ok := t.(*TaskAdd); ok && ta.Url != "" {
+		return 1
+	}
+	return 0
+}
+
 func (t *TaskAdd) Valid() error {
 	if t.Url == "" {
 		return fmt.Errorf("url param is required")
@@ -61,26 +86,25 @@ func (t *TaskAdd) Do(pch chan tasks.Progress) {
 
 	// TODO - unify these to use the same response from a given URL
 	done := make(chan int, 0)
+	archived := make(chan error, 1)
 	go func() {
-		if _, _, err := u.Get(t.store); err != nil {
-			fmt.Printf("error getting url: %s\n", err.Error())
+		if _, _, err := GetUrl(t.ctx, t.store, u); err != nil {
+			logging.FromContext(t.ctx).Errorf("error getting url: %s", err.Error())
 		}
 
 		done <- 0
 	}()
 	go func() {
-		_, _, err := ArchiveUrl(t.store, t.ipfsApiServerUrl, u)
-		if err != nil {
-			p.Error = err
-			pch <- p
-			return
-		}
-
-		done <- 0
+		_, _, err := ArchiveUrl(t.ctx, t.store, t.ipfsApiServerUrl, u)
+		archived <- err
 	}()
 
 	<-done
-	<-done
+	if err := <-archived; err != nil {
+		p.Error = err
+		pch <- p
+		return
+	}
 
 	if err := u.Save(t.store); err != nil {
 		p.Error = fmt.Errorf("error saving url: %s", err.Error())
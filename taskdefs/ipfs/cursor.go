@@ -0,0 +1,99 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/datatogether/core"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"sync"
+	"time"
+)
+
+// ArchivedUrl is the result of archiving a single url
+type ArchivedUrl struct {
+	HeaderHash string    `json:"headerHash"`
+	BodyHash   string    `json:"bodyHash"`
+	LastGet    time.Time `json:"lastGet"`
+}
+
+// ArchiveCursor tracks the set of urls a task has already archived,
+// appending each url to the task's checkpoint log as it goes. Tasks that
+// walk large numbers of urls can use a cursor in place of calling
+// ArchiveUrl directly, and on redelivery will skip any url archived before
+// the task was interrupted.
+// ArchiveCursor is safe for use from multiple goroutines
+type ArchiveCursor struct {
+	lock     sync.Mutex
+	cp       tasks.Checkpointer
+	Archived map[string]*ArchivedUrl `json:"archived"`
+}
+
+// cursorEntry is the checkpoint log entry for a single archived url
+type cursorEntry struct {
+	Url string `json:"url"`
+	ArchivedUrl
+}
+
+// NewArchiveCursor creates a cursor, loading any previous state from cp.
+// cp may be nil, in which case nothing is persisted
+func NewArchiveCursor(cp tasks.Checkpointer) (*ArchiveCursor, error) {
+	c := &ArchiveCursor{cp: cp, Archived: map[string]*ArchivedUrl{}}
+	if cp == nil {
+		return c, nil
+	}
+
+	err := cp.Entries(func(data []byte) error {
+		e := &cursorEntry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return err
+		}
+		c.Archived[e.Url] = &e.ArchivedUrl
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Resumed reports weather this cursor picked up state from a prior run
+func (c *ArchiveCursor) Resumed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.Archived) > 0
+}
+
+// ArchiveUrl archives url, skipping the work if the url has already
+// been archived by this cursor
+func (c *ArchiveCursor) ArchiveUrl(ctx context.Context, store datastore.Datastore, ipfsApiUrl string, url *core.Url) (headerHash, bodyHash string, err error) {
+	c.lock.Lock()
+	prev := c.Archived[url.Url]
+	c.lock.Unlock()
+
+	if prev != nil {
+		lastGet := prev.LastGet
+		url.LastGet = &lastGet
+		url.Hash = prev.BodyHash
+		return prev.HeaderHash, prev.BodyHash, nil
+	}
+
+	headerHash, bodyHash, err = ArchiveUrl(ctx, store, ipfsApiUrl, url)
+	if err != nil {
+		return
+	}
+
+	au := &ArchivedUrl{HeaderHash: headerHash, BodyHash: bodyHash, LastGet: time.Now()}
+	if url.LastGet != nil {
+		au.LastGet = *url.LastGet
+	}
+
+	c.lock.Lock()
+	c.Archived[url.Url] = au
+	c.lock.Unlock()
+
+	if c.cp != nil {
+		err = c.cp.Append(&cursorEntry{Url: url.Url, ArchivedUrl: *au})
+	}
+	return
+}
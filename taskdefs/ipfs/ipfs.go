@@ -2,9 +2,12 @@ package ipfs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/datatogether/core"
+	"github.com/datatogether/task_mgmt/metrics"
+	"github.com/datatogether/task_mgmt/tracing"
 	"github.com/ipfs/go-datastore"
 	// "github.com/jbenet/go-base58"
 	// "github.com/multiformats/go-multihash"
@@ -12,13 +15,19 @@ import (
 	"mime/multipart"
 	"net/http"
 	"path/filepath"
+	"time"
 )
 
 // Should be set by implementers
 var IpfsApiServerUrl = ""
 
+var (
+	ipfsAddDuration = metrics.NewHistogram("task_mgmt_ipfs_add_duration_seconds", "Latency of adds to ipfs.", nil, "result")
+	ipfsAddBytes    = metrics.NewCounter("task_mgmt_ipfs_add_bytes_total", "Bytes successfully added to ipfs.")
+)
+
 // TODO - add a skipHashed arg that allows us to skip urls that already have been seen
-func ArchiveUrl(store datastore.Datastore, ipfsApiUrl string, url *core.Url) (headerHash, bodyHash string, err error) {
+func ArchiveUrl(ctx context.Context, store datastore.Datastore, ipfsApiUrl string, url *core.Url) (headerHash, bodyHash string, err error) {
 	urlstr := url.Url
 	// header, body, err := GetUrlBytes(urlstr)
 	// if err != nil {
@@ -26,7 +35,7 @@ func ArchiveUrl(store datastore.Datastore, ipfsApiUrl string, url *core.Url) (he
 	// 	return
 	// }
 
-	body, _, err := url.Get(store)
+	body, _, err := GetUrl(ctx, store, url)
 	if err != nil {
 		err = fmt.Errorf("Error fetching url '%s': %s", urlstr, err.Error())
 		return
@@ -50,13 +59,13 @@ func ArchiveUrl(store datastore.Datastore, ipfsApiUrl string, url *core.Url) (he
 
 	header := buf.Bytes()
 
-	headerHash, err = WriteToIpfs(ipfsApiUrl, filepath.Base(urlstr), header)
+	headerHash, err = WriteToIpfs(ctx, ipfsApiUrl, filepath.Base(urlstr), header)
 	if err != nil {
 		err = fmt.Errorf("Error writing %s header to ipfs: %s", filepath.Base(urlstr), err.Error())
 		return
 	}
 
-	bodyHash, err = WriteToIpfs(ipfsApiUrl, filepath.Base(urlstr), body)
+	bodyHash, err = WriteToIpfs(ctx, ipfsApiUrl, filepath.Base(urlstr), body)
 	if err != nil {
 		err = fmt.Errorf("Error writing %s body to ipfs: %s", filepath.Base(urlstr), err.Error())
 		return
@@ -72,7 +81,53 @@ func ArchiveUrl(store datastore.Datastore, ipfsApiUrl string, url *core.Url) (he
 	return
 }
 
-func WriteToIpfs(ipfsurl, filename string, data []byte) (hash string, err error) {
+// GetUrl fetches url the way core.Url.Get does, abandoning the request
+// if ctx is cancelled
+func GetUrl(ctx context.Context, store datastore.Datastore, url *core.Url) (body []byte, links []*core.Link, err error) {
+	if !url.ShouldEnqueueGet() {
+		// fetched recently, core reads the already-stored links
+		return url.Get(store)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url.Url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	return url.HandleGetResponse(store, res)
+}
+
+func WriteToIpfs(ctx context.Context, ipfsurl, filename string, data []byte) (hash string, err error) {
+	start := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "error"
+		} else {
+			ipfsAddBytes.Add(float64(len(data)))
+		}
+		ipfsAddDuration.Observe(time.Since(start).Seconds(), result)
+	}()
+
+	// writes made by a running task are traced as part of it
+	if parent := tracing.FromContext(ctx); parent != nil {
+		span := tracing.Start("ipfs.add", tracing.KindInternal, parent.Context())
+		span.SetAttribute("ipfs.filename", filename)
+		span.SetAttribute("ipfs.bytes", len(data))
+		ctx = tracing.ContextWithSpan(ctx, span)
+		defer func() {
+			if err == nil {
+				span.SetAttribute("ipfs.hash", hash)
+			}
+			span.End(err)
+		}()
+	}
+
 	body := &bytes.Buffer{}
 	w := multipart.NewWriter(body)
 	var (
@@ -99,7 +154,7 @@ func WriteToIpfs(ipfsurl, filename string, data []byte) (hash string, err error)
 	}
 
 	// add to IPFS
-	ipfsReq, err = http.NewRequest("POST", fmt.Sprintf("%s/add", ipfsurl), body)
+	ipfsReq, err = http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/add", ipfsurl), body)
 	if err != nil {
 		err = fmt.Errorf("error creating request: %s", err.Error())
 		return
@@ -130,8 +185,12 @@ func WriteToIpfs(ipfsurl, filename string, data []byte) (hash string, err error)
 	return reply.Hash, nil
 }
 
-func ReadFile(ipfsUrl, hash string) (io.ReadCloser, error) {
-	res, err := http.Get(fmt.Sprintf("%s/cat?arg=%s", ipfsUrl, hash))
+func ReadFile(ctx context.Context, ipfsUrl, hash string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/cat?arg=%s", ipfsUrl, hash), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,7 @@
 package kiwix
 
 import (
+	"context"
 	"fmt"
 	"github.com/datatogether/sql_datastore"
 	"github.com/datatogether/task_mgmt/source"
@@ -11,10 +12,12 @@ import (
 type TaskUpdateSources struct {
 	// internal datastore pointer
 	store datastore.Datastore
+	// cancelled if the task is
+	ctx context.Context
 }
 
 func NewTaskUpdateSources() tasks.Taskable {
-	return &TaskUpdateSources{}
+	return &TaskUpdateSources{ctx: context.Background()}
 }
 
 func (t *TaskUpdateSources) Valid() error {
@@ -34,6 +37,11 @@ func (t *TaskUpdateSources) SetDatastore(store datastore.Datastore) {
 	t.store = store
 }
 
+// SetContext gives TaskUpdateSources a way to find out it's been cancelled
+func (t *TaskUpdateSources) SetContext(ctx context.Context) {
+	t.ctx = ctx
+}
+
 // Do performs the task
 func (t *TaskUpdateSources) Do(updates chan tasks.Progress) {
 	p := tasks.Progress{Percent: 0.0, Step: 1, Steps: 2, Status: "fetching zims list"}
@@ -65,9 +73,14 @@ func (t *TaskUpdateSources) Do(updates chan tasks.Progress) {
 	p.Step++
 	updates <- p
 	for _, s := range sources {
+		if err := t.ctx.Err(); err != nil {
+			p.Error = err
+			updates <- p
+			return
+		}
 		for _, z := range zims {
 			if s.Url == z.Url {
-				if err := z.FetchMd5(); err != nil {
+				if err := z.FetchMd5(t.ctx); err != nil {
 					p.Error = fmt.Errorf("error fetching MD5 checksum for source '%s': %s", s.Url, err.Error())
 					updates <- p
 					return
@@ -1,6 +1,7 @@
 package kiwix
 
 import (
+	"context"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"net/http"
@@ -34,8 +35,12 @@ func (z *Zim) Title() string {
 	return fmt.Sprintf("%s - %s", z.Project, z.Language)
 }
 
-func (z *Zim) FetchMd5() error {
-	res, err := http.Get(z.Md5Url)
+func (z *Zim) FetchMd5(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", z.Md5Url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -2,12 +2,14 @@ package pod
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/datatogether/cdxj"
 	"github.com/datatogether/core"
 	"github.com/datatogether/linked_data/pod"
 	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/task_mgmt/logging"
 	"github.com/datatogether/task_mgmt/taskdefs/ipfs"
 	"github.com/datatogether/task_mgmt/tasks"
 	"github.com/ipfs/go-datastore"
@@ -27,7 +29,7 @@ type AddCatalog struct {
 	// title for collection if no collection present
 	CollectionTitle string
 	// url that points to catalog
-	Url string `json:"url"`
+	Url string `json:"url" required:"true"`
 	// paginate into dataset list, zero is no pagination / offset
 	Limit int
 	// offset to start archiving at
@@ -37,11 +39,21 @@ type AddCatalog struct {
 	// skip items that already have a hash value
 	SkipArchived bool
 	// how long to sleep between requests in seconds(inside of parallel routines)
-	CrawDelay time.Duration
+	CrawDelay time.Duration `description:"seconds to sleep between requests, half a second if omitted" default:""`
+	// spawn an ipfs.addurl subtask per dataset distribution instead of
+	// archiving in-process. Parallelism is ignored when fanning out, and
+	// no cdxj index is written
+	FanOut bool
 	// url of IPFS api server, should be set internally
 	ipfsApiServerUrl string
 	// internal datastore pointer
 	store datastore.Datastore
+	// internal checkpoint for resuming
+	checkpoint tasks.Checkpointer
+	// internal handle for spawning subtasks
+	subtasks tasks.Subtasker
+	// cancelled if the task is
+	ctx context.Context
 }
 
 func NewAddCatalog() tasks.Taskable {
@@ -49,6 +61,7 @@ func NewAddCatalog() tasks.Taskable {
 		CrawDelay:        defaultCrawlDelay,
 		Parallelism:      2,
 		ipfsApiServerUrl: IpfsApiServerUrl,
+		ctx:              context.Background(),
 	}
 }
 
@@ -69,6 +82,35 @@ func (t *AddCatalog) SetDatastore(store datastore.Datastore) {
 	t.store = store
 }
 
+// SetCheckpointer gives AddCatalog a place to record archived distributions,
+// so an interrupted task can pick up where it left off
+func (t *AddCatalog) SetCheckpointer(cp tasks.Checkpointer) {
+	t.checkpoint = cp
+}
+
+// SetSubtasker gives AddCatalog a way to fan out into subtasks
+func (t *AddCatalog) SetSubtasker(s tasks.Subtasker) {
+	t.subtasks = s
+}
+
+// SetContext gives AddCatalog a way to find out it's been cancelled
+func (t *AddCatalog) SetContext(ctx context.Context) {
+	t.ctx = ctx
+}
+
+// CatalogUrlCount counts the datasets a pod.addcatalog task archives. the
+// size of unlimited catalogs isn't known until they're fetched, so they
+// count only the catalog url
+func CatalogUrlCount(t tasks.Taskable) int {
+	if ac, ok := t.(*AddCatalog); ok {
+		if ac.Limit > 0 {
+			return ac.Limit
+		}
+		return 1
+	}
+	return 0
+}
+
 func (t *AddCatalog) Valid() error {
 	if t.Url == "" {
 		return fmt.Errorf("url is required")
@@ -110,7 +152,7 @@ func (t *AddCatalog) Do(pch chan tasks.Progress) {
 	p.Step++
 
 	u := core.Url{Url: t.Url}
-	body, _, err := u.Get(t.store)
+	body, _, err := ipfs.GetUrl(t.ctx, t.store, &u)
 	if err != nil {
 		p.Error = fmt.Errorf("error getting url: %s", err.Error())
 		pch <- p
@@ -138,8 +180,20 @@ func (t *AddCatalog) Do(pch chan tasks.Progress) {
 	p.Status = fmt.Sprintf("archiving items %d/%d of %d items", t.Offset, t.Offset+t.Limit, len(cat.Dataset))
 	pch <- p
 
+	if t.FanOut && t.subtasks != nil {
+		t.fanOut(cat, collection, pch, p)
+		return
+	}
+
 	// t.Limit := t.Limit + t.Offset
 
+	cursor, err := ipfs.NewArchiveCursor(t.checkpoint)
+	if err != nil {
+		p.Error = fmt.Errorf("error loading checkpoint: %s", err.Error())
+		pch <- p
+		return
+	}
+
 	// pctAdd := 1.0 / float32(len(cat.Dataset))
 	indexBuf := bytes.NewBuffer(nil)
 	index := cdxj.NewWriter(indexBuf)
@@ -148,6 +202,9 @@ func (t *AddCatalog) Do(pch chan tasks.Progress) {
 	// of indexes *remaining* with each iteration
 	archiveIndexes := func(cat *pod.Catalog, chanNum, start, stop int, done chan int) {
 		for i := start; i <= stop; i++ {
+			if t.ctx.Err() != nil {
+				break
+			}
 			ds := cat.Dataset[i]
 
 			p.Status = fmt.Sprintf("archiving item %d", i)
@@ -157,9 +214,9 @@ func (t *AddCatalog) Do(pch chan tasks.Progress) {
 				if dist.DownloadURL != "" {
 					u := &core.Url{Url: dist.DownloadURL}
 
-					headerHash, bodyHash, err := ipfs.ArchiveUrl(t.store, t.ipfsApiServerUrl, u)
+					headerHash, bodyHash, err := cursor.ArchiveUrl(t.ctx, t.store, t.ipfsApiServerUrl, u)
 					if err != nil {
-						fmt.Println("error archiving u url:", err.Error())
+						logging.FromContext(t.ctx).Errorf("error archiving url: %s", err.Error())
 						continue
 					}
 
@@ -167,13 +224,13 @@ func (t *AddCatalog) Do(pch chan tasks.Progress) {
 					go func() {
 						data, err := json.Marshal(ds)
 						if err != nil {
-							fmt.Println("error marshaling dataset to json:", err.Error())
+							logging.FromContext(t.ctx).Errorf("error marshaling dataset to json: %s", err.Error())
 							return
 						}
 
 						meta := map[string]interface{}{}
 						if err := json.Unmarshal(data, &meta); err != nil {
-							fmt.Println("error unmarshaling dataset to generic metadata:", err.Error())
+							logging.FromContext(t.ctx).Errorf("error unmarshaling dataset to generic metadata: %s", err.Error())
 							return
 						}
 
@@ -183,7 +240,7 @@ func (t *AddCatalog) Do(pch chan tasks.Progress) {
 						}
 
 						if err := md.Write(t.store); err != nil {
-							fmt.Println("error writing metadata to store:", err.Error())
+							logging.FromContext(t.ctx).Errorf("error writing metadata to store: %s", err.Error())
 							return
 						}
 					}()
@@ -218,7 +275,10 @@ func (t *AddCatalog) Do(pch chan tasks.Progress) {
 						return
 					}
 
-					time.Sleep(t.CrawDelay)
+					select {
+					case <-time.After(t.CrawDelay):
+					case <-t.ctx.Done():
+					}
 				}
 			}
 		}
@@ -236,7 +296,12 @@ func (t *AddCatalog) Do(pch chan tasks.Progress) {
 	// Drain the channel.
 	for i := 0; i < t.Parallelism; i++ {
 		num := <-c // wait for one task to complete
-		fmt.Printf("chan %d complete\n", num)
+		logging.FromContext(t.ctx).Debugf("chan %d complete", num)
+	}
+	if err := t.ctx.Err(); err != nil {
+		p.Error = err
+		pch <- p
+		return
 	}
 
 	p.Step++
@@ -248,13 +313,13 @@ func (t *AddCatalog) Do(pch chan tasks.Progress) {
 		pch <- p
 		return
 	}
-	indexhash, err := ipfs.WriteToIpfs(t.ipfsApiServerUrl, fmt.Sprintf("%s.cdxj", collection.Id), indexBuf.Bytes())
+	indexhash, err := ipfs.WriteToIpfs(t.ctx, t.ipfsApiServerUrl, fmt.Sprintf("%s.cdxj", collection.Id), indexBuf.Bytes())
 	if err != nil {
 		p.Error = fmt.Errorf("Error writing index to ipfs: %s", err.Error())
 		pch <- p
 		return
 	}
-	fmt.Printf("collection %s index hash: %s\n", collection.Id, indexhash)
+	logging.FromContext(t.ctx).Infof("collection %s index hash: %s", collection.Id, indexhash)
 
 	p.Step++
 	p.Status = "saving collection results"
@@ -270,3 +335,59 @@ func (t *AddCatalog) Do(pch chan tasks.Progress) {
 	pch <- p
 	return
 }
+
+// fanOut spawns an ipfs.addurl subtask for each dataset distribution,
+// adding each url to the collection as it goes
+func (t *AddCatalog) fanOut(cat *pod.Catalog, collection *core.Collection, pch chan tasks.Progress, p tasks.Progress) {
+	stop := t.Offset + t.Limit
+	if stop > len(cat.Dataset) {
+		stop = len(cat.Dataset)
+	}
+
+	p.Step++
+	for i := t.Offset; i < stop; i++ {
+		if err := t.ctx.Err(); err != nil {
+			p.Error = err
+			pch <- p
+			return
+		}
+		p.Status = fmt.Sprintf("spawning subtasks for item %d", i)
+		pch <- p
+
+		for j, dist := range cat.Dataset[i].Distribution {
+			if dist.DownloadURL == "" {
+				continue
+			}
+
+			title := fmt.Sprintf("archive %s", dist.DownloadURL)
+			if _, err := t.subtasks.Spawn(title, "ipfs.addurl", map[string]interface{}{
+				"url": dist.DownloadURL,
+			}); err != nil {
+				p.Error = fmt.Errorf("error spawning subtask for dataset %d dist %d: %s", i, j, err.Error())
+				pch <- p
+				return
+			}
+
+			if err := collection.SaveItems(t.store, []*core.CollectionItem{
+				&core.CollectionItem{Url: core.Url{Url: dist.DownloadURL}},
+			}); err != nil {
+				p.Error = fmt.Errorf("error saving dataset %d dist %d to collection: %s", i, j, err.Error())
+				pch <- p
+				return
+			}
+		}
+	}
+
+	p.Step++
+	p.Status = "saving collection results"
+	pch <- p
+	if err := collection.Save(t.store); err != nil {
+		p.Error = fmt.Errorf("Error saving collection: %s", err.Error())
+		pch <- p
+		return
+	}
+
+	p.Percent = 1.0
+	p.Done = true
+	pch <- p
+}
@@ -2,12 +2,14 @@ package sciencebase
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/datatogether/cdxj"
 	"github.com/datatogether/core"
 	sb "github.com/datatogether/linked_data/sciencebase"
 	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/task_mgmt/logging"
 	"github.com/datatogether/task_mgmt/taskdefs/ipfs"
 	"github.com/datatogether/task_mgmt/tasks"
 	"github.com/ipfs/go-datastore"
@@ -27,7 +29,7 @@ type AddCatalogTree struct {
 	// title for collection if no collection present
 	CollectionTitle string
 	// url that points to catalog
-	Url string `json:"url"`
+	Url string `json:"url" required:"true"`
 	// how many items deep to crawl at most, -1 == no max
 	MaxDepth int
 	// how many fetching goroutines to spin up. max 5
@@ -35,11 +37,15 @@ type AddCatalogTree struct {
 	// skip items that already have a hash value
 	SkipArchived bool
 	// how long to sleep between requests in seconds(inside of parallel routines)
-	CrawDelay time.Duration
+	CrawDelay time.Duration `description:"seconds to sleep between requests, half a second if omitted" default:""`
 	// url of IPFS api server, should be set internally
 	ipfsApiServerUrl string
 	// internal datastore pointer
 	store datastore.Datastore
+	// internal checkpoint for resuming
+	checkpoint tasks.Checkpointer
+	// cancelled if the task is
+	ctx context.Context
 }
 
 func NewAddCatalogTree() tasks.Taskable {
@@ -47,6 +53,7 @@ func NewAddCatalogTree() tasks.Taskable {
 		CrawDelay:        defaultCrawlDelay,
 		Parallelism:      2,
 		ipfsApiServerUrl: IpfsApiServerUrl,
+		ctx:              context.Background(),
 	}
 }
 
@@ -67,6 +74,46 @@ func (t *AddCatalogTree) SetDatastore(store datastore.Datastore) {
 	t.store = store
 }
 
+// SetCheckpointer gives AddCatalogTree a place to record the visited set,
+// so an interrupted task can pick up where it left off
+func (t *AddCatalogTree) SetCheckpointer(cp tasks.Checkpointer) {
+	t.checkpoint = cp
+}
+
+// SetContext gives AddCatalogTree a way to find out it's been cancelled
+func (t *AddCatalogTree) SetContext(ctx context.Context) {
+	t.ctx = ctx
+}
+
+// CatalogTreeDedupKey coalesces sb.addCatalogTree tasks that share a root url
+func CatalogTreeDedupKey(t tasks.Taskable) string {
+	if act, ok := t.(*AddCatalogTree); ok {
+		return act.Url
+	}
+	return ""
+}
+
+// MaxUnprivilegedParallelism is the highest Parallelism non-admins
+// can run sb.addCatalogTree tasks with
+const MaxUnprivilegedParallelism = 5
+
+// CatalogTreePrivileged requires admins for highly-parallel crawls
+func CatalogTreePrivileged(t tasks.Taskable) bool {
+	if act, ok := t.(*AddCatalogTree); ok {
+		return act.Parallelism > MaxUnprivilegedParallelism
+	}
+	return false
+}
+
+// CatalogTreeUrlCount counts the root url of a sb.addCatalogTree task, the
+// size of the tree isn't known until it's crawled
+func CatalogTreeUrlCount(t tasks.Taskable) int {
+	if _, ok := t.(*AddCatalogTree); ok {
+		return 1
+	}
+	return 0
+}
+
 func (t *AddCatalogTree) Valid() error {
 	if t.Url == "" {
 		return fmt.Errorf("url is required")
@@ -113,8 +160,24 @@ func (t *AddCatalogTree) Do(pch chan tasks.Progress) {
 	// TODO - refactor done chan to report progress, possibly sending the number
 	// of indexes *remaining* with each iteration
 
-	if err := ArchiveCatalog(t.store, t.ipfsApiServerUrl, collection, index, t.Url, t.MaxDepth, t.Parallelism); err != nil {
-		fmt.Println(err.Error())
+	cursor, err := ipfs.NewArchiveCursor(t.checkpoint)
+	if err != nil {
+		p.Error = fmt.Errorf("Error loading checkpoint: %s", err.Error())
+		pch <- p
+		return
+	}
+	if cursor.Resumed() {
+		p.Status = "resuming from checkpoint"
+		pch <- p
+	}
+
+	if err := ArchiveCatalog(t.ctx, t.store, t.ipfsApiServerUrl, cursor, collection, index, t.Url, t.MaxDepth, t.Parallelism); err != nil {
+		logging.FromContext(t.ctx).Errorf("error archiving catalog: %s", err.Error())
+	}
+	if err := t.ctx.Err(); err != nil {
+		p.Error = err
+		pch <- p
+		return
 	}
 
 	p.Step++
@@ -126,13 +189,13 @@ func (t *AddCatalogTree) Do(pch chan tasks.Progress) {
 		pch <- p
 		return
 	}
-	indexhash, err := ipfs.WriteToIpfs(t.ipfsApiServerUrl, fmt.Sprintf("%s.cdxj", collection.Id), indexBuf.Bytes())
+	indexhash, err := ipfs.WriteToIpfs(t.ctx, t.ipfsApiServerUrl, fmt.Sprintf("%s.cdxj", collection.Id), indexBuf.Bytes())
 	if err != nil {
 		p.Error = fmt.Errorf("Error writing index to ipfs: %s", err.Error())
 		pch <- p
 		return
 	}
-	fmt.Printf("collection %s index hash: %s\n", collection.Id, indexhash)
+	logging.FromContext(t.ctx).Infof("collection %s index hash: %s", collection.Id, indexhash)
 
 	p.Step++
 	p.Status = "saving collection results"
@@ -149,7 +212,10 @@ func (t *AddCatalogTree) Do(pch chan tasks.Progress) {
 	return
 }
 
-func ArchiveCatalog(store datastore.Datastore, ipfsApiUrl string, col *core.Collection, index *cdxj.Writer, rootUrl string, maxDepth, parallelism int) error {
+// ArchiveCatalog walks a sciencebase catalog from rootUrl, archiving each item.
+// urls already recorded in cursor are not re-archived, but are still walked to
+// discover their children. archiving stops early if ctx is cancelled
+func ArchiveCatalog(ctx context.Context, store datastore.Datastore, ipfsApiUrl string, cursor *ipfs.ArchiveCursor, col *core.Collection, index *cdxj.Writer, rootUrl string, maxDepth, parallelism int) error {
 	visit := make(chan childItem, 100)
 	visited := make(chan childItem, 100)
 	tracks := make([]chan childItem, parallelism)
@@ -160,8 +226,8 @@ func ArchiveCatalog(store datastore.Datastore, ipfsApiUrl string, col *core.Coll
 		tracks[i] = make(chan childItem, 100)
 		go func(track, visit, visited chan childItem) {
 			for child := range track {
-				if err := ArchiveChild(store, ipfsApiUrl, col, index, child, visit, visited); err != nil {
-					fmt.Println("error archiving url", err.Error())
+				if err := ArchiveChild(ctx, store, ipfsApiUrl, cursor, col, index, child, visit, visited); err != nil {
+					logging.FromContext(ctx).Errorf("error archiving url: %s", err.Error())
 					// TODO - collect errored urls, or flag as errored?
 				}
 			}
@@ -174,7 +240,7 @@ func ArchiveCatalog(store datastore.Datastore, ipfsApiUrl string, col *core.Coll
 		for {
 			select {
 			case child, ok := <-visit:
-				fmt.Println("visit", child.url)
+				logging.FromContext(ctx).Debugf("visit %s", child.url)
 				if ok && maxDepth == -1 || child.depth < maxDepth {
 					tracks[t] <- child
 					t++
@@ -195,8 +261,12 @@ func ArchiveCatalog(store datastore.Datastore, ipfsApiUrl string, col *core.Coll
 	// add root item to kick off
 	visit <- childItem{0, rootUrl}
 
-	<-wait
-	fmt.Println(time.Since(start), count, "nodes")
+	select {
+	case <-wait:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	logging.FromContext(ctx).Infof("archived %d nodes in %s", count, time.Since(start))
 	return nil
 }
 
@@ -205,24 +275,24 @@ type childItem struct {
 	url   string
 }
 
-func ArchiveChild(store datastore.Datastore, ipfsApiUrl string, collection *core.Collection, index *cdxj.Writer, child childItem, visit, visited chan childItem) error {
+func ArchiveChild(ctx context.Context, store datastore.Datastore, ipfsApiUrl string, cursor *ipfs.ArchiveCursor, collection *core.Collection, index *cdxj.Writer, child childItem, visit, visited chan childItem) error {
 	// core
 	u := &core.Url{Url: child.url}
-	hh, bh, err := ipfs.ArchiveUrl(store, ipfsApiUrl, u)
+	hh, bh, err := cursor.ArchiveUrl(ctx, store, ipfsApiUrl, u)
 	if err != nil {
 		return err
 	}
 	count++
 
-	body, err := ipfs.ReadFile(ipfsApiUrl, bh)
+	body, err := ipfs.ReadFile(ctx, ipfsApiUrl, bh)
 	if err != nil {
-		fmt.Println("error getting ipfs json body:", err.Error())
+		logging.FromContext(ctx).Errorf("error getting ipfs json body: %s", err.Error())
 		return err
 	}
 
 	item := &sb.Item{}
 	if err := json.NewDecoder(body).Decode(item); err != nil {
-		fmt.Println("error decoding child json", u.Url, err.Error())
+		logging.FromContext(ctx).Errorf("error decoding child json %s: %s", u.Url, err.Error())
 		return err
 	}
 	body.Close()
@@ -230,21 +300,21 @@ func ArchiveChild(store datastore.Datastore, ipfsApiUrl string, collection *core
 	// grab any children in a goroutine
 	if item.HasChildren {
 		u := &core.Url{Url: item.ChildrenJsonUrl()}
-		hh, bh, err := ipfs.ArchiveUrl(store, ipfsApiUrl, u)
+		hh, bh, err := cursor.ArchiveUrl(ctx, store, ipfsApiUrl, u)
 		if err != nil {
-			fmt.Println("error archiving children catalog url: ", err.Error())
+			logging.FromContext(ctx).Errorf("error archiving children catalog url: %s", err.Error())
 			return err
 		}
 
-		body, err := ipfs.ReadFile(ipfsApiUrl, bh)
+		body, err := ipfs.ReadFile(ctx, ipfsApiUrl, bh)
 		if err != nil {
-			fmt.Println("error getting ipfs json body:", err.Error())
+			logging.FromContext(ctx).Errorf("error getting ipfs json body: %s", err.Error())
 			return err
 		}
 
 		c := &sb.Catalog{}
 		if err := json.NewDecoder(body).Decode(c); err != nil {
-			fmt.Printf("error decoding chilren json: %s", err.Error())
+			logging.FromContext(ctx).Errorf("error decoding chilren json: %s", err.Error())
 			return err
 		}
 		body.Close()
@@ -0,0 +1,160 @@
+package tasks
+
+import (
+	"github.com/datatogether/task_mgmt/auth"
+	"github.com/ipfs/go-datastore"
+	"sort"
+)
+
+// Action is an operation a user can perform on a task
+type Action string
+
+const (
+	// ActionRead lists & reads tasks, their events & progress
+	ActionRead Action = "read"
+	// ActionSubmit enqueues a task, including clones
+	ActionSubmit Action = "submit"
+	// ActionCancel cancels an unfinished task
+	ActionCancel Action = "cancel"
+	// ActionRetry sends a failed task back to the queue
+	ActionRetry Action = "retry"
+)
+
+// PrivilegedFunc reports weather a task needs the admin role to submit,
+// usually because it's params are expensive, say a high degree of parallelism
+type PrivilegedFunc func(t Taskable) bool
+
+// privileged maps task types to PrivilegedFuncs
+var privileged = map[string]PrivilegedFunc{}
+
+// RegisterPrivileged marks tasks of type name that f reports as privileged
+func RegisterPrivileged(name string, f PrivilegedFunc) {
+	privileged[name] = f
+}
+
+// Privileged reports weather submitting t requires the admin role
+func (t *Task) Privileged() (bool, error) {
+	f := privileged[t.Type]
+	if f == nil {
+		return false, nil
+	}
+
+	tt, err := t.taskable()
+	if err != nil {
+		return false, err
+	}
+	return f(tt), nil
+}
+
+// RequiredRole gives the role userId needs to perform action on t
+func (t *Task) RequiredRole(userId string, action Action) (auth.Role, error) {
+	switch action {
+	case ActionSubmit:
+		if p, err := t.Privileged(); err != nil {
+			return auth.RoleNone, err
+		} else if p {
+			return auth.RoleAdmin, nil
+		}
+		return auth.RoleSubmitter, nil
+	case ActionRetry:
+		if p, err := t.Privileged(); err != nil {
+			return auth.RoleNone, err
+		} else if p {
+			return auth.RoleAdmin, nil
+		}
+		fallthrough
+	case ActionCancel:
+		if userId != "" && t.UserId == userId {
+			return auth.RoleSubmitter, nil
+		}
+		return auth.RoleAdmin, nil
+	default:
+		return auth.RoleViewer, nil
+	}
+}
+
+// Authorize checks userId may perform action on t under policies,
+// returning auth.ErrForbidden if not. an empty userId is an
+// unauthenticated user, who only gets Wildcard user policies
+func Authorize(policies auth.Policies, userId string, action Action, t *Task) error {
+	required, err := t.RequiredRole(userId, action)
+	if err != nil {
+		return err
+	}
+	if policies.Role(userId, t.Type) < required {
+		return auth.ErrForbidden
+	}
+	return nil
+}
+
+// Authorizer checks actions against policies read from a store
+type Authorizer struct {
+	Store datastore.Datastore
+}
+
+// Authorize reads the policies that apply to userId & checks they
+// permit action on t
+func (a Authorizer) Authorize(userId string, action Action, t *Task) error {
+	policies, err := auth.ReadPolicies(a.Store, userId)
+	if err != nil {
+		return err
+	}
+	return Authorize(policies, userId, action, t)
+}
+
+// Readable narrows q to the task types userId may read. reading doesn't
+// depend on anything but a task's type, so listings can select readable
+// tasks in the query instead of filtering every task
+func (a Authorizer) Readable(userId string, q TaskQuery) (TaskQuery, error) {
+	policies, err := auth.ReadPolicies(a.Store, userId)
+	if err != nil {
+		return q, err
+	}
+
+	// types named by policies or registered may differ from the wildcard
+	typed := map[string]bool{}
+	for _, p := range policies {
+		if p.TaskType != auth.Wildcard {
+			typed[p.TaskType] = true
+		}
+	}
+	for name := range taskdefs {
+		typed[name] = true
+	}
+
+	readable := func(taskType string) bool {
+		return Authorize(policies, userId, ActionRead, &Task{Type: taskType}) == nil
+	}
+	if readable(auth.Wildcard) {
+		// everything but the types that are denied
+		for taskType := range typed {
+			if !readable(taskType) {
+				q.ExcludeTypes = append(q.ExcludeTypes, taskType)
+			}
+		}
+		sort.Strings(q.ExcludeTypes)
+		return q, nil
+	}
+
+	types := []string{}
+	for taskType := range typed {
+		if readable(taskType) && (q.Types == nil || contains(q.Types, taskType)) {
+			types = append(types, taskType)
+		}
+	}
+	sort.Strings(types)
+	q.Types = types
+	return q, nil
+}
+
+// Filter returns a filter that only passes tasks userId may perform
+// action on. tasks that fail to authorize are dropped
+func (a Authorizer) Filter(userId string, action Action) (TaskFilter, error) {
+	policies, err := auth.ReadPolicies(a.Store, userId)
+	if err != nil {
+		return nil, err
+	}
+	return func(t *Task) bool {
+		return Authorize(policies, userId, action, t) == nil
+	}, nil
+}
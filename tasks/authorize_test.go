@@ -0,0 +1,130 @@
+package tasks
+
+import (
+	"github.com/datatogether/task_mgmt/auth"
+	"github.com/ipfs/go-datastore"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	RegisterTaskdef("test.url", newUrlTask)
+	RegisterPrivileged("test.url", func(t Taskable) bool {
+		return t.(*urlTask).Url == "http://expensive.com"
+	})
+
+	store := datastore.NewMapDatastore()
+	for _, p := range []*auth.Policy{
+		auth.NewPolicy(auth.Wildcard, auth.Wildcard, auth.RoleViewer),
+		auth.NewPolicy("submitter", "test.url", auth.RoleSubmitter),
+		auth.NewPolicy("admin", auth.Wildcard, auth.RoleAdmin),
+	} {
+		if err := p.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	cheap := &Task{Type: "test.url", UserId: "submitter", Params: map[string]interface{}{"url": "http://a.com"}}
+	expensive := &Task{Type: "test.url", UserId: "submitter", Params: map[string]interface{}{"url": "http://expensive.com"}}
+	others := &Task{Type: "test.url", UserId: "someone_else", Params: map[string]interface{}{"url": "http://a.com"}}
+
+	cases := []struct {
+		userId string
+		action Action
+		task   *Task
+		err    error
+	}{
+		{"", ActionRead, cheap, nil},
+		{"", ActionSubmit, cheap, auth.ErrForbidden},
+		{"viewer", ActionRead, cheap, nil},
+		{"viewer", ActionSubmit, cheap, auth.ErrForbidden},
+		{"submitter", ActionSubmit, cheap, nil},
+		{"submitter", ActionSubmit, expensive, auth.ErrForbidden},
+		{"submitter", ActionCancel, cheap, nil},
+		{"submitter", ActionCancel, others, auth.ErrForbidden},
+		{"submitter", ActionRetry, cheap, nil},
+		{"submitter", ActionRetry, expensive, auth.ErrForbidden},
+		{"submitter", ActionRetry, others, auth.ErrForbidden},
+		{"admin", ActionSubmit, expensive, nil},
+		{"admin", ActionCancel, others, nil},
+		{"admin", ActionRetry, others, nil},
+	}
+
+	a := Authorizer{Store: store}
+	for i, c := range cases {
+		if err := a.Authorize(c.userId, c.action, c.task); err != c.err {
+			t.Errorf("case %d: %s %s error mismatch. expected: %v, got: %v", i, c.userId, c.action, c.err, err)
+		}
+	}
+
+	filter, err := a.Filter("viewer", ActionSubmit)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if filter(cheap) {
+		t.Errorf("expected viewer filter to reject submitting")
+	}
+
+	filter, err = a.Filter("submitter", ActionRetry)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !filter(cheap) || filter(others) {
+		t.Errorf("expected submitter filter to only pass retrying their own tasks")
+	}
+}
+
+func TestReadable(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	RegisterTaskdef("test.url", newUrlTask)
+
+	store := datastore.NewMapDatastore()
+	for _, p := range []*auth.Policy{
+		auth.NewPolicy(auth.Wildcard, auth.Wildcard, auth.RoleViewer),
+		auth.NewPolicy("hidden", "test.url", auth.RoleNone),
+		auth.NewPolicy("narrow", auth.Wildcard, auth.RoleNone),
+		auth.NewPolicy("narrow", "test", auth.RoleViewer),
+	} {
+		if err := p.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	ts := []*Task{{Title: "test", Type: "test"}, {Title: "url", Type: "test.url"}}
+	for _, task := range ts {
+		if err := task.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	cases := []struct {
+		userId string
+		expect []string
+	}{
+		{"viewer", []string{"test", "test.url"}},
+		{"hidden", []string{"test"}},
+		{"narrow", []string{"test"}},
+	}
+
+	a := Authorizer{Store: store}
+	for _, c := range cases {
+		q, err := a.Readable(c.userId, TaskQuery{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		got, err := ReadTaskQuery(store, q)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		types := []string{}
+		for _, task := range got {
+			types = append(types, task.Type)
+		}
+		sort.Strings(types)
+		if strings.Join(types, ",") != strings.Join(c.expect, ",") {
+			t.Errorf("%s: expected readable types %v, got: %v", c.userId, c.expect, types)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package tasks
+
+import (
+	"sync"
+)
+
+// Broker carries updates from the workers performing tasks to anyone
+// following them. Updates are best-effort, subscribers that need every
+// state change should also check the store
+type Broker interface {
+	// Publish sends the current state of t to it's subscribers
+	Publish(t *Task) error
+	// Subscribe sends updates published for the task with id taskId to
+	// updates until cancel is called
+	Subscribe(taskId string) (updates <-chan *Task, cancel func(), err error)
+}
+
+// MemBroker is a Broker for subscribers in the same process as the
+// workers publishing updates
+type MemBroker struct {
+	lock sync.Mutex
+	subs map[string]map[chan *Task]bool
+}
+
+// NewMemBroker creates an in-process broker
+func NewMemBroker() *MemBroker {
+	return &MemBroker{subs: map[string]map[chan *Task]bool{}}
+}
+
+// Publish fulfills the Broker interface. Subscribers that aren't keeping
+// up miss updates rather than blocking the publisher
+func (b *MemBroker) Publish(t *Task) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for ch := range b.subs[t.Id] {
+		// publishers keep changing the task they publish, send a copy
+		update := *t
+		select {
+		case ch <- &update:
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscribe fulfills the Broker interface
+func (b *MemBroker) Subscribe(taskId string) (<-chan *Task, func(), error) {
+	ch := make(chan *Task, 10)
+
+	b.lock.Lock()
+	if b.subs[taskId] == nil {
+		b.subs[taskId] = map[chan *Task]bool{}
+	}
+	b.subs[taskId][ch] = true
+	b.lock.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			delete(b.subs[taskId], ch)
+			if len(b.subs[taskId]) == 0 {
+				delete(b.subs, taskId)
+			}
+		})
+	}
+	return ch, cancel, nil
+}
@@ -0,0 +1,367 @@
+package tasks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pborman/uuid"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Checkpointer persists an opaque cursor on behalf of a running task.
+// If a task is redelivered after a crash or retry, the last saved
+// checkpoint will be available to Load, letting the task resume
+// instead of starting over
+type Checkpointer interface {
+	// Load reads the last saved checkpoint into v, returning false
+	// if no checkpoint has been saved
+	Load(v interface{}) (bool, error)
+	// Save persists v as the task's current checkpoint, v must be
+	// json-serializable
+	Save(v interface{}) error
+	// Append adds v to the end of the task's checkpoint log, v must be
+	// json-serializable. unlike Save, the cost of appending doesn't grow
+	// with the checkpoint, cursors that record every item of work done
+	// should append each item
+	Append(v interface{}) error
+	// Entries calls each with the json of every entry appended to the
+	// checkpoint log, oldest first
+	Entries(each func(data []byte) error) error
+}
+
+// CheckpointTaskable is a task that can resume from a checkpoint. task-orchestrators
+// will detect this method and call it before calling Taskable.Do
+type CheckpointTaskable interface {
+	Taskable
+	SetCheckpointer(c Checkpointer)
+}
+
+// storeCheckpointer is a Checkpointer that writes checkpoints
+// to a datastore, keyed by task id
+type storeCheckpointer struct {
+	store  datastore.Datastore
+	taskId string
+}
+
+// NewCheckpointer creates a Checkpointer that persists checkpoints
+// for the given task id to store
+func NewCheckpointer(store datastore.Datastore, taskId string) Checkpointer {
+	return &storeCheckpointer{store: store, taskId: taskId}
+}
+
+func (c *storeCheckpointer) Load(v interface{}) (bool, error) {
+	cp := &Checkpoint{Id: c.taskId}
+	if err := cp.Read(c.store); err == datastore.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err := json.Unmarshal(cp.Data, v); err != nil {
+		return false, fmt.Errorf("error decoding checkpoint: %s", err.Error())
+	}
+	return true, nil
+}
+
+func (c *storeCheckpointer) Save(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding checkpoint: %s", err.Error())
+	}
+
+	cp := &Checkpoint{
+		Id:      c.taskId,
+		Updated: time.Now().Round(time.Second).In(time.UTC),
+		Data:    data,
+	}
+	return c.store.Put(cp.Key(), cp)
+}
+
+func (c *storeCheckpointer) Append(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding checkpoint entry: %s", err.Error())
+	}
+
+	e := &CheckpointEntry{
+		// entry ids are prefixed with their task id so that entries for a
+		// single task can be queried by key prefix
+		Id:      fmt.Sprintf("%s.%s", c.taskId, uuid.New()),
+		TaskId:  c.taskId,
+		Created: time.Now().In(time.UTC),
+		Data:    data,
+	}
+	return c.store.Put(e.Key(), e)
+}
+
+func (c *storeCheckpointer) Entries(each func(data []byte) error) error {
+	entries, err := readCheckpointEntries(c.store, c.taskId)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := each(e.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCheckpointEntries reads the checkpoint log for a task, oldest first
+func readCheckpointEntries(store datastore.Datastore, taskId string) ([]*CheckpointEntry, error) {
+	entries := []*CheckpointEntry{}
+	if db := sqlDB(store); db != nil {
+		// the log can be far longer than the datastore will page through
+		rows, err := db.Query(qCheckpointEntriesAll, taskId)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			e := &CheckpointEntry{}
+			if err := e.UnmarshalSQL(rows); err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		}
+		return entries, rows.Err()
+	}
+
+	res, err := store.Query(query.Query{
+		Prefix:  fmt.Sprintf("/%s:%s.", CheckpointEntry{}.DatastoreType(), taskId),
+		Filters: []query.Filter{sql_datastore.FilterKeyTypeEq(CheckpointEntry{}.DatastoreType())},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		e, ok := r.Value.(*CheckpointEntry)
+		if !ok {
+			return nil, fmt.Errorf("Invalid Response")
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
+
+// deleteCheckpoint removes a task's checkpoint & checkpoint log
+func deleteCheckpoint(store datastore.Datastore, taskId string) error {
+	cp := &Checkpoint{Id: taskId}
+	if err := cp.Delete(store); err != nil && err != datastore.ErrNotFound {
+		return err
+	}
+
+	if db := sqlDB(store); db != nil {
+		_, err := db.Exec(qCheckpointEntriesDelete, taskId)
+		return err
+	}
+	entries, err := readCheckpointEntries(store, taskId)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := store.Delete(e.Key()); err != nil && err != datastore.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checkpoint is the stored cursor for a task, Id matches the task's id
+type Checkpoint struct {
+	// id of the task this checkpoint belongs to
+	Id string `json:"id"`
+	// last time the checkpoint was saved
+	Updated time.Time `json:"updated"`
+	// opaque json-encoded cursor
+	Data []byte `json:"data"`
+}
+
+// DatastoreType is to fulfill the sql_datastore.Model interface
+func (c Checkpoint) DatastoreType() string {
+	return "Checkpoint"
+}
+
+// GetId returns the id of the task this checkpoint belongs to
+func (c Checkpoint) GetId() string {
+	return c.Id
+}
+
+// Key is to fulfill the sql_datastore.Model interface
+func (c Checkpoint) Key() datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%s:%s", c.DatastoreType(), c.GetId()))
+}
+
+func (c *Checkpoint) Read(store datastore.Datastore) error {
+	ci, err := store.Get(c.Key())
+	if err != nil {
+		return err
+	}
+
+	got, ok := ci.(*Checkpoint)
+	if !ok {
+		return fmt.Errorf("Invalid Response")
+	}
+	*c = *got
+	return nil
+}
+
+func (c *Checkpoint) Delete(store datastore.Datastore) error {
+	return store.Delete(c.Key())
+}
+
+func (c *Checkpoint) NewSQLModel(key datastore.Key) sql_datastore.Model {
+	return &Checkpoint{Id: key.Name()}
+}
+
+func (c *Checkpoint) SQLQuery(cmd sql_datastore.Cmd) string {
+	switch cmd {
+	case sql_datastore.CmdCreateTable:
+		return qCheckpointCreateTable
+	case sql_datastore.CmdExistsOne:
+		return qCheckpointExists
+	case sql_datastore.CmdSelectOne:
+		return qCheckpointRead
+	case sql_datastore.CmdInsertOne:
+		return qCheckpointInsert
+	case sql_datastore.CmdUpdateOne:
+		return qCheckpointUpdate
+	case sql_datastore.CmdDeleteOne:
+		return qCheckpointDelete
+	default:
+		return ""
+	}
+}
+
+func (c *Checkpoint) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		id      string
+		updated time.Time
+		data    []byte
+	)
+	if err := row.Scan(&id, &updated, &data); err != nil {
+		if err == sql.ErrNoRows {
+			return datastore.ErrNotFound
+		}
+		return err
+	}
+
+	*c = Checkpoint{
+		Id:      id,
+		Updated: updated,
+		Data:    data,
+	}
+	return nil
+}
+
+func (c *Checkpoint) SQLParams(cmd sql_datastore.Cmd) []interface{} {
+	switch cmd {
+	case sql_datastore.CmdSelectOne, sql_datastore.CmdExistsOne, sql_datastore.CmdDeleteOne:
+		return []interface{}{c.Id}
+	default:
+		return []interface{}{
+			c.Id,
+			c.Updated,
+			c.Data,
+		}
+	}
+}
+
+// CheckpointEntry is a single entry in a task's checkpoint log
+type CheckpointEntry struct {
+	// identifier for the entry, prefixed with the task id
+	Id string `json:"id"`
+	// task this entry belongs to
+	TaskId string `json:"taskId"`
+	// when the entry was appended
+	Created time.Time `json:"created"`
+	// opaque json-encoded entry
+	Data []byte `json:"data"`
+}
+
+// DatastoreType is to fulfill the sql_datastore.Model interface
+func (e CheckpointEntry) DatastoreType() string {
+	return "CheckpointEntry"
+}
+
+// GetId returns the entry's identifier
+func (e CheckpointEntry) GetId() string {
+	return e.Id
+}
+
+// Key is to fulfill the sql_datastore.Model interface
+func (e CheckpointEntry) Key() datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%s:%s", e.DatastoreType(), e.GetId()))
+}
+
+func (e *CheckpointEntry) NewSQLModel(key datastore.Key) sql_datastore.Model {
+	id := key.Name()
+	return &CheckpointEntry{Id: id, TaskId: strings.SplitN(id, ".", 2)[0]}
+}
+
+func (e *CheckpointEntry) SQLQuery(cmd sql_datastore.Cmd) string {
+	switch cmd {
+	case sql_datastore.CmdCreateTable:
+		return qCheckpointEntryCreateTable
+	case sql_datastore.CmdExistsOne:
+		return qCheckpointEntryExists
+	case sql_datastore.CmdSelectOne:
+		return qCheckpointEntryRead
+	case sql_datastore.CmdInsertOne:
+		return qCheckpointEntryInsert
+	case sql_datastore.CmdUpdateOne:
+		return qCheckpointEntryUpdate
+	case sql_datastore.CmdDeleteOne:
+		return qCheckpointEntryDelete
+	default:
+		return ""
+	}
+}
+
+func (e *CheckpointEntry) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		id, taskId string
+		created    time.Time
+		data       []byte
+	)
+	if err := row.Scan(&id, &taskId, &created, &data); err != nil {
+		if err == sql.ErrNoRows {
+			return datastore.ErrNotFound
+		}
+		return err
+	}
+
+	*e = CheckpointEntry{
+		Id:      id,
+		TaskId:  taskId,
+		Created: created,
+		Data:    data,
+	}
+	return nil
+}
+
+func (e *CheckpointEntry) SQLParams(cmd sql_datastore.Cmd) []interface{} {
+	switch cmd {
+	case sql_datastore.CmdSelectOne, sql_datastore.CmdExistsOne, sql_datastore.CmdDeleteOne:
+		return []interface{}{e.Id}
+	default:
+		return []interface{}{
+			e.Id,
+			e.TaskId,
+			e.Created,
+			e.Data,
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package tasks
+
+import (
+	"fmt"
+	"github.com/ipfs/go-datastore"
+	"testing"
+)
+
+type checkpointTask struct {
+	cp      Checkpointer
+	resumed bool
+}
+
+func newCheckpointTask() Taskable {
+	return &checkpointTask{}
+}
+
+func (c *checkpointTask) Valid() error {
+	return nil
+}
+
+func (c *checkpointTask) SetCheckpointer(cp Checkpointer) {
+	c.cp = cp
+}
+
+func (c *checkpointTask) Do(updates chan Progress) {
+	cursor := struct{ Offset int }{}
+	ok, err := c.cp.Load(&cursor)
+	if err != nil {
+		updates <- Progress{Error: err}
+		return
+	}
+	if !ok {
+		cursor.Offset = 10
+		c.cp.Save(cursor)
+		updates <- Progress{Error: errTestInterrupted}
+		return
+	}
+	updates <- Progress{Done: true, Status: "resumed"}
+}
+
+var errTestInterrupted = fmt.Errorf("interrupted")
+
+func TestCheckpointResume(t *testing.T) {
+	RegisterTaskdef("test.checkpoint", newCheckpointTask)
+	store := datastore.NewMapDatastore()
+
+	task := &Task{Type: "test.checkpoint"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tc := make(chan *Task, 10)
+	if err := task.Do(store, tc); err != errTestInterrupted {
+		t.Fatalf("expected first run to be interrupted, got: %v", err)
+	}
+
+	cursor := struct{ Offset int }{}
+	if ok, err := NewCheckpointer(store, task.Id).Load(&cursor); err != nil || !ok {
+		t.Fatalf("expected checkpoint to be saved. ok: %t, err: %v", ok, err)
+	}
+	if cursor.Offset != 10 {
+		t.Errorf("checkpoint offset mismatch. expected: %d, got: %d", 10, cursor.Offset)
+	}
+
+	if err := task.Do(store, tc); err != nil {
+		t.Fatalf("expected resumed run to succeed, got: %s", err.Error())
+	}
+	if task.Progress.Status != "resumed" {
+		t.Errorf("expected task to resume from checkpoint")
+	}
+
+	if ok, _ := NewCheckpointer(store, task.Id).Load(&cursor); ok {
+		t.Errorf("expected checkpoint to be removed after success")
+	}
+}
+
+func TestCheckpointLog(t *testing.T) {
+	store := datastore.NewMapDatastore()
+	cp := NewCheckpointer(store, "task")
+	for i := 0; i < 3; i++ {
+		if err := cp.Append(i); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// entries for other tasks aren't read
+	if err := NewCheckpointer(store, "other").Append(10); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	got := ""
+	err := cp.Entries(func(data []byte) error {
+		got += string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got != "012" {
+		t.Errorf("expected entries 0, 1 & 2 in order, got: %s", got)
+	}
+
+	if err := deleteCheckpoint(store, "task"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if entries, err := readCheckpointEntries(store, "task"); err != nil || len(entries) != 0 {
+		t.Errorf("expected deleting the checkpoint to remove it's log, got: %d entries, %v", len(entries), err)
+	}
+	if entries, _ := readCheckpointEntries(store, "other"); len(entries) != 1 {
+		t.Errorf("expected other task's log to be kept, got %d entries", len(entries))
+	}
+}
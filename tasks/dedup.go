@@ -0,0 +1,294 @@
+package tasks
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"sync"
+	"time"
+)
+
+// DedupKeyFunc produces a key that identifies the work a task will do,
+// two tasks of the same type with the same key are considered duplicates.
+// returning an empty string opts a task out of deduplication
+type DedupKeyFunc func(t Taskable) string
+
+// dedupRule pairs a key func with the window of time that a succeeded
+// task will continue to absorb duplicate submissions
+type dedupRule struct {
+	key    DedupKeyFunc
+	window time.Duration
+}
+
+// dedupRules is an internal registry of deduplication rules, keyed by task type
+var dedupRules = map[string]dedupRule{}
+
+// RegisterDedupKey declares a deduplication rule for a task type, it should be
+// called alongside RegisterTaskdef. New submissions that produce the same key as
+// an active task, or a task that succeeded within window will be coalesced
+// into the existing task instead of being enqueued.
+func RegisterDedupKey(name string, window time.Duration, f DedupKeyFunc) {
+	dedupRules[name] = dedupRule{key: f, window: window}
+}
+
+// DedupKey returns the deduplication key for this task, an empty string
+// means the task type has no dedup rule, or the rule opted out for these params
+func (t *Task) DedupKey() (string, error) {
+	rule, ok := dedupRules[t.Type]
+	if !ok {
+		return "", nil
+	}
+
+	tt, err := t.taskable()
+	if err != nil {
+		return "", err
+	}
+
+	key := rule.key(tt)
+	if key == "" {
+		return "", nil
+	}
+
+	// hash the key to keep it safe for use as a datastore key
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s", t.Type, key)))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// FindDuplicate checks store for a task that t should be coalesced into,
+// returning nil if no such task exists
+func FindDuplicate(store datastore.Datastore, t *Task) (*Task, error) {
+	key, err := t.DedupKey()
+	if err != nil || key == "" {
+		return nil, err
+	}
+
+	d := &TaskDedup{Id: key}
+	if err := d.Read(store); err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	prev := &Task{Id: d.TaskId}
+	if err := prev.Read(store); err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// never coalesce a task into itself
+	if prev.Id == t.Id || !prev.holdsDedupKey() {
+		return nil, nil
+	}
+	return prev, nil
+}
+
+// holdsDedupKey reports weather t absorbs duplicate submissions, which it
+// does until it fails, or for the dedup window after it succeeds
+func (t *Task) holdsDedupKey() bool {
+	if t.Failed != nil {
+		return false
+	}
+	return t.Succeeded == nil || time.Since(*t.Succeeded) < dedupRules[t.Type].window
+}
+
+// dedupLock serializes claiming dedup keys in stores that aren't backed by
+// postgres, which are only shared within this process
+var dedupLock sync.Mutex
+
+// Coalesce saves t as a new task that claims it's dedup key. if a duplicate
+// task already holds the key t is replaced with the duplicate instead &
+// true is returned. Callers should skip enqueuing coalesced tasks
+func (t *Task) Coalesce(store datastore.Datastore) (bool, error) {
+	key, err := t.DedupKey()
+	if err != nil {
+		return false, err
+	}
+	if key == "" {
+		return false, t.Save(store)
+	}
+	if t.Id != "" {
+		// tasks that already exist have made their claim
+		if exists, err := store.Has(t.Key()); err != nil || exists {
+			return false, t.Save(store)
+		}
+	}
+
+	if db := sqlDB(store); db != nil {
+		return t.claimDedup(db, key)
+	}
+
+	dedupLock.Lock()
+	defer dedupLock.Unlock()
+	dup, err := FindDuplicate(store, t)
+	if err != nil {
+		return false, err
+	} else if dup != nil {
+		*t = *dup
+		return true, nil
+	}
+	return false, t.Save(store)
+}
+
+// claimDedup inserts t as a new task holding key in a single transaction.
+// The key's row is locked until the task is written, so concurrent claims
+// for the same key see either no holder or a task they coalesce into
+func (t *Task) claimDedup(db *sql.DB, key string) (coalesced bool, err error) {
+	if err := t.valid(); err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil || coalesced {
+			tx.Rollback()
+		}
+	}()
+
+	t.setCreated()
+	t.bumpVersion()
+	if _, err = tx.Exec(qTaskDedupClaim, key, t.Id, t.Created); err != nil {
+		return false, err
+	}
+
+	var holder string
+	if err = tx.QueryRow(qTaskDedupLock, key).Scan(&holder); err != nil {
+		return false, err
+	}
+	if holder != t.Id {
+		prev := &Task{}
+		if err = prev.UnmarshalSQL(tx.QueryRow(qTaskReadById, holder)); err == nil && prev.holdsDedupKey() {
+			*t = *prev
+			return true, nil
+		} else if err != nil && err != datastore.ErrNotFound {
+			return false, err
+		}
+		if _, err = tx.Exec(qTaskDedupUpdate, key, t.Id, t.Created); err != nil {
+			return false, err
+		}
+	}
+
+	if _, err = tx.Exec(qTaskInsert, t.SQLParams(sql_datastore.CmdInsertOne)...); err != nil {
+		return false, err
+	}
+	return false, tx.Commit()
+}
+
+// recordDedup points the dedup key for t at t, so future duplicate
+// submissions will find it
+func (t *Task) recordDedup(store datastore.Datastore) error {
+	key, err := t.DedupKey()
+	if err != nil || key == "" {
+		return err
+	}
+
+	d := &TaskDedup{
+		Id:      key,
+		TaskId:  t.Id,
+		Created: time.Now().Round(time.Second).In(time.UTC),
+	}
+	return store.Put(d.Key(), d)
+}
+
+// TaskDedup maps a deduplication key to the most recent task
+// submitted with that key
+type TaskDedup struct {
+	// hashed dedup key, see Task.DedupKey
+	Id string `json:"id"`
+	// id of the task this key currently resolves to
+	TaskId string `json:"taskId"`
+	// when this record was last written
+	Created time.Time `json:"created"`
+}
+
+// DatastoreType is to fulfill the sql_datastore.Model interface
+func (d TaskDedup) DatastoreType() string {
+	return "TaskDedup"
+}
+
+// GetId returns the dedup key
+func (d TaskDedup) GetId() string {
+	return d.Id
+}
+
+// Key is to fulfill the sql_datastore.Model interface
+func (d TaskDedup) Key() datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%s:%s", d.DatastoreType(), d.GetId()))
+}
+
+func (d *TaskDedup) Read(store datastore.Datastore) error {
+	di, err := store.Get(d.Key())
+	if err != nil {
+		return err
+	}
+
+	got, ok := di.(*TaskDedup)
+	if !ok {
+		return fmt.Errorf("Invalid Response")
+	}
+	*d = *got
+	return nil
+}
+
+func (d *TaskDedup) NewSQLModel(key datastore.Key) sql_datastore.Model {
+	return &TaskDedup{Id: key.Name()}
+}
+
+func (d *TaskDedup) SQLQuery(cmd sql_datastore.Cmd) string {
+	switch cmd {
+	case sql_datastore.CmdCreateTable:
+		return qTaskDedupCreateTable
+	case sql_datastore.CmdExistsOne:
+		return qTaskDedupExists
+	case sql_datastore.CmdSelectOne:
+		return qTaskDedupRead
+	case sql_datastore.CmdInsertOne:
+		return qTaskDedupInsert
+	case sql_datastore.CmdUpdateOne:
+		return qTaskDedupUpdate
+	case sql_datastore.CmdDeleteOne:
+		return qTaskDedupDelete
+	default:
+		return ""
+	}
+}
+
+func (d *TaskDedup) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		id, taskId string
+		created    time.Time
+	)
+	if err := row.Scan(&id, &taskId, &created); err != nil {
+		if err == sql.ErrNoRows {
+			return datastore.ErrNotFound
+		}
+		return err
+	}
+
+	*d = TaskDedup{
+		Id:      id,
+		TaskId:  taskId,
+		Created: created,
+	}
+	return nil
+}
+
+func (d *TaskDedup) SQLParams(cmd sql_datastore.Cmd) []interface{} {
+	switch cmd {
+	case sql_datastore.CmdSelectOne, sql_datastore.CmdExistsOne, sql_datastore.CmdDeleteOne:
+		return []interface{}{d.Id}
+	default:
+		return []interface{}{
+			d.Id,
+			d.TaskId,
+			d.Created,
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package tasks
+
+import (
+	"github.com/ipfs/go-datastore"
+	"sync"
+	"testing"
+	"time"
+)
+
+type urlTask struct {
+	Url string `json:"url"`
+}
+
+func newUrlTask() Taskable {
+	return &urlTask{}
+}
+
+func (u urlTask) Valid() error {
+	return nil
+}
+
+func (u urlTask) Do(updates chan Progress) {
+	updates <- Progress{Done: true}
+}
+
+func urlTaskDedupKey(t Taskable) string {
+	return t.(*urlTask).Url
+}
+
+func TestFindDuplicate(t *testing.T) {
+	RegisterTaskdef("test.url", newUrlTask)
+	RegisterDedupKey("test.url", time.Hour, urlTaskDedupKey)
+
+	store := datastore.NewMapDatastore()
+	now := time.Now()
+
+	a := &Task{Type: "test.url", Params: map[string]interface{}{"url": "http://a.com"}, Enqueued: &now}
+	if err := a.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := []struct {
+		url       string
+		succeeded *time.Time
+		dup       bool
+	}{
+		{"http://a.com", nil, true},
+		{"http://b.com", nil, false},
+		{"http://a.com", &now, true},
+		{"http://a.com", timePtr(now.Add(-2 * time.Hour)), false},
+	}
+
+	for i, c := range cases {
+		a.Succeeded = c.succeeded
+		if err := a.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		b := &Task{Type: "test.url", Params: map[string]interface{}{"url": c.url}}
+		got, err := FindDuplicate(store, b)
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err.Error())
+			continue
+		}
+		if c.dup && (got == nil || got.Id != a.Id) {
+			t.Errorf("case %d expected duplicate of task %s, got: %v", i, a.Id, got)
+		}
+		if !c.dup && got != nil {
+			t.Errorf("case %d expected no duplicate, got: %s", i, got.Id)
+		}
+	}
+}
+
+func TestCoalesceConcurrent(t *testing.T) {
+	RegisterTaskdef("test.url", newUrlTask)
+	RegisterDedupKey("test.url", time.Hour, urlTaskDedupKey)
+
+	store := NewLockedStore(datastore.NewMapDatastore())
+	submit := func() *Task {
+		return &Task{Type: "test.url", Params: map[string]interface{}{"url": "http://a.com"}}
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan *Task, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task := submit()
+			coalesced, err := task.Coalesce(store)
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			if !coalesced {
+				results <- task
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	created := []*Task{}
+	for task := range results {
+		created = append(created, task)
+	}
+	if len(created) != 1 {
+		t.Fatalf("expected exactly one of 10 concurrent submissions to be created, got: %d", len(created))
+	}
+
+	// failing frees the key for new submissions
+	a := created[0]
+	a.Failed = timePtr(time.Now())
+	if err := a.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	b := submit()
+	if coalesced, err := b.Coalesce(store); err != nil {
+		t.Fatal(err.Error())
+	} else if coalesced || b.Id == a.Id {
+		t.Errorf("expected a new task once the duplicate failed, got: %s", b.Id)
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,204 @@
+package tasks
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pborman/uuid"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EventType names a change in the lifecycle of a task
+type EventType string
+
+const (
+	// EventEnqueued is logged when a task is sent to the queue
+	EventEnqueued EventType = "enqueued"
+	// EventRequeued is logged when a task is sent back to the queue
+	EventRequeued EventType = "requeued"
+	// EventStarted is logged when a worker starts a task
+	EventStarted EventType = "started"
+	// EventProgress is logged when a running task reports a new status
+	EventProgress EventType = "progress"
+	// EventSucceeded is logged when a task completes
+	EventSucceeded EventType = "succeeded"
+	// EventFailed is logged when a task errors
+	EventFailed EventType = "failed"
+	// EventCancelled is logged when a task is cancelled
+	EventCancelled EventType = "cancelled"
+	// EventRetried is logged when a failed task is retried
+	EventRetried EventType = "retried"
+)
+
+// TaskEvent is an entry in the log of changes to a task
+type TaskEvent struct {
+	// identifier for the event, prefixed with the task id
+	Id string `json:"id"`
+	// task this event belongs to
+	TaskId string `json:"taskId"`
+	// when the event occurred
+	Created time.Time `json:"created"`
+	// kind of event
+	Type EventType `json:"type"`
+	// human-readable description of the event
+	Message string `json:"message,omitempty"`
+}
+
+// DatastoreType is to fulfill the sql_datastore.Model interface
+func (e TaskEvent) DatastoreType() string {
+	return "TaskEvent"
+}
+
+// GetId returns an event's cannonical identifier
+func (e TaskEvent) GetId() string {
+	return e.Id
+}
+
+// Key is to fulfill the sql_datastore.Model interface
+func (e TaskEvent) Key() datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%s:%s", e.DatastoreType(), e.GetId()))
+}
+
+// LogEvent adds an event to the task's event log
+func (t *Task) LogEvent(store datastore.Datastore, typ EventType, message string) error {
+	if t.Id == "" {
+		return fmt.Errorf("can't log events for a task without an id")
+	}
+
+	e := &TaskEvent{
+		// event ids are prefixed with their task id so that events for a
+		// single task can be queried by key prefix
+		Id:      fmt.Sprintf("%s.%s", t.Id, uuid.New()),
+		TaskId:  t.Id,
+		Created: time.Now().In(time.UTC),
+		Type:    typ,
+		Message: message,
+	}
+	if err := store.Put(e.Key(), e); err != nil {
+		return err
+	}
+
+	for _, h := range eventHandlers {
+		h(t, e)
+	}
+	return nil
+}
+
+// EventHandler is called with each event logged, & the task it was
+// logged for. handlers are called synchronously & must not block
+type EventHandler func(t *Task, e *TaskEvent)
+
+// eventHandlers are called after each event is logged
+var eventHandlers []EventHandler
+
+// HandleEvents registers h to be called with every event logged by this process
+func HandleEvents(h EventHandler) {
+	eventHandlers = append(eventHandlers, h)
+}
+
+// ReadTaskEvents reads the event log for a task from store, oldest first
+func ReadTaskEvents(store datastore.Datastore, taskId string) ([]*TaskEvent, error) {
+	q := query.Query{
+		Prefix:  fmt.Sprintf("/%s:%s.", TaskEvent{}.DatastoreType(), taskId),
+		Filters: []query.Filter{sql_datastore.FilterKeyTypeEq(TaskEvent{}.DatastoreType())},
+		Limit:   1000,
+	}
+
+	res, err := store.Query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*TaskEvent{}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		e, ok := r.Value.(*TaskEvent)
+		if !ok {
+			return nil, fmt.Errorf("Invalid Response")
+		}
+		events = append(events, e)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Created.Before(events[j].Created)
+	})
+	return events, nil
+}
+
+// NewSQLModel creates an event from key. list queries are keyed by
+// task id with a trailing "."
+func (e *TaskEvent) NewSQLModel(key datastore.Key) sql_datastore.Model {
+	id := key.Name()
+	if strings.HasSuffix(id, ".") {
+		return &TaskEvent{TaskId: strings.TrimSuffix(id, ".")}
+	}
+	return &TaskEvent{Id: id, TaskId: strings.SplitN(id, ".", 2)[0]}
+}
+
+func (e *TaskEvent) SQLQuery(cmd sql_datastore.Cmd) string {
+	switch cmd {
+	case sql_datastore.CmdCreateTable:
+		return qTaskEventCreateTable
+	case sql_datastore.CmdExistsOne:
+		return qTaskEventExists
+	case sql_datastore.CmdSelectOne:
+		return qTaskEventRead
+	case sql_datastore.CmdInsertOne:
+		return qTaskEventInsert
+	case sql_datastore.CmdUpdateOne:
+		return qTaskEventUpdate
+	case sql_datastore.CmdDeleteOne:
+		return qTaskEventDelete
+	case sql_datastore.CmdList:
+		return qTaskEvents
+	default:
+		return ""
+	}
+}
+
+func (e *TaskEvent) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		id, taskId, typ, message string
+		created                  time.Time
+	)
+	if err := row.Scan(&id, &taskId, &created, &typ, &message); err != nil {
+		if err == sql.ErrNoRows {
+			return datastore.ErrNotFound
+		}
+		return err
+	}
+
+	*e = TaskEvent{
+		Id:      id,
+		TaskId:  taskId,
+		Created: created,
+		Type:    EventType(typ),
+		Message: message,
+	}
+	return nil
+}
+
+func (e *TaskEvent) SQLParams(cmd sql_datastore.Cmd) []interface{} {
+	switch cmd {
+	case sql_datastore.CmdSelectOne, sql_datastore.CmdExistsOne, sql_datastore.CmdDeleteOne:
+		return []interface{}{e.Id}
+	case sql_datastore.CmdList:
+		return []interface{}{e.TaskId}
+	default:
+		return []interface{}{
+			e.Id,
+			e.TaskId,
+			e.Created,
+			string(e.Type),
+			e.Message,
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package tasks
+
+import (
+	"context"
+	"github.com/ipfs/go-datastore"
+	"testing"
+	"time"
+)
+
+func TestTaskEvents(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	task := &Task{Title: "events", Type: "test"}
+	other := &Task{Title: "other", Type: "test"}
+	for _, tsk := range []*Task{task, other} {
+		if err := tsk.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	tc := make(chan *Task, 10)
+	go func() {
+		for range tc {
+		}
+	}()
+	for _, tsk := range []*Task{task, other} {
+		if err := tsk.Do(store, tc); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	events, err := ReadTaskEvents(store, task.Id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := []EventType{EventStarted, EventSucceeded}
+	if len(events) != len(expect) {
+		t.Fatalf("expected %d events, got: %d", len(expect), len(events))
+	}
+	for i, e := range events {
+		if e.TaskId != task.Id {
+			t.Errorf("event %d task id mismatch. expected: %s, got: %s", i, task.Id, e.TaskId)
+		}
+		if e.Type != expect[i] {
+			t.Errorf("event %d type mismatch. expected: %s, got: %s", i, expect[i], e.Type)
+		}
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	task := &Task{Title: "handled", Type: "test"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	handled := []EventType{}
+	HandleEvents(func(tsk *Task, e *TaskEvent) {
+		if tsk.Id == task.Id {
+			handled = append(handled, e.Type)
+		}
+	})
+
+	if err := task.LogEvent(store, EventEnqueued, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := task.Cancel(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := []EventType{EventEnqueued, EventCancelled}
+	if len(handled) != len(expect) {
+		t.Fatalf("expected %d handled events, got: %d", len(expect), len(handled))
+	}
+	for i, typ := range expect {
+		if handled[i] != typ {
+			t.Errorf("event %d type mismatch. expected: %s, got: %s", i, typ, handled[i])
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	parent := &Task{Title: "parent", Type: "test"}
+	if err := parent.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	child := &Task{Title: "child", Type: "test", ParentId: parent.Id}
+	if err := child.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := parent.Cancel(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := child.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !parent.Cancelled() || !child.Cancelled() {
+		t.Errorf("expected parent & child to be cancelled")
+	}
+
+	if err := parent.Cancel(store); err == nil {
+		t.Errorf("expected cancelling a finished task to error")
+	}
+
+	// cancelled tasks that get delivered to a worker shouldn't run
+	tc := make(chan *Task, 10)
+	go func() {
+		for range tc {
+		}
+	}()
+	if err := child.Do(store, tc); err != ErrTaskCancelled {
+		t.Errorf("expected performing a cancelled task to return ErrTaskCancelled, got: %v", err)
+	}
+}
+
+// blockingTask runs until it's context is cancelled
+type blockingTask struct {
+	ctx     context.Context
+	stopped chan bool
+}
+
+func (t *blockingTask) Valid() error                   { return nil }
+func (t *blockingTask) SetContext(ctx context.Context) { t.ctx = ctx }
+func (t *blockingTask) Do(updates chan Progress) {
+	updates <- Progress{Status: "blocking"}
+	<-t.ctx.Done()
+	t.stopped <- true
+	updates <- Progress{Error: t.ctx.Err()}
+}
+
+func TestCancelStopsTaskable(t *testing.T) {
+	stopped := make(chan bool, 1)
+	RegisterTaskdef("test.blocking", func() Taskable { return &blockingTask{stopped: stopped} })
+	interval := cancelCheckInterval
+	cancelCheckInterval = 10 * time.Millisecond
+	defer func() { cancelCheckInterval = interval }()
+
+	store := NewLockedStore(datastore.NewMapDatastore())
+	task := &Task{Title: "blocking", Type: "test.blocking"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tc := make(chan *Task, 10)
+	go func() {
+		for range tc {
+		}
+	}()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- task.Do(store, tc)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancelled := &Task{Id: task.Id}
+	if err := cancelled.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := cancelled.Cancel(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	select {
+	case err := <-errs:
+		if err != ErrTaskCancelled {
+			t.Errorf("expected ErrTaskCancelled, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled task didn't stop")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("expected the taskable's context to be cancelled")
+	}
+}
@@ -1,6 +1,8 @@
 package tasks
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 )
 
@@ -22,3 +24,36 @@ func (p Progress) String() string {
 	}
 	return fmt.Sprintf("%d/%d: %f - %s", p.Step, p.Steps, p.Percent, p.Status)
 }
+
+// progressJSON is the encoded form of progress, with Error as a string
+type progressJSON struct {
+	Percent float32 `json:"percent"`
+	Step    int     `json:"step"`
+	Steps   int     `json:"steps"`
+	Status  string  `json:"status"`
+	Done    bool    `json:"done"`
+	Dest    string  `json:"dest"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// MarshalJSON encodes progress, writing Error as it's message
+func (p Progress) MarshalJSON() ([]byte, error) {
+	pj := progressJSON{p.Percent, p.Step, p.Steps, p.Status, p.Done, p.Dest, ""}
+	if p.Error != nil {
+		pj.Error = p.Error.Error()
+	}
+	return json.Marshal(pj)
+}
+
+// UnmarshalJSON decodes progress written by MarshalJSON
+func (p *Progress) UnmarshalJSON(data []byte) error {
+	pj := progressJSON{}
+	if err := json.Unmarshal(data, &pj); err != nil {
+		return err
+	}
+	*p = Progress{pj.Percent, pj.Step, pj.Steps, pj.Status, pj.Done, pj.Dest, nil}
+	if pj.Error != "" {
+		p.Error = errors.New(pj.Error)
+	}
+	return nil
+}
@@ -14,7 +14,14 @@ CREATE TABLE tasks (
   enqueued         timestamp,
   started          timestamp,
   succeeded        timestamp,
-  failed           timestamp
+  failed           timestamp,
+  parent_id        text NOT NULL DEFAULT '',
+  subtasks         integer NOT NULL DEFAULT 0,
+  worker_id        text NOT NULL DEFAULT '',
+  attempts         integer NOT NULL DEFAULT 1,
+  version          bigint NOT NULL DEFAULT 0,
+  callback_url     text NOT NULL DEFAULT '',
+  parent_attempt   integer NOT NULL DEFAULT 0
 );`
 
 // an available task a source.Checksum && repo.LatestCommit combination that doesn't
@@ -43,31 +50,251 @@ WHERE
 const qTasks = `
 SELECT
   id, created, updated, title, user_id, type,
-  params, status, error, enqueued, started, succeeded, failed
+  params, status, error, enqueued, started, succeeded, failed,
+  parent_id, subtasks, worker_id, attempts, version, callback_url, parent_attempt
 FROM tasks
 ORDER BY created DESC
 LIMIT $1 OFFSET $2;`
 
+// qTasksWhere lists tasks, most recent first. it's formatted with a WHERE
+// clause, see TaskQuery
+const qTasksWhere = `
+SELECT
+  id, created, updated, title, user_id, type,
+  params, status, error, enqueued, started, succeeded, failed,
+  parent_id, subtasks, worker_id, attempts, version, callback_url, parent_attempt
+FROM tasks
+%s
+ORDER BY created DESC, id`
+
+// qTaskUsageActive counts a user's unfinished top-level tasks by type
+const qTaskUsageActive = `
+SELECT type, COUNT(*) FROM tasks
+WHERE user_id = $1 AND parent_id = '' AND succeeded IS NULL AND failed IS NULL
+GROUP BY type;`
+
+// qTaskUsageSince counts a user's top-level tasks created after $2 by type,
+// with the oldest creation time
+const qTaskUsageSince = `
+SELECT type, COUNT(*), MIN(created) FROM tasks
+WHERE user_id = $1 AND parent_id = '' AND created > $2
+GROUP BY type;`
+
 const qTaskExists = `SELECT exists(SELECT 1 FROM tasks WHERE id = $1);`
 
 const qTaskReadById = `
 SELECT 
   id, created, updated, title, user_id, type,
-  params, status, error, enqueued, started, succeeded, failed
+  params, status, error, enqueued, started, succeeded, failed,
+  parent_id, subtasks, worker_id, attempts, version, callback_url, parent_attempt
 FROM tasks
 WHERE id = $1;`
 
 const qTaskInsert = `
 INSERT INTO tasks
   (id, created, updated, title, user_id, type,
-   params, status, error, enqueued, started, succeeded, failed)
+   params, status, error, enqueued, started, succeeded, failed,
+   parent_id, subtasks, worker_id, attempts, version, callback_url, parent_attempt)
 VALUES
-  ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13);`
+  ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20);`
 
 const qTaskUpdate = `
 UPDATE tasks SET
   created = $2, updated = $3, title = $4, user_id = $5, type = $6,
-  params = $7, status = $8, error = $9, enqueued = $10, started = $11, succeeded = $12, failed = $13
+  params = $7, status = $8, error = $9, enqueued = $10, started = $11, succeeded = $12, failed = $13,
+  parent_id = $14, subtasks = $15, worker_id = $16, attempts = $17, version = $18, callback_url = $19,
+  parent_attempt = $20
 WHERE id = $1;`
 
 const qTaskDelete = `DELETE FROM tasks WHERE id = $1;`
+
+// qTaskClaim sets the worker of an unfinished task, unless it's held by
+// another worker that's heartbeated since $4
+const qTaskClaim = `
+UPDATE tasks SET
+  worker_id = $2, started = $3, updated = $3, version = GREATEST(version + 1, $5)
+WHERE id = $1 AND succeeded IS NULL AND failed IS NULL AND (
+  worker_id = '' OR worker_id = $2 OR NOT EXISTS (
+    SELECT 1 FROM workers WHERE workers.id::text = tasks.worker_id AND workers.heartbeat > $4
+  )
+);`
+
+const qTaskDedupCreateTable = `
+CREATE TABLE task_dedups (
+  id               text NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);`
+
+const qTaskDedupExists = `SELECT exists(SELECT 1 FROM task_dedups WHERE id = $1);`
+
+const qTaskDedupRead = `
+SELECT
+  id, task_id, created
+FROM task_dedups
+WHERE id = $1;`
+
+const qTaskDedupInsert = `
+INSERT INTO task_dedups
+  (id, task_id, created)
+VALUES
+  ($1, $2, $3);`
+
+const qTaskDedupUpdate = `
+UPDATE task_dedups SET
+  task_id = $2, created = $3
+WHERE id = $1;`
+
+const qTaskDedupDelete = `DELETE FROM task_dedups WHERE id = $1;`
+
+// qTaskDedupClaim makes sure a dedup key has a row to lock, pointing new
+// keys at the claiming task
+const qTaskDedupClaim = `
+INSERT INTO task_dedups
+  (id, task_id, created)
+VALUES
+  ($1, $2, $3)
+ON CONFLICT (id) DO NOTHING;`
+
+const qTaskDedupLock = `SELECT task_id FROM task_dedups WHERE id = $1 FOR UPDATE;`
+
+const qCheckpointCreateTable = `
+CREATE TABLE task_checkpoints (
+  id               UUID NOT NULL PRIMARY KEY,
+  updated          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  data             json
+);`
+
+const qCheckpointExists = `SELECT exists(SELECT 1 FROM task_checkpoints WHERE id = $1);`
+
+const qCheckpointRead = `
+SELECT
+  id, updated, data
+FROM task_checkpoints
+WHERE id = $1;`
+
+const qCheckpointInsert = `
+INSERT INTO task_checkpoints
+  (id, updated, data)
+VALUES
+  ($1, $2, $3);`
+
+const qCheckpointUpdate = `
+UPDATE task_checkpoints SET
+  updated = $2, data = $3
+WHERE id = $1;`
+
+const qCheckpointDelete = `DELETE FROM task_checkpoints WHERE id = $1;`
+
+const qCheckpointEntryCreateTable = `
+CREATE TABLE task_checkpoint_entries (
+  id               text NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  data             json
+);`
+
+const qCheckpointEntryExists = `SELECT exists(SELECT 1 FROM task_checkpoint_entries WHERE id = $1);`
+
+const qCheckpointEntryRead = `
+SELECT
+  id, task_id, created, data
+FROM task_checkpoint_entries
+WHERE id = $1;`
+
+const qCheckpointEntryInsert = `
+INSERT INTO task_checkpoint_entries
+  (id, task_id, created, data)
+VALUES
+  ($1, $2, $3, $4);`
+
+const qCheckpointEntryUpdate = `
+UPDATE task_checkpoint_entries SET
+  task_id = $2, created = $3, data = $4
+WHERE id = $1;`
+
+const qCheckpointEntryDelete = `DELETE FROM task_checkpoint_entries WHERE id = $1;`
+
+const qCheckpointEntriesAll = `
+SELECT
+  id, task_id, created, data
+FROM task_checkpoint_entries
+WHERE task_id = $1
+ORDER BY created, id;`
+
+const qCheckpointEntriesDelete = `DELETE FROM task_checkpoint_entries WHERE task_id = $1;`
+
+const qWorkerCreateTable = `
+CREATE TABLE workers (
+  id               UUID NOT NULL PRIMARY KEY,
+  hostname         text NOT NULL DEFAULT '',
+  capabilities     json,
+  started          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  heartbeat        timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);`
+
+const qWorkers = `
+SELECT
+  id, hostname, capabilities, started, heartbeat
+FROM workers
+ORDER BY heartbeat DESC
+LIMIT $1 OFFSET $2;`
+
+const qWorkerExists = `SELECT exists(SELECT 1 FROM workers WHERE id = $1);`
+
+const qWorkerReadById = `
+SELECT
+  id, hostname, capabilities, started, heartbeat
+FROM workers
+WHERE id = $1;`
+
+const qWorkerInsert = `
+INSERT INTO workers
+  (id, hostname, capabilities, started, heartbeat)
+VALUES
+  ($1, $2, $3, $4, $5);`
+
+const qWorkerUpdate = `
+UPDATE workers SET
+  hostname = $2, capabilities = $3, started = $4, heartbeat = $5
+WHERE id = $1;`
+
+const qWorkerDelete = `DELETE FROM workers WHERE id = $1;`
+
+const qTaskEventCreateTable = `
+CREATE TABLE task_events (
+  id               text NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  type             text NOT NULL DEFAULT '',
+  message          text NOT NULL DEFAULT ''
+);`
+
+const qTaskEvents = `
+SELECT
+  id, task_id, created, type, message
+FROM task_events
+WHERE task_id = $3
+ORDER BY created ASC
+LIMIT $1 OFFSET $2;`
+
+const qTaskEventExists = `SELECT exists(SELECT 1 FROM task_events WHERE id = $1);`
+
+const qTaskEventRead = `
+SELECT
+  id, task_id, created, type, message
+FROM task_events
+WHERE id = $1;`
+
+const qTaskEventInsert = `
+INSERT INTO task_events
+  (id, task_id, created, type, message)
+VALUES
+  ($1, $2, $3, $4, $5);`
+
+const qTaskEventUpdate = `
+UPDATE task_events SET
+  task_id = $2, created = $3, type = $4, message = $5
+WHERE id = $1;`
+
+const qTaskEventDelete = `DELETE FROM task_events WHERE id = $1;`
@@ -0,0 +1,403 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/ipfs/go-datastore"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaLimit is a kind of limit a quota places on task submission
+type QuotaLimit string
+
+const (
+	// LimitActive caps the number of unfinished tasks
+	LimitActive QuotaLimit = "active"
+	// LimitHourly caps the number of tasks submitted in the last hour
+	LimitHourly QuotaLimit = "hour"
+	// LimitUrlsDaily caps the number of urls tasks submitted in the
+	// last day will archive
+	LimitUrlsDaily QuotaLimit = "urls"
+)
+
+// QuotaRule limits the tasks users can submit. Limits are counted for each
+// user separately. An empty UserId applies the rule to all users, an empty
+// Type limits totals across all task types
+type QuotaRule struct {
+	// user this rule applies to, empty for all users
+	UserId string `json:"userId,omitempty"`
+	// task type this rule applies to, empty for totals across all types
+	Type string `json:"type,omitempty"`
+	// kind of limit
+	Limit QuotaLimit `json:"limit"`
+	// maximum allowed
+	Max int `json:"max"`
+}
+
+// ParseQuotaRule parses a rule of the form [user/][type]:[limit]=[max], eg:
+// "ipfs.addurl:active=5", "*:hour=100" or "alice/*:urls=50000". "*" matches
+// any user, or totals across all task types
+func ParseQuotaRule(s string) (QuotaRule, error) {
+	r := QuotaRule{}
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return r, fmt.Errorf("quota rule '%s' must be of the form [user/]type:limit=max", s)
+	}
+
+	scope := strings.SplitN(strings.TrimSpace(parts[0]), ":", 2)
+	if len(scope) != 2 {
+		return r, fmt.Errorf("quota rule '%s' must be of the form [user/]type:limit=max", s)
+	}
+	if i := strings.LastIndex(scope[0], "/"); i >= 0 {
+		if user := scope[0][:i]; user != "*" {
+			r.UserId = user
+		}
+		scope[0] = scope[0][i+1:]
+	}
+	if scope[0] != "*" {
+		r.Type = scope[0]
+	}
+
+	switch l := QuotaLimit(scope[1]); l {
+	case LimitActive, LimitHourly, LimitUrlsDaily:
+		r.Limit = l
+	default:
+		return r, fmt.Errorf("quota rule '%s': limit must be one of active, hour, urls", s)
+	}
+
+	max, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || max < 0 {
+		return r, fmt.Errorf("quota rule '%s': max must be a positive number", s)
+	}
+	r.Max = max
+	return r, nil
+}
+
+func (r QuotaRule) appliesTo(userId, taskType string) bool {
+	return (r.UserId == "" || r.UserId == userId) && r.Type == taskType
+}
+
+// UrlCountFunc gives the number of urls a task will archive
+type UrlCountFunc func(t Taskable) int
+
+// urlCounts maps task types to UrlCountFuncs
+var urlCounts = map[string]UrlCountFunc{}
+
+// RegisterUrlCount sets how urls are counted toward daily url quotas for
+// tasks of type name. Tasks of types without a UrlCountFunc count no urls
+func RegisterUrlCount(name string, f UrlCountFunc) {
+	urlCounts[name] = f
+}
+
+// UrlCount gives the number of urls t will archive
+func (t *Task) UrlCount() (int, error) {
+	f := urlCounts[t.Type]
+	if f == nil {
+		return 0, nil
+	}
+
+	tt, err := t.taskable()
+	if err != nil {
+		return 0, err
+	}
+	return f(tt), nil
+}
+
+// Usage counts a user's submissions for quotas
+type Usage struct {
+	// number of unfinished tasks
+	Active int `json:"active"`
+	// number of tasks submitted in the last hour
+	LastHour int `json:"lastHour"`
+	// number of urls in tasks submitted in the last day
+	UrlsLastDay int `json:"urlsLastDay"`
+
+	// oldest submission times in each window, for working out when
+	// usage will fall
+	oldestHour, oldestDay time.Time
+}
+
+func (u *Usage) get(l QuotaLimit) int {
+	switch l {
+	case LimitActive:
+		return u.Active
+	case LimitHourly:
+		return u.LastHour
+	default:
+		return u.UrlsLastDay
+	}
+}
+
+// UsageReport is a user's current usage, in total & by task type
+type UsageReport struct {
+	UserId string            `json:"userId"`
+	Total  *Usage            `json:"total"`
+	Types  map[string]*Usage `json:"types"`
+	// quota rules that apply to the user
+	Quotas []QuotaRule `json:"quotas"`
+}
+
+// usageFor gives usage for a task type, empty for the total
+func (u *UsageReport) usageFor(taskType string) *Usage {
+	if taskType == "" {
+		return u.Total
+	}
+	if u.Types[taskType] == nil {
+		return &Usage{}
+	}
+	return u.Types[taskType]
+}
+
+// usage gives the usage of a task type, adding it to the report if needed
+func (u *UsageReport) usage(taskType string) *Usage {
+	if u.Types[taskType] == nil {
+		u.Types[taskType] = &Usage{}
+	}
+	return u.Types[taskType]
+}
+
+// ReadUsage counts the tasks userId has submitted, as of now. Only
+// top-level tasks count, subtasks a task spawns are part of it's usage
+func ReadUsage(store datastore.Datastore, rules []QuotaRule, userId string, now time.Time) (*UsageReport, error) {
+	report := &UsageReport{
+		UserId: userId,
+		Total:  &Usage{},
+		Types:  map[string]*Usage{},
+		Quotas: []QuotaRule{},
+	}
+	for _, r := range rules {
+		if r.UserId == "" || r.UserId == userId {
+			report.Quotas = append(report.Quotas, r)
+		}
+	}
+
+	hourAgo, dayAgo := now.Add(-time.Hour), now.Add(-24*time.Hour)
+	if db := sqlDB(store); db != nil {
+		if err := readUsageCounts(db, report, userId, hourAgo); err != nil {
+			return report, err
+		}
+	}
+
+	// postgres counts tasks, other stores are scanned. either way urls are
+	// counted from the params of the last day's tasks
+	q := TaskQuery{UserId: userId, TopLevel: true}
+	if sqlDB(store) != nil {
+		q.CreatedAfter = dayAgo
+		q.Types = []string{}
+		for name := range urlCounts {
+			q.Types = append(q.Types, name)
+		}
+	}
+	ts, err := ReadTaskQuery(store, q)
+	if err != nil {
+		return report, err
+	}
+
+	for _, t := range ts {
+		tu := report.usage(t.Type)
+
+		var urls int
+		if t.Created.After(dayAgo) {
+			// tasks of types that are no longer registered count no urls
+			urls, _ = t.UrlCount()
+		}
+
+		for _, u := range []*Usage{report.Total, tu} {
+			if q.CreatedAfter.IsZero() {
+				if finishedState(t) == "" {
+					u.Active++
+				}
+				if t.Created.After(hourAgo) {
+					u.LastHour++
+					u.oldestHour = oldest(u.oldestHour, t.Created)
+				}
+			}
+			if t.Created.After(dayAgo) && urls > 0 {
+				u.UrlsLastDay += urls
+				u.oldestDay = oldest(u.oldestDay, t.Created)
+			}
+		}
+	}
+	return report, nil
+}
+
+// readUsageCounts counts userId's active & last hour tasks into report
+func readUsageCounts(db *sql.DB, report *UsageReport, userId string, hourAgo time.Time) error {
+	rows, err := db.Query(qTaskUsageActive, userId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			taskType string
+			n        int
+		)
+		if err := rows.Scan(&taskType, &n); err != nil {
+			return err
+		}
+		report.usage(taskType).Active += n
+		report.Total.Active += n
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(qTaskUsageSince, userId, hourAgo)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			taskType string
+			n        int
+			min      time.Time
+		)
+		if err := rows.Scan(&taskType, &n, &min); err != nil {
+			return err
+		}
+		for _, u := range []*Usage{report.Total, report.usage(taskType)} {
+			u.LastHour += n
+			u.oldestHour = oldest(u.oldestHour, min)
+		}
+	}
+	return rows.Err()
+}
+
+// oldest gives the earlier of a & b, ignoring a if it's zero
+func oldest(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// QuotaError is returned when a submission would exceed a quota
+type QuotaError struct {
+	Rule QuotaRule
+	// usage at the time of submission
+	Used int
+	// how long until usage may fall below the limit, zero if unknown
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	scope := "all"
+	if e.Rule.Type != "" {
+		scope = e.Rule.Type
+	}
+	switch e.Rule.Limit {
+	case LimitActive:
+		return fmt.Sprintf("quota exceeded: at most %d %s tasks can be active at once, %d are active", e.Rule.Max, scope, e.Used)
+	case LimitHourly:
+		return fmt.Sprintf("quota exceeded: at most %d %s tasks can be submitted per hour, %d have been submitted", e.Rule.Max, scope, e.Used)
+	default:
+		return fmt.Sprintf("quota exceeded: %s tasks can archive at most %d urls per day, %d have been submitted", scope, e.Rule.Max, e.Used)
+	}
+}
+
+// quotaRule finds the most specific rule of a limit for a user & type scope,
+// user rules win over rules for all users
+func quotaRule(rules []QuotaRule, userId, taskType string, l QuotaLimit) *QuotaRule {
+	var rule *QuotaRule
+	for i, r := range rules {
+		if r.Limit == l && r.appliesTo(userId, taskType) && (rule == nil || rule.UserId == "") {
+			rule = &rules[i]
+		}
+	}
+	return rule
+}
+
+// quotaLock serializes submissions to stores that aren't backed by postgres
+var quotaLock sync.Mutex
+
+// lockQuotaClass is the postgres advisory lock class submissions take a
+// lock on their user's id in
+const lockQuotaClass = 4300
+
+// SubmitWithinQuota checks submitting t won't exceed any quota in rules,
+// then calls submit to save t. the check & submit hold a lock on t's user,
+// so concurrent submissions can't each fit under a quota that together
+// they exceed
+func SubmitWithinQuota(store datastore.Datastore, rules []QuotaRule, t *Task, submit func() error) error {
+	if len(rules) == 0 || t.ParentId != "" {
+		return submit()
+	}
+
+	if db := sqlDB(store); db != nil {
+		// advisory locks belong to a session, so hold it on a dedicated connection
+		ctx := context.Background()
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1, hashtext($2));`, lockQuotaClass, t.UserId); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1, hashtext($2));`, lockQuotaClass, t.UserId)
+	} else {
+		quotaLock.Lock()
+		defer quotaLock.Unlock()
+	}
+
+	if err := CheckQuota(store, rules, t); err != nil {
+		return err
+	}
+	return submit()
+}
+
+// CheckQuota returns a *QuotaError if submitting t would exceed any quota in
+// rules that apply to t's user. use SubmitWithinQuota to check & submit
+// atomically
+func CheckQuota(store datastore.Datastore, rules []QuotaRule, t *Task) error {
+	if len(rules) == 0 || t.ParentId != "" {
+		return nil
+	}
+
+	now := time.Now()
+	report, err := ReadUsage(store, rules, t.UserId, now)
+	if err != nil {
+		return err
+	}
+	urls, err := t.UrlCount()
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range []string{t.Type, ""} {
+		u := report.usageFor(scope)
+		for _, l := range []QuotaLimit{LimitActive, LimitHourly, LimitUrlsDaily} {
+			rule := quotaRule(rules, t.UserId, scope, l)
+			if rule == nil {
+				continue
+			}
+
+			add := 1
+			if l == LimitUrlsDaily {
+				if add = urls; add == 0 {
+					continue
+				}
+			}
+			if used := u.get(l); used+add > rule.Max {
+				e := &QuotaError{Rule: *rule, Used: used}
+				switch l {
+				case LimitHourly:
+					e.RetryAfter = u.oldestHour.Add(time.Hour).Sub(now)
+				case LimitUrlsDaily:
+					e.RetryAfter = u.oldestDay.Add(24 * time.Hour).Sub(now)
+				}
+				if e.RetryAfter < 0 {
+					e.RetryAfter = 0
+				}
+				return e
+			}
+		}
+	}
+	return nil
+}
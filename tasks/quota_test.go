@@ -0,0 +1,135 @@
+package tasks
+
+import (
+	"fmt"
+	"github.com/ipfs/go-datastore"
+	"testing"
+	"time"
+)
+
+func TestParseQuotaRule(t *testing.T) {
+	cases := []struct {
+		in     string
+		expect QuotaRule
+		err    bool
+	}{
+		{"ipfs.addurl:active=5", QuotaRule{Type: "ipfs.addurl", Limit: LimitActive, Max: 5}, false},
+		{"*:hour=100", QuotaRule{Limit: LimitHourly, Max: 100}, false},
+		{"alice/*:urls=50000", QuotaRule{UserId: "alice", Limit: LimitUrlsDaily, Max: 50000}, false},
+		{"*/pod.addcatalog:active=1", QuotaRule{Type: "pod.addcatalog", Limit: LimitActive, Max: 1}, false},
+		{"ipfs.addurl=5", QuotaRule{}, true},
+		{"ipfs.addurl:weekly=5", QuotaRule{}, true},
+		{"ipfs.addurl:active=lots", QuotaRule{}, true},
+	}
+
+	for i, c := range cases {
+		got, err := ParseQuotaRule(c.in)
+		if c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if !c.err && got != c.expect {
+			t.Errorf("case %d mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	RegisterTaskdef("test.quota", newUrlTask)
+	RegisterUrlCount("test.quota", func(Taskable) int { return 10 })
+	store := datastore.NewMapDatastore()
+
+	now := time.Now()
+	lastWeek := now.Add(-7 * 24 * time.Hour)
+	hoursAgo := now.Add(-2 * time.Hour)
+	for i, created := range []time.Time{lastWeek, hoursAgo, now} {
+		task := &Task{Type: "test.quota", UserId: "alice", Params: map[string]interface{}{"url": fmt.Sprintf("http://%d.com", i)}}
+		if created != now {
+			task.Succeeded = &created
+		}
+		if err := task.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+		// backdate creation, Save only sets Created for new tasks
+		task.Created = created
+		if err := task.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	report, err := ReadUsage(store, nil, "alice", now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.Total.Active != 1 || report.Total.LastHour != 1 || report.Total.UrlsLastDay != 20 {
+		t.Errorf("usage mismatch: %#v", report.Total)
+	}
+
+	next := &Task{Type: "test.quota", UserId: "alice", Params: map[string]interface{}{"url": "http://next.com"}}
+	cases := []struct {
+		rules []QuotaRule
+		limit QuotaLimit
+	}{
+		{nil, ""},
+		{[]QuotaRule{{Limit: LimitActive, Max: 2}}, ""},
+		{[]QuotaRule{{Limit: LimitActive, Max: 1}}, LimitActive},
+		{[]QuotaRule{{Type: "test.quota", Limit: LimitHourly, Max: 1}}, LimitHourly},
+		{[]QuotaRule{{Type: "other", Limit: LimitHourly, Max: 0}}, ""},
+		{[]QuotaRule{{Limit: LimitUrlsDaily, Max: 30}}, ""},
+		{[]QuotaRule{{Limit: LimitUrlsDaily, Max: 29}}, LimitUrlsDaily},
+		// user rules override rules for all users
+		{[]QuotaRule{{Limit: LimitActive, Max: 1}, {UserId: "alice", Limit: LimitActive, Max: 5}}, ""},
+		{[]QuotaRule{{UserId: "bob", Limit: LimitActive, Max: 0}}, ""},
+	}
+
+	for i, c := range cases {
+		err := CheckQuota(store, c.rules, next)
+		if c.limit == "" {
+			if err != nil {
+				t.Errorf("case %d unexpected error: %s", i, err.Error())
+			}
+			continue
+		}
+
+		qe, ok := err.(*QuotaError)
+		if !ok {
+			t.Errorf("case %d expected a quota error, got: %v", i, err)
+			continue
+		}
+		if qe.Rule.Limit != c.limit {
+			t.Errorf("case %d limit mismatch. expected: %s, got: %s", i, c.limit, qe.Rule.Limit)
+		}
+		if c.limit == LimitUrlsDaily && (qe.RetryAfter <= 20*time.Hour || qe.RetryAfter > 22*time.Hour) {
+			t.Errorf("case %d expected retry after ~22h, got: %s", i, qe.RetryAfter)
+		}
+	}
+}
+
+func TestSubmitWithinQuota(t *testing.T) {
+	RegisterTaskdef("test.quota", newUrlTask)
+	store := NewLockedStore(datastore.NewMapDatastore())
+	rules := []QuotaRule{{Limit: LimitActive, Max: 3}}
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			task := &Task{Type: "test.quota", UserId: "alice", Params: map[string]interface{}{"url": fmt.Sprintf("http://%d.com", i)}}
+			errs <- SubmitWithinQuota(store, rules, task, func() error {
+				return task.Save(store)
+			})
+		}(i)
+	}
+
+	submitted := 0
+	for i := 0; i < 10; i++ {
+		err := <-errs
+		if err == nil {
+			submitted++
+		} else if _, ok := err.(*QuotaError); !ok {
+			t.Errorf("unexpected error: %s", err.Error())
+		}
+	}
+	if submitted != 3 {
+		t.Errorf("expected 3 submissions within quota, got %d", submitted)
+	}
+}
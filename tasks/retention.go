@@ -0,0 +1,238 @@
+package tasks
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/ipfs/go-datastore"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionRule is how long finished tasks of a type & terminal state
+// are kept before they're removed. An empty Type or State matches
+// any type or state
+type RetentionRule struct {
+	// task type this rule applies to, empty for all types
+	Type string
+	// terminal state this rule applies to, either "succeeded", "failed",
+	// or empty for both
+	State string
+	// how long after finishing a task is kept
+	MaxAge time.Duration
+}
+
+// ParseRetentionRule parses a rule of the form [type]:[state]=[age], eg:
+// "ipfs.addurl:succeeded=30d" or "*:failed=90d". state can be omitted, and
+// "*" matches any type or state. ages are durations, with a "d" suffix for days
+func ParseRetentionRule(s string) (RetentionRule, error) {
+	r := RetentionRule{}
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return r, fmt.Errorf("retention rule '%s' must be of the form type:state=age", s)
+	}
+
+	scope := strings.SplitN(strings.TrimSpace(parts[0]), ":", 2)
+	if scope[0] != "*" {
+		r.Type = scope[0]
+	}
+	if len(scope) == 2 && scope[1] != "*" {
+		r.State = scope[1]
+	}
+	if r.State != "" && r.State != "succeeded" && r.State != "failed" {
+		return r, fmt.Errorf("retention rule '%s': state must be succeeded or failed", s)
+	}
+
+	age, err := parseAge(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return r, fmt.Errorf("retention rule '%s': %s", s, err.Error())
+	}
+	r.MaxAge = age
+	return r, nil
+}
+
+// parseAge parses a duration, adding support for a "d" suffix for days
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid age: %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// specificity ranks rules so that more specific rules win
+func (r RetentionRule) specificity() int {
+	n := 0
+	if r.Type != "" {
+		n += 2
+	}
+	if r.State != "" {
+		n++
+	}
+	return n
+}
+
+func (r RetentionRule) matches(t *Task) bool {
+	return (r.Type == "" || r.Type == t.Type) && (r.State == "" || r.State == finishedState(t))
+}
+
+// finishedState is "succeeded" or "failed" for finished tasks, empty otherwise
+func finishedState(t *Task) string {
+	switch {
+	case t.Succeeded != nil:
+		return "succeeded"
+	case t.Failed != nil:
+		return "failed"
+	default:
+		return ""
+	}
+}
+
+// finishedAt is when a finished task completed
+func finishedAt(t *Task) time.Time {
+	if t.Succeeded != nil {
+		return *t.Succeeded
+	}
+	return *t.Failed
+}
+
+// Expired reports weather a finished task has outlived the most specific
+// rule that matches it. Unfinished tasks & tasks with no matching rule
+// never expire
+func (t *Task) Expired(rules []RetentionRule, now time.Time) bool {
+	if finishedState(t) == "" {
+		return false
+	}
+
+	var rule *RetentionRule
+	for i, r := range rules {
+		if r.matches(t) && (rule == nil || r.specificity() > rule.specificity()) {
+			rule = &rules[i]
+		}
+	}
+	return rule != nil && now.Sub(finishedAt(t)) > rule.MaxAge
+}
+
+// Archiver exports tasks before they're removed by EnforceRetention
+type Archiver interface {
+	Archive(ts []*Task) error
+}
+
+// RetentionBatchSize is how many tasks EnforceRetention reads at a time
+var RetentionBatchSize = 500
+
+// EnforceRetention removes tasks that have expired under rules, along with
+// their event logs & checkpoints. tasks are read in batches of tasks old
+// enough to have expired under the shortest rule. if archiver is non-nil each
+// batch of expired tasks is archived first, and nothing more is removed if
+// archiving fails. It returns the tasks that were removed
+func EnforceRetention(store datastore.Datastore, rules []RetentionRule, archiver Archiver) ([]*Task, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	shortest := rules[0].MaxAge
+	for _, r := range rules {
+		if r.MaxAge < shortest {
+			shortest = r.MaxAge
+		}
+	}
+
+	removed := []*Task{}
+	// removed tasks drop out of later batches, so only tasks that were
+	// kept need to be skipped
+	kept := 0
+	for {
+		batch, err := ReadTaskQuery(store, TaskQuery{FinishedBefore: now.Add(-shortest), Limit: RetentionBatchSize, Offset: kept})
+		if err != nil {
+			return removed, err
+		}
+
+		expired := []*Task{}
+		for _, t := range batch {
+			if t.Expired(rules, now) {
+				expired = append(expired, t)
+			} else {
+				kept++
+			}
+		}
+
+		if archiver != nil && len(expired) > 0 {
+			if err := archiver.Archive(expired); err != nil {
+				return removed, fmt.Errorf("error archiving expired tasks: %s", err.Error())
+			}
+		}
+		for _, t := range expired {
+			if err := t.remove(store); err != nil {
+				return removed, err
+			}
+			removed = append(removed, t)
+		}
+
+		if len(batch) < RetentionBatchSize {
+			return removed, nil
+		}
+	}
+}
+
+// remove deletes a task & everything stored alongside it
+func (t *Task) remove(store datastore.Datastore) error {
+	events, err := ReadTaskEvents(store, t.Id)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if err := store.Delete(e.Key()); err != nil && err != datastore.ErrNotFound {
+			return err
+		}
+	}
+
+	if err := deleteCheckpoint(store, t.Id); err != nil {
+		return err
+	}
+
+	return t.Delete(store)
+}
+
+// WriteNDJSON writes tasks to w as gzip-compressed newline-delimited json
+func WriteNDJSON(w io.Writer, ts []*Task) error {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	for _, t := range ts {
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+	}
+	return gz.Close()
+}
+
+// NDJSONArchiver archives tasks to compressed ndjson files in Dir,
+// one file per call to Archive
+type NDJSONArchiver struct {
+	Dir string
+}
+
+func (a NDJSONArchiver) Archive(ts []*Task) error {
+	if err := os.MkdirAll(a.Dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	path := filepath.Join(a.Dir, fmt.Sprintf("tasks-%s.ndjson.gz", time.Now().UTC().Format("20060102T150405.000000000")))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteNDJSON(f, ts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,137 @@
+package tasks
+
+import (
+	"fmt"
+	"github.com/ipfs/go-datastore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionRule(t *testing.T) {
+	cases := []struct {
+		in  string
+		out RetentionRule
+		err bool
+	}{
+		{"ipfs.addurl:succeeded=30d", RetentionRule{"ipfs.addurl", "succeeded", 30 * 24 * time.Hour}, false},
+		{"*:failed=90d", RetentionRule{"", "failed", 90 * 24 * time.Hour}, false},
+		{"pod.addcatalog=12h", RetentionRule{"pod.addcatalog", "", 12 * time.Hour}, false},
+		{"*:running=1d", RetentionRule{}, true},
+		{"ipfs.addurl", RetentionRule{}, true},
+		{"ipfs.addurl=soon", RetentionRule{}, true},
+	}
+
+	for i, c := range cases {
+		got, err := ParseRetentionRule(c.in)
+		if c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if !c.err && got != c.out {
+			t.Errorf("case %d mismatch. expected: %v, got: %v", i, c.out, got)
+		}
+	}
+}
+
+func TestEnforceRetention(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	RegisterTaskdef("test.other", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	old := time.Now().Add(-48 * time.Hour)
+	recent := time.Now().Add(-time.Hour)
+	oldSuccess := &Task{Title: "old success", Type: "test", Succeeded: &old}
+	oldFailure := &Task{Title: "old failure", Type: "test", Failed: &old}
+	newSuccess := &Task{Title: "new success", Type: "test", Succeeded: &recent}
+	otherType := &Task{Title: "other", Type: "test.other", Succeeded: &old}
+	running := &Task{Title: "running", Type: "test", Started: &old}
+	for _, task := range []*Task{oldSuccess, oldFailure, newSuccess, otherType, running} {
+		if err := task.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := oldSuccess.LogEvent(store, EventSucceeded, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rules := []RetentionRule{
+		{Type: "test", State: "succeeded", MaxAge: 24 * time.Hour},
+		{State: "failed", MaxAge: 72 * time.Hour},
+	}
+
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	removed, err := EnforceRetention(store, rules, NDJSONArchiver{Dir: dir})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(removed) != 1 || removed[0].Id != oldSuccess.Id {
+		t.Fatalf("expected only the old succeeded task to be removed, got %d tasks", len(removed))
+	}
+
+	if err := oldSuccess.Read(store); err != datastore.ErrNotFound {
+		t.Errorf("expected removed task to be deleted, got: %v", err)
+	}
+	events, err := ReadTaskEvents(store, oldSuccess.Id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(events) != 0 {
+		t.Errorf("expected removed task's events to be deleted")
+	}
+	for _, task := range []*Task{oldFailure, newSuccess, otherType, running} {
+		if err := task.Read(store); err != nil {
+			t.Errorf("expected task '%s' to be kept, got: %s", task.Title, err.Error())
+		}
+	}
+
+	archives, err := filepath.Glob(filepath.Join(dir, "*.ndjson.gz"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(archives) != 1 {
+		t.Errorf("expected 1 archive file, got: %d", len(archives))
+	}
+}
+
+func TestEnforceRetentionBatches(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+	batchSize := RetentionBatchSize
+	RetentionBatchSize = 2
+	defer func() { RetentionBatchSize = batchSize }()
+
+	old := time.Now().Add(-48 * time.Hour)
+	kept := &Task{Title: "kept", Type: "test", Failed: &old}
+	if err := kept.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 5; i++ {
+		task := &Task{Title: fmt.Sprintf("old %d", i), Type: "test", Succeeded: &old}
+		if err := task.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	rules := []RetentionRule{
+		{State: "succeeded", MaxAge: 24 * time.Hour},
+		{State: "failed", MaxAge: 72 * time.Hour},
+	}
+	removed, err := EnforceRetention(store, rules, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(removed) != 5 {
+		t.Errorf("expected 5 tasks to be removed in batches, got: %d", len(removed))
+	}
+	if err := kept.Read(store); err != nil {
+		t.Errorf("expected unexpired task to be kept, got: %s", err.Error())
+	}
+}
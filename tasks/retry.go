@@ -0,0 +1,116 @@
+package tasks
+
+import (
+	"fmt"
+	"github.com/ipfs/go-datastore"
+	"time"
+)
+
+// Clone creates a new, unsaved task from t. title & any params in
+// overrides replace t's values, all other params are copied from t
+func (t *Task) Clone(title string, overrides map[string]interface{}) *Task {
+	params := map[string]interface{}{}
+	for k, v := range t.Params {
+		params[k] = v
+	}
+	for k, v := range overrides {
+		params[k] = v
+	}
+
+	if title == "" {
+		title = t.Title
+	}
+
+	return &Task{
+		Title:       title,
+		Type:        t.Type,
+		UserId:      t.UserId,
+		Params:      params,
+		CallbackUrl: t.CallbackUrl,
+	}
+}
+
+// Retry sends a failed task back to the queue at amqpurl. Tasks that
+// checkpoint will resume from where they left off
+func (task *Task) Retry(store datastore.Datastore, amqpurl string) error {
+	if task.Failed == nil {
+		return fmt.Errorf("only failed tasks can be retried")
+	}
+	if amqpurl == "" {
+		return fmt.Errorf("retrying tasks requires a queue")
+	}
+
+	if err := task.reset(store); err != nil {
+		return err
+	}
+	if err := task.Requeue(store, amqpurl); err != nil {
+		return err
+	}
+	// a parent that failed because this task did is waiting on it again
+	return task.updateParent(store, nil)
+}
+
+// reset clears a failed task's result & starts it's next attempt. subtasks
+// spawned by earlier attempts record the attempt that spawned them, so the
+// next attempt only waits on the subtasks it spawns
+func (task *Task) reset(store datastore.Datastore) error {
+	prev := task.Error
+	task.Failed = nil
+	task.Succeeded = nil
+	task.Error = ""
+	task.Subtasks = 0
+	task.Attempts++
+	return task.LogEvent(store, EventRetried, fmt.Sprintf("attempt %d, previous error: %s", task.Attempts, prev))
+}
+
+// FailedSince is a filter for failed tasks of taskType that failed
+// after since. an empty taskType matches all types, a zero since
+// matches all failures. cancelled tasks were stopped on purpose, and
+// don't match
+func FailedSince(taskType string, since time.Time) TaskFilter {
+	return func(t *Task) bool {
+		return t.Failed != nil && !t.Cancelled() &&
+			(taskType == "" || t.Type == taskType) &&
+			t.Failed.After(since)
+	}
+}
+
+// RetryTasks retries all failed tasks in store that pass filter, returning
+// the tasks that were retried. Only failed tasks can be retried, so filter is
+// always combined with a check for failure. retries count against their
+// owner's quotas in rules, retrying stops at the first task over quota
+func RetryTasks(store datastore.Datastore, amqpurl string, rules []QuotaRule, filter TaskFilter) ([]*Task, error) {
+	failed, err := ReadTasksFilter(store, func(t *Task) bool {
+		return t.Failed != nil && filter(t)
+	}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	failed = withoutRetriedParents(failed)
+
+	for i, t := range failed {
+		if err := SubmitWithinQuota(store, rules, t, func() error {
+			return t.Retry(store, amqpurl)
+		}); err != nil {
+			return failed[:i], err
+		}
+	}
+	return failed, nil
+}
+
+// withoutRetriedParents drops subtasks whose parent is also in ts. parents
+// spawn their subtasks again when they're retried
+func withoutRetriedParents(ts []*Task) []*Task {
+	ids := map[string]bool{}
+	for _, t := range ts {
+		ids[t.Id] = true
+	}
+
+	kept := []*Task{}
+	for _, t := range ts {
+		if t.ParentId == "" || !ids[t.ParentId] {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,97 @@
+package tasks
+
+import (
+	"github.com/ipfs/go-datastore"
+	"testing"
+	"time"
+)
+
+func TestClone(t *testing.T) {
+	orig := &Task{
+		Id:     "a",
+		Title:  "original",
+		Type:   "test",
+		UserId: "user",
+		Params: map[string]interface{}{"url": "http://a.com", "depth": 1},
+	}
+
+	clone := orig.Clone("", map[string]interface{}{"depth": 2})
+	if clone.Id != "" {
+		t.Errorf("expected clone to have no id")
+	}
+	if clone.Title != orig.Title || clone.Type != orig.Type || clone.UserId != orig.UserId {
+		t.Errorf("expected clone to copy title, type & user")
+	}
+	if clone.Params["url"] != "http://a.com" || clone.Params["depth"] != 2 {
+		t.Errorf("clone params mismatch: %v", clone.Params)
+	}
+	if orig.Params["depth"] != 1 {
+		t.Errorf("expected overrides to leave original params unchanged")
+	}
+
+	if renamed := orig.Clone("renamed", nil); renamed.Title != "renamed" {
+		t.Errorf("expected clone title to be overridden, got: %s", renamed.Title)
+	}
+}
+
+func TestFailedSince(t *testing.T) {
+	now := time.Now()
+	yesterday := now.Add(-24 * time.Hour)
+	lastWeek := now.Add(-7 * 24 * time.Hour)
+
+	cases := []struct {
+		task   *Task
+		typ    string
+		since  time.Time
+		expect bool
+	}{
+		{&Task{Type: "pod.addcatalog", Failed: &now}, "pod.addcatalog", yesterday, true},
+		{&Task{Type: "pod.addcatalog", Failed: &lastWeek}, "pod.addcatalog", yesterday, false},
+		{&Task{Type: "ipfs.addurl", Failed: &now}, "pod.addcatalog", yesterday, false},
+		{&Task{Type: "ipfs.addurl", Failed: &lastWeek}, "", time.Time{}, true},
+		{&Task{Type: "pod.addcatalog", Succeeded: &now}, "", time.Time{}, false},
+		{&Task{Type: "pod.addcatalog", Failed: &now, Error: ErrTaskCancelled.Error()}, "", time.Time{}, false},
+	}
+
+	for i, c := range cases {
+		if got := FailedSince(c.typ, c.since)(c.task); got != c.expect {
+			t.Errorf("case %d: expected %t, got %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestWithoutRetriedParents(t *testing.T) {
+	parent := &Task{Id: "parent"}
+	child := &Task{Id: "child", ParentId: "parent"}
+	orphan := &Task{Id: "orphan", ParentId: "other"}
+
+	got := withoutRetriedParents([]*Task{child, parent, orphan})
+	if len(got) != 2 || got[0] != parent || got[1] != orphan {
+		t.Errorf("expected the child of a retried parent to be dropped, got: %v", got)
+	}
+}
+
+func TestRetryTasksWithinQuota(t *testing.T) {
+	RegisterTaskdef("test.quota", newUrlTask)
+	store := datastore.NewMapDatastore()
+	rules := []QuotaRule{{Limit: LimitActive, Max: 1}}
+
+	now := time.Now()
+	for _, task := range []*Task{
+		{Type: "test.quota", UserId: "alice", Params: map[string]interface{}{"url": "http://a.com"}},
+		{Type: "test.quota", UserId: "alice", Params: map[string]interface{}{"url": "http://b.com"}, Failed: &now},
+	} {
+		if err := task.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// alice's active task leaves no room to retry her failed one
+	retried, err := RetryTasks(store, "amqp://localhost", rules, FailedSince("", time.Time{}))
+	if _, ok := err.(*QuotaError); !ok {
+		t.Errorf("expected a quota error, got: %v", err)
+	}
+	if len(retried) != 0 {
+		t.Errorf("expected no tasks to be retried, got %d", len(retried))
+	}
+}
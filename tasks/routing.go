@@ -0,0 +1,97 @@
+package tasks
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultQueueName is the queue all tasks were sent to before tasks were
+// routed by type. Workers that accept all task types still drain it
+const DefaultQueueName = "tasks"
+
+// taskdefTags maps task types to routing tags
+var taskdefTags = map[string]string{}
+
+// TagTaskdef assigns a routing tag to a task type. Task types that share a tag
+// share a queue, so a pool of workers can accept a tag, (say "ipfs") instead of
+// listing each task type. Untagged task types get a queue of their own.
+func TagTaskdef(name, tag string) {
+	taskdefTags[name] = tag
+}
+
+// QueueName gives the name of the queue tasks of taskType are routed to
+func QueueName(taskType string) string {
+	if tag := taskdefTags[taskType]; tag != "" {
+		return fmt.Sprintf("%s.tag.%s", DefaultQueueName, tag)
+	}
+	return fmt.Sprintf("%s.type.%s", DefaultQueueName, taskType)
+}
+
+// Accepts reports weather a worker with capabilities will perform tasks of
+// taskType. capabilities are task types or tags, empty capabilities accept all
+func Accepts(capabilities []string, taskType string) bool {
+	if len(capabilities) == 0 {
+		return true
+	}
+	for _, c := range capabilities {
+		if c == taskType || (c != "" && c == taskdefTags[taskType]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidCapabilities checks that capabilities name registered task types or
+// tags, and cover whole queues. tagged task types share a queue, a worker that
+// accepted only some of a tag's types would pull the others off the queue only
+// to hand them back, so capabilities must name the tag instead
+func ValidCapabilities(capabilities []string) error {
+	for _, c := range capabilities {
+		if _, ok := taskdefs[c]; !ok && !isTag(c) {
+			return fmt.Errorf("%s isn't a registered task type or tag", c)
+		}
+	}
+
+	for _, c := range capabilities {
+		tag := taskdefTags[c]
+		if tag == "" {
+			continue
+		}
+		for _, name := range RegisteredTaskdefs() {
+			if taskdefTags[name] == tag && !Accepts(capabilities, name) {
+				return fmt.Errorf("%s shares the %s queue with %s, accept the tag %s instead", c, QueueName(c), name, tag)
+			}
+		}
+	}
+	return nil
+}
+
+// isTag reports weather name is the routing tag of a task type
+func isTag(name string) bool {
+	for _, tag := range taskdefTags {
+		if tag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkerQueues lists the queues a worker with capabilities should consume from
+func WorkerQueues(capabilities []string) []string {
+	set := map[string]bool{}
+	for _, name := range RegisteredTaskdefs() {
+		if Accepts(capabilities, name) {
+			set[QueueName(name)] = true
+		}
+	}
+	if len(capabilities) == 0 {
+		set[DefaultQueueName] = true
+	}
+
+	queues := make([]string, 0, len(set))
+	for q := range set {
+		queues = append(queues, q)
+	}
+	sort.Strings(queues)
+	return queues
+}
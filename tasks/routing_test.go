@@ -0,0 +1,73 @@
+package tasks
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRouting(t *testing.T) {
+	RegisterTaskdef("test.routing.a", NewExampleTask)
+	RegisterTaskdef("test.routing.b", NewExampleTask)
+	RegisterTaskdef("test.routing.c", NewExampleTask)
+	TagTaskdef("test.routing.a", "routing")
+	TagTaskdef("test.routing.b", "routing")
+	defer func() {
+		delete(taskdefTags, "test.routing.a")
+		delete(taskdefTags, "test.routing.b")
+	}()
+
+	if got := QueueName("test.routing.a"); got != "tasks.tag.routing" {
+		t.Errorf("tagged queue name mismatch: %s", got)
+	}
+	if got := QueueName("test.routing.c"); got != "tasks.type.test.routing.c" {
+		t.Errorf("untagged queue name mismatch: %s", got)
+	}
+
+	cases := []struct {
+		caps     []string
+		taskType string
+		accepts  bool
+	}{
+		{nil, "test.routing.a", true},
+		{[]string{"routing"}, "test.routing.a", true},
+		{[]string{"routing"}, "test.routing.c", false},
+		{[]string{"test.routing.c"}, "test.routing.c", true},
+		{[]string{"test.routing.c"}, "test.routing.a", false},
+	}
+	for i, c := range cases {
+		if got := Accepts(c.caps, c.taskType); got != c.accepts {
+			t.Errorf("case %d: expected accepts %s to be %t", i, c.taskType, c.accepts)
+		}
+	}
+
+	if err := ValidCapabilities([]string{"routing", "test.routing.a", "test.routing.c"}); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if err := ValidCapabilities([]string{"test.routing.a", "test.routing.c"}); err == nil {
+		t.Errorf("expected accepting part of a tag to error")
+	}
+	if err := ValidCapabilities([]string{"test.routing.a", "test.routing.b"}); err != nil {
+		t.Errorf("expected accepting every type of a tag to be valid, got: %s", err.Error())
+	}
+	if err := ValidCapabilities([]string{"routing", "test.routing.typo"}); err == nil {
+		t.Errorf("expected accepting an unregistered task type to error")
+	}
+	if err := ValidCapabilities([]string{"routnig"}); err == nil {
+		t.Errorf("expected accepting an unknown tag to error")
+	}
+
+	queues := WorkerQueues([]string{"routing", "test.routing.c"})
+	expect := []string{"tasks.tag.routing", "tasks.type.test.routing.c"}
+	if !reflect.DeepEqual(queues, expect) {
+		t.Errorf("worker queues mismatch. expected: %v, got: %v", expect, queues)
+	}
+
+	all := WorkerQueues(nil)
+	found := false
+	for _, q := range all {
+		found = found || q == DefaultQueueName
+	}
+	if !found {
+		t.Errorf("expected workers accepting everything to consume the %s queue", DefaultQueueName)
+	}
+}
@@ -0,0 +1,162 @@
+package tasks
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SchemaDraft is the JSON Schema version taskdef schemas are written in
+const SchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is the subset of JSON Schema needed to describe task params &
+// the api's requests and responses
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Const                string             `json:"const,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Default              interface{}        `json:"default,omitempty"`
+	// Order lists Properties in the order they're declared, json objects
+	// are unordered so it isn't part of the encoded schema
+	Order []string `json:"-"`
+}
+
+var (
+	durationType   = reflect.TypeOf(time.Duration(0))
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// SchemaOf describes the json encoding of v, see TaskdefSchema for the
+// struct tags it reads
+func SchemaOf(v interface{}) *Schema {
+	return schemaFor(reflect.ValueOf(v))
+}
+
+// TaskdefSchema describes the params accepted by a registered task type,
+// derived from the exported fields of the type's Taskable. fields are named
+// by their json tags, and can carry a `description:"..."` tag, and a
+// `required:"true"` tag if the task isn't valid without them. non-zero
+// values set by the taskdef's constructor become defaults, unless a
+// `default:"..."` tag overrides them, an empty default tag hides the default
+func TaskdefSchema(name string) (*Schema, error) {
+	tt, err := NewTaskable(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s := schemaFor(reflect.ValueOf(tt))
+	if s.Type != "object" {
+		// taskables that aren't structs accept no params
+		s = &Schema{Type: "object"}
+	}
+	s.Schema = SchemaDraft
+	s.Title = name
+	return s, nil
+}
+
+// schemaFor describes the json encoding of v
+func schemaFor(v reflect.Value) *Schema {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return schemaForType(v.Type())
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct || v.Type() == timeType {
+		return schemaForType(v.Type())
+	}
+
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Anonymous {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+
+		prop := schemaFor(v.Field(i))
+		prop.Description = f.Tag.Get("description")
+		if def, ok := f.Tag.Lookup("default"); ok {
+			if def != "" {
+				prop.Default = def
+			}
+		} else if prop.Type != "object" && !isZero(v.Field(i)) {
+			prop.Default = v.Field(i).Interface()
+		}
+
+		s.Properties[name] = prop
+		s.Order = append(s.Order, name)
+		if f.Tag.Get("required") == "true" {
+			s.Required = append(s.Required, name)
+		}
+	}
+	return s
+}
+
+// schemaForType describes the json encoding of values of type t
+func schemaForType(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == durationType:
+		return &Schema{Type: "integer"}
+	case t == rawMessageType:
+		return &Schema{}
+	case t == errorType:
+		// errors are encoded as their messages
+		return &Schema{Type: "string"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return &Schema{Type: "string", Format: "byte"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaForType(t.Elem())}
+	case reflect.Struct:
+		return schemaFor(reflect.New(t).Elem())
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaForType(t.Elem())}
+	}
+	return &Schema{}
+}
+
+// isZero reports weather v holds it's type's zero value
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
@@ -0,0 +1,125 @@
+package tasks
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+type schemaTask struct {
+	ExampleTask
+	Url      string        `json:"url" required:"true" description:"url to fetch"`
+	Limit    int           `json:"limit"`
+	Ratio    float64       `json:"ratio"`
+	Skip     bool          `json:"skip"`
+	Tags     []string      `json:"tags"`
+	Delay    time.Duration `json:"delay" default:""`
+	Since    time.Time     `json:"since"`
+	Untagged string
+	Hidden   string `json:"-"`
+	internal string
+}
+
+func newSchemaTask() Taskable {
+	return &schemaTask{Limit: 10, Delay: time.Second}
+}
+
+func TestTaskdefSchema(t *testing.T) {
+	RegisterTaskdef("test.schema", newSchemaTask)
+	RegisterTaskdef("test.example", NewExampleTask)
+
+	s, err := TaskdefSchema("test.schema")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.Title != "test.schema" || s.Type != "object" || s.Schema != SchemaDraft {
+		t.Errorf("schema header mismatch: %#v", s)
+	}
+	if strings.Join(s.Order, ",") != "url,limit,ratio,skip,tags,delay,since,Untagged" {
+		t.Errorf("property order mismatch: %v", s.Order)
+	}
+	if len(s.Required) != 1 || s.Required[0] != "url" {
+		t.Errorf("expected url to be required, got: %v", s.Required)
+	}
+
+	cases := []struct {
+		prop, typ, format string
+		def               interface{}
+	}{
+		{"url", "string", "", nil},
+		{"limit", "integer", "", 10},
+		{"ratio", "number", "", nil},
+		{"skip", "boolean", "", nil},
+		{"tags", "array", "", nil},
+		{"delay", "integer", "", nil},
+		{"since", "string", "date-time", nil},
+		{"Untagged", "string", "", nil},
+	}
+	for _, c := range cases {
+		p := s.Properties[c.prop]
+		if p == nil {
+			t.Errorf("%s: missing property", c.prop)
+			continue
+		}
+		if p.Type != c.typ || p.Format != c.format || p.Default != c.def {
+			t.Errorf("%s: expected %s %s default %v, got: %s %s default %v", c.prop, c.typ, c.format, c.def, p.Type, p.Format, p.Default)
+		}
+	}
+	if s.Properties["url"].Description != "url to fetch" {
+		t.Errorf("expected description from tag")
+	}
+	if s.Properties["tags"].Items == nil || s.Properties["tags"].Items.Type != "string" {
+		t.Errorf("expected string items")
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(data), `"$schema":"`+SchemaDraft+`"`) || strings.Contains(string(data), "Order") {
+		t.Errorf("encoding mismatch: %s", data)
+	}
+
+	empty, err := TaskdefSchema("test.example")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if empty.Type != "object" || len(empty.Properties) != 0 {
+		t.Errorf("expected an empty object schema, got: %#v", empty)
+	}
+
+	if _, err := TaskdefSchema("test.unregistered"); err == nil {
+		t.Errorf("expected unregistered types to error")
+	}
+}
+
+func TestSchemaOf(t *testing.T) {
+	s := SchemaOf(&Task{})
+	if s.Properties["progress"] == nil || s.Properties["progress"].Properties["error"].Type != "string" {
+		t.Errorf("expected progress errors to be strings")
+	}
+	if s.Properties["enqueued"].Format != "date-time" {
+		t.Errorf("expected time pointers to be date-times")
+	}
+	if s.Properties["TraceParent"] != nil || s.Properties["traceParent"] != nil {
+		t.Errorf("expected fields tagged '-' to be left out")
+	}
+
+	cases := []struct {
+		v               interface{}
+		typ, format     string
+		additionalProps bool
+	}{
+		{json.RawMessage(`{}`), "", "", false},
+		{[]byte("hi"), "string", "byte", false},
+		{map[string]int{}, "object", "", true},
+		{[]*TaskEvent{}, "array", "", false},
+	}
+	for i, c := range cases {
+		got := SchemaOf(c.v)
+		if got.Type != c.typ || got.Format != c.format || (got.AdditionalProperties != nil) != c.additionalProps {
+			t.Errorf("case %d: schema mismatch: %#v", i, got)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package tasks
+
+import (
+	"database/sql"
+	"github.com/datatogether/sql_datastore"
+	"github.com/ipfs/go-datastore"
+)
+
+// sqlDB returns the database behind store if it's backed by postgres, nil
+// otherwise. Whenever the datastore interface isn't expressive enough, eg:
+// for filtered queries & atomic updates, tasks fall back to plain SQL
+// against this db. other stores are only shared within a process, so their
+// callers fall back to scans & locks instead
+func sqlDB(store datastore.Datastore) *sql.DB {
+	if s, ok := store.(*sql_datastore.Datastore); ok && s.DB != nil {
+		return s.DB
+	}
+	return nil
+}
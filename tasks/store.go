@@ -0,0 +1,56 @@
+package tasks
+
+import (
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"sync"
+)
+
+// LockedStore makes a datastore safe for concurrent use. tasks read &
+// write their store from many goroutines, which in-memory stores like
+// datastore.MapDatastore aren't built for
+type LockedStore struct {
+	sync.Mutex
+	ds datastore.Datastore
+}
+
+// NewLockedStore wraps ds in a LockedStore
+func NewLockedStore(ds datastore.Datastore) *LockedStore {
+	return &LockedStore{ds: ds}
+}
+
+func (s *LockedStore) Put(key datastore.Key, value interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.ds.Put(key, value)
+}
+
+func (s *LockedStore) Get(key datastore.Key) (interface{}, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.ds.Get(key)
+}
+
+func (s *LockedStore) Has(key datastore.Key) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.ds.Has(key)
+}
+
+func (s *LockedStore) Delete(key datastore.Key) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.ds.Delete(key)
+}
+
+func (s *LockedStore) Query(q query.Query) (query.Results, error) {
+	s.Lock()
+	defer s.Unlock()
+	res, err := s.ds.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	// drain results while locked
+	entries, err := res.Rest()
+	return query.ResultsWithEntries(q, entries), err
+}
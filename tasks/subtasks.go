@@ -0,0 +1,236 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-datastore"
+	"sync"
+	"time"
+)
+
+// SubtaskAmqpUrl is the queue subtasks are enqueued to, should be set by implementers.
+// If empty, subtasks are performed in-process as they're spawned
+var SubtaskAmqpUrl = ""
+
+// Subtasker lets a running task fan work out into child tasks. Children
+// are enqueued like any other task, so they spread across all workers.
+// Once the parent task reports it's done, it waits for all of it's children
+// to finish before it's marked as complete, tracking progress as they do
+type Subtasker interface {
+	// Spawn creates & enqueues a child task of the running task
+	Spawn(title, taskType string, params map[string]interface{}) (*Task, error)
+}
+
+// SubtaskTaskable is a task that spawns subtasks. task-orchestrators
+// will detect this method and call it before calling Taskable.Do
+type SubtaskTaskable interface {
+	Taskable
+	SetSubtasker(s Subtasker)
+}
+
+// subtasker spawns children of parent, counting as it goes
+type subtasker struct {
+	lock    sync.Mutex
+	store   datastore.Datastore
+	parent  *Task
+	spawned int
+	// trace context children continue
+	traceParent string
+}
+
+func (s *subtasker) Spawn(title, taskType string, params map[string]interface{}) (*Task, error) {
+	child := &Task{
+		Title:         title,
+		Type:          taskType,
+		UserId:        s.parent.UserId,
+		ParentId:      s.parent.Id,
+		ParentAttempt: s.parent.Attempts,
+		Params:        params,
+
+		TraceParent: s.traceParent,
+	}
+
+	if SubtaskAmqpUrl == "" {
+		if err := child.runInline(s.store); err != nil {
+			return nil, err
+		}
+	} else if err := child.Enqueue(s.store, SubtaskAmqpUrl); err != nil {
+		return nil, err
+	}
+
+	// a child that was coalesced into some other task isn't ours to wait on
+	if child.ParentId != s.parent.Id {
+		return child, nil
+	}
+
+	s.lock.Lock()
+	s.spawned++
+	s.lock.Unlock()
+	return child, nil
+}
+
+func (s *subtasker) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.spawned
+}
+
+// runInline performs a subtask immediately, for use when no queue is configured
+func (t *Task) runInline(store datastore.Datastore) error {
+	now := time.Now()
+	t.Enqueued = &now
+	if err := t.Save(store); err != nil {
+		return err
+	}
+
+	tc := make(chan *Task, 10)
+	go func() {
+		for range tc {
+		}
+	}()
+	defer close(tc)
+
+	// child errors are recorded on the child, and reported through the parent
+	t.Do(store, tc)
+	return nil
+}
+
+// parentLock serializes updates to parent tasks in stores that aren't backed
+// by postgres, which are only shared within this process
+var parentLock sync.Mutex
+
+// lockParentClass is the postgres advisory lock class subtask progress
+// updates take a lock on their parent's id in
+const lockParentClass = 4301
+
+// lockParent calls f holding a lock on the parent task id, so concurrent
+// children can't each save a parent they read before the other's update
+func lockParent(store datastore.Datastore, id string, f func() error) error {
+	if db := sqlDB(store); db != nil {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		// nothing is written through tx, it only holds the lock until rollback
+		defer tx.Rollback()
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1, hashtext($2));`, lockParentClass, id); err != nil {
+			return err
+		}
+		return f()
+	}
+
+	parentLock.Lock()
+	defer parentLock.Unlock()
+	return f()
+}
+
+// updateSubtaskProgress recalculates a parent task's progress from it's
+// children, completing the parent once all subtasks have finished. parents
+// that failed because a subtask did are recalculated too, so retrying the
+// subtask clears the parent's failure. t is re-read while holding a lock on
+// it, so updates from concurrent children don't overwrite each other
+func (t *Task) updateSubtaskProgress(store datastore.Datastore, tc chan *Task) error {
+	var changed, wasFailed bool
+	err := lockParent(store, t.Id, func() error {
+		if err := t.Read(store); err != nil {
+			return err
+		}
+		wasFailed = t.Failed != nil
+		changed = t.Subtasks > 0 && t.Succeeded == nil && !t.Cancelled()
+		if !changed {
+			return nil
+		}
+		if err := t.recalcSubtaskProgress(store); err != nil {
+			return err
+		}
+		return t.Save(store)
+	})
+	if err != nil || !changed {
+		return err
+	}
+
+	if tc != nil {
+		tc <- t
+	}
+
+	switch {
+	case t.Succeeded != nil:
+		return t.LogEvent(store, EventSucceeded, "")
+	case t.Failed != nil && !wasFailed:
+		return t.LogEvent(store, EventFailed, t.Error)
+	case t.Failed == nil && wasFailed:
+		return t.LogEvent(store, EventProgress, t.Status)
+	}
+	return nil
+}
+
+// recalcSubtaskProgress sets t's status, progress & completion from the
+// subtasks spawned by it's current attempt
+func (t *Task) recalcSubtaskProgress(store datastore.Datastore) error {
+	children, err := ReadChildTasks(store, t.Id)
+	if err != nil {
+		return err
+	}
+
+	succeeded, failed := 0, 0
+	for _, c := range children {
+		// children of earlier attempts were replaced by this attempt's
+		if c.parentAttempt() != t.Attempts {
+			continue
+		}
+		if c.Succeeded != nil {
+			succeeded++
+		} else if c.Failed != nil {
+			failed++
+		}
+	}
+	finished := succeeded + failed
+
+	t.Status = fmt.Sprintf("%d/%d subtasks complete", finished, t.Subtasks)
+	t.Progress = &Progress{
+		Step:    finished,
+		Steps:   t.Subtasks,
+		Percent: float32(finished) / float32(t.Subtasks),
+		Status:  t.Status,
+	}
+
+	switch {
+	case finished < t.Subtasks:
+		t.Failed = nil
+		t.Error = ""
+	case failed > 0:
+		t.Error = fmt.Sprintf("%d of %d subtasks failed", failed, t.Subtasks)
+		if t.Failed == nil {
+			now := time.Now()
+			t.Failed = &now
+		}
+		t.Progress.Error = errors.New(t.Error)
+		t.Progress.Done = true
+	default:
+		now := time.Now()
+		t.Failed = nil
+		t.Error = ""
+		t.Succeeded = &now
+		t.Progress.Done = true
+	}
+	return nil
+}
+
+// parentAttempt gives the attempt of the parent that spawned t. subtasks
+// stored before attempts were recorded belong to the first
+func (t *Task) parentAttempt() int {
+	if t.ParentAttempt == 0 {
+		return 1
+	}
+	return t.ParentAttempt
+}
+
+// updateParent notifies a subtask's parent that the subtask has changed state
+func (t *Task) updateParent(store datastore.Datastore, tc chan *Task) error {
+	if t.ParentId == "" {
+		return nil
+	}
+
+	parent := &Task{Id: t.ParentId}
+	return parent.updateSubtaskProgress(store, tc)
+}
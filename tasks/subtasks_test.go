@@ -0,0 +1,226 @@
+package tasks
+
+import (
+	"github.com/ipfs/go-datastore"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fanOutTask struct {
+	Children int `json:"children"`
+	subtasks Subtasker
+}
+
+func newFanOutTask() Taskable {
+	return &fanOutTask{}
+}
+
+func (f *fanOutTask) Valid() error {
+	return nil
+}
+
+func (f *fanOutTask) SetSubtasker(s Subtasker) {
+	f.subtasks = s
+}
+
+func (f *fanOutTask) Do(updates chan Progress) {
+	for i := 0; i < f.Children; i++ {
+		if _, err := f.subtasks.Spawn("child", "test.child", nil); err != nil {
+			updates <- Progress{Error: err}
+			return
+		}
+	}
+	updates <- Progress{Done: true}
+}
+
+func TestSubtasks(t *testing.T) {
+	RegisterTaskdef("test.fanout", newFanOutTask)
+	RegisterTaskdef("test.child", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	parent := &Task{Type: "test.fanout", Params: map[string]interface{}{"children": 3}}
+	if err := parent.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tc := make(chan *Task, 10)
+	go func() {
+		for range tc {
+		}
+	}()
+	if err := parent.Do(store, tc); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	children, err := ReadChildTasks(store, parent.Id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(children) != 3 {
+		t.Errorf("expected 3 children, got: %d", len(children))
+	}
+
+	if err := parent.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if parent.Subtasks != 3 {
+		t.Errorf("subtasks count mismatch. expected: %d, got: %d", 3, parent.Subtasks)
+	}
+	if parent.Succeeded == nil {
+		t.Errorf("expected parent to succeed once all subtasks finished")
+	}
+}
+
+func TestRetriedSubtaskReopensParent(t *testing.T) {
+	store := datastore.NewMapDatastore()
+	now := time.Now()
+
+	parent := &Task{Type: "test.fanout", Subtasks: 2}
+	if err := parent.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	a := &Task{Type: "test.child", ParentId: parent.Id, Succeeded: &now}
+	b := &Task{Type: "test.child", ParentId: parent.Id, Failed: &now, Error: "oh no"}
+	for _, c := range []*Task{a, b} {
+		if err := c.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	cases := []struct {
+		failed, succeeded *time.Time
+		parentFailed      bool
+		parentSucceeded   bool
+	}{
+		{&now, nil, true, false},
+		// retrying b puts the parent back to waiting on it
+		{nil, nil, false, false},
+		{nil, &now, false, true},
+	}
+
+	for i, c := range cases {
+		b.Failed, b.Succeeded = c.failed, c.succeeded
+		if err := b.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := b.updateParent(store, nil); err != nil {
+			t.Fatalf("case %d: %s", i, err.Error())
+		}
+		if err := parent.Read(store); err != nil {
+			t.Fatal(err.Error())
+		}
+		if (parent.Failed != nil) != c.parentFailed || (parent.Succeeded != nil) != c.parentSucceeded {
+			t.Errorf("case %d: expected parent failed: %t, succeeded: %t. got failed: %t, succeeded: %t", i, c.parentFailed, c.parentSucceeded, parent.Failed != nil, parent.Succeeded != nil)
+		}
+	}
+}
+
+func TestRetriedParentWaitsOnNewSubtasks(t *testing.T) {
+	RegisterTaskdef("test.fanout", newFanOutTask)
+	RegisterTaskdef("test.child", NewExampleTask)
+	store := datastore.NewMapDatastore()
+	tc := make(chan *Task, 10)
+	go func() {
+		for range tc {
+		}
+	}()
+
+	// the first attempt had a succeeded & a failed child
+	now := time.Now()
+	parent := &Task{Type: "test.fanout", Params: map[string]interface{}{"children": 2}, Subtasks: 2, Failed: &now, Error: "1 of 2 subtasks failed"}
+	if err := parent.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	succeeded := &Task{Type: "test.child", ParentId: parent.Id, ParentAttempt: 1, Succeeded: &now}
+	failed := &Task{Type: "test.child", ParentId: parent.Id, ParentAttempt: 1, Failed: &now, Error: "oh no"}
+	for _, c := range []*Task{succeeded, failed} {
+		if err := c.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if err := parent.reset(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := parent.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	// the first attempt's children finishing again mustn't finish the retry
+	if err := failed.updateParent(store, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := parent.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if parent.Failed != nil || parent.Succeeded != nil {
+		t.Errorf("expected retried parent to stay open, got error: %s", parent.Error)
+	}
+
+	if err := parent.Do(store, tc); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := parent.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if parent.Failed != nil || parent.Succeeded == nil {
+		t.Errorf("expected retried parent to succeed with it's new subtasks, got error: %s", parent.Error)
+	}
+}
+
+func TestConcurrentSubtasksCompleteParent(t *testing.T) {
+	RegisterTaskdef("test.fanout", newFanOutTask)
+	RegisterTaskdef("test.child", NewExampleTask)
+	store := slowSaveStore{NewLockedStore(datastore.NewMapDatastore())}
+
+	n := 20
+	parent := &Task{Type: "test.fanout", Params: map[string]interface{}{"children": n}, Subtasks: n}
+	if err := parent.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	children := make([]*Task, n)
+	for i := range children {
+		children[i] = &Task{Type: "test.child", ParentId: parent.Id, ParentAttempt: 1}
+		if err := children[i].Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// children finishing at once each update the parent, none may be lost
+	wg := sync.WaitGroup{}
+	for _, c := range children {
+		wg.Add(1)
+		// finish a copy, the in-memory store holds the saved pointer
+		go func(c Task) {
+			defer wg.Done()
+			now := time.Now()
+			c.Succeeded = &now
+			if err := c.Save(store); err != nil {
+				t.Error(err.Error())
+				return
+			}
+			if err := c.updateParent(store, nil); err != nil {
+				t.Error(err.Error())
+			}
+		}(*c)
+	}
+	wg.Wait()
+
+	if err := parent.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if parent.Succeeded == nil {
+		t.Errorf("expected parent to succeed once all subtasks have, got status: %s", parent.Status)
+	}
+}
+
+// slowSaveStore widens the gap between reading & saving a task, so
+// unsynchronized read-modify-writes interleave. Task.Save checks Has first
+type slowSaveStore struct {
+	datastore.Datastore
+}
+
+func (s slowSaveStore) Has(key datastore.Key) (bool, error) {
+	time.Sleep(time.Millisecond)
+	return s.Datastore.Has(key)
+}
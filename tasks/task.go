@@ -1,14 +1,19 @@
 package tasks
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/datatogether/sql_datastore"
 	"github.com/datatogether/sqlutil"
+	"github.com/datatogether/task_mgmt/logging"
+	"github.com/datatogether/task_mgmt/tracing"
 	"github.com/ipfs/go-datastore"
 	"github.com/pborman/uuid"
 	"github.com/streadway/amqp"
+	"net/url"
 	"time"
 )
 
@@ -54,6 +59,29 @@ type Task struct {
 	// progress of this task's completion
 	// progress may not be stored, but instead kept ephemerally
 	Progress *Progress `json:"progress,omitempty"`
+	// id of the task that spawned this task, empty for top-level tasks
+	ParentId string `json:"parentId,omitempty"`
+	// attempt of the parent that spawned this task. a retried parent only
+	// waits on the subtasks it's current attempt spawns
+	ParentAttempt int `json:"parentAttempt,omitempty"`
+	// number of subtasks this task spawned, set once the task
+	// has finished spawning
+	Subtasks int `json:"subtasks,omitempty"`
+	// id of the worker that claimed this task, if any
+	WorkerId string `json:"workerId,omitempty"`
+	// number of times this task has been submitted for completion,
+	// starting at 1 & increasing each time the task is retried
+	Attempts int `json:"attempts"`
+	// Version increases every time the task's state or progress changes,
+	// versions are nanosecond timestamps so they stay ordered when a task
+	// is changed from different processes
+	Version int64 `json:"version"`
+	// url that's sent a signed request when the task succeeds, fails
+	// or is cancelled, if set
+	CallbackUrl string `json:"callbackUrl,omitempty"`
+	// W3C traceparent the task's work continues, carried to workers in
+	// the queue message's headers. it isn't stored
+	TraceParent string `json:"-"`
 }
 
 // DatastoreType is to fulfill the sql_datastore.Model interface
@@ -84,22 +112,114 @@ func (t *Task) QueueMsg() (amqp.Publishing, error) {
 		return amqp.Publishing{}, fmt.Errorf("Error marshaling params to JSON: %s", err.Error())
 	}
 
-	return amqp.Publishing{
+	msg := amqp.Publishing{
 		ContentType:   "application/json",
 		CorrelationId: t.Id,
 		Type:          t.Type,
 		UserId:        t.UserId,
 		Body:          body,
-	}, nil
+	}
+	if t.TraceParent != "" {
+		msg.Headers = amqp.Table{tracing.Header: t.TraceParent}
+	}
+	return msg, nil
 }
 
 // Enqueue adds a task to the queue located at ampqurl, writing creates/updates
 // for the task to the given store
 func (task *Task) Enqueue(store datastore.Datastore, amqpurl string) error {
-	// Initial save to get an ID, prove we tried to submit
+	// Initial save to get an ID, prove we tried to submit. if an equivalent
+	// task is already underway there's nothing to enqueue, task is replaced
+	// with the existing task
+	if coalesced, err := task.Coalesce(store); err != nil {
+		return err
+	} else if coalesced {
+		return nil
+	}
+
+	if err := task.publish(store, amqpurl); err != nil {
+		// record the failure, which also frees the task's dedup key
+		now := time.Now()
+		task.Failed = &now
+		task.Error = err.Error()
+		task.Save(store)
+		return err
+	}
+	return task.LogEvent(store, EventEnqueued, "")
+}
+
+// Requeue clears any record of a task having been started & sends it back
+// to the queue at amqpurl
+func (task *Task) Requeue(store datastore.Datastore, amqpurl string) error {
+	task.Started = nil
+	task.WorkerId = ""
+	task.Progress = nil
+	task.Status = ""
+	if err := task.publish(store, amqpurl); err != nil {
+		return err
+	}
+	return task.LogEvent(store, EventRequeued, "")
+}
+
+// ErrTaskCancelled is the error recorded on tasks that have been cancelled
+var ErrTaskCancelled = errors.New("task cancelled")
+
+// Cancelled reports weather the task was stopped by a call to Cancel
+func (task *Task) Cancelled() bool {
+	return task.Failed != nil && task.Error == ErrTaskCancelled.Error()
+}
+
+// Cancel marks an unfinished task & any unfinished subtasks as failed.
+// Workers check for cancellation while tasks run, cancelling the context
+// of taskables that accept one & no longer tracking the task
+func (task *Task) Cancel(store datastore.Datastore) error {
+	if task.Succeeded != nil || task.Failed != nil {
+		return fmt.Errorf("task %s has already finished", task.Id)
+	}
+
+	now := time.Now()
+	task.Failed = &now
+	task.Error = ErrTaskCancelled.Error()
 	if err := task.Save(store); err != nil {
 		return err
 	}
+	if err := task.LogEvent(store, EventCancelled, ""); err != nil {
+		return err
+	}
+
+	children, err := ReadChildTasks(store, task.Id)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		if c.Succeeded == nil && c.Failed == nil {
+			if err := c.Cancel(store); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkCancelled reads the stored copy of a running task to see if
+// it's been cancelled
+func (task *Task) checkCancelled(store datastore.Datastore) bool {
+	stored := &Task{Id: task.Id}
+	if err := stored.Read(store); err != nil {
+		return false
+	}
+	return stored.Cancelled()
+}
+
+// publish sends a saved task to the queue at amqpurl, marking it as enqueued.
+// the task's work continues the trace from a span recording the publish
+func (task *Task) publish(store datastore.Datastore, amqpurl string) (err error) {
+	span := tracing.Start(fmt.Sprintf("task.Enqueue %s", task.Type), tracing.KindProducer, tracing.Parent(task.TraceParent))
+	span.SetAttribute("task.id", task.Id)
+	span.SetAttribute("task.type", task.Type)
+	span.SetAttribute("messaging.destination.name", QueueName(task.Type))
+	defer func() { span.End(err) }()
+	task.TraceParent = span.TraceParent()
 
 	// connect to queue server & submit task
 	conn, err := amqp.Dial(amqpurl)
@@ -115,12 +235,12 @@ func (task *Task) Enqueue(store datastore.Datastore, amqpurl string) error {
 	defer ch.Close()
 
 	q, err := ch.QueueDeclare(
-		"tasks", // name
-		false,   // durable
-		false,   // delete when unused
-		false,   // exclusive
-		false,   // no-wait
-		nil,     // arguments
+		QueueName(task.Type), // name
+		false,                // durable
+		false,                // delete when unused
+		false,                // exclusive
+		false,                // no-wait
+		nil,                  // arguments
 	)
 	if err != nil {
 		return fmt.Errorf("Failed to declare a queue: %s", err.Error())
@@ -154,11 +274,36 @@ func TaskFromDelivery(store datastore.Datastore, msg amqp.Delivery) (*Task, erro
 	if err := t.Read(store); err != nil {
 		return nil, err
 	}
+	if tp, ok := msg.Headers[tracing.Header].(string); ok {
+		t.TraceParent = tp
+	}
 	return t, nil
 }
 
-// Do performs the
-func (task *Task) Do(store datastore.Datastore, tc chan *Task) error {
+// Do performs the task, recording a span that continues the task's trace.
+// ContextTaskables are given a context carrying the span, so it's the
+// parent of spans made while they run, & a log entry with the task's fields
+func (task *Task) Do(store datastore.Datastore, tc chan *Task) (err error) {
+	span := tracing.Start(fmt.Sprintf("task.Do %s", task.Type), tracing.KindConsumer, tracing.Parent(task.TraceParent))
+	span.SetAttribute("task.id", task.Id)
+	span.SetAttribute("task.type", task.Type)
+	span.SetAttribute("task.attempts", task.Attempts)
+	if task.UserId != "" {
+		span.SetAttribute("user.id", task.UserId)
+	}
+	defer func() {
+		span.End(err)
+	}()
+
+	ctx := tracing.ContextWithSpan(context.Background(), span)
+	ctx = logging.ContextWithEntry(ctx, logging.Log.WithFields(task.LogFields()))
+	return task.do(ctx, store, tc, span)
+}
+
+// cancelCheckInterval is how often running tasks are checked for cancellation
+var cancelCheckInterval = time.Second
+
+func (task *Task) do(ctx context.Context, store datastore.Datastore, tc chan *Task, span *tracing.Span) error {
 	newTask := taskdefs[task.Type]
 	if newTask == nil {
 		return fmt.Errorf("unknown task type: %s", task.Type)
@@ -180,78 +325,197 @@ func (task *Task) Do(store datastore.Datastore, tc chan *Task) error {
 		dsT.SetDatastore(store)
 	}
 
+	// If the task can resume from a checkpoint, give it a place
+	// to read & write checkpoints for this task
+	if cpT, ok := tt.(CheckpointTaskable); ok {
+		cpT.SetCheckpointer(NewCheckpointer(store, task.Id))
+	}
+
+	// If the task fans out into subtasks, give it a way to spawn them
+	spawner := &subtasker{store: store, parent: task, traceParent: span.TraceParent()}
+	if stT, ok := tt.(SubtaskTaskable); ok {
+		stT.SetSubtasker(spawner)
+	}
+
+	// If the task can be stopped, give it a context that's cancelled
+	// along with the task
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if ctxT, ok := tt.(ContextTaskable); ok {
+		ctxT.SetContext(ctx)
+	}
+
 	pc := make(chan Progress, 10)
 
+	if task.Started == nil {
+		now := time.Now()
+		task.Started = &now
+	}
 	if err := task.Save(store); err != nil {
 		return err
 	}
+	task.LogEvent(store, EventStarted, "")
 
 	// execute the task in a goroutine
 	go tt.Do(pc)
 
-	for p := range pc {
-		// TODO - log progress and pipe out of this func
-		// so others can listen in for updates
-		// fmt.Println(p.String())
+	// checking for cancellation means a trip to the store, so only check
+	// once in a while, or when the task is about to finish
+	ticker := time.NewTicker(cancelCheckInterval)
+	defer ticker.Stop()
+	for {
+		var p Progress
+		select {
+		case <-ticker.C:
+			if task.checkCancelled(store) {
+				return task.stop(cancel, pc)
+			}
+			continue
+		case p = <-pc:
+		}
+
+		if (p.Done || p.Error != nil) && task.checkCancelled(store) {
+			return task.stop(cancel, pc)
+		}
+
+		if p.Status != "" && (task.Progress == nil || task.Progress.Status != p.Status) {
+			task.LogEvent(store, EventProgress, p.Status)
+		}
 		task.Progress = &p
+		task.bumpVersion()
 		tc <- task
 
 		if p.Error != nil {
 			task.Error = p.Error.Error()
 			now := time.Now()
 			task.Failed = &now
-			go task.Save(store)
+			if err := task.Save(store); err != nil {
+				return err
+			}
+			task.LogEvent(store, EventFailed, task.Error)
+			if err := task.updateParent(store, tc); err != nil {
+				return fmt.Errorf("%s, error updating parent task: %s", p.Error.Error(), err.Error())
+			}
 			return p.Error
 		}
 		if p.Done {
+			// finished tasks have no need for a checkpoint
+			if err := deleteCheckpoint(store, task.Id); err != nil {
+				return err
+			}
+
+			// tasks that spawned subtasks wait for them to finish
+			if n := spawner.count(); n > 0 {
+				task.Subtasks = n
+				task.Status = fmt.Sprintf("waiting on %d subtasks", n)
+				if err := task.Save(store); err != nil {
+					return err
+				}
+				task.LogEvent(store, EventProgress, task.Status)
+				// some, or all subtasks may have finished before we got here
+				return task.updateSubtaskProgress(store, tc)
+			}
+
 			now := time.Now()
 			task.Succeeded = &now
-			go task.Save(store)
-			return nil
+			if err := task.Save(store); err != nil {
+				return err
+			}
+			task.LogEvent(store, EventSucceeded, "")
+			return task.updateParent(store, tc)
 		}
 	}
+}
 
-	return nil
+// stop cancels the context of a cancelled task, draining updates the
+// taskable sends on it's way out
+func (task *Task) stop(cancel context.CancelFunc, pc chan Progress) error {
+	cancel()
+	go func() {
+		for range pc {
+		}
+	}()
+	return ErrTaskCancelled
+}
+
+// LogFields describes the task in log entries
+func (t *Task) LogFields() logging.Fields {
+	fields := logging.Fields{"task_id": t.Id, "task_type": t.Type}
+	if t.UserId != "" {
+		fields["user_id"] = t.UserId
+	}
+	if t.WorkerId != "" {
+		fields["worker_id"] = t.WorkerId
+	}
+	return fields
 }
 
 // StatusString returns a string representation of the status
 // of a task based on the state of it's date stamps
 func (t *Task) StatusString() string {
-	if t.Enqueued == nil {
-		return "enquing"
-	} else if t.Enqueued != nil {
-		return "queued"
-	} else if t.Succeeded != nil {
-		return "finished"
-	} else if t.Failed != nil {
+	switch {
+	case t.Cancelled():
+		return "cancelled"
+	case t.Failed != nil:
 		return "failed"
-	} else {
+	case t.Succeeded != nil:
+		return "finished"
+	case t.Started != nil:
 		return "running"
+	case t.Enqueued != nil:
+		return "queued"
+	default:
+		return "enquing"
 	}
 }
 
 func (t *Task) valid() error {
+	// create the task locally to check validity
+	tt, err := t.taskable()
+	if err != nil {
+		return err
+	}
+
+	if err := tt.Valid(); err != nil {
+		return fmt.Errorf("Invalid task: %s", err.Error())
+	}
+
+	if t.CallbackUrl != "" {
+		if err := ValidCallbackUrl(t.CallbackUrl); err != nil {
+			return fmt.Errorf("Invalid task: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// ValidCallbackUrl checks u is an absolute http or https url
+func ValidCallbackUrl(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("callback url '%s' must be an absolute http or https url", u)
+	}
+	return nil
+}
+
+// taskable creates a Taskable for this task's type, with params
+// unmarshaled into it
+func (t *Task) taskable() (Taskable, error) {
 	if taskdefs[t.Type] == nil {
-		return fmt.Errorf("unrecognized task type: '%s'", t.Type)
+		return nil, fmt.Errorf("unrecognized task type: '%s'", t.Type)
 	}
 
 	body, err := json.Marshal(t.Params)
 	if err != nil {
-		return fmt.Errorf("Error marshaling params to JSON: %s", err.Error())
+		return nil, fmt.Errorf("Error marshaling params to JSON: %s", err.Error())
 	}
 
-	// create the task locally to check validity
-	// TODO - this should be moved into tasks package?
 	tt := taskdefs[t.Type]()
 	if err := json.Unmarshal(body, tt); err != nil {
-		return fmt.Errorf("Error creating task from JSON: %s", err.Error())
-	}
-
-	if err := tt.Valid(); err != nil {
-		return fmt.Errorf("Invalid task: %s", err.Error())
+		return nil, fmt.Errorf("Error creating task from JSON: %s", err.Error())
 	}
 
-	return nil
+	return tt, nil
 }
 
 func (t *Task) Read(store datastore.Datastore) error {
@@ -286,14 +550,40 @@ func (t *Task) Save(store datastore.Datastore) (err error) {
 	}
 
 	if !exists {
-		t.Id = uuid.New()
-		t.Created = time.Now().Round(time.Second).In(time.UTC)
-		t.Updated = t.Created
+		t.setCreated()
 	} else {
 		t.Updated = time.Now().Round(time.Second).In(time.UTC)
 	}
+	t.bumpVersion()
 
-	return store.Put(t.Key(), t)
+	if err := store.Put(t.Key(), t); err != nil {
+		return err
+	}
+
+	// newly-created tasks claim their dedup key
+	if !exists {
+		return t.recordDedup(store)
+	}
+	return nil
+}
+
+// setCreated gives a new task it's id & creation time
+func (t *Task) setCreated() {
+	t.Id = uuid.New()
+	t.Created = time.Now().Round(time.Second).In(time.UTC)
+	t.Updated = t.Created
+	if t.Attempts == 0 {
+		t.Attempts = 1
+	}
+}
+
+// bumpVersion moves the task to a new version, always greater than the last
+func (t *Task) bumpVersion() {
+	v := time.Now().UnixNano()
+	if v <= t.Version {
+		v = t.Version + 1
+	}
+	t.Version = v
 }
 
 func (t *Task) Delete(store datastore.Datastore) error {
@@ -328,6 +618,9 @@ func (t *Task) SQLQuery(cmd sql_datastore.Cmd) string {
 func (t *Task) UnmarshalSQL(row sqlutil.Scannable) error {
 	var (
 		id, title, userId, typ, status, e    string
+		parentId, workerId, callbackUrl      string
+		subtasks, attempts, parentAttempt    int
+		version                              int64
 		paramBytes                           []byte
 		params                               map[string]interface{}
 		created, updated                     time.Time
@@ -336,9 +629,12 @@ func (t *Task) UnmarshalSQL(row sqlutil.Scannable) error {
 	err := row.Scan(
 		&id, &created, &updated, &title, &userId, &typ, &paramBytes, &status, &e,
 		&enqueued, &started, &succeeded, &failed,
+		&parentId, &subtasks, &workerId, &attempts, &version, &callbackUrl, &parentAttempt,
 	)
 	if err == sql.ErrNoRows {
 		return datastore.ErrNotFound
+	} else if err != nil {
+		return err
 	}
 
 	if paramBytes != nil {
@@ -349,19 +645,26 @@ func (t *Task) UnmarshalSQL(row sqlutil.Scannable) error {
 	}
 
 	*t = Task{
-		Id:        id,
-		Created:   created,
-		Updated:   updated,
-		Title:     title,
-		UserId:    userId,
-		Type:      typ,
-		Params:    params,
-		Status:    status,
-		Error:     e,
-		Enqueued:  enqueued,
-		Started:   started,
-		Succeeded: succeeded,
-		Failed:    failed,
+		Id:            id,
+		Created:       created,
+		Updated:       updated,
+		Title:         title,
+		UserId:        userId,
+		Type:          typ,
+		Params:        params,
+		Status:        status,
+		Error:         e,
+		Enqueued:      enqueued,
+		Started:       started,
+		Succeeded:     succeeded,
+		Failed:        failed,
+		ParentId:      parentId,
+		ParentAttempt: parentAttempt,
+		Subtasks:      subtasks,
+		WorkerId:      workerId,
+		Attempts:      attempts,
+		Version:       version,
+		CallbackUrl:   callbackUrl,
 	}
 
 	return nil
@@ -392,6 +695,13 @@ func (t *Task) SQLParams(cmd sql_datastore.Cmd) []interface{} {
 			t.Started,
 			t.Succeeded,
 			t.Failed,
+			t.ParentId,
+			t.Subtasks,
+			t.WorkerId,
+			t.Attempts,
+			t.Version,
+			t.CallbackUrl,
+			t.ParentAttempt,
 			// t.Progress,
 		}
 	}
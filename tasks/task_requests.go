@@ -2,6 +2,7 @@ package tasks
 
 import (
 	"github.com/ipfs/go-datastore"
+	"time"
 )
 
 // TaskRequests encapsulates all types of requests that can be made
@@ -15,6 +16,38 @@ type TaskRequests struct {
 	// Store to read / write tasks to only required
 	// to fulfill requests, not submit them
 	Store datastore.Datastore
+	// Authorizer checks requests against stored policies, nil permits
+	// all requests. RPC callers are trusted to supply the id of the
+	// user they're acting for
+	Authorizer *Authorizer
+	// Quotas limit enqueued & cloned tasks, empty for no limits
+	Quotas []QuotaRule
+	// Broker delivers task updates to WaitForUpdate, if nil
+	// WaitForUpdate polls the store
+	Broker Broker
+}
+
+// authorize checks userId may perform action on t
+func (r TaskRequests) authorize(userId string, action Action, t *Task) error {
+	if r.Authorizer == nil {
+		return nil
+	}
+	return r.Authorizer.Authorize(userId, action, t)
+}
+
+// filter narrows f to tasks userId may perform action on. f may be nil,
+// in which case the returned filter is nil if there's no Authorizer
+func (r TaskRequests) filter(userId string, action Action, f TaskFilter) (TaskFilter, error) {
+	if r.Authorizer == nil {
+		return f, nil
+	}
+	allowed, err := r.Authorizer.Filter(userId, action)
+	if err != nil || f == nil {
+		return allowed, err
+	}
+	return func(t *Task) bool {
+		return f(t) && allowed(t)
+	}, nil
 }
 
 // TasksEnqueueParams are for enqueing a task.
@@ -29,18 +62,30 @@ type TasksEnqueueParams struct {
 	UserId string
 	// Parameters to feed to the task
 	Params map[string]interface{}
+	// url to notify when the task finishes, optional
+	CallbackUrl string
+	// W3C traceparent of the caller, the task's work continues it's
+	// trace if set
+	TraceParent string
 }
 
 // Add a task to the queue for completion
 func (r TaskRequests) Enqueue(params *TasksEnqueueParams, task *Task) (err error) {
 	t := &Task{
-		Title:  params.Title,
-		Type:   params.Type,
-		UserId: params.UserId,
-		Params: params.Params,
+		Title:       params.Title,
+		Type:        params.Type,
+		UserId:      params.UserId,
+		Params:      params.Params,
+		CallbackUrl: params.CallbackUrl,
+		TraceParent: params.TraceParent,
 	}
 
-	if err := t.Enqueue(r.Store, r.AmqpUrl); err != nil {
+	if err := r.authorize(params.UserId, ActionSubmit, t); err != nil {
+		return err
+	}
+	if err := SubmitWithinQuota(r.Store, r.Quotas, t, func() error {
+		return t.Enqueue(r.Store, r.AmqpUrl)
+	}); err != nil {
 		return err
 	}
 
@@ -51,6 +96,8 @@ func (r TaskRequests) Enqueue(params *TasksEnqueueParams, task *Task) (err error
 // Get a single Task, currently only lookup by ID is supported
 type TasksGetParams struct {
 	Id string
+	// User making the request
+	UserId string
 }
 
 func (t TaskRequests) Get(args *TasksGetParams, res *Task) (err error) {
@@ -61,6 +108,9 @@ func (t TaskRequests) Get(args *TasksGetParams, res *Task) (err error) {
 	if err != nil {
 		return err
 	}
+	if err := t.authorize(args.UserId, ActionRead, tsk); err != nil {
+		return err
+	}
 
 	*res = *tsk
 	return nil
@@ -70,9 +120,24 @@ type TasksListParams struct {
 	OrderBy string
 	Limit   int
 	Offset  int
+	// User making the request, only tasks they can read are listed
+	UserId string
 }
 
 func (t TaskRequests) List(args *TasksListParams, res *[]*Task) (err error) {
+	if t.Authorizer != nil {
+		q, err := t.Authorizer.Readable(args.UserId, TaskQuery{Limit: args.Limit, Offset: args.Offset})
+		if err != nil {
+			return err
+		}
+		ts, err := ReadTaskQuery(t.Store, q)
+		if err != nil {
+			return err
+		}
+		*res = ts
+		return nil
+	}
+
 	ts, err := ReadTasks(t.Store, args.OrderBy, args.Limit, args.Offset)
 	if err != nil {
 		return err
@@ -80,3 +145,180 @@ func (t TaskRequests) List(args *TasksListParams, res *[]*Task) (err error) {
 	*res = ts
 	return nil
 }
+
+// TasksCancelParams are for cancelling a task
+type TasksCancelParams struct {
+	Id string
+	// User making the request
+	UserId string
+}
+
+// Cancel an unfinished task
+func (r TaskRequests) Cancel(args *TasksCancelParams, res *Task) (err error) {
+	t := &Task{Id: args.Id}
+	if err := t.Read(r.Store); err != nil {
+		return err
+	}
+	if err := r.authorize(args.UserId, ActionCancel, t); err != nil {
+		return err
+	}
+	if err := t.Cancel(r.Store); err != nil {
+		return err
+	}
+
+	*res = *t
+	return nil
+}
+
+// TasksRetryParams are for retrying a failed task
+type TasksRetryParams struct {
+	Id string
+	// User making the request
+	UserId string
+}
+
+// Retry sends a failed task back to the queue
+func (r TaskRequests) Retry(args *TasksRetryParams, res *Task) (err error) {
+	t := &Task{Id: args.Id}
+	if err := t.Read(r.Store); err != nil {
+		return err
+	}
+	if err := r.authorize(args.UserId, ActionRetry, t); err != nil {
+		return err
+	}
+	if err := SubmitWithinQuota(r.Store, r.Quotas, t, func() error {
+		return t.Retry(r.Store, r.AmqpUrl)
+	}); err != nil {
+		return err
+	}
+
+	*res = *t
+	return nil
+}
+
+// TasksEventsParams are for reading a task's event log
+type TasksEventsParams struct {
+	Id string
+	// User making the request
+	UserId string
+}
+
+// Events lists the event log for a task, oldest first
+func (r TaskRequests) Events(args *TasksEventsParams, res *[]*TaskEvent) (err error) {
+	if r.Authorizer != nil {
+		t := &Task{Id: args.Id}
+		if err := t.Read(r.Store); err != nil {
+			return err
+		}
+		if err := r.authorize(args.UserId, ActionRead, t); err != nil {
+			return err
+		}
+	}
+
+	events, err := ReadTaskEvents(r.Store, args.Id)
+	if err != nil {
+		return err
+	}
+
+	*res = events
+	return nil
+}
+
+// TasksCloneParams are for creating a new task from an existing one
+type TasksCloneParams struct {
+	// Id of the task to clone
+	Id string
+	// Title for the new task, defaults to the cloned task's title
+	Title string
+	// Params override the cloned task's params
+	Params map[string]interface{}
+	// User making the request, who will own the new task
+	UserId string
+}
+
+// Clone enqueues a new task with the params of an existing task
+func (r TaskRequests) Clone(args *TasksCloneParams, res *Task) (err error) {
+	t := &Task{Id: args.Id}
+	if err := t.Read(r.Store); err != nil {
+		return err
+	}
+
+	clone := t.Clone(args.Title, args.Params)
+	clone.UserId = args.UserId
+	if err := r.authorize(args.UserId, ActionSubmit, clone); err != nil {
+		return err
+	}
+	if err := SubmitWithinQuota(r.Store, r.Quotas, clone, func() error {
+		return clone.Enqueue(r.Store, r.AmqpUrl)
+	}); err != nil {
+		return err
+	}
+
+	*res = *clone
+	return nil
+}
+
+// TasksRetryManyParams select failed tasks to retry in bulk
+type TasksRetryManyParams struct {
+	// Type of task to retry, empty retries all types
+	Type string
+	// only retry tasks that failed after Since, the zero
+	// time retries all failed tasks
+	Since time.Time
+	// User making the request, only tasks they can retry are retried
+	UserId string
+}
+
+// RetryMany retries all failed tasks that match the given params
+func (r TaskRequests) RetryMany(args *TasksRetryManyParams, res *[]*Task) (err error) {
+	filter, err := r.filter(args.UserId, ActionRetry, FailedSince(args.Type, args.Since))
+	if err != nil {
+		return err
+	}
+	retried, err := RetryTasks(r.Store, r.AmqpUrl, r.Quotas, filter)
+	*res = retried
+	return err
+}
+
+// TasksWaitParams are for waiting on a change to a task
+type TasksWaitParams struct {
+	Id string
+	// return once the task has a version newer than SinceVersion, zero
+	// returns the current task
+	SinceVersion int64
+	// how long to wait, defaults to DefaultWaitTimeout, capped at MaxWaitTimeout
+	Timeout time.Duration
+	// User making the request
+	UserId string
+}
+
+// WaitForUpdate long-polls for the next change to a task's state or progress,
+// returning the changed task, or the unchanged task if Timeout passes first.
+// Finished tasks are returned right away, eg: a caller following a task calls
+// WaitForUpdate with the version of the last task it got until the task finishes
+func (r TaskRequests) WaitForUpdate(args *TasksWaitParams, res *Task) (err error) {
+	if r.Authorizer != nil {
+		t := &Task{Id: args.Id}
+		if err := t.Read(r.Store); err != nil {
+			return err
+		}
+		if err := r.authorize(args.UserId, ActionRead, t); err != nil {
+			return err
+		}
+	}
+
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = DefaultWaitTimeout
+	} else if timeout > MaxWaitTimeout {
+		timeout = MaxWaitTimeout
+	}
+
+	t, err := WaitForUpdate(r.Store, r.Broker, args.Id, args.SinceVersion, timeout)
+	if err != nil {
+		return err
+	}
+
+	*res = *t
+	return nil
+}
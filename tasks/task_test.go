@@ -3,7 +3,8 @@ package tasks
 import (
 	"fmt"
 	// "github.com/ipfs/go-datastore"
-	// "testing"
+	"testing"
+	"time"
 )
 
 type ExampleTask struct {
@@ -112,6 +113,27 @@ func (e ExampleTask) Do(updates chan Progress) {
 // 	}
 // }
 
+func TestStatusString(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		task   *Task
+		expect string
+	}{
+		{&Task{}, "enquing"},
+		{&Task{Enqueued: &now}, "queued"},
+		{&Task{Enqueued: &now, Started: &now}, "running"},
+		{&Task{Enqueued: &now, Started: &now, Succeeded: &now}, "finished"},
+		{&Task{Enqueued: &now, Started: &now, Failed: &now, Error: "oh no"}, "failed"},
+		{&Task{Enqueued: &now, Failed: &now, Error: ErrTaskCancelled.Error()}, "cancelled"},
+	}
+
+	for i, c := range cases {
+		if got := c.task.StatusString(); got != c.expect {
+			t.Errorf("case %d: expected %s, got: %s", i, c.expect, got)
+		}
+	}
+}
+
 func CompareTasks(a, b *Task) error {
 	if a.Id != b.Id {
 		return fmt.Errorf("Id mismatch: %s != %s", a.Id, b.Id)
@@ -1,8 +1,10 @@
 package tasks
 
 import (
+	"context"
 	"fmt"
 	"github.com/ipfs/go-datastore"
+	"sort"
 )
 
 // taskdefs is an internal registry of all types of tasks that can be performed.
@@ -15,6 +17,16 @@ func RegisterTaskdef(name string, f NewTaskFunc) {
 	taskdefs[name] = f
 }
 
+// RegisteredTaskdefs lists the names of all registered task types
+func RegisteredTaskdefs() []string {
+	names := make([]string, 0, len(taskdefs))
+	for name := range taskdefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // NewTaskable generates a new Taskable instance from the registered
 // types
 func NewTaskable(name string) (Taskable, error) {
@@ -51,3 +63,11 @@ type DatastoreTaskable interface {
 	Taskable
 	SetDatastore(ds datastore.Datastore)
 }
+
+// ContextTaskable is a task that can be stopped part way through. task-orchestrators
+// call SetContext before calling Taskable.Do, the context is cancelled when the
+// task is, and long-running tasks should give up once it's done
+type ContextTaskable interface {
+	Taskable
+	SetContext(ctx context.Context)
+}
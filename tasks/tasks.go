@@ -3,31 +3,40 @@ package tasks
 import (
 	"database/sql"
 	"fmt"
-	// "github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sql_datastore"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
+	"github.com/lib/pq"
+	"sort"
+	"strings"
+	"time"
 )
 
-// ReadTasks reads a list of tasks from store
-func ReadTasks(store datastore.Datastore, orderby string, limit, offset int) ([]*Task, error) {
-	q := query.Query{
-		Prefix: fmt.Sprintf("/%s", Task{}.DatastoreType()),
-		Limit:  limit,
-		Offset: offset,
+// tasksQuery selects a page of tasks, a zero limit selects all tasks
+func tasksQuery(limit, offset int) query.Query {
+	return query.Query{
+		// the trailing colon keeps prefix-matching datastores from
+		// including other types that start with "Task"
+		Prefix:  fmt.Sprintf("/%s:", Task{}.DatastoreType()),
+		Filters: []query.Filter{sql_datastore.FilterKeyTypeEq(Task{}.DatastoreType())},
+		Limit:   limit,
+		Offset:  offset,
 		// TODO - add native ordering support
 		// Orders: []query.Order{}
 	}
+}
 
-	res, err := store.Query(q)
+// ReadTasks reads a list of tasks from store
+func ReadTasks(store datastore.Datastore, orderby string, limit, offset int) ([]*Task, error) {
+	res, err := store.Query(tasksQuery(limit, offset))
 	if err != nil {
 		return nil, err
 	}
 
-	tasks := make([]*Task, limit)
-	i := 0
+	tasks := make([]*Task, 0, limit)
 	for r := range res.Next() {
 		if r.Error != nil {
-			return nil, err
+			return nil, r.Error
 		}
 
 		c, ok := r.Value.(*Task)
@@ -35,11 +44,261 @@ func ReadTasks(store datastore.Datastore, orderby string, limit, offset int) ([]
 			return nil, fmt.Errorf("Invalid Response")
 		}
 
-		tasks[i] = c
-		i++
+		// not all datastores respect query limits
+		if len(tasks) < limit {
+			tasks = append(tasks, c)
+		}
+	}
+
+	return tasks, nil
+}
+
+// TaskFilter reports weather a task should be included in a set of results
+type TaskFilter func(t *Task) bool
+
+// ReadTasksFilter reads tasks from store that pass filter, most recent first.
+// The datastore interface has no way to express filters, so this scans
+// the full list of tasks
+func ReadTasksFilter(store datastore.Datastore, filter TaskFilter, limit, offset int) ([]*Task, error) {
+	matches := []*Task{}
+	err := eachTask(store, func(t *Task) error {
+		if filter(t) {
+			matches = append(matches, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// order the same way as qTasksWhere, so pages are stable
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Created.Equal(matches[j].Created) {
+			return matches[i].Id < matches[j].Id
+		}
+		return matches[i].Created.After(matches[j].Created)
+	})
+
+	if offset >= len(matches) {
+		return []*Task{}, nil
+	}
+	matches = matches[offset:]
+	if limit > 0 && limit < len(matches) {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// ReadChildTasks reads all subtasks spawned by the task with id parentId
+func ReadChildTasks(store datastore.Datastore, parentId string) ([]*Task, error) {
+	return ReadTaskQuery(store, TaskQuery{ParentId: parentId})
+}
+
+// TaskQuery selects tasks by their fields. zero-valued fields match any task
+type TaskQuery struct {
+	// only tasks spawned by this task
+	ParentId string
+	// only tasks that weren't spawned by another task
+	TopLevel bool
+	// only tasks submitted by this user
+	UserId string
+	// only tasks created after this time, if it isn't zero
+	CreatedAfter time.Time
+	// only tasks claimed by one of these workers
+	WorkerIds []string
+	// only tasks of these types, if not nil
+	Types []string
+	// no tasks of these types
+	ExcludeTypes []string
+	// only tasks that haven't succeeded or failed
+	Unfinished bool
+	// only tasks that succeeded or failed at or after this time, if it
+	// isn't zero
+	FinishedSince time.Time
+	// only tasks that succeeded or failed before this time, if it isn't zero
+	FinishedBefore time.Time
+	// number of tasks to return, zero returns all matches
+	Limit int
+	// number of matches to skip
+	Offset int
+}
+
+// where gives the SQL conditions & arguments that select tasks matching q
+func (q TaskQuery) where() (string, []interface{}) {
+	conds := []string{}
+	args := []interface{}{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if q.ParentId != "" {
+		add("parent_id = $%d", q.ParentId)
+	}
+	if q.TopLevel {
+		conds = append(conds, "parent_id = ''")
+	}
+	if q.UserId != "" {
+		add("user_id = $%d", q.UserId)
+	}
+	if !q.CreatedAfter.IsZero() {
+		add("created > $%d", q.CreatedAfter)
+	}
+	if q.WorkerIds != nil {
+		add("worker_id = ANY($%d)", pq.Array(q.WorkerIds))
+	}
+	if q.Types != nil {
+		add("type = ANY($%d)", pq.Array(q.Types))
+	}
+	if len(q.ExcludeTypes) > 0 {
+		add("type <> ALL($%d)", pq.Array(q.ExcludeTypes))
+	}
+	if q.Unfinished {
+		conds = append(conds, "succeeded IS NULL AND failed IS NULL")
+	}
+	if !q.FinishedSince.IsZero() {
+		add("COALESCE(succeeded, failed) >= $%d", q.FinishedSince)
+	}
+	if !q.FinishedBefore.IsZero() {
+		add("COALESCE(succeeded, failed) < $%d", q.FinishedBefore)
+	}
+
+	if len(conds) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// match reports weather t is selected by q
+func (q TaskQuery) match(t *Task) bool {
+	if q.ParentId != "" && t.ParentId != q.ParentId {
+		return false
+	}
+	if q.TopLevel && t.ParentId != "" {
+		return false
+	}
+	if q.UserId != "" && t.UserId != q.UserId {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && !t.Created.After(q.CreatedAfter) {
+		return false
+	}
+	if q.WorkerIds != nil && !contains(q.WorkerIds, t.WorkerId) {
+		return false
 	}
+	if q.Types != nil && !contains(q.Types, t.Type) {
+		return false
+	}
+	if contains(q.ExcludeTypes, t.Type) {
+		return false
+	}
+	if q.Unfinished && (t.Succeeded != nil || t.Failed != nil) {
+		return false
+	}
+	if !q.FinishedSince.IsZero() && (finishedState(t) == "" || finishedAt(t).Before(q.FinishedSince)) {
+		return false
+	}
+	if !q.FinishedBefore.IsZero() && (finishedState(t) == "" || !finishedAt(t).Before(q.FinishedBefore)) {
+		return false
+	}
+	return true
+}
 
-	return tasks[:i], nil
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadTaskQuery reads tasks from store that match q, most recent first.
+// postgres-backed stores select tasks with an indexed query, other stores
+// are scanned
+func ReadTaskQuery(store datastore.Datastore, q TaskQuery) ([]*Task, error) {
+	db := sqlDB(store)
+	if db == nil {
+		return ReadTasksFilter(store, q.match, q.Limit, q.Offset)
+	}
+
+	where, args := q.where()
+	query := fmt.Sprintf(qTasksWhere, where)
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if q.Offset > 0 {
+		args = append(args, q.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ts := []*Task{}
+	for rows.Next() {
+		t := &Task{}
+		if err := t.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, rows.Err()
+}
+
+// eachTask pages through all tasks in store, calling fn for each task once
+func eachTask(store datastore.Datastore, fn func(t *Task) error) error {
+	if sqlDB(store) == nil {
+		// other stores don't order results, so pages of them overlap &
+		// skip tasks. they're only held in memory, read them in one go
+		res, err := store.Query(tasksQuery(0, 0))
+		if err != nil {
+			return err
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			t, ok := e.Value.(*Task)
+			if !ok {
+				return fmt.Errorf("Invalid Response")
+			}
+			if err := fn(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	const pageSize = 100
+	seen := map[string]bool{}
+	for offset := 0; ; offset += pageSize {
+		page, err := ReadTasks(store, "created DESC", pageSize, offset)
+		if err != nil {
+			return err
+		}
+
+		added := 0
+		for _, t := range page {
+			if seen[t.Id] {
+				continue
+			}
+			seen[t.Id] = true
+			added++
+			if err := fn(t); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < pageSize || added == 0 {
+			return nil
+		}
+	}
 }
 
 // TODO - transfer to kiwix taskdef
@@ -32,6 +32,32 @@ func TestReadTasks(t *testing.T) {
 	}
 }
 
+func TestReadTasksFilterScansAllTasks(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+
+	// more tasks than fit in a page, which in-memory stores return unordered
+	store := datastore.NewMapDatastore()
+	n := 250
+	for i := 0; i < n; i++ {
+		tsk := &Task{Title: "a", Type: "test"}
+		if err := tsk.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	tasks, err := ReadTasksFilter(store, func(*Task) bool { return true }, 0, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	seen := map[string]bool{}
+	for _, tsk := range tasks {
+		seen[tsk.Id] = true
+	}
+	if len(tasks) != n || len(seen) != n {
+		t.Errorf("expected %d distinct tasks, got %d of %d", n, len(seen), len(tasks))
+	}
+}
+
 // TODO - re-enable
 // func TestGenerateAvailableTasks(t *testing.T) {
 // 	defer resetTestData(appDB, "tasks")
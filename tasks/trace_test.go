@@ -0,0 +1,140 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/datatogether/task_mgmt/tracing"
+	"github.com/ipfs/go-datastore"
+	"github.com/streadway/amqp"
+	"strings"
+	"testing"
+)
+
+type exportedSpan struct {
+	TraceId      string `json:"traceId"`
+	SpanId       string `json:"spanId"`
+	ParentSpanId string `json:"parentSpanId"`
+	Name         string `json:"name"`
+}
+
+// exportedSpans decodes spans written by a tracing.WriterExporter
+func exportedSpans(t *testing.T, buf *bytes.Buffer) []exportedSpan {
+	spans := []exportedSpan{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		req := struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []exportedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}{}
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			t.Fatalf("error decoding span: %s", err.Error())
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func TestTraceParent(t *testing.T) {
+	RegisterTaskdef("test.fanout", newFanOutTask)
+	RegisterTaskdef("test.child", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	buf := &bytes.Buffer{}
+	tracing.SetExporter(tracing.NewWriterExporter(buf, "test"))
+	defer tracing.SetExporter(nil)
+
+	caller := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	parent := &Task{Type: "test.fanout", Params: map[string]interface{}{"children": 2}, TraceParent: caller}
+	if err := parent.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	msg, err := parent.QueueMsg()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg.Headers[tracing.Header] != caller {
+		t.Errorf("expected queue message to carry trace context, got: %v", msg.Headers)
+	}
+
+	delivered, err := TaskFromDelivery(store, amqp.Delivery{CorrelationId: parent.Id, Headers: msg.Headers})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if delivered.TraceParent != caller {
+		t.Errorf("expected delivered task to continue the trace, got: '%s'", delivered.TraceParent)
+	}
+
+	tc := make(chan *Task, 10)
+	go func() {
+		for range tc {
+		}
+	}()
+	if err := delivered.Do(store, tc); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	spans := exportedSpans(t, buf)
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got: %d", len(spans))
+	}
+	do := spans[len(spans)-1]
+	if do.Name != "task.Do test.fanout" || do.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || do.ParentSpanId != "00f067aa0ba902b7" {
+		t.Errorf("task span mismatch: %#v", do)
+	}
+	// subtasks performed inline are children of the task that spawned them
+	for _, s := range spans[:2] {
+		if s.Name != "task.Do test.child" || s.TraceId != do.TraceId || s.ParentSpanId != do.SpanId {
+			t.Errorf("subtask span mismatch: %#v", s)
+		}
+	}
+}
+
+// contextSpanTask records the span of the context it's given
+type contextSpanTask struct {
+	spans chan *tracing.Span
+	ctx   context.Context
+}
+
+func (t *contextSpanTask) Valid() error                   { return nil }
+func (t *contextSpanTask) SetContext(ctx context.Context) { t.ctx = ctx }
+func (t *contextSpanTask) Do(updates chan Progress) {
+	t.spans <- tracing.FromContext(t.ctx)
+	updates <- Progress{Done: true}
+}
+
+func TestContextSpan(t *testing.T) {
+	spans := make(chan *tracing.Span, 1)
+	RegisterTaskdef("test.contextspan", func() Taskable { return &contextSpanTask{spans: spans} })
+	store := datastore.NewMapDatastore()
+
+	buf := &bytes.Buffer{}
+	tracing.SetExporter(tracing.NewWriterExporter(buf, "test"))
+	defer tracing.SetExporter(nil)
+
+	task := &Task{Type: "test.contextspan", TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	tc := make(chan *Task, 10)
+	go func() {
+		for range tc {
+		}
+	}()
+	if err := task.Do(store, tc); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	got := <-spans
+	exported := exportedSpans(t, buf)
+	if got == nil || len(exported) != 1 || got.Context().SpanId.String() != exported[0].SpanId {
+		t.Errorf("expected the taskable's context to carry the task's span, got: %v", got)
+	}
+}
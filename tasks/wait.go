@@ -0,0 +1,67 @@
+package tasks
+
+import (
+	"github.com/ipfs/go-datastore"
+	"time"
+)
+
+const (
+	// DefaultWaitTimeout is how long WaitForUpdate waits if no timeout is given
+	DefaultWaitTimeout = 30 * time.Second
+	// MaxWaitTimeout caps how long WaitForUpdate can wait
+	MaxWaitTimeout = 5 * time.Minute
+)
+
+// WaitPollInterval is how often WaitForUpdate re-reads the task from the
+// store, catching state changes the broker missed
+var WaitPollInterval = 2 * time.Second
+
+// WaitForUpdate blocks until the task with id has a version newer than
+// sinceVersion, returning the newer task. Finished tasks won't change again,
+// so they're returned right away. if nothing changes before timeout the
+// current task is returned unchanged, callers can compare versions to tell.
+// updates arrive from broker if it's non-nil, and by polling the store
+func WaitForUpdate(store datastore.Datastore, broker Broker, id string, sinceVersion int64, timeout time.Duration) (*Task, error) {
+	// subscribe before reading so no update falls between the two
+	var updates <-chan *Task
+	if broker != nil {
+		ch, cancel, err := broker.Subscribe(id)
+		if err != nil {
+			return nil, err
+		}
+		defer cancel()
+		updates = ch
+	}
+
+	t := &Task{Id: id}
+	if err := t.Read(store); err != nil {
+		return nil, err
+	}
+	if t.Version > sinceVersion || finishedState(t) != "" {
+		return t, nil
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(WaitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case u := <-updates:
+			if u.Version > sinceVersion {
+				return u, nil
+			}
+		case <-ticker.C:
+			current := &Task{Id: id}
+			if err := current.Read(store); err != nil {
+				return nil, err
+			}
+			if current.Version > sinceVersion || finishedState(current) != "" {
+				return current, nil
+			}
+		case <-deadline.C:
+			return t, nil
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package tasks
+
+import (
+	"github.com/ipfs/go-datastore"
+	"testing"
+	"time"
+)
+
+func TestSaveBumpsVersion(t *testing.T) {
+	store := datastore.NewMapDatastore()
+	task := &Task{Title: "versioned", Type: "test"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	first := task.Version
+
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Version <= first {
+		t.Errorf("expected save to increase version. %d <= %d", task.Version, first)
+	}
+}
+
+func TestWaitForUpdate(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := NewLockedStore(datastore.NewMapDatastore())
+	broker := NewMemBroker()
+
+	task := &Task{Title: "waited on", Type: "test"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// older versions return right away
+	got, err := WaitForUpdate(store, broker, task.Id, 0, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Version != task.Version {
+		t.Errorf("expected current version %d, got %d", task.Version, got.Version)
+	}
+
+	// nothing changes before the timeout
+	got, err = WaitForUpdate(store, broker, task.Id, task.Version, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Version != task.Version {
+		t.Errorf("expected unchanged task on timeout")
+	}
+
+	// published progress. MapDatastore keeps the pointers it's given,
+	// so the "worker" changes a copy of the task
+	since := task.Version
+	worker := &Task{}
+	*worker = *task
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		worker.Progress = &Progress{Percent: 0.5, Status: "halfway"}
+		worker.bumpVersion()
+		broker.Publish(worker)
+	}()
+	got, err = WaitForUpdate(store, broker, task.Id, since, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Version <= since || got.Progress == nil || got.Progress.Status != "halfway" {
+		t.Errorf("expected published progress, got version %d, progress: %v", got.Version, got.Progress)
+	}
+
+	// state changes the broker misses are picked up from the store
+	defer func(d time.Duration) { WaitPollInterval = d }(WaitPollInterval)
+	WaitPollInterval = 10 * time.Millisecond
+	since = got.Version
+	worker = &Task{}
+	*worker = *got
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		now := time.Now()
+		worker.Succeeded = &now
+		worker.Save(store)
+	}()
+	got, err = WaitForUpdate(store, nil, task.Id, since, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Succeeded == nil {
+		t.Errorf("expected finished task")
+	}
+
+	// finished tasks return right away, even if they're no newer
+	start := time.Now()
+	if _, err := WaitForUpdate(store, broker, task.Id, got.Version, time.Second); err != nil {
+		t.Fatal(err.Error())
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected finished task to return without waiting")
+	}
+}
+
+func TestMemBroker(t *testing.T) {
+	b := NewMemBroker()
+	updates, cancel, err := b.Subscribe("a")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b.Publish(&Task{Id: "b"})
+	b.Publish(&Task{Id: "a", Version: 1})
+	if u := <-updates; u.Id != "a" || u.Version != 1 {
+		t.Errorf("expected update for a, got: %s %d", u.Id, u.Version)
+	}
+
+	cancel()
+	cancel()
+	b.Publish(&Task{Id: "a", Version: 2})
+	select {
+	case u := <-updates:
+		t.Errorf("expected no updates after cancel, got version %d", u.Version)
+	default:
+	}
+}
@@ -0,0 +1,327 @@
+package tasks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pborman/uuid"
+	"os"
+	"sync"
+	"time"
+)
+
+// Worker is a process that pulls tasks off the queue & performs them.
+// Workers register themselves on startup & periodically heartbeat, a worker
+// that stops heartbeating is considered dead, and any tasks it claimed
+// are orphaned
+type Worker struct {
+	// uuid identifier for worker
+	Id string `json:"id"`
+	// hostname of the machine the worker is running on
+	Hostname string `json:"hostname"`
+	// task types (or tags) this worker accepts
+	Capabilities []string `json:"capabilities"`
+	// when the worker registered
+	Started time.Time `json:"started"`
+	// last time the worker checked in
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+// NewWorker creates a worker for the current process
+func NewWorker(capabilities []string) *Worker {
+	hostname, _ := os.Hostname()
+	now := time.Now().Round(time.Second).In(time.UTC)
+	return &Worker{
+		Id:           uuid.New(),
+		Hostname:     hostname,
+		Capabilities: capabilities,
+		Started:      now,
+		Heartbeat:    now,
+	}
+}
+
+// DatastoreType is to fulfill the sql_datastore.Model interface
+func (w Worker) DatastoreType() string {
+	return "Worker"
+}
+
+// GetId returns a worker's cannonical identifier
+func (w Worker) GetId() string {
+	return w.Id
+}
+
+// Key is to fulfill the sql_datastore.Model interface
+func (w Worker) Key() datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%s:%s", w.DatastoreType(), w.GetId()))
+}
+
+// Expired reports weather the worker has missed heartbeats for longer than lease
+func (w *Worker) Expired(lease time.Duration) bool {
+	return time.Since(w.Heartbeat) > lease
+}
+
+// Beat records a heartbeat for the worker
+func (w *Worker) Beat(store datastore.Datastore) error {
+	w.Heartbeat = time.Now().Round(time.Second).In(time.UTC)
+	return w.Save(store)
+}
+
+func (w *Worker) Read(store datastore.Datastore) error {
+	if w.Id == "" {
+		return datastore.ErrNotFound
+	}
+
+	wi, err := store.Get(w.Key())
+	if err != nil {
+		return err
+	}
+
+	got, ok := wi.(*Worker)
+	if !ok {
+		return fmt.Errorf("Invalid Response")
+	}
+	*w = *got
+	return nil
+}
+
+func (w *Worker) Save(store datastore.Datastore) error {
+	if w.Id == "" {
+		return fmt.Errorf("worker id is required")
+	}
+	return store.Put(w.Key(), w)
+}
+
+func (w *Worker) Delete(store datastore.Datastore) error {
+	return store.Delete(w.Key())
+}
+
+// ReadWorkers reads a list of registered workers from store
+func ReadWorkers(store datastore.Datastore, limit, offset int) ([]*Worker, error) {
+	q := query.Query{
+		Prefix: fmt.Sprintf("/%s", Worker{}.DatastoreType()),
+		Limit:  limit,
+		Offset: offset,
+	}
+
+	res, err := store.Query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	workers := make([]*Worker, 0, limit)
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		w, ok := r.Value.(*Worker)
+		if !ok {
+			return nil, fmt.Errorf("Invalid Response")
+		}
+
+		if len(workers) < limit {
+			workers = append(workers, w)
+		}
+	}
+
+	return workers, nil
+}
+
+// ErrTaskClaimed is returned by Claim for tasks that are finished, or
+// held by another live worker
+var ErrTaskClaimed = errors.New("task is finished or claimed by another worker")
+
+// claimLock serializes claims in stores that aren't backed by postgres
+var claimLock sync.Mutex
+
+// Claim marks a task as started by a worker. A task can be delivered more
+// than once, eg: when the reaper requeues a task the queue also redelivers,
+// so claims are refused while the task is held by another worker that has
+// heartbeated within lease
+func (t *Task) Claim(store datastore.Datastore, workerId string, lease time.Duration) error {
+	now := time.Now()
+	if db := sqlDB(store); db != nil {
+		t.bumpVersion()
+		res, err := db.Exec(qTaskClaim, t.Id, workerId, now.In(time.UTC), now.Add(-lease).In(time.UTC), t.Version)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrTaskClaimed
+		}
+		return t.Read(store)
+	}
+
+	claimLock.Lock()
+	defer claimLock.Unlock()
+	stored := &Task{Id: t.Id}
+	if err := stored.Read(store); err != nil {
+		return err
+	}
+	if stored.Succeeded != nil || stored.Failed != nil {
+		return ErrTaskClaimed
+	}
+	if stored.WorkerId != "" && stored.WorkerId != workerId {
+		holder := &Worker{Id: stored.WorkerId}
+		if err := holder.Read(store); err == nil && !holder.Expired(lease) {
+			return ErrTaskClaimed
+		} else if err != nil && err != datastore.ErrNotFound {
+			return err
+		}
+	}
+
+	t.WorkerId = workerId
+	t.Started = &now
+	return t.Save(store)
+}
+
+// ReapAction is what to do with tasks orphaned by a dead worker
+type ReapAction string
+
+const (
+	// ReapRequeue sends orphaned tasks back to the queue
+	ReapRequeue ReapAction = "requeue"
+	// ReapFail marks orphaned tasks as failed
+	ReapFail ReapAction = "fail"
+)
+
+// ReapWorkers finds workers that haven't heartbeated within lease, and
+// requeues or fails any unfinished tasks they'd claimed. Reaped workers
+// are removed from the registry. It returns the tasks that were reaped
+func ReapWorkers(store datastore.Datastore, amqpurl string, lease time.Duration, action ReapAction) ([]*Task, error) {
+	workers, err := ReadWorkers(store, 1000, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	dead := map[string]bool{}
+	for _, w := range workers {
+		if w.Expired(lease) {
+			dead[w.Id] = true
+		}
+	}
+	if len(dead) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(dead))
+	for id := range dead {
+		ids = append(ids, id)
+	}
+	claimed, err := ReadTaskQuery(store, TaskQuery{WorkerIds: ids, Unfinished: true})
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make([]*Task, 0, len(claimed))
+	for _, t := range claimed {
+		// parents waiting on subtasks are finished with their worker
+		if t.Subtasks > 0 {
+			continue
+		}
+		orphans = append(orphans, t)
+	}
+
+	for _, t := range orphans {
+		if action == ReapFail || amqpurl == "" {
+			now := time.Now()
+			t.Failed = &now
+			t.Error = fmt.Sprintf("worker %s stopped responding", t.WorkerId)
+			err = t.Save(store)
+		} else {
+			err = t.Requeue(store, amqpurl)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for id := range dead {
+		w := &Worker{Id: id}
+		if err := w.Delete(store); err != nil && err != datastore.ErrNotFound {
+			return orphans, err
+		}
+	}
+
+	return orphans, nil
+}
+
+func (w *Worker) NewSQLModel(key datastore.Key) sql_datastore.Model {
+	return &Worker{Id: key.Name()}
+}
+
+func (w *Worker) SQLQuery(cmd sql_datastore.Cmd) string {
+	switch cmd {
+	case sql_datastore.CmdCreateTable:
+		return qWorkerCreateTable
+	case sql_datastore.CmdExistsOne:
+		return qWorkerExists
+	case sql_datastore.CmdSelectOne:
+		return qWorkerReadById
+	case sql_datastore.CmdInsertOne:
+		return qWorkerInsert
+	case sql_datastore.CmdUpdateOne:
+		return qWorkerUpdate
+	case sql_datastore.CmdDeleteOne:
+		return qWorkerDelete
+	case sql_datastore.CmdList:
+		return qWorkers
+	default:
+		return ""
+	}
+}
+
+func (w *Worker) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		id, hostname       string
+		capBytes           []byte
+		capabilities       []string
+		started, heartbeat time.Time
+	)
+	if err := row.Scan(&id, &hostname, &capBytes, &started, &heartbeat); err != nil {
+		if err == sql.ErrNoRows {
+			return datastore.ErrNotFound
+		}
+		return err
+	}
+
+	if capBytes != nil {
+		if err := json.Unmarshal(capBytes, &capabilities); err != nil {
+			return err
+		}
+	}
+
+	*w = Worker{
+		Id:           id,
+		Hostname:     hostname,
+		Capabilities: capabilities,
+		Started:      started,
+		Heartbeat:    heartbeat,
+	}
+	return nil
+}
+
+func (w *Worker) SQLParams(cmd sql_datastore.Cmd) []interface{} {
+	switch cmd {
+	case sql_datastore.CmdSelectOne, sql_datastore.CmdExistsOne, sql_datastore.CmdDeleteOne:
+		return []interface{}{w.Id}
+	case sql_datastore.CmdList:
+		return []interface{}{}
+	default:
+		capabilities, _ := json.Marshal(w.Capabilities)
+		return []interface{}{
+			w.Id,
+			w.Hostname,
+			capabilities,
+			w.Started,
+			w.Heartbeat,
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package tasks
+
+import (
+	"github.com/ipfs/go-datastore"
+	"testing"
+	"time"
+)
+
+func TestReapWorkers(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	dead := NewWorker([]string{"test"})
+	dead.Heartbeat = time.Now().Add(-time.Hour)
+	live := NewWorker([]string{"test"})
+	for _, w := range []*Worker{dead, live} {
+		if err := w.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	orphan := &Task{Title: "orphan", Type: "test"}
+	running := &Task{Title: "running", Type: "test"}
+	if err := orphan.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := running.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := orphan.Claim(store, dead.Id, time.Minute); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := running.Claim(store, live.Id, time.Minute); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	reaped, err := ReapWorkers(store, "", time.Minute, ReapFail)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reaped) != 1 || reaped[0].Id != orphan.Id {
+		t.Fatalf("expected only orphaned task to be reaped, got: %d tasks", len(reaped))
+	}
+
+	if err := orphan.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if orphan.Failed == nil {
+		t.Errorf("expected orphaned task to be marked failed")
+	}
+
+	if err := running.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if running.Failed != nil {
+		t.Errorf("task claimed by live worker shouldn't be reaped")
+	}
+
+	if err := dead.Read(store); err != datastore.ErrNotFound {
+		t.Errorf("expected dead worker to be removed from registry, got: %v", err)
+	}
+
+	workers, err := ReadWorkers(store, 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(workers) != 1 {
+		t.Errorf("expected 1 registered worker, got: %d", len(workers))
+	}
+}
+
+func TestClaim(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	dead := NewWorker([]string{"test"})
+	dead.Heartbeat = time.Now().Add(-time.Hour)
+	a, b := NewWorker([]string{"test"}), NewWorker([]string{"test"})
+	for _, w := range []*Worker{dead, a, b} {
+		if err := w.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	task := &Task{Title: "claimed", Type: "test"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := []struct {
+		worker *Worker
+		err    error
+	}{
+		{dead, nil},
+		// tasks held by dead workers can be taken
+		{a, nil},
+		{a, nil},
+		// a second delivery to a live worker is refused
+		{b, ErrTaskClaimed},
+	}
+
+	for i, c := range cases {
+		delivered := &Task{Id: task.Id}
+		if err := delivered.Read(store); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := delivered.Claim(store, c.worker.Id, time.Minute); err != c.err {
+			t.Errorf("case %d: expected error %v, got: %v", i, c.err, err)
+		}
+	}
+
+	if err := task.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.WorkerId != a.Id {
+		t.Errorf("expected task to be held by worker %s, got: %s", a.Id, task.WorkerId)
+	}
+
+	now := time.Now()
+	task.Succeeded = &now
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := task.Claim(store, a.Id, time.Minute); err != ErrTaskClaimed {
+		t.Errorf("expected finished tasks to be refused, got: %v", err)
+	}
+}
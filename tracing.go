@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/datatogether/task_mgmt/tracing"
+	"net/http"
+	"os"
+)
+
+// startTracing exports spans to cfg.TraceExport, and traces requests made
+// with http.DefaultClient, which taskdefs fetch with
+func startTracing() {
+	if _, ok := http.DefaultClient.Transport.(*tracing.Transport); !ok {
+		http.DefaultClient.Transport = &tracing.Transport{Next: http.DefaultClient.Transport}
+	}
+
+	switch cfg.TraceExport {
+	case "":
+		return
+	case "stdout":
+		tracing.SetExporter(tracing.NewWriterExporter(os.Stdout, "task_mgmt"))
+	default:
+		e, err := tracing.NewFileExporter(cfg.TraceExport, "task_mgmt")
+		if err != nil {
+			log.Infof("tracing disabled: %s", err.Error())
+			return
+		}
+		e.OnError = func(err error) {
+			log.Infof("error exporting span: %s", err.Error())
+		}
+		tracing.SetExporter(e)
+	}
+	log.Infof("exporting traces to %s", cfg.TraceExport)
+}
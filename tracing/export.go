@@ -0,0 +1,184 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Exporter sends finished spans somewhere they can be read
+type Exporter interface {
+	Export(s *Span) error
+}
+
+var exporter struct {
+	lock sync.Mutex
+	e    Exporter
+}
+
+// SetExporter sets where sampled spans are sent as they end, nil disables
+// exporting
+func SetExporter(e Exporter) {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	exporter.e = e
+}
+
+func currentExporter() Exporter {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	return exporter.e
+}
+
+// WriterExporter writes each span as a line of OTLP/JSON, an
+// ExportTraceServiceRequest holding the single span. files written this way
+// can be read by the OpenTelemetry collector's otlpjsonfile receiver
+type WriterExporter struct {
+	// service.name resource attribute
+	Service string
+	// OnError is called with errors writing spans, optional
+	OnError func(err error)
+
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterExporter creates an exporter that writes to w
+func NewWriterExporter(w io.Writer, service string) *WriterExporter {
+	return &WriterExporter{Service: service, w: w}
+}
+
+// NewFileExporter creates an exporter that appends to the file at path,
+// creating it if it doesn't exist
+func NewFileExporter(path, service string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening trace file: %s", err.Error())
+	}
+	return NewWriterExporter(f, service), nil
+}
+
+// Export writes s
+func (e *WriterExporter) Export(s *Span) error {
+	data, err := json.Marshal(e.request(s))
+	if err != nil {
+		return e.error(err)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if _, err := e.w.Write(append(data, '\n')); err != nil {
+		return e.error(err)
+	}
+	return nil
+}
+
+func (e *WriterExporter) error(err error) error {
+	if e.OnError != nil {
+		e.OnError(err)
+	}
+	return err
+}
+
+// the OTLP/JSON encoding of an ExportTraceServiceRequest, with just the
+// fields spans recorded here use
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceId           string          `json:"traceId"`
+		SpanId            string          `json:"spanId"`
+		ParentSpanId      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              Kind            `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// status codes
+const (
+	statusOk    = 1
+	statusError = 2
+)
+
+func (e *WriterExporter) request(s *Span) *otlpRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	span := otlpSpan{
+		TraceId:           s.context.TraceId.String(),
+		SpanId:            s.context.SpanId.String(),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: statusOk},
+	}
+	if s.parent != (SpanId{}) {
+		span.ParentSpanId = s.parent.String()
+	}
+	if s.err != "" {
+		span.Status = otlpStatus{Code: statusError, Message: s.err}
+	}
+	for _, a := range s.attrs {
+		span.Attributes = append(span.Attributes, attribute(a.Key, a.Value))
+	}
+
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{attribute("service.name", e.Service)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/datatogether/task_mgmt/tracing"},
+			Spans: []otlpSpan{span},
+		}},
+	}}}
+}
+
+// attribute encodes a value as an OTLP AnyValue, 64 bit integers are
+// strings in the JSON encoding
+func attribute(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch val := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": val}
+	case bool:
+		v = map[string]interface{}{"boolValue": val}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(val)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(val, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": val}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprintf("%v", val)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
@@ -0,0 +1,195 @@
+// Package tracing records spans for work that crosses process boundaries,
+// propagating trace context as W3C traceparent headers & exporting finished
+// spans in the OpenTelemetry protocol's JSON encoding.
+//
+// Spans are always created & propagated so traces continue through this
+// process, they're only exported once an Exporter is set with SetExporter
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header is the http header & amqp message header trace context is carried in
+const Header = "traceparent"
+
+// TraceId identifies a trace, shared by every span in it
+type TraceId [16]byte
+
+func (id TraceId) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanId identifies a single span within a trace
+type SpanId [8]byte
+
+func (id SpanId) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanContext is the part of a span that's propagated to other processes
+type SpanContext struct {
+	TraceId TraceId
+	SpanId  SpanId
+	// Sampled spans are exported
+	Sampled bool
+}
+
+// Valid is false for the zero SpanContext
+func (sc SpanContext) Valid() bool {
+	return sc.TraceId != TraceId{} && sc.SpanId != SpanId{}
+}
+
+// TraceParent formats sc as a traceparent header value, an invalid context
+// gives an empty string
+func (sc SpanContext) TraceParent() string {
+	if !sc.Valid() {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceId, sc.SpanId, flags)
+}
+
+// ParseTraceParent reads a traceparent header value
+func ParseTraceParent(s string) (SpanContext, error) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("invalid traceparent: '%s'", s)
+	}
+	if err := decodeHex(parts[1], sc.TraceId[:]); err != nil {
+		return sc, fmt.Errorf("invalid traceparent trace id: %s", err.Error())
+	}
+	if err := decodeHex(parts[2], sc.SpanId[:]); err != nil {
+		return sc, fmt.Errorf("invalid traceparent span id: %s", err.Error())
+	}
+	flags := []byte{0}
+	if err := decodeHex(parts[3], flags); err != nil {
+		return sc, fmt.Errorf("invalid traceparent flags: %s", err.Error())
+	}
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.Valid() {
+		return SpanContext{}, fmt.Errorf("invalid traceparent: '%s'", s)
+	}
+	return sc, nil
+}
+
+func decodeHex(s string, dst []byte) error {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return fmt.Errorf("expected %d lowercase hex characters", hex.EncodedLen(len(dst)))
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// Parent reads trace context from a traceparent value, giving the zero
+// SpanContext if it's empty or invalid, which starts a new trace
+func Parent(traceparent string) SpanContext {
+	sc, _ := ParseTraceParent(traceparent)
+	return sc
+}
+
+// Kind describes a span's relationship to other processes, values match
+// the OpenTelemetry protocol's SpanKind
+type Kind int
+
+const (
+	KindInternal Kind = iota + 1
+	KindServer
+	KindClient
+	KindProducer
+	KindConsumer
+)
+
+// Span is a single timed operation
+type Span struct {
+	lock     sync.Mutex
+	name     string
+	kind     Kind
+	context  SpanContext
+	parent   SpanId
+	start    time.Time
+	end      time.Time
+	attrs    []Attribute
+	err      string
+	ended    bool
+	exporter Exporter
+}
+
+// Attribute is a key-value pair describing a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Start begins a span as a child of parent. if parent isn't valid the span
+// starts a new, sampled trace
+func Start(name string, kind Kind, parent SpanContext) *Span {
+	s := &Span{name: name, kind: kind, start: time.Now(), exporter: currentExporter()}
+	if parent.Valid() {
+		s.context.TraceId = parent.TraceId
+		s.context.Sampled = parent.Sampled
+		s.parent = parent.SpanId
+	} else {
+		rand.Read(s.context.TraceId[:])
+		s.context.Sampled = true
+	}
+	rand.Read(s.context.SpanId[:])
+	return s
+}
+
+// Context gives the span's context, for propagation & starting child spans
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+// TraceParent gives the span's context as a traceparent header value
+func (s *Span) TraceParent() string {
+	return s.context.TraceParent()
+}
+
+// SetAttribute describes the span, value should be a string, bool, int,
+// int64 or float64. other types are formatted as strings
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attrs = append(s.attrs, Attribute{key, value})
+}
+
+// End finishes the span, recording err if it's not nil & exporting the
+// span if it's sampled. calls after the first have no effect
+func (s *Span) End(err error) {
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.lock.Unlock()
+
+	if s.context.Sampled && s.exporter != nil {
+		s.exporter.Export(s)
+	}
+}
+
+type contextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying s
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// FromContext gives the span carried by ctx, nil if it doesn't carry one
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(contextKey{}).(*Span)
+	return s
+}
@@ -0,0 +1,195 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	cases := []struct {
+		in      string
+		valid   bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6-00f067aa0ba902b7-01", false, false},
+	}
+
+	for i, c := range cases {
+		sc, err := ParseTraceParent(c.in)
+		if (err == nil) != c.valid {
+			t.Errorf("case %d: expected valid: %t, got error: %v", i, c.valid, err)
+			continue
+		}
+		if !c.valid {
+			continue
+		}
+		if sc.Sampled != c.sampled {
+			t.Errorf("case %d: expected sampled: %t", i, c.sampled)
+		}
+		if c.in[:2] == "00" && sc.TraceParent() != c.in {
+			t.Errorf("case %d: round trip mismatch: %s", i, sc.TraceParent())
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	root := Start("root", KindServer, Parent(""))
+	if !root.Context().Valid() || !root.Context().Sampled {
+		t.Fatalf("expected a new sampled trace, got: %s", root.TraceParent())
+	}
+
+	child := Start("child", KindInternal, Parent(root.TraceParent()))
+	if child.Context().TraceId != root.Context().TraceId {
+		t.Errorf("expected child to continue the trace")
+	}
+	if child.Context().SpanId == root.Context().SpanId {
+		t.Errorf("expected child to have it's own span id")
+	}
+
+	unsampled := Start("unsampled", KindInternal, Parent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"))
+	if unsampled.Context().Sampled {
+		t.Errorf("expected sampling decision to be inherited")
+	}
+}
+
+// recordExporter collects exported spans as decoded OTLP/JSON
+type recordExporter struct {
+	buf bytes.Buffer
+}
+
+func record() *recordExporter {
+	r := &recordExporter{}
+	SetExporter(NewWriterExporter(&r.buf, "test"))
+	return r
+}
+
+func (r *recordExporter) spans(t *testing.T) []otlpSpan {
+	spans := []otlpSpan{}
+	for _, line := range strings.Split(strings.TrimSpace(r.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		req := &otlpRequest{}
+		if err := json.Unmarshal([]byte(line), req); err != nil {
+			t.Fatalf("error decoding exported span: %s", err.Error())
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func TestWriterExporter(t *testing.T) {
+	rec := record()
+	defer SetExporter(nil)
+
+	parent := Start("parent", KindConsumer, Parent(""))
+	span := Start("work", KindInternal, parent.Context())
+	span.SetAttribute("task.id", "abc")
+	span.SetAttribute("task.attempts", 2)
+	span.SetAttribute("done", true)
+	span.End(fmt.Errorf("oh no"))
+	span.End(nil)
+	parent.End(nil)
+
+	unsampled := Start("unsampled", KindInternal, Parent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"))
+	unsampled.End(nil)
+
+	if !strings.Contains(rec.buf.String(), `"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"test"}}]}`) {
+		t.Errorf("expected service name resource attribute:\n%s", rec.buf.String())
+	}
+
+	spans := rec.spans(t)
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 exported spans, got: %d", len(spans))
+	}
+	s := spans[0]
+	if s.Name != "work" || s.Kind != KindInternal || s.TraceId != parent.Context().TraceId.String() || s.ParentSpanId != parent.Context().SpanId.String() {
+		t.Errorf("span mismatch: %#v", s)
+	}
+	if s.Status.Code != statusError || s.Status.Message != "oh no" {
+		t.Errorf("expected error status, got: %#v", s.Status)
+	}
+	if len(s.Attributes) != 3 || s.Attributes[1].Value["intValue"] != "2" || s.Attributes[2].Value["boolValue"] != true {
+		t.Errorf("attribute mismatch: %#v", s.Attributes)
+	}
+	if spans[1].ParentSpanId != "" || spans[1].Status.Code != statusOk {
+		t.Errorf("expected an ok root span, got: %#v", spans[1])
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if FromContext(context.Background()) != nil {
+		t.Errorf("expected no span")
+	}
+	a := Start("a", KindInternal, Parent(""))
+	if FromContext(ContextWithSpan(context.Background(), a)) != a {
+		t.Errorf("expected the context's span")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	rec := record()
+	defer SetExporter(nil)
+
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(Header)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &Transport{}}
+
+	// requests outside a traced operation aren't traced
+	if _, err := client.Get(srv.URL); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got != "" || rec.buf.Len() != 0 {
+		t.Errorf("expected untraced request, got header: '%s'", got)
+	}
+
+	task := Start("task", KindConsumer, Parent(""))
+	req, _ := http.NewRequestWithContext(ContextWithSpan(context.Background(), task), "GET", srv.URL+"/missing", nil)
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err.Error())
+	}
+	if req.Header.Get(Header) != "" {
+		t.Errorf("expected the caller's request to be left alone")
+	}
+
+	spans := rec.spans(t)
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got: %d", len(spans))
+	}
+	s := spans[0]
+	if s.Name != "HTTP GET" || s.Kind != KindClient || s.ParentSpanId != task.Context().SpanId.String() {
+		t.Errorf("span mismatch: %#v", s)
+	}
+	if got != fmt.Sprintf("00-%s-%s-01", s.TraceId, s.SpanId) {
+		t.Errorf("expected request to carry the span's context, got: %s", got)
+	}
+	if s.Status.Code != statusError {
+		t.Errorf("expected a 404 to be an error")
+	}
+}
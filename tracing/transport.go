@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Transport records a client span for each request made within a traced
+// operation, and passes the span's context on in the traceparent header.
+// requests made outside of one pass straight through
+type Transport struct {
+	// Next performs requests, http.DefaultTransport if nil
+	Next http.RoundTripper
+}
+
+// RoundTrip performs a request, the span carried by the request's context
+// is the parent of it's span
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	parent := FromContext(req.Context())
+	if parent == nil {
+		return next.RoundTrip(req)
+	}
+
+	span := Start(fmt.Sprintf("HTTP %s", req.Method), KindClient, parent.Context())
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("url.full", req.URL.String())
+	span.SetAttribute("server.address", req.URL.Hostname())
+
+	// RoundTrippers musn't modify the request they're given
+	req = req.WithContext(ContextWithSpan(req.Context(), span))
+	if req.Header = req.Header.Clone(); req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set(Header, span.TraceParent())
+
+	res, err := next.RoundTrip(req)
+	if err != nil {
+		span.End(err)
+		return res, err
+	}
+
+	span.SetAttribute("http.response.status_code", res.StatusCode)
+	if res.StatusCode >= 400 {
+		span.End(fmt.Errorf("%s", res.Status))
+	} else {
+		span.End(nil)
+	}
+	return res, nil
+}
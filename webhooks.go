@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/task_mgmt/auth"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/datatogether/task_mgmt/webhooks"
+	"github.com/ipfs/go-datastore"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// dispatcher sends task events to webhook subscriptions, set by startWebhooks
+var dispatcher *webhooks.Dispatcher
+
+// how often failed webhook deliveries are checked for retries that are due
+const webhookPollInterval = 5 * time.Second
+
+// startWebhooks sends events this process logs to webhook subscriptions
+// & task callback urls
+func startWebhooks() {
+	dispatcher = &webhooks.Dispatcher{
+		Store:          store,
+		CallbackSecret: cfg.WebhookSecret,
+		AllowPrivate:   cfg.WebhookAllowPrivate,
+		OnError: func(err error) {
+			log.Infof("webhook error: %s", err.Error())
+		},
+	}
+	tasks.HandleEvents(dispatcher.HandleEvent)
+	dispatcher.Poll(webhookPollInterval)
+}
+
+// WebhooksHandler lists & creates webhook subscriptions
+func WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		ListWebhooksHandler(w, r)
+	case "POST":
+		CreateWebhookHandler(w, r)
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// WebhookHandler manages a single webhook subscription
+func WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	_, action := webhookPath(r)
+	switch {
+	case r.Method == "GET" && action == "":
+		ReadWebhookHandler(w, r)
+	case r.Method == "DELETE" && action == "":
+		DeleteWebhookHandler(w, r)
+	case r.Method == "GET" && action == "deliveries":
+		WebhookDeliveriesHandler(w, r)
+	case r.Method == "POST" && action == "test":
+		TestWebhookHandler(w, r)
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// webhookPath splits a /webhooks/[id]/[action] request path
+func webhookPath(r *http.Request) (id, action string) {
+	parts := strings.SplitN(strings.Trim(r.URL.Path[len("/webhooks/"):], "/"), "/", 2)
+	id = parts[0]
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	return
+}
+
+// authorizeWebhooks checks the user making r can manage webhooks. subscriptions
+// receive events for all tasks, so when policies are enforced only admins
+// for all task types can
+func authorizeWebhooks(w http.ResponseWriter, r *http.Request) bool {
+	if !cfg.EnforcePolicies {
+		return true
+	}
+
+	userId := requestUserId(r)
+	policies, err := auth.ReadPolicies(store, userId)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return false
+	}
+	if policies.Role(userId, auth.Wildcard) < auth.RoleAdmin {
+		apiutil.WriteErrResponse(w, http.StatusForbidden, fmt.Errorf("%s: only admins can manage webhooks", auth.ErrForbidden.Error()))
+		return false
+	}
+	return true
+}
+
+// readWebhook reads the subscription identified by the request path, writing
+// an error response & returning nil if it can't be read
+func readWebhook(w http.ResponseWriter, r *http.Request) *webhooks.Subscription {
+	if !authorizeWebhooks(w, r) {
+		return nil
+	}
+
+	id, _ := webhookPath(r)
+	s := &webhooks.Subscription{Id: id}
+	if err := s.Read(store); err == datastore.ErrNotFound {
+		NotFoundHandler(w, r)
+		return nil
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	return s
+}
+
+func ListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeWebhooks(w, r) {
+		return
+	}
+
+	subs, err := webhooks.ReadSubscriptions(store)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	// secrets are only shown on creation
+	for _, s := range subs {
+		s.Secret = ""
+	}
+	apiutil.WriteResponse(w, subs)
+}
+
+// CreateWebhookHandler adds a subscription, eg:
+// POST /webhooks {"url":"https://example.com/hook","events":["failed"]}
+// the response includes the subscription's secret, which isn't shown again
+func CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeWebhooks(w, r) {
+		return
+	}
+
+	p := &webhooks.Subscription{}
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s, err := webhooks.NewSubscription(requestUserId(r), p.Url, p.Events, p.Secret)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.Save(store); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, s)
+}
+
+func ReadWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	s := readWebhook(w, r)
+	if s == nil {
+		return
+	}
+	s.Secret = ""
+	apiutil.WriteResponse(w, s)
+}
+
+func DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	s := readWebhook(w, r)
+	if s == nil {
+		return
+	}
+	if err := s.Delete(store); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.Secret = ""
+	apiutil.WriteMessageResponse(w, "webhook deleted", s)
+}
+
+// WebhookDeliveriesHandler lists recent deliveries to a subscription,
+// newest first
+func WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	s := readWebhook(w, r)
+	if s == nil {
+		return
+	}
+
+	p := apiutil.PageFromRequest(r)
+	ds, err := webhooks.ReadDeliveries(store, s.Id, p.Limit(), p.Offset())
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WritePageResponse(w, ds, r, p)
+}
+
+// TestWebhookHandler sends a test event to a subscription & responds with
+// the delivery, whether or not it succeeded
+func TestWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	s := readWebhook(w, r)
+	if s == nil {
+		return
+	}
+
+	d := dispatcher
+	if d == nil {
+		d = &webhooks.Dispatcher{Store: store, AllowPrivate: cfg.WebhookAllowPrivate}
+	}
+	del, err := d.Test(s)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if del.Delivered == nil {
+		apiutil.WriteMessageResponse(w, fmt.Sprintf("test delivery failed: %s", del.Error), del)
+		return
+	}
+	apiutil.WriteMessageResponse(w, "test delivery succeeded", del)
+}
@@ -0,0 +1,341 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pborman/uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+// request headers sent with each delivery
+const (
+	// HeaderEvent names the event being delivered
+	HeaderEvent = "X-Task-Mgmt-Event"
+	// HeaderDelivery is the id of the delivery, repeated across retries
+	HeaderDelivery = "X-Task-Mgmt-Delivery"
+	// HeaderSignature is "sha256=" followed by the hex HMAC-SHA256 of the
+	// request body, keyed by the subscription's secret
+	HeaderSignature = "X-Task-Mgmt-Signature"
+)
+
+// Payload is the JSON body of a delivery
+type Payload struct {
+	// event being delivered
+	Event tasks.EventType `json:"event"`
+	// when the event occurred
+	Created time.Time `json:"created"`
+	// description of the event, if any
+	Message string `json:"message,omitempty"`
+	// state of the task as of the event, nil for test deliveries
+	Task *tasks.Task `json:"task,omitempty"`
+}
+
+// Sign gives the signature header value for body
+func Sign(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks a signature header value against body, for receivers
+// of webhooks
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// Delivery is an entry in the log of requests sent for an event, updated
+// with each attempt to send it
+type Delivery struct {
+	// version 4 uuid
+	Id string `json:"id"`
+	// subscription the delivery was sent for, empty for task callbacks
+	SubscriptionId string `json:"subscriptionId,omitempty"`
+	// task the event happened to, empty for test deliveries
+	TaskId string `json:"taskId,omitempty"`
+	// event being delivered
+	Event tasks.EventType `json:"event"`
+	// url the delivery is sent to
+	Url string `json:"url"`
+	// request body
+	Payload json.RawMessage `json:"payload"`
+	// number of requests made so far
+	Attempts int `json:"attempts"`
+	// status code of the latest response, zero if no response was received
+	StatusCode int `json:"statusCode,omitempty"`
+	// error from the latest attempt
+	Error string `json:"error,omitempty"`
+	// when the delivery was created
+	Created time.Time `json:"created"`
+	// when a request succeeded, nil until then
+	Delivered *time.Time `json:"delivered,omitempty"`
+	// when the next attempt will be made, nil once the delivery succeeds or
+	// runs out of attempts
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+}
+
+// NewDelivery creates a delivery of payload to url
+func NewDelivery(subscriptionId, taskId string, event tasks.EventType, url string, payload []byte) *Delivery {
+	return &Delivery{
+		Id:             uuid.New(),
+		SubscriptionId: subscriptionId,
+		TaskId:         taskId,
+		Event:          event,
+		Url:            url,
+		Payload:        payload,
+		Created:        time.Now().In(time.UTC),
+	}
+}
+
+// DatastoreType is to fulfill the sql_datastore.Model interface
+func (d Delivery) DatastoreType() string {
+	return "Delivery"
+}
+
+// GetId returns the delivery's id
+func (d Delivery) GetId() string {
+	return d.Id
+}
+
+// Key is to fulfill the sql_datastore.Model interface
+func (d Delivery) Key() datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%s:%s", d.DatastoreType(), d.GetId()))
+}
+
+func (d *Delivery) Read(store datastore.Datastore) error {
+	di, err := store.Get(d.Key())
+	if err != nil {
+		return err
+	}
+
+	got, ok := di.(*Delivery)
+	if !ok {
+		return fmt.Errorf("Invalid Response")
+	}
+	*d = *got
+	return nil
+}
+
+func (d *Delivery) Save(store datastore.Datastore) error {
+	if d.Id == "" {
+		return fmt.Errorf("deliveries require an id")
+	}
+	return store.Put(d.Key(), d)
+}
+
+func (d *Delivery) Delete(store datastore.Datastore) error {
+	return store.Delete(d.Key())
+}
+
+// ReadDeliveries lists deliveries for a subscription, newest first. an
+// empty subscriptionId lists deliveries of task callbacks. a limit of zero
+// lists all of them
+func ReadDeliveries(store datastore.Datastore, subscriptionId string, limit, offset int) ([]*Delivery, error) {
+	if db := sqlDB(store); db != nil {
+		var lim interface{}
+		if limit > 0 {
+			lim = limit
+		}
+		rows, err := db.Query(qDeliveriesForSubscription, subscriptionId, lim, offset)
+		if err != nil {
+			return nil, err
+		}
+		return scanDeliveries(rows)
+	}
+
+	ds, err := scanStoredDeliveries(store, func(d *Delivery) bool {
+		return d.SubscriptionId == subscriptionId
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ds, func(i, j int) bool {
+		return ds[i].Created.After(ds[j].Created)
+	})
+	if offset >= len(ds) {
+		return ds[:0], nil
+	}
+	ds = ds[offset:]
+	if limit > 0 && len(ds) > limit {
+		ds = ds[:limit]
+	}
+	return ds, nil
+}
+
+// claimLock serializes claims on stores that aren't backed by postgres
+var claimLock sync.Mutex
+
+// ClaimDueDeliveries returns up to limit deliveries due for another attempt
+// as of now, pushing their next attempt back to until so they aren't
+// claimed again in the meantime
+func ClaimDueDeliveries(store datastore.Datastore, now, until time.Time, limit int) ([]*Delivery, error) {
+	now, until = now.In(time.UTC), until.In(time.UTC)
+	if db := sqlDB(store); db != nil {
+		rows, err := db.Query(qDeliveriesClaimDue, now, until, limit)
+		if err != nil {
+			return nil, err
+		}
+		return scanDeliveries(rows)
+	}
+
+	claimLock.Lock()
+	defer claimLock.Unlock()
+	ds, err := scanStoredDeliveries(store, func(d *Delivery) bool {
+		return d.NextAttempt != nil && !d.NextAttempt.After(now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ds, func(i, j int) bool {
+		return ds[i].NextAttempt.Before(*ds[j].NextAttempt)
+	})
+	if limit > 0 && len(ds) > limit {
+		ds = ds[:limit]
+	}
+
+	claimed := make([]*Delivery, len(ds))
+	for i, d := range ds {
+		// save a copy, claimed deliveries change as they're attempted
+		c := *d
+		c.NextAttempt = &until
+		if err := c.Save(store); err != nil {
+			return nil, err
+		}
+		claimed[i] = &Delivery{}
+		*claimed[i] = c
+	}
+	return claimed, nil
+}
+
+// scanStoredDeliveries reads copies of the deliveries in store that match
+func scanStoredDeliveries(store datastore.Datastore, match func(d *Delivery) bool) ([]*Delivery, error) {
+	res, err := store.Query(query.Query{
+		Prefix: fmt.Sprintf("/%s", Delivery{}.DatastoreType()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ds := []*Delivery{}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		d, ok := r.Value.(*Delivery)
+		if !ok {
+			return nil, fmt.Errorf("Invalid Response")
+		}
+		if match(d) {
+			c := *d
+			ds = append(ds, &c)
+		}
+	}
+	return ds, nil
+}
+
+func scanDeliveries(rows *sql.Rows) ([]*Delivery, error) {
+	defer rows.Close()
+	ds := []*Delivery{}
+	for rows.Next() {
+		d := &Delivery{}
+		if err := d.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, rows.Err()
+}
+
+func (d *Delivery) NewSQLModel(key datastore.Key) sql_datastore.Model {
+	return &Delivery{Id: key.Name()}
+}
+
+func (d *Delivery) SQLQuery(cmd sql_datastore.Cmd) string {
+	switch cmd {
+	case sql_datastore.CmdCreateTable:
+		return qDeliveryCreateTable
+	case sql_datastore.CmdExistsOne:
+		return qDeliveryExists
+	case sql_datastore.CmdSelectOne:
+		return qDeliveryRead
+	case sql_datastore.CmdInsertOne:
+		return qDeliveryInsert
+	case sql_datastore.CmdUpdateOne:
+		return qDeliveryUpdate
+	case sql_datastore.CmdDeleteOne:
+		return qDeliveryDelete
+	case sql_datastore.CmdList:
+		return qDeliveries
+	default:
+		return ""
+	}
+}
+
+func (d *Delivery) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		id, subscriptionId, taskId, event, url, e string
+		payload                                   []byte
+		attempts, statusCode                      int
+		created                                   time.Time
+		delivered, nextAttempt                    *time.Time
+	)
+	err := row.Scan(
+		&id, &subscriptionId, &taskId, &event, &url, &payload,
+		&attempts, &statusCode, &e, &created, &delivered, &nextAttempt,
+	)
+	if err == sql.ErrNoRows {
+		return datastore.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	*d = Delivery{
+		Id:             id,
+		SubscriptionId: subscriptionId,
+		TaskId:         taskId,
+		Event:          tasks.EventType(event),
+		Url:            url,
+		Payload:        payload,
+		Attempts:       attempts,
+		StatusCode:     statusCode,
+		Error:          e,
+		Created:        created,
+		Delivered:      delivered,
+		NextAttempt:    nextAttempt,
+	}
+	return nil
+}
+
+func (d *Delivery) SQLParams(cmd sql_datastore.Cmd) []interface{} {
+	switch cmd {
+	case sql_datastore.CmdSelectOne, sql_datastore.CmdExistsOne, sql_datastore.CmdDeleteOne:
+		return []interface{}{d.Id}
+	case sql_datastore.CmdList:
+		return []interface{}{}
+	default:
+		return []interface{}{
+			d.Id,
+			d.SubscriptionId,
+			d.TaskId,
+			string(d.Event),
+			d.Url,
+			[]byte(d.Payload),
+			d.Attempts,
+			d.StatusCode,
+			d.Error,
+			d.Created,
+			d.Delivered,
+			d.NextAttempt,
+		}
+	}
+}
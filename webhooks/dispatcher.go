@@ -0,0 +1,291 @@
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultBackoff is how long Dispatchers wait between attempts to send a
+// delivery, six attempts are made over about seven hours
+var DefaultBackoff = []time.Duration{
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+}
+
+// DefaultTimeout is how long a Dispatcher waits for a response
+var DefaultTimeout = 15 * time.Second
+
+// RetryBatchSize is the most due deliveries a Dispatcher retries at a time
+var RetryBatchSize = 100
+
+// callbackEvents are the events task callback urls are sent
+var callbackEvents = map[tasks.EventType]bool{
+	tasks.EventSucceeded: true,
+	tasks.EventFailed:    true,
+	tasks.EventCancelled: true,
+}
+
+// Dispatcher sends task events to subscriptions & task callback urls.
+// The first attempt at a delivery is sent right away, failed deliveries
+// record when they're next due & are retried by whichever Dispatcher
+// polling the store claims them first
+type Dispatcher struct {
+	// Store to read subscriptions from & log deliveries to
+	Store datastore.Datastore
+	// Client sends requests. if nil a client with DefaultTimeout that
+	// refuses to connect to loopback, private & link-local addresses is used
+	Client *http.Client
+	// lets the default client connect to loopback & private addresses, for
+	// receivers on the same network
+	AllowPrivate bool
+	// key task callbacks are signed with, callbacks are unsigned if empty
+	CallbackSecret string
+	// waits between attempts, DefaultBackoff if nil. a delivery fails once
+	// it's out of retries
+	Backoff []time.Duration
+	// OnError is called with errors reading subscriptions or saving
+	// deliveries, optional
+	OnError func(err error)
+
+	clientOnce    sync.Once
+	defaultClient *http.Client
+}
+
+// HandleEvent queues deliveries for an event, to be registered with
+// tasks.HandleEvents
+func (d *Dispatcher) HandleEvent(t *tasks.Task, e *tasks.TaskEvent) {
+	// marshal now, t may change once HandleEvent returns
+	body, err := json.Marshal(&Payload{
+		Event:   e.Type,
+		Created: e.Created,
+		Message: e.Message,
+		Task:    t,
+	})
+	if err != nil {
+		d.error(err)
+		return
+	}
+
+	taskType, taskId, callbackUrl := t.Type, t.Id, t.CallbackUrl
+	go func() {
+		if err := d.Dispatch(taskType, taskId, callbackUrl, e.Type, body); err != nil {
+			d.error(err)
+		}
+	}()
+}
+
+// Dispatch creates deliveries of an event payload for each matching
+// subscription & the task's callback url, sending them in the background
+func (d *Dispatcher) Dispatch(taskType, taskId, callbackUrl string, event tasks.EventType, payload []byte) error {
+	subs, err := ReadSubscriptions(d.Store)
+	if err != nil {
+		return err
+	}
+
+	secrets := map[*Delivery]string{}
+	for _, s := range subs {
+		if s.Matches(taskType, event) {
+			secrets[NewDelivery(s.Id, taskId, event, s.Url, payload)] = s.Secret
+		}
+	}
+	if callbackUrl != "" && callbackEvents[event] {
+		secrets[NewDelivery("", taskId, event, callbackUrl, payload)] = d.CallbackSecret
+	}
+
+	// deliveries are saved claimed, like RetryDue claims them, so if this
+	// process dies mid-attempt the poller picks them up once the claim runs out
+	claim := time.Now().Add(2 * d.client().Timeout).In(time.UTC)
+	for del, secret := range secrets {
+		del.NextAttempt = &claim
+		saved := *del
+		if err := saved.Save(d.Store); err != nil {
+			return err
+		}
+		go func(del *Delivery, secret string) {
+			if err := d.attempt(del, secret, true); err != nil {
+				d.error(err)
+			}
+		}(del, secret)
+	}
+	return nil
+}
+
+// Poll retries due deliveries every interval until stop is called
+func (d *Dispatcher) Poll(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := d.RetryDue(time.Now()); err != nil {
+					d.error(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// RetryDue claims deliveries due for another attempt as of now & attempts
+// them. claims last as long as a request can, so a delivery abandoned
+// mid-attempt is picked up again once it's claim runs out
+func (d *Dispatcher) RetryDue(now time.Time) error {
+	ds, err := ClaimDueDeliveries(d.Store, now, now.Add(2*d.client().Timeout), RetryBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, del := range ds {
+		secret, err := d.secret(del)
+		if err != nil {
+			del.Error, del.NextAttempt = err.Error(), nil
+			if err := del.Save(d.Store); err != nil {
+				d.error(err)
+			}
+			continue
+		}
+		if err := d.attempt(del, secret, true); err != nil {
+			d.error(err)
+		}
+	}
+	return nil
+}
+
+// secret gives the key del is signed with
+func (d *Dispatcher) secret(del *Delivery) (string, error) {
+	if del.SubscriptionId == "" {
+		return d.CallbackSecret, nil
+	}
+	s := &Subscription{Id: del.SubscriptionId}
+	if err := s.Read(d.Store); err == datastore.ErrNotFound {
+		return "", fmt.Errorf("subscription was deleted")
+	} else if err != nil {
+		return "", err
+	}
+	return s.Secret, nil
+}
+
+// Test sends a single test delivery to a subscription, without retries
+func (d *Dispatcher) Test(s *Subscription) (*Delivery, error) {
+	body, err := json.Marshal(&Payload{
+		Event:   EventTest,
+		Created: time.Now().In(time.UTC),
+		Message: "test delivery",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	del := NewDelivery(s.Id, "", EventTest, s.Url, body)
+	err = d.attempt(del, s.Secret, false)
+	return del, err
+}
+
+// attempt sends del once, recording the result. attempt only returns errors
+// saving del, the outcome of the request is recorded on del
+func (d *Dispatcher) attempt(del *Delivery, secret string, retry bool) error {
+	del.Attempts++
+	del.StatusCode, del.Error, del.NextAttempt = 0, "", nil
+
+	res, err := d.send(del, secret)
+	if err == nil {
+		// drain the body so connections are reused
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+		res.Body.Close()
+
+		del.StatusCode = res.StatusCode
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			now := time.Now().In(time.UTC)
+			del.Delivered = &now
+		} else {
+			err = fmt.Errorf("unexpected response status: %s", res.Status)
+		}
+	}
+
+	if err != nil {
+		del.Error = err.Error()
+		backoff := d.backoff()
+		if retry && del.Attempts <= len(backoff) {
+			next := time.Now().Add(backoff[del.Attempts-1]).In(time.UTC)
+			del.NextAttempt = &next
+		}
+	}
+
+	return del.Save(d.Store)
+}
+
+func (d *Dispatcher) send(del *Delivery, secret string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", del.Url, bytes.NewReader(del.Payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "task_mgmt-webhooks")
+	req.Header.Set(HeaderEvent, string(del.Event))
+	req.Header.Set(HeaderDelivery, del.Id)
+	if secret != "" {
+		req.Header.Set(HeaderSignature, Sign(secret, del.Payload))
+	}
+	return d.client().Do(req)
+}
+
+func (d *Dispatcher) client() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+	d.clientOnce.Do(func() {
+		dialer := &net.Dialer{Timeout: DefaultTimeout}
+		if !d.AllowPrivate {
+			dialer.Control = dialPublic
+		}
+		d.defaultClient = &http.Client{
+			Timeout:   DefaultTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		}
+	})
+	return d.defaultClient
+}
+
+// dialPublic refuses connections to addresses that aren't public. it's
+// checked once hostnames are resolved, so they can't be used to reach
+// internal services
+func dialPublic(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+func (d *Dispatcher) backoff() []time.Duration {
+	if d.Backoff != nil {
+		return d.Backoff
+	}
+	return DefaultBackoff
+}
+
+func (d *Dispatcher) error(err error) {
+	if d.OnError != nil {
+		d.OnError(err)
+	}
+}
@@ -0,0 +1,114 @@
+package webhooks
+
+const qSubscriptionCreateTable = `
+CREATE TABLE webhook_subscriptions (
+  id               UUID NOT NULL PRIMARY KEY,
+  user_id          text NOT NULL DEFAULT '',
+  url              text NOT NULL,
+  events           text NOT NULL DEFAULT '',
+  secret           text NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);`
+
+const qSubscriptions = `
+SELECT
+  id, user_id, url, events, secret, created
+FROM webhook_subscriptions
+ORDER BY created DESC
+LIMIT $1 OFFSET $2;`
+
+const qSubscriptionExists = `SELECT exists(SELECT 1 FROM webhook_subscriptions WHERE id = $1);`
+
+const qSubscriptionRead = `
+SELECT
+  id, user_id, url, events, secret, created
+FROM webhook_subscriptions
+WHERE id = $1;`
+
+const qSubscriptionInsert = `
+INSERT INTO webhook_subscriptions
+  (id, user_id, url, events, secret, created)
+VALUES
+  ($1, $2, $3, $4, $5, $6);`
+
+const qSubscriptionUpdate = `
+UPDATE webhook_subscriptions SET
+  user_id = $2, url = $3, events = $4, secret = $5, created = $6
+WHERE id = $1;`
+
+const qSubscriptionDelete = `DELETE FROM webhook_subscriptions WHERE id = $1;`
+
+const qDeliveryCreateTable = `
+CREATE TABLE webhook_deliveries (
+  id               UUID NOT NULL PRIMARY KEY,
+  subscription_id  text NOT NULL DEFAULT '',
+  task_id          text NOT NULL DEFAULT '',
+  event            text NOT NULL,
+  url              text NOT NULL,
+  payload          json,
+  attempts         integer NOT NULL DEFAULT 0,
+  status_code      integer NOT NULL DEFAULT 0,
+  error            text NOT NULL DEFAULT '',
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  delivered        timestamp,
+  next_attempt     timestamp
+);`
+
+const qDeliveries = `
+SELECT
+  id, subscription_id, task_id, event, url, payload,
+  attempts, status_code, error, created, delivered, next_attempt
+FROM webhook_deliveries
+ORDER BY created DESC
+LIMIT $1 OFFSET $2;`
+
+// qDeliveriesForSubscription lists a subscription's deliveries, newest
+// first. a null limit lists all of them
+const qDeliveriesForSubscription = `
+SELECT
+  id, subscription_id, task_id, event, url, payload,
+  attempts, status_code, error, created, delivered, next_attempt
+FROM webhook_deliveries
+WHERE subscription_id = $1
+ORDER BY created DESC
+LIMIT $2 OFFSET $3;`
+
+// qDeliveriesClaimDue pushes the next attempt of up to $3 deliveries due as
+// of $1 back to $2, returning them. deliveries other transactions are
+// claiming are skipped
+const qDeliveriesClaimDue = `
+UPDATE webhook_deliveries SET next_attempt = $2
+WHERE id IN (
+  SELECT id FROM webhook_deliveries
+  WHERE next_attempt <= $1
+  ORDER BY next_attempt
+  LIMIT $3
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING
+  id, subscription_id, task_id, event, url, payload,
+  attempts, status_code, error, created, delivered, next_attempt;`
+
+const qDeliveryExists = `SELECT exists(SELECT 1 FROM webhook_deliveries WHERE id = $1);`
+
+const qDeliveryRead = `
+SELECT
+  id, subscription_id, task_id, event, url, payload,
+  attempts, status_code, error, created, delivered, next_attempt
+FROM webhook_deliveries
+WHERE id = $1;`
+
+const qDeliveryInsert = `
+INSERT INTO webhook_deliveries
+  (id, subscription_id, task_id, event, url, payload,
+   attempts, status_code, error, created, delivered, next_attempt)
+VALUES
+  ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);`
+
+const qDeliveryUpdate = `
+UPDATE webhook_deliveries SET
+  subscription_id = $2, task_id = $3, event = $4, url = $5, payload = $6,
+  attempts = $7, status_code = $8, error = $9, created = $10, delivered = $11, next_attempt = $12
+WHERE id = $1;`
+
+const qDeliveryDelete = `DELETE FROM webhook_deliveries WHERE id = $1;`
@@ -0,0 +1,17 @@
+package webhooks
+
+import (
+	"database/sql"
+	"github.com/datatogether/sql_datastore"
+	"github.com/ipfs/go-datastore"
+)
+
+// sqlDB returns the database behind store if it's backed by postgres, nil
+// otherwise. deliveries are listed & claimed with plain SQL against it,
+// other stores are scanned
+func sqlDB(store datastore.Datastore) *sql.DB {
+	if s, ok := store.(*sql_datastore.Datastore); ok && s.DB != nil {
+		return s.DB
+	}
+	return nil
+}
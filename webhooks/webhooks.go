@@ -0,0 +1,275 @@
+// Package webhooks sends task lifecycle events to external urls. Subscriptions
+// receive events for all tasks, filtered by task type & event. Tasks can also
+// name a callback url that's notified when they finish. Requests carry a JSON
+// Payload, signed with an HMAC of the body, and are retried with backoff
+package webhooks
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pborman/uuid"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Wildcard matches any task type or event in a subscription's event filter
+const Wildcard = "*"
+
+// EventTest is the event sent by test deliveries. it's always sent,
+// regardless of a subscription's event filter
+const EventTest tasks.EventType = "test"
+
+// events lists the events subscriptions can filter for
+var events = []tasks.EventType{
+	tasks.EventEnqueued,
+	tasks.EventRequeued,
+	tasks.EventStarted,
+	tasks.EventProgress,
+	tasks.EventSucceeded,
+	tasks.EventFailed,
+	tasks.EventCancelled,
+	tasks.EventRetried,
+}
+
+// Subscription sends events for matching tasks to a url
+type Subscription struct {
+	// version 4 uuid
+	Id string `json:"id"`
+	// user that created the subscription
+	UserId string `json:"userId"`
+	// url events are POSTed to
+	Url string `json:"url"`
+	// filters of the form [type:]event, eg: "failed" or "ipfs.addurl:succeeded".
+	// either part can be Wildcard. empty sends all events
+	Events []string `json:"events"`
+	// key requests are signed with. only returned when a subscription is
+	// created, generated if empty
+	Secret string `json:"secret,omitempty"`
+	// when the subscription was created
+	Created time.Time `json:"created"`
+}
+
+// NewSubscription creates a subscription for userId, generating a secret
+// if one isn't given
+func NewSubscription(userId, url string, events []string, secret string) (*Subscription, error) {
+	if secret == "" {
+		buf := make([]byte, 24)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(buf)
+	}
+
+	s := &Subscription{
+		Id:      uuid.New(),
+		UserId:  userId,
+		Url:     url,
+		Events:  events,
+		Secret:  secret,
+		Created: time.Now().Round(time.Second).In(time.UTC),
+	}
+	if s.Events == nil {
+		s.Events = []string{}
+	}
+	return s, s.valid()
+}
+
+func (s *Subscription) valid() error {
+	if err := tasks.ValidCallbackUrl(s.Url); err != nil {
+		return err
+	}
+	for _, f := range s.Events {
+		if strings.Contains(f, ",") {
+			return fmt.Errorf("invalid event filter '%s'", f)
+		}
+		_, ev := splitFilter(f)
+		if !knownEvent(ev) {
+			return fmt.Errorf("invalid event filter '%s': unknown event '%s'", f, ev)
+		}
+	}
+	return nil
+}
+
+func knownEvent(ev string) bool {
+	if ev == Wildcard {
+		return true
+	}
+	for _, e := range events {
+		if ev == string(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitFilter separates an event filter into it's task type & event,
+// a filter without a task type matches all types
+func splitFilter(f string) (taskType, event string) {
+	if i := strings.LastIndex(f, ":"); i >= 0 {
+		return f[:i], f[i+1:]
+	}
+	return Wildcard, f
+}
+
+// Matches reports weather an event for a task of taskType passes the
+// subscription's event filter
+func (s *Subscription) Matches(taskType string, event tasks.EventType) bool {
+	if len(s.Events) == 0 || event == EventTest {
+		return true
+	}
+	for _, f := range s.Events {
+		typ, ev := splitFilter(f)
+		if (typ == Wildcard || typ == taskType) && (ev == Wildcard || ev == string(event)) {
+			return true
+		}
+	}
+	return false
+}
+
+// DatastoreType is to fulfill the sql_datastore.Model interface
+func (s Subscription) DatastoreType() string {
+	return "Subscription"
+}
+
+// GetId returns the subscription's id
+func (s Subscription) GetId() string {
+	return s.Id
+}
+
+// Key is to fulfill the sql_datastore.Model interface
+func (s Subscription) Key() datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%s:%s", s.DatastoreType(), s.GetId()))
+}
+
+func (s *Subscription) Read(store datastore.Datastore) error {
+	si, err := store.Get(s.Key())
+	if err != nil {
+		return err
+	}
+
+	got, ok := si.(*Subscription)
+	if !ok {
+		return fmt.Errorf("Invalid Response")
+	}
+	*s = *got
+	return nil
+}
+
+func (s *Subscription) Save(store datastore.Datastore) error {
+	if s.Id == "" {
+		return fmt.Errorf("subscriptions require an id")
+	}
+	if err := s.valid(); err != nil {
+		return err
+	}
+	return store.Put(s.Key(), s)
+}
+
+func (s *Subscription) Delete(store datastore.Datastore) error {
+	return store.Delete(s.Key())
+}
+
+// ReadSubscriptions lists stored subscriptions, newest first
+func ReadSubscriptions(store datastore.Datastore) ([]*Subscription, error) {
+	res, err := store.Query(query.Query{
+		Prefix: fmt.Sprintf("/%s", Subscription{}.DatastoreType()),
+		Limit:  1000,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	subs := []*Subscription{}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		s, ok := r.Value.(*Subscription)
+		if !ok {
+			return nil, fmt.Errorf("Invalid Response")
+		}
+		subs = append(subs, s)
+	}
+
+	sort.SliceStable(subs, func(i, j int) bool {
+		return subs[i].Created.After(subs[j].Created)
+	})
+	return subs, nil
+}
+
+func (s *Subscription) NewSQLModel(key datastore.Key) sql_datastore.Model {
+	return &Subscription{Id: key.Name()}
+}
+
+func (s *Subscription) SQLQuery(cmd sql_datastore.Cmd) string {
+	switch cmd {
+	case sql_datastore.CmdCreateTable:
+		return qSubscriptionCreateTable
+	case sql_datastore.CmdExistsOne:
+		return qSubscriptionExists
+	case sql_datastore.CmdSelectOne:
+		return qSubscriptionRead
+	case sql_datastore.CmdInsertOne:
+		return qSubscriptionInsert
+	case sql_datastore.CmdUpdateOne:
+		return qSubscriptionUpdate
+	case sql_datastore.CmdDeleteOne:
+		return qSubscriptionDelete
+	case sql_datastore.CmdList:
+		return qSubscriptions
+	default:
+		return ""
+	}
+}
+
+func (s *Subscription) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		id, userId, url, events, secret string
+		created                         time.Time
+	)
+	if err := row.Scan(&id, &userId, &url, &events, &secret, &created); err != nil {
+		if err == sql.ErrNoRows {
+			return datastore.ErrNotFound
+		}
+		return err
+	}
+
+	*s = Subscription{
+		Id:      id,
+		UserId:  userId,
+		Url:     url,
+		Events:  []string{},
+		Secret:  secret,
+		Created: created,
+	}
+	if events != "" {
+		s.Events = strings.Split(events, ",")
+	}
+	return nil
+}
+
+func (s *Subscription) SQLParams(cmd sql_datastore.Cmd) []interface{} {
+	switch cmd {
+	case sql_datastore.CmdSelectOne, sql_datastore.CmdExistsOne, sql_datastore.CmdDeleteOne:
+		return []interface{}{s.Id}
+	case sql_datastore.CmdList:
+		return []interface{}{}
+	default:
+		return []interface{}{
+			s.Id,
+			s.UserId,
+			s.Url,
+			strings.Join(s.Events, ","),
+			s.Secret,
+			s.Created,
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver records requests, responding with statuses in order then 200
+type receiver struct {
+	sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rc.Lock()
+	defer rc.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) count() int {
+	rc.Lock()
+	defer rc.Unlock()
+	return len(rc.requests)
+}
+
+// waitForDeliveries waits for n deliveries to finish
+func waitForDeliveries(t *testing.T, store datastore.Datastore, subscriptionId string, n int) []*Delivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ds, err := ReadDeliveries(store, subscriptionId, 0, 0)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		done := 0
+		for _, d := range ds {
+			if d.NextAttempt == nil && d.Attempts > 0 {
+				done++
+			}
+		}
+		if done == n {
+			return ds
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d deliveries", n)
+	return nil
+}
+
+func TestSubscriptionMatches(t *testing.T) {
+	cases := []struct {
+		events   []string
+		taskType string
+		event    tasks.EventType
+		expect   bool
+	}{
+		{[]string{}, "ipfs.addurl", tasks.EventProgress, true},
+		{[]string{"failed"}, "ipfs.addurl", tasks.EventFailed, true},
+		{[]string{"failed"}, "ipfs.addurl", tasks.EventSucceeded, false},
+		{[]string{"failed"}, "ipfs.addurl", EventTest, true},
+		{[]string{"ipfs.addurl:*"}, "ipfs.addurl", tasks.EventStarted, true},
+		{[]string{"ipfs.addurl:*"}, "pod.catalog", tasks.EventStarted, false},
+		{[]string{"pod.catalog:succeeded", "*:failed"}, "ipfs.addurl", tasks.EventFailed, true},
+		{[]string{"pod.catalog:succeeded", "*:failed"}, "ipfs.addurl", tasks.EventSucceeded, false},
+	}
+
+	for i, c := range cases {
+		s := &Subscription{Events: c.events}
+		if got := s.Matches(c.taskType, c.event); got != c.expect {
+			t.Errorf("case %d: expected %t, got %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestNewSubscription(t *testing.T) {
+	s, err := NewSubscription("alice", "https://example.com/hook", nil, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.Secret == "" {
+		t.Errorf("expected a secret to be generated")
+	}
+
+	for _, c := range []struct {
+		url    string
+		events []string
+	}{
+		{"example.com/hook", nil},
+		{"ftp://example.com/hook", nil},
+		{"https://example.com/hook", []string{"finished"}},
+		{"https://example.com/hook", []string{"ipfs.addurl:done"}},
+		{"https://example.com/hook", []string{"failed,succeeded"}},
+	} {
+		if _, err := NewSubscription("alice", c.url, c.events, ""); err == nil {
+			t.Errorf("expected %s %v to be invalid", c.url, c.events)
+		}
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"event":"succeeded"}`)
+	sig := Sign("secret", body)
+	if !Verify("secret", body, sig) {
+		t.Errorf("expected signature to verify")
+	}
+	if Verify("other", body, sig) {
+		t.Errorf("expected signature with a different secret to fail")
+	}
+	if Verify("secret", []byte(`{"event":"failed"}`), sig) {
+		t.Errorf("expected signature of a different body to fail")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	store := tasks.NewLockedStore(datastore.NewMapDatastore())
+	failures, _ := NewSubscription("alice", srv.URL+"/failures", []string{"failed"}, "sub-secret")
+	all, _ := NewSubscription("alice", srv.URL+"/all", nil, "")
+	for _, s := range []*Subscription{failures, all} {
+		if err := s.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	d := &Dispatcher{Store: store, CallbackSecret: "callback-secret", AllowPrivate: true}
+	task := &tasks.Task{Id: "task", Type: "test", CallbackUrl: srv.URL + "/callback"}
+	d.HandleEvent(task, &tasks.TaskEvent{TaskId: task.Id, Type: tasks.EventFailed, Created: time.Now()})
+
+	for _, id := range []string{failures.Id, all.Id, ""} {
+		ds := waitForDeliveries(t, store, id, 1)
+		if ds[0].Delivered == nil || ds[0].StatusCode != http.StatusOK {
+			t.Errorf("expected delivery to %s to succeed, got: %d %s", ds[0].Url, ds[0].StatusCode, ds[0].Error)
+		}
+	}
+
+	rc.Lock()
+	defer rc.Unlock()
+	if len(rc.requests) != 3 {
+		t.Fatalf("expected 3 requests, got: %d", len(rc.requests))
+	}
+	secrets := map[string]string{"/failures": "sub-secret", "/all": all.Secret, "/callback": "callback-secret"}
+	for i, r := range rc.requests {
+		if r.Header.Get(HeaderEvent) != "failed" {
+			t.Errorf("%s event header mismatch. expected: failed, got: %s", r.URL.Path, r.Header.Get(HeaderEvent))
+		}
+		if !Verify(secrets[r.URL.Path], rc.bodies[i], r.Header.Get(HeaderSignature)) {
+			t.Errorf("%s signature didn't verify", r.URL.Path)
+		}
+		p := &Payload{}
+		if err := json.Unmarshal(rc.bodies[i], p); err != nil {
+			t.Fatal(err.Error())
+		}
+		if p.Task == nil || p.Task.Id != task.Id {
+			t.Errorf("%s payload missing task", r.URL.Path)
+		}
+	}
+}
+
+func TestDispatchFiltersEvents(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	store := tasks.NewLockedStore(datastore.NewMapDatastore())
+	s, _ := NewSubscription("alice", srv.URL, []string{"failed"}, "")
+	if err := s.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	d := &Dispatcher{Store: store, AllowPrivate: true}
+	// callbacks are only sent for finished tasks
+	if err := d.Dispatch("test", "task", srv.URL, tasks.EventStarted, []byte(`{}`)); err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if rc.count() != 0 {
+		t.Errorf("expected no requests, got: %d", rc.count())
+	}
+}
+
+func TestDispatchRetries(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	store := tasks.NewLockedStore(datastore.NewMapDatastore())
+	s, _ := NewSubscription("alice", srv.URL, nil, "")
+	if err := s.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	d := &Dispatcher{Store: store, AllowPrivate: true, Backoff: []time.Duration{time.Millisecond, time.Millisecond}}
+	stop := d.Poll(5 * time.Millisecond)
+	defer stop()
+	if err := d.Dispatch("test", "task", "", tasks.EventSucceeded, []byte(`{}`)); err != nil {
+		t.Fatal(err.Error())
+	}
+	del := waitForDeliveries(t, store, s.Id, 1)[0]
+	if del.Attempts != 3 || del.Delivered == nil {
+		t.Errorf("expected delivery to succeed on the 3rd attempt, got: %d attempts, delivered: %v", del.Attempts, del.Delivered)
+	}
+
+	// out of retries
+	rc.Lock()
+	rc.statuses = []int{500, 500, 500}
+	rc.Unlock()
+	if err := d.Dispatch("test", "task", "", tasks.EventFailed, []byte(`{}`)); err != nil {
+		t.Fatal(err.Error())
+	}
+	ds := waitForDeliveries(t, store, s.Id, 2)
+	if ds[0].Attempts != 3 || ds[0].Delivered != nil || ds[0].StatusCode != 500 || ds[0].Error == "" {
+		t.Errorf("expected delivery to fail after 3 attempts, got: %d attempts, status %d", ds[0].Attempts, ds[0].StatusCode)
+	}
+}
+
+func TestDispatchSurvivesCrash(t *testing.T) {
+	// the first request hangs, as if the node sending it died mid-attempt
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := false
+		once.Do(func() { first = true })
+		if first {
+			close(started)
+			<-release
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	store := tasks.NewLockedStore(datastore.NewMapDatastore())
+	s, _ := NewSubscription("alice", srv.URL, nil, "")
+	if err := s.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+	d := &Dispatcher{Store: store, AllowPrivate: true, Client: client}
+	if err := d.Dispatch("test", "task", "", tasks.EventSucceeded, []byte(`{}`)); err != nil {
+		t.Fatal(err.Error())
+	}
+	ds, err := ReadDeliveries(store, s.Id, 0, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ds) != 1 || ds[0].NextAttempt == nil || ds[0].NextAttempt.Before(time.Now().Add(time.Minute)) {
+		t.Fatalf("expected the delivery to be saved claimed for the first attempt")
+	}
+
+	// another node retries the delivery once the claim runs out
+	<-started
+	other := &Dispatcher{Store: store, AllowPrivate: true, Client: client}
+	if err := other.RetryDue(time.Now().Add(3 * time.Minute)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ds, err = ReadDeliveries(store, s.Id, 0, 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ds) != 1 || ds[0].Delivered == nil {
+		t.Errorf("expected the abandoned delivery to be retried")
+	}
+}
+
+func TestDispatcherTest(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusNotFound}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	store := tasks.NewLockedStore(datastore.NewMapDatastore())
+	s, _ := NewSubscription("alice", srv.URL, []string{"failed"}, "")
+	d := &Dispatcher{Store: store, AllowPrivate: true}
+
+	del, err := d.Test(s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if del.Event != EventTest || del.StatusCode != http.StatusNotFound || del.NextAttempt != nil {
+		t.Errorf("expected a single failed test delivery, got: %s %d", del.Event, del.StatusCode)
+	}
+
+	if del, err = d.Test(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	if del.Delivered == nil {
+		t.Errorf("expected test delivery to succeed: %s", del.Error)
+	}
+}
+
+func TestDispatcherRefusesPrivate(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	store := tasks.NewLockedStore(datastore.NewMapDatastore())
+	s, _ := NewSubscription("alice", srv.URL, nil, "")
+	d := &Dispatcher{Store: store}
+
+	del, err := d.Test(s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if del.Delivered != nil || rc.count() != 0 {
+		t.Errorf("expected delivery to a loopback address to be refused")
+	}
+}
+
+func TestClaimDueDeliveries(t *testing.T) {
+	store := tasks.NewLockedStore(datastore.NewMapDatastore())
+	now := time.Now().In(time.UTC)
+	for i, next := range []time.Duration{-time.Minute, -time.Second, time.Minute} {
+		del := NewDelivery("sub", "task", tasks.EventFailed, "https://example.com", []byte(`{}`))
+		del.Created = now.Add(time.Duration(i) * time.Second)
+		due := now.Add(next)
+		del.NextAttempt = &due
+		if err := del.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	delivered := NewDelivery("sub", "task", tasks.EventFailed, "https://example.com", []byte(`{}`))
+	if err := delivered.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	until := now.Add(time.Hour)
+	claimed, err := ClaimDueDeliveries(store, now, until, 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(claimed) != 1 || !claimed[0].NextAttempt.Equal(until) {
+		t.Fatalf("expected the most overdue delivery to be claimed until %s, got: %v", until, claimed)
+	}
+	if claimed, err = ClaimDueDeliveries(store, now, until, 10); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(claimed) != 1 {
+		t.Errorf("expected the remaining due delivery to be claimed, got: %d", len(claimed))
+	}
+	if claimed, err = ClaimDueDeliveries(store, now, until, 10); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(claimed) != 0 {
+		t.Errorf("expected claimed deliveries not to be claimed again, got: %d", len(claimed))
+	}
+
+	ds, err := ReadDeliveries(store, "sub", 2, 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ds) != 2 || !ds[0].Created.After(ds[1].Created) {
+		t.Errorf("expected a page of 2 deliveries newest first, got: %d", len(ds))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/task_mgmt/tasks"
+	"net/http"
+	"time"
+)
+
+// worker is the registry entry for this process, nil if this process
+// isn't accepting tasks
+var worker *tasks.Worker
+
+// registerWorker adds this process to the worker registry & starts
+// heartbeating in the background
+func registerWorker(capabilities []string) *tasks.Worker {
+	w := tasks.NewWorker(capabilities)
+	if err := w.Save(store); err != nil {
+		log.Infof("error registering worker: %s", err.Error())
+	}
+	log.Infof("registered worker %s on %s", w.Id, w.Hostname)
+
+	interval := configDuration("WORKER_HEARTBEAT_INTERVAL", cfg.WorkerHeartbeatInterval, 10*time.Second)
+	go func() {
+		for range time.Tick(interval) {
+			if err := w.Beat(store); err != nil {
+				log.Infof("worker heartbeat error: %s", err.Error())
+			}
+		}
+	}()
+
+	return w
+}
+
+// workerLease is how long a worker can go without heartbeating before
+// it's considered dead
+func workerLease() time.Duration {
+	return configDuration("WORKER_LEASE_TIMEOUT", cfg.WorkerLeaseTimeout, time.Minute)
+}
+
+// startReaper periodically checks for workers that have stopped
+// heartbeating, recovering any tasks they left behind
+func startReaper() {
+	lease := workerLease()
+	action := tasks.ReapAction(cfg.ReaperAction)
+	if action != tasks.ReapFail {
+		action = tasks.ReapRequeue
+	}
+
+	go func() {
+		for range time.Tick(lease / 2) {
+			// every api node runs the reaper, but only one reaps at a time
+			_, err := tryAdvisoryLock(context.Background(), appDB, lockReaper, func() error {
+				reaped, err := tasks.ReapWorkers(store, cfg.AmqpUrl, lease, action)
+				for _, t := range reaped {
+					log.Infof("reaped orphaned task %s,%s (%s)", t.Id, t.Type, action)
+				}
+				return err
+			})
+			if err != nil {
+				log.Infof("reaper error: %s", err.Error())
+			}
+		}
+	}()
+}
+
+func WorkersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		ListWorkersHandler(w, r)
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+func ListWorkersHandler(w http.ResponseWriter, r *http.Request) {
+	p := apiutil.PageFromRequest(r)
+	ws, err := tasks.ReadWorkers(store, p.Limit(), p.Offset())
+	if err != nil {
+		log.Infoln(err.Error())
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	apiutil.WritePageResponse(w, ws, r, p)
+}